@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/imaging"
+	"gemini-mcp/internal/storage"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// Image understanding
+type GeminiImageAnalyzeInput struct {
+	ImagePaths     []string       `json:"image_paths" jsonschema:"description:Paths to one or more local image files to analyze (PNG, JPEG, WebP supported)"`
+	Task           string         `json:"task,omitempty" jsonschema:"description:Analysis task: 'caption' (short description), 'ocr' (transcribe visible text), 'tags' (descriptive keywords), 'critique' (detailed quality review), 'question' (answer the question). Defaults to 'question' when a question is given, otherwise 'caption'.,enum:caption,enum:ocr,enum:tags,enum:critique,enum:question"`
+	Question       string         `json:"question,omitempty" jsonschema:"description:Question to answer about the images, e.g. 'Is the logo legible?'. Also used as extra instructions for the other tasks."`
+	Model          string         `json:"model,omitempty" jsonschema:"description:Gemini model to use for analysis,default:gemini-2.5-flash"`
+	JSONOutput     bool           `json:"json_output,omitempty" jsonschema:"description:Return the answer as JSON in the structured field. Enabled automatically for the 'tags' task or when a response schema is provided.,default:false"`
+	ResponseSchema map[string]any `json:"response_schema,omitempty" jsonschema:"description:Optional JSON schema the structured answer must follow, e.g. {\"type\":\"object\",\"properties\":{\"legible\":{\"type\":\"boolean\"}}}"`
+	CacheName      string         `json:"cache_name,omitempty" jsonschema:"description:Optional context cache (name or display name from cache_create) with reference images and instructions to analyze against. The model defaults to the cache's model."`
+}
+
+type GeminiImageAnalyzeOutput struct {
+	Task         string   `json:"task"`
+	Model        string   `json:"model"`
+	FallbackFrom string   `json:"fallback_from,omitempty"`
+	Images       []string `json:"images"`
+	Text         string   `json:"text"`
+	Structured   any      `json:"structured,omitempty"`
+	GeneratedAt  string   `json:"generated_at"`
+}
+
+// tagsSchema is the response schema used for the 'tags' task when the caller
+// does not provide one.
+var tagsSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"tags": map[string]any{
+			"type":  "array",
+			"items": map[string]any{"type": "string"},
+		},
+	},
+	"required": []any{"tags"},
+}
+
+func (s *Server) registerAnalysisTools(server *mcp.Server) {
+	// Register gemini_image_analyze tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_analyze",
+		Description: "Understand local images using Google's Gemini AI models. Caption images, transcribe visible text (OCR), extract descriptive tags, write detailed critiques, or answer questions such as 'is the logo legible?'. Returns text and, optionally, JSON structured output following a caller-supplied schema. Useful for verifying the results of the image generation tools.",
+	}, s.handleGeminiImageAnalyze)
+
+	// Register gemini_image_detect tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_detect",
+		Description: "Detect or segment objects in a local image using Google's Gemini 2.5 models. Returns labelled bounding boxes in pixel coordinates; in segment mode each object's mask is saved as a PNG file (white marks the object) that can be passed to gemini_image_edit as mask_image_path. Optionally saves an annotated overlay image.",
+	}, s.handleGeminiImageDetect)
+
+	// Register gemini_video_analyze tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_video_analyze",
+		Description: "Understand local videos using Google's Gemini AI models. Uploads the video through the Files API, then produces a summary with key points, a timestamped scene list, or answers to questions about the content. Works with the MP4 files saved by the Veo tools. Returns text plus structured JSON, and the uploaded file name so follow-up questions can skip the upload.",
+	}, s.handleGeminiVideoAnalyze)
+
+	// Register gemini_transcribe tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_transcribe",
+		Description: "Transcribe speech in a local audio or video file using Google's Gemini AI models, such as Veo 3 clips with generated audio. Produces a timestamped transcript with optional speaker labels in the chosen language and saves matching .srt and .vtt subtitle files next to the media.",
+	}, s.handleGeminiTranscribe)
+}
+
+func (s *Server) handleGeminiImageAnalyze(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageAnalyzeInput) (*mcp.CallToolResult, GeminiImageAnalyzeOutput, error) {
+	if len(input.ImagePaths) == 0 {
+		return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("at least 1 input image is required")
+	}
+
+	task := input.Task
+	if task == "" {
+		if input.Question != "" {
+			task = "question"
+		} else {
+			task = "caption"
+		}
+	}
+	if task == "question" && input.Question == "" {
+		return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("question is required for the 'question' task")
+	}
+
+	config, model, err := s.cachedContentConfig(ctx, input.CacheName, input.Model, false)
+	if err != nil {
+		return nil, GeminiImageAnalyzeOutput{}, err
+	}
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+
+	log.Printf("Analyzing %d image(s) with model %s (task: %s)", len(input.ImagePaths), model, task)
+
+	// Build task instructions
+	var promptParts []string
+	switch task {
+	case "caption":
+		promptParts = append(promptParts, "Write a concise, descriptive caption for the image(s)")
+	case "ocr":
+		promptParts = append(promptParts, "Transcribe all text visible in the image(s) exactly as it appears, preserving line breaks. If there is no text, say so")
+	case "tags":
+		promptParts = append(promptParts, "List descriptive tags for the image(s) covering subjects, objects, setting, style, colors and mood")
+	case "critique":
+		promptParts = append(promptParts, "Write a detailed critique of the image(s) covering composition, lighting, color, subject clarity, text legibility and any visual artifacts or defects")
+	case "question":
+		promptParts = append(promptParts, "Answer the following question about the image(s)")
+	default:
+		return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("unsupported task: %s", task)
+	}
+
+	if input.Question != "" {
+		promptParts = append(promptParts, input.Question)
+	}
+
+	if len(input.ImagePaths) > 1 {
+		promptParts = append(promptParts, "The images are provided in order; refer to them as image 1, image 2, and so on")
+	}
+
+	promptText := strings.Join(promptParts, ". ")
+	parts := []*genai.Part{genai.NewPartFromText(promptText)}
+
+	imageParts, err := s.mediaParts(ctx, input.ImagePaths)
+	if err != nil {
+		return nil, GeminiImageAnalyzeOutput{}, err
+	}
+	parts = append(parts, imageParts...)
+
+	// Request JSON output when asked for, or when a schema implies it
+	schema := input.ResponseSchema
+	if schema == nil && task == "tags" {
+		schema = tagsSchema
+	}
+	jsonOutput := input.JSONOutput || schema != nil
+	if jsonOutput {
+		if config == nil {
+			config = &genai.GenerateContentConfig{}
+		}
+		config.ResponseMIMEType = "application/json"
+		if schema != nil {
+			config.ResponseJsonSchema = schema
+		}
+	}
+
+	contents := []*genai.Content{
+		genai.NewContentFromParts(parts, genai.RoleUser),
+	}
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
+	if err != nil {
+		return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("error analyzing images: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("no analysis was generated")
+	}
+
+	resultText := response.Text()
+
+	var structured any
+	if jsonOutput {
+		if err := json.Unmarshal([]byte(resultText), &structured); err != nil {
+			return nil, GeminiImageAnalyzeOutput{}, fmt.Errorf("model returned invalid JSON: %v", err)
+		}
+	}
+
+	return nil, GeminiImageAnalyzeOutput{
+		Task:         task,
+		Model:        model,
+		FallbackFrom: fallbackFrom(requestedModel, model),
+		Images:       input.ImagePaths,
+		Text:         resultText,
+		Structured:   structured,
+		GeneratedAt:  time.Now().Format("20060102_150405"),
+	}, nil
+}
+
+// Object detection and segmentation
+type GeminiImageDetectInput struct {
+	ImagePath       string `json:"image_path" jsonschema:"description:Path to the local image file to run detection on (PNG, JPEG, WebP supported)"`
+	Mode            string `json:"mode,omitempty" jsonschema:"description:'detect' returns bounding boxes; 'segment' also returns a segmentation mask per object, saved as PNG files,default:detect,enum:detect,enum:segment"`
+	Objects         string `json:"objects,omitempty" jsonschema:"description:Optional description of what to find, e.g. 'the red car' or 'all people'. If omitted, all prominent objects are detected."`
+	MaxObjects      int    `json:"max_objects,omitempty" jsonschema:"description:Maximum number of objects to return,default:25"`
+	Model           string `json:"model,omitempty" jsonschema:"description:Gemini model to use for detection,default:gemini-2.5-flash"`
+	SaveOverlay     bool   `json:"save_overlay,omitempty" jsonschema:"description:Also save a copy of the image annotated with the boxes and masks,default:false"`
+	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Optional. Local directory path where masks and the overlay image will be saved."`
+}
+
+type PixelBox struct {
+	XMin int `json:"x_min"`
+	YMin int `json:"y_min"`
+	XMax int `json:"x_max"`
+	YMax int `json:"y_max"`
+}
+
+type DetectedObject struct {
+	Label          string   `json:"label"`
+	Box            PixelBox `json:"box"`
+	BoxNormalized  [4]int   `json:"box_normalized" jsonschema:"description:Box as [ymin, xmin, ymax, xmax] normalized to 0-1000"`
+	MaskPath       string   `json:"mask_path,omitempty"`
+	MaskPixelCount int      `json:"mask_pixel_count,omitempty"`
+}
+
+type GeminiImageDetectOutput struct {
+	Image        string           `json:"image"`
+	Mode         string           `json:"mode"`
+	Model        string           `json:"model"`
+	FallbackFrom string           `json:"fallback_from,omitempty"`
+	Width        int              `json:"width"`
+	Height       int              `json:"height"`
+	Objects      []DetectedObject `json:"objects"`
+	OverlayPath  string           `json:"overlay_path,omitempty"`
+	SavedFiles   []string         `json:"saved_files,omitempty"`
+	StoredFiles  []storage.Object `json:"stored_files,omitempty"`
+	GeneratedAt  string           `json:"generated_at"`
+}
+
+func (s *Server) handleGeminiImageDetect(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageDetectInput) (*mcp.CallToolResult, GeminiImageDetectOutput, error) {
+	if input.ImagePath == "" {
+		return nil, GeminiImageDetectOutput{}, fmt.Errorf("image_path is required")
+	}
+
+	mode := input.Mode
+	if mode == "" {
+		mode = "detect"
+	}
+	if mode != "detect" && mode != "segment" {
+		return nil, GeminiImageDetectOutput{}, fmt.Errorf("unsupported mode: %s", mode)
+	}
+
+	maxObjects := input.MaxObjects
+	if maxObjects == 0 {
+		maxObjects = 25
+	}
+
+	model := input.Model
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+
+	imgData, err := os.ReadFile(input.ImagePath)
+	if err != nil {
+		return nil, GeminiImageDetectOutput{}, fmt.Errorf("failed to read input image: %v", err)
+	}
+	img, err := imaging.Decode(imgData)
+	if err != nil {
+		return nil, GeminiImageDetectOutput{}, err
+	}
+	bounds := img.Bounds()
+
+	log.Printf("Running %s on image %s with model %s", mode, input.ImagePath, model)
+
+	objects := input.Objects
+	if objects == "" {
+		objects = "all of the prominent items"
+	}
+
+	var promptText string
+	if mode == "segment" {
+		promptText = fmt.Sprintf("Give the segmentation masks for %s in the image. Output a JSON list of segmentation masks where each entry contains the 2D bounding box in the key \"box_2d\", the segmentation mask in key \"mask\", and the text label in the key \"label\". Use descriptive labels. Limit to %d objects.", objects, maxObjects)
+	} else {
+		promptText = fmt.Sprintf("Detect %s in the image. Output a JSON list where each entry contains the 2D bounding box in the key \"box_2d\" as [ymin, xmin, ymax, xmax] normalized to 0-1000, and the text label in the key \"label\". Use descriptive labels. Limit to %d objects.", objects, maxObjects)
+	}
+
+	// The image was read for its size and annotations already
+	imagePart, err := s.dataPart(ctx, input.ImagePath, imgData)
+	if err != nil {
+		return nil, GeminiImageDetectOutput{}, err
+	}
+	parts := []*genai.Part{genai.NewPartFromText(promptText), imagePart}
+
+	contents := []*genai.Content{
+		genai.NewContentFromParts(parts, genai.RoleUser),
+	}
+
+	// Thinking degrades box and mask quality, so it is disabled
+	config := &genai.GenerateContentConfig{
+		ResponseMIMEType: "application/json",
+		ThinkingConfig: &genai.ThinkingConfig{
+			ThinkingBudget: genai.Ptr[int32](0),
+		},
+	}
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
+	if err != nil {
+		return nil, GeminiImageDetectOutput{}, fmt.Errorf("error detecting objects: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		return nil, GeminiImageDetectOutput{}, fmt.Errorf("no detections were generated")
+	}
+
+	detections, err := imaging.ParseDetections(response.Text())
+	if err != nil {
+		return nil, GeminiImageDetectOutput{}, err
+	}
+	if len(detections) > maxObjects {
+		detections = detections[:maxObjects]
+	}
+
+	outputDir := input.OutputDirectory
+	if outputDir == "" {
+		outputDir = s.outputDir(ctx)
+	}
+
+	var savedFiles []string
+	timestamp := time.Now().Format("20060102_150405")
+	base := strings.TrimSuffix(filepath.Base(input.ImagePath), filepath.Ext(input.ImagePath))
+
+	results := make([]DetectedObject, 0, len(detections))
+	boxes := make([]image.Rectangle, 0, len(detections))
+	masks := make([]*image.Gray, 0, len(detections))
+
+	for i, detection := range detections {
+		box := imaging.PixelBox(detection.Box2D, bounds)
+		obj := DetectedObject{
+			Label:         detection.Label,
+			Box:           PixelBox{XMin: box.Min.X, YMin: box.Min.Y, XMax: box.Max.X, YMax: box.Max.Y},
+			BoxNormalized: detection.Box2D,
+		}
+		boxes = append(boxes, box)
+
+		var mask *image.Gray
+		if mode == "segment" && detection.Mask != "" {
+			mask, err = imaging.DecodeMask(detection.Mask, box, bounds)
+			if err != nil {
+				log.Printf("Warning: Could not decode mask for %q: %v", detection.Label, err)
+			}
+		}
+		masks = append(masks, mask)
+
+		if mask != nil {
+			for _, v := range mask.Pix {
+				if v > 0 {
+					obj.MaskPixelCount++
+				}
+			}
+
+			if outputDir != "" {
+				if err := os.MkdirAll(outputDir, 0755); err == nil {
+					filename := fmt.Sprintf("gemini_mask_%s_%s_%d.png", base, timestamp, i)
+					outputPath := filepath.Join(outputDir, filename)
+
+					if data, err := imaging.EncodePNG(mask); err == nil {
+						if err := cas.WriteFile(outputPath, data, 0644); err == nil {
+							savedFiles = append(savedFiles, outputPath)
+							obj.MaskPath = outputPath
+							log.Printf("Saved mask to: %s", outputPath)
+						}
+					}
+				}
+			}
+		}
+
+		results = append(results, obj)
+	}
+
+	var overlayPath string
+	if input.SaveOverlay && outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err == nil {
+			filename := fmt.Sprintf("gemini_%s_overlay_%s_%s.png", mode, base, timestamp)
+			outputPath := filepath.Join(outputDir, filename)
+
+			if data, err := imaging.EncodePNG(imaging.Annotate(img, boxes, masks)); err == nil {
+				if err := cas.WriteFile(outputPath, data, 0644); err == nil {
+					savedFiles = append(savedFiles, outputPath)
+					overlayPath = outputPath
+					log.Printf("Saved overlay image to: %s", outputPath)
+				}
+			}
+		}
+	}
+
+	return nil, GeminiImageDetectOutput{
+		Image:        input.ImagePath,
+		Mode:         mode,
+		Model:        model,
+		FallbackFrom: fallbackFrom(requestedModel, model),
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+		Objects:      results,
+		OverlayPath:  overlayPath,
+		SavedFiles:   savedFiles,
+		StoredFiles:  s.storeFiles(ctx, savedFiles),
+		GeneratedAt:  timestamp,
+	}, nil
+}
+
+// Video understanding
+type GeminiVideoAnalyzeInput struct {
+	VideoPath      string         `json:"video_path,omitempty" jsonschema:"description:Path to a local video file (MP4, MOV, WebM), such as one saved by veo_text_to_video. The video is uploaded through the Files API."`
+	FileName       string         `json:"file_name,omitempty" jsonschema:"description:Name of a video already uploaded through the Files API (e.g. 'files/abc123'), as returned by a previous call. Used instead of video_path to avoid uploading again."`
+	Task           string         `json:"task,omitempty" jsonschema:"description:Analysis task: 'summary' (overall summary and key points), 'scenes' (timestamped scene list), 'question' (answer the question). Defaults to 'question' when a question is given, otherwise 'summary'.,enum:summary,enum:scenes,enum:question"`
+	Question       string         `json:"question,omitempty" jsonschema:"description:Question to answer about the video. Also used as extra instructions for the other tasks."`
+	Model          string         `json:"model,omitempty" jsonschema:"description:Gemini model to use for analysis,default:gemini-2.5-flash"`
+	ResponseSchema map[string]any `json:"response_schema,omitempty" jsonschema:"description:Optional JSON schema overriding the task's default structured output; the result is returned in the structured field."`
+	CacheName      string         `json:"cache_name,omitempty" jsonschema:"description:Optional context cache (name or display name from cache_create) with reference images and instructions to analyze against. The model defaults to the cache's model."`
+}
+
+type VideoScene struct {
+	Start       string `json:"start" jsonschema:"description:Scene start timestamp (MM:SS)"`
+	End         string `json:"end" jsonschema:"description:Scene end timestamp (MM:SS)"`
+	Description string `json:"description"`
+}
+
+// videoAnalysis is the structured result requested for the built-in tasks.
+type videoAnalysis struct {
+	Summary   string       `json:"summary,omitempty"`
+	KeyPoints []string     `json:"key_points,omitempty"`
+	Scenes    []VideoScene `json:"scenes,omitempty"`
+	Answer    string       `json:"answer,omitempty"`
+}
+
+type GeminiVideoAnalyzeOutput struct {
+	Task         string       `json:"task"`
+	Model        string       `json:"model"`
+	FallbackFrom string       `json:"fallback_from,omitempty"`
+	VideoPath    string       `json:"video_path,omitempty"`
+	FileName     string       `json:"file_name"`
+	FileURI      string       `json:"file_uri"`
+	Text         string       `json:"text"`
+	Summary      string       `json:"summary,omitempty"`
+	KeyPoints    []string     `json:"key_points,omitempty"`
+	Scenes       []VideoScene `json:"scenes,omitempty"`
+	Answer       string       `json:"answer,omitempty"`
+	Structured   any          `json:"structured,omitempty"`
+	GeneratedAt  string       `json:"generated_at"`
+}
+
+// videoTaskSchemas are the response schemas for the built-in video tasks.
+var videoTaskSchemas = map[string]map[string]any{
+	"summary": {
+		"type": "object",
+		"properties": map[string]any{
+			"summary":    map[string]any{"type": "string"},
+			"key_points": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+		"required": []any{"summary"},
+	},
+	"scenes": {
+		"type": "object",
+		"properties": map[string]any{
+			"summary": map[string]any{"type": "string"},
+			"scenes": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"start":       map[string]any{"type": "string"},
+						"end":         map[string]any{"type": "string"},
+						"description": map[string]any{"type": "string"},
+					},
+					"required": []any{"start", "end", "description"},
+				},
+			},
+		},
+		"required": []any{"scenes"},
+	},
+	"question": {
+		"type": "object",
+		"properties": map[string]any{
+			"answer": map[string]any{"type": "string"},
+		},
+		"required": []any{"answer"},
+	},
+}
+
+func (s *Server) handleGeminiVideoAnalyze(ctx context.Context, req *mcp.CallToolRequest, input GeminiVideoAnalyzeInput) (*mcp.CallToolResult, GeminiVideoAnalyzeOutput, error) {
+	if input.VideoPath == "" && input.FileName == "" {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("video_path or file_name is required")
+	}
+
+	task := input.Task
+	if task == "" {
+		if input.Question != "" {
+			task = "question"
+		} else {
+			task = "summary"
+		}
+	}
+	if task == "question" && input.Question == "" {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("question is required for the 'question' task")
+	}
+
+	schema, ok := videoTaskSchemas[task]
+	if !ok {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("unsupported task: %s", task)
+	}
+	if input.ResponseSchema != nil {
+		schema = input.ResponseSchema
+	}
+
+	config, model, err := s.cachedContentConfig(ctx, input.CacheName, input.Model, false)
+	if err != nil {
+		return nil, GeminiVideoAnalyzeOutput{}, err
+	}
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+
+	// Upload the video, or reuse a previous upload
+	var file *genai.File
+	if input.FileName != "" {
+		file, err = s.getActiveFile(ctx, input.FileName)
+	} else {
+		file, err = s.uploadFile(ctx, input.VideoPath, "")
+	}
+	if err != nil {
+		return nil, GeminiVideoAnalyzeOutput{}, err
+	}
+
+	log.Printf("Analyzing video %s with model %s (task: %s)", file.Name, model, task)
+
+	var promptParts []string
+	switch task {
+	case "summary":
+		promptParts = append(promptParts, "Summarize this video and list its key points, including any speech, on-screen text and notable sounds")
+	case "scenes":
+		promptParts = append(promptParts, "Break this video down into scenes. For each scene give the start and end timestamps in MM:SS format and describe what happens, including camera movement and audio")
+	case "question":
+		promptParts = append(promptParts, "Answer the following question about this video")
+	}
+
+	if input.Question != "" {
+		promptParts = append(promptParts, input.Question)
+	}
+
+	promptText := strings.Join(promptParts, ". ")
+	parts := []*genai.Part{
+		genai.NewPartFromURI(file.URI, file.MIMEType),
+		genai.NewPartFromText(promptText),
+	}
+
+	contents := []*genai.Content{
+		genai.NewContentFromParts(parts, genai.RoleUser),
+	}
+
+	if config == nil {
+		config = &genai.GenerateContentConfig{}
+	}
+	config.ResponseMIMEType = "application/json"
+	config.ResponseJsonSchema = schema
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
+	if err != nil {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("error analyzing video: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("no analysis was generated")
+	}
+
+	resultText := response.Text()
+	output := GeminiVideoAnalyzeOutput{
+		Task:         task,
+		Model:        model,
+		FallbackFrom: fallbackFrom(requestedModel, model),
+		VideoPath:    input.VideoPath,
+		FileName:     file.Name,
+		FileURI:      file.URI,
+		Text:         resultText,
+		GeneratedAt:  time.Now().Format("20060102_150405"),
+	}
+
+	// Custom schemas are returned as-is; built-in tasks get typed fields and
+	// a readable text rendering
+	if input.ResponseSchema != nil {
+		if err := json.Unmarshal([]byte(resultText), &output.Structured); err != nil {
+			return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("model returned invalid JSON: %v", err)
+		}
+		return nil, output, nil
+	}
+
+	var analysis videoAnalysis
+	if err := json.Unmarshal([]byte(resultText), &analysis); err != nil {
+		return nil, GeminiVideoAnalyzeOutput{}, fmt.Errorf("model returned invalid JSON: %v", err)
+	}
+	output.Summary = analysis.Summary
+	output.KeyPoints = analysis.KeyPoints
+	output.Scenes = analysis.Scenes
+	output.Answer = analysis.Answer
+
+	switch task {
+	case "summary":
+		lines := []string{analysis.Summary}
+		for _, point := range analysis.KeyPoints {
+			lines = append(lines, "- "+point)
+		}
+		output.Text = strings.Join(lines, "\n")
+	case "scenes":
+		var lines []string
+		for _, scene := range analysis.Scenes {
+			lines = append(lines, fmt.Sprintf("%s-%s %s", scene.Start, scene.End, scene.Description))
+		}
+		output.Text = strings.Join(lines, "\n")
+	case "question":
+		output.Text = analysis.Answer
+	}
+
+	return nil, output, nil
+}
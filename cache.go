@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// Context caching
+type CacheCreateInput struct {
+	Name                string   `json:"name" jsonschema:"description:Display name for the cache, e.g. 'brand-guide'. Tools accept it as cache_name."`
+	Model               string   `json:"model,omitempty" jsonschema:"description:Model the cache is created for. Requests using the cache must use the same model, so use an image model such as gemini-2.5-flash-image-preview for caches passed to gemini_image_generation or gemini_image_edit.,default:gemini-2.5-flash"`
+	ReferenceImagePaths []string `json:"reference_image_paths,omitempty" jsonschema:"description:Paths to reference images (or 'files/<id>' names of uploaded files) to store in the cache"`
+	SystemInstruction   string   `json:"system_instruction,omitempty" jsonschema:"description:System instruction stored with the cache, e.g. brand guidelines that every request should follow"`
+	TTL                 string   `json:"ttl,omitempty" jsonschema:"description:How long the cache lives, as a duration such as '30m' or '2h',default:1h"`
+}
+
+type CacheListInput struct {
+	PageSize  int    `json:"page_size,omitempty" jsonschema:"description:Maximum number of caches to return,default:50"`
+	PageToken string `json:"page_token,omitempty" jsonschema:"description:Token from a previous call to fetch the next page"`
+}
+
+type CacheUpdateInput struct {
+	CacheName string `json:"cache_name" jsonschema:"description:Cache name ('cachedContents/<id>') or display name"`
+	TTL       string `json:"ttl" jsonschema:"description:New time to live from now, as a duration such as '30m' or '2h'"`
+}
+
+type CacheDeleteInput struct {
+	CacheName string `json:"cache_name" jsonschema:"description:Cache name ('cachedContents/<id>') or display name"`
+}
+
+type CacheInfo struct {
+	Name            string `json:"name"`
+	DisplayName     string `json:"display_name,omitempty"`
+	Model           string `json:"model"`
+	CreateTime      string `json:"create_time,omitempty"`
+	UpdateTime      string `json:"update_time,omitempty"`
+	ExpireTime      string `json:"expire_time,omitempty"`
+	TotalTokenCount int    `json:"total_token_count,omitempty"`
+	ImageCount      int    `json:"image_count,omitempty"`
+}
+
+type CacheListOutput struct {
+	Caches        []CacheInfo `json:"caches"`
+	Count         int         `json:"count"`
+	NextPageToken string      `json:"next_page_token,omitempty"`
+}
+
+type CacheDeleteOutput struct {
+	Deleted string `json:"deleted"`
+}
+
+func (s *Server) registerCacheTools(server *mcp.Server) {
+	// Register cache_create tool
+	addTool(server, &mcp.Tool{
+		Name:        "cache_create",
+		Description: "Create a named context cache of reference images and a system instruction using the Gemini Caches API. Pass the cache name as cache_name to gemini_image_generation, gemini_image_edit and the analysis tools so repeated calls against the same assets do not upload them again.",
+	}, s.handleCacheCreate)
+
+	// Register cache_list tool
+	addTool(server, &mcp.Tool{
+		Name:        "cache_list",
+		Description: "List context caches with their models, token counts and expiration times. With isolation, only the caller's own caches are listed, so a page may hold fewer than page_size caches.",
+	}, s.handleCacheList)
+
+	// Register cache_update tool
+	addTool(server, &mcp.Tool{
+		Name:        "cache_update",
+		Description: "Extend or shorten the time to live of a context cache.",
+	}, s.handleCacheUpdate)
+
+	// Register cache_delete tool
+	addTool(server, &mcp.Tool{
+		Name:        "cache_delete",
+		Description: "Delete a context cache before it expires to stop paying for its storage.",
+	}, s.handleCacheDelete)
+}
+
+func (s *Server) handleCacheCreate(ctx context.Context, req *mcp.CallToolRequest, input CacheCreateInput) (*mcp.CallToolResult, CacheInfo, error) {
+	if input.Name == "" {
+		return nil, CacheInfo{}, fmt.Errorf("name is required")
+	}
+	if len(input.ReferenceImagePaths) == 0 && input.SystemInstruction == "" {
+		return nil, CacheInfo{}, fmt.Errorf("reference_image_paths or system_instruction is required")
+	}
+
+	model := input.Model
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+
+	ttl := time.Hour
+	if input.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(input.TTL); err != nil || ttl <= 0 {
+			return nil, CacheInfo{}, fmt.Errorf("invalid ttl: %s", input.TTL)
+		}
+	}
+
+	config := &genai.CreateCachedContentConfig{
+		DisplayName: uploadPrefix(ctx) + input.Name,
+		TTL:         ttl,
+	}
+
+	if len(input.ReferenceImagePaths) > 0 {
+		parts, err := s.mediaParts(ctx, input.ReferenceImagePaths)
+		if err != nil {
+			return nil, CacheInfo{}, err
+		}
+		config.Contents = []*genai.Content{
+			genai.NewContentFromParts(parts, genai.RoleUser),
+		}
+	}
+
+	if input.SystemInstruction != "" {
+		config.SystemInstruction = genai.NewContentFromText(input.SystemInstruction, genai.RoleUser)
+	}
+
+	log.Printf("Creating cache %q for model %s with %d reference image(s), ttl %s", input.Name, model, len(input.ReferenceImagePaths), ttl)
+
+	cache, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.CachedContent, error) {
+		return s.client.Caches.Create(ctx, model, config)
+	})
+	if err != nil {
+		return nil, CacheInfo{}, fmt.Errorf("error creating cache: %w", err)
+	}
+	return nil, cacheInfo(ctx, cache), nil
+}
+
+func (s *Server) handleCacheList(ctx context.Context, req *mcp.CallToolRequest, input CacheListInput) (*mcp.CallToolResult, CacheListOutput, error) {
+	pageSize := input.PageSize
+	if pageSize == 0 {
+		pageSize = 50
+	}
+
+	page, err := retry.Do(ctx, s.retryPolicy(), func() (genai.Page[genai.CachedContent], error) {
+		return s.client.Caches.List(ctx, &genai.ListCachedContentsConfig{
+			PageSize:  int32(pageSize),
+			PageToken: input.PageToken,
+		})
+	})
+	if err != nil {
+		return nil, CacheListOutput{}, fmt.Errorf("error listing caches: %w", err)
+	}
+
+	caches := make([]CacheInfo, 0, len(page.Items))
+	for _, cache := range page.Items {
+		if ownsUpload(ctx, cache.DisplayName) {
+			caches = append(caches, cacheInfo(ctx, cache))
+		}
+	}
+
+	return nil, CacheListOutput{
+		Caches:        caches,
+		Count:         len(caches),
+		NextPageToken: page.NextPageToken,
+	}, nil
+}
+
+func (s *Server) handleCacheUpdate(ctx context.Context, req *mcp.CallToolRequest, input CacheUpdateInput) (*mcp.CallToolResult, CacheInfo, error) {
+	if input.CacheName == "" {
+		return nil, CacheInfo{}, fmt.Errorf("cache_name is required")
+	}
+	ttl, err := time.ParseDuration(input.TTL)
+	if err != nil || ttl <= 0 {
+		return nil, CacheInfo{}, fmt.Errorf("invalid ttl: %s", input.TTL)
+	}
+
+	cache, err := s.findCache(ctx, input.CacheName)
+	if err != nil {
+		return nil, CacheInfo{}, err
+	}
+
+	cache, err = retry.Do(ctx, s.retryPolicy(), func() (*genai.CachedContent, error) {
+		return s.client.Caches.Update(ctx, cache.Name, &genai.UpdateCachedContentConfig{TTL: ttl})
+	})
+	if err != nil {
+		return nil, CacheInfo{}, fmt.Errorf("error updating cache: %w", err)
+	}
+
+	log.Printf("Updated cache %s ttl to %s", cache.Name, ttl)
+	return nil, cacheInfo(ctx, cache), nil
+}
+
+func (s *Server) handleCacheDelete(ctx context.Context, req *mcp.CallToolRequest, input CacheDeleteInput) (*mcp.CallToolResult, CacheDeleteOutput, error) {
+	if input.CacheName == "" {
+		return nil, CacheDeleteOutput{}, fmt.Errorf("cache_name is required")
+	}
+
+	cache, err := s.findCache(ctx, input.CacheName)
+	if err != nil {
+		return nil, CacheDeleteOutput{}, err
+	}
+
+	_, err = retry.Do(ctx, s.retryPolicy(), func() (*genai.DeleteCachedContentResponse, error) {
+		return s.client.Caches.Delete(ctx, cache.Name, nil)
+	})
+	if err != nil {
+		return nil, CacheDeleteOutput{}, fmt.Errorf("error deleting cache: %w", err)
+	}
+
+	log.Printf("Deleted cache %s", cache.Name)
+	return nil, CacheDeleteOutput{Deleted: cache.Name}, nil
+}
+
+// findCache looks up a cache of the caller by resource name or display name.
+func (s *Server) findCache(ctx context.Context, name string) (*genai.CachedContent, error) {
+	if strings.HasPrefix(name, "cachedContents/") {
+		cache, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.CachedContent, error) {
+			return s.client.Caches.Get(ctx, name, nil)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting cache %s: %v", name, err)
+		}
+		if !ownsUpload(ctx, cache.DisplayName) {
+			return nil, fmt.Errorf("cache %q not found", name)
+		}
+		return cache, nil
+	}
+	displayName := uploadPrefix(ctx) + name
+
+	config := &genai.ListCachedContentsConfig{}
+	for {
+		page, err := retry.Do(ctx, s.retryPolicy(), func() (genai.Page[genai.CachedContent], error) {
+			return s.client.Caches.List(ctx, config)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing caches: %w", err)
+		}
+		for _, cache := range page.Items {
+			if cache.DisplayName == displayName {
+				return cache, nil
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil, fmt.Errorf("cache %q not found", name)
+		}
+		config = &genai.ListCachedContentsConfig{PageToken: page.NextPageToken}
+	}
+}
+
+// resolveCache returns the resource name of the cache to use for a request
+// and the model to send it to. Cached content can only be used with the model
+// it was created for, so an empty model defaults to the cache's model and a
+// different one is rejected, as is a cache for a model that does not generate
+// images when the tool needs images.
+func (s *Server) resolveCache(ctx context.Context, cacheName, model string, images bool) (string, string, error) {
+	cache, err := s.findCache(ctx, cacheName)
+	if err != nil {
+		return "", "", err
+	}
+
+	cacheModel := strings.TrimPrefix(cache.Model, "models/")
+	if model != "" && strings.TrimPrefix(model, "models/") != cacheModel {
+		return "", "", fmt.Errorf("cache %s was created for model %s and cannot be used with %s", cache.Name, cacheModel, model)
+	}
+	if images && !isImageModel(cacheModel) {
+		return "", "", fmt.Errorf("cache %s was created for model %s, which does not generate images; create it with an image model such as gemini-2.5-flash-image-preview", cache.Name, cacheModel)
+	}
+	if model == "" {
+		model = cacheModel
+	}
+	return cache.Name, model, nil
+}
+
+func cacheInfo(ctx context.Context, cache *genai.CachedContent) CacheInfo {
+	info := CacheInfo{
+		Name:        cache.Name,
+		DisplayName: strings.TrimPrefix(cache.DisplayName, uploadPrefix(ctx)),
+		Model:       strings.TrimPrefix(cache.Model, "models/"),
+	}
+	if !cache.CreateTime.IsZero() {
+		info.CreateTime = cache.CreateTime.Format(time.RFC3339)
+	}
+	if !cache.UpdateTime.IsZero() {
+		info.UpdateTime = cache.UpdateTime.Format(time.RFC3339)
+	}
+	if !cache.ExpireTime.IsZero() {
+		info.ExpireTime = cache.ExpireTime.Format(time.RFC3339)
+	}
+	if cache.UsageMetadata != nil {
+		info.TotalTokenCount = int(cache.UsageMetadata.TotalTokenCount)
+		info.ImageCount = int(cache.UsageMetadata.ImageCount)
+	}
+	return info
+}
+
+// cachedContentConfig returns the request config and model for a request
+// that may use a cache. The config is nil when no cache is requested. images
+// reports whether the tool generates images.
+func (s *Server) cachedContentConfig(ctx context.Context, cacheName, model string, images bool) (*genai.GenerateContentConfig, string, error) {
+	if cacheName == "" {
+		return nil, model, nil
+	}
+	cachedContent, model, err := s.resolveCache(ctx, cacheName, model, images)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("Using cache %s with model %s", cachedContent, model)
+	return &genai.GenerateContentConfig{CachedContent: cachedContent}, model, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/sandbox"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// fileHashes describes the files that exist among paths, for the input and
+// output hashes of metadata files. Uploaded files and missing paths are left
+// out.
+func fileHashes(paths ...string) []cas.File {
+	files := []cas.File{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if file, err := cas.Describe(path); err == nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// contentStore returns the content-addressed store of the caller's output
+// directory.
+func (s *Server) contentStore(ctx context.Context) *cas.Store {
+	return cas.Open(filepath.Join(s.outputDir(ctx), cas.Dir))
+}
+
+// inputPaths returns the paths the arguments of a tool call read from.
+func inputPaths(args map[string]any) []string {
+	var paths []string
+	var collect func(value any)
+	collect = func(value any) {
+		switch v := value.(type) {
+		case string:
+			paths = append(paths, v)
+		case []any:
+			for _, item := range v {
+				collect(item)
+			}
+		}
+	}
+	for name, value := range args {
+		if access, ok := pathAccess(name); ok && access == sandbox.Read {
+			collect(value)
+		}
+	}
+	return paths
+}
+
+// toolOutput holds the fields of tool results that output bookkeeping uses.
+type toolOutput struct {
+	SavedFiles []string `json:"saved_files"`
+	Model      string   `json:"model"`
+}
+
+// parseOutput returns the fields of the result of a successful tool call.
+func parseOutput(result mcp.Result) toolOutput {
+	var output toolOutput
+	res, ok := result.(*mcp.CallToolResult)
+	if !ok || res.IsError || res.StructuredContent == nil {
+		return output
+	}
+	if data, err := json.Marshal(res.StructuredContent); err == nil {
+		json.Unmarshal(data, &output)
+	}
+	return output
+}
+
+// contentMiddleware keeps the files saved by tool calls in the
+// content-addressed store if OUTPUT_LAYOUT is content, so that identical
+// files share their content, and records which inputs they were made from.
+// Inputs in the output directory are stored as well, so that saving one of
+// them again adds no copy.
+func (s *Server) contentMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil || s.config.OutputLayout != config.LayoutContent {
+			return next(ctx, method, req)
+		}
+
+		// Hash the inputs before the tool can replace them
+		var args map[string]any
+		json.Unmarshal(callReq.Params.Arguments, &args)
+		inputs := fileHashes(inputPaths(args)...)
+
+		result, err := next(ctx, method, req)
+		saved := parseOutput(result).SavedFiles
+		if err != nil || len(saved) == 0 {
+			return result, err
+		}
+
+		store := s.contentStore(ctx)
+		record := cas.Record{Time: time.Now().UTC(), Tool: callReq.Params.Name, Inputs: inputs}
+		for _, path := range saved {
+			file, _, err := store.Add(path)
+			if err != nil {
+				log.Printf("Error storing %s by content: %v", path, err)
+				continue
+			}
+			record.Outputs = append(record.Outputs, file)
+		}
+		if len(record.Outputs) == 0 {
+			return result, nil
+		}
+		if root, err := sandbox.Resolve(s.outputDir(ctx)); err == nil {
+			for _, in := range inputs {
+				if path, err := sandbox.Resolve(in.Path); err == nil && sandbox.Within(path, []string{root}) {
+					if _, _, err := store.Add(path); err != nil {
+						log.Printf("Error storing %s by content: %v", path, err)
+					}
+				}
+			}
+		}
+		if err := store.Record(record); err != nil {
+			log.Printf("Error recording the lineage of %s: %v", callReq.Params.Name, err)
+		}
+		return result, nil
+	}
+}
+
+// OutputsLineageInput selects an output file by path or content hash.
+type OutputsLineageInput struct {
+	Path   string `json:"path,omitempty" jsonschema:"description:Path of an output file"`
+	SHA256 string `json:"sha256,omitempty" jsonschema:"description:SHA-256 hash of the content of an output file, instead of its path"`
+}
+
+// OutputsLineageOutput lists the tool calls an output descends from.
+type OutputsLineageOutput struct {
+	SHA256  string       `json:"sha256"`
+	Records []cas.Record `json:"records"`
+}
+
+func (s *Server) registerContentTools(server *mcp.Server) {
+	// Keep saved files by content and record their lineage
+	server.AddReceivingMiddleware(s.contentMiddleware)
+
+	// Register outputs_lineage tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_lineage",
+		Description: "Trace how an output file was made: the tool call that produced its content, then the calls that produced that call's inputs, and so on. Each step lists the input and output files with their SHA-256 hashes. Requires OUTPUT_LAYOUT=content.",
+	}, s.handleOutputsLineage)
+}
+
+func (s *Server) handleOutputsLineage(ctx context.Context, req *mcp.CallToolRequest, input OutputsLineageInput) (*mcp.CallToolResult, OutputsLineageOutput, error) {
+	if s.config.OutputLayout != config.LayoutContent {
+		return nil, OutputsLineageOutput{}, fmt.Errorf("lineage is only recorded if OUTPUT_LAYOUT is %s", config.LayoutContent)
+	}
+	hash := input.SHA256
+	if input.Path != "" {
+		file, err := cas.Describe(input.Path)
+		if err != nil {
+			return nil, OutputsLineageOutput{}, fmt.Errorf("error reading %s: %w", input.Path, err)
+		}
+		hash = file.SHA256
+	}
+	if hash == "" {
+		return nil, OutputsLineageOutput{}, fmt.Errorf("path or sha256 is required")
+	}
+
+	records, err := s.contentStore(ctx).Lineage(hash)
+	if err != nil {
+		return nil, OutputsLineageOutput{}, err
+	}
+	if records == nil {
+		records = []cas.Record{}
+	}
+	return nil, OutputsLineageOutput{SHA256: hash, Records: records}, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+
+	"gemini-mcp/internal/pricing"
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// veoVideoSeconds is the length of the videos generated by the Veo tools.
+const veoVideoSeconds = 8
+
+// Cost estimation
+type EstimateCostInput struct {
+	Model                string   `json:"model" jsonschema:"description:Model to estimate, e.g. 'gemini-2.5-flash', 'gemini-2.5-flash-image-preview', 'imagen-4.0-ultra-generate-001' or 'veo-3.0-generate-001'"`
+	Prompt               string   `json:"prompt,omitempty" jsonschema:"description:Prompt to count input tokens for. Only Gemini models are billed by input tokens."`
+	AttachmentPaths      []string `json:"attachment_paths,omitempty" jsonschema:"description:Optional paths to images, videos or audio files (or 'files/<id>' names) sent with the prompt"`
+	NumImages            int      `json:"num_images,omitempty" jsonschema:"description:Number of images to generate with an image model,default:1"`
+	Resolution           string   `json:"resolution,omitempty" jsonschema:"description:Video resolution for Veo models,default:720p,enum:720p,enum:1080p"`
+	VideoSeconds         float64  `json:"video_seconds,omitempty" jsonschema:"description:Length of the video in seconds for Veo models,default:8"`
+	ExpectedOutputTokens int      `json:"expected_output_tokens,omitempty" jsonschema:"description:Expected number of response tokens for text models"`
+}
+
+type CostEstimate struct {
+	Items    []pricing.Estimate `json:"items"`
+	TotalUSD float64            `json:"total_usd"`
+	Complete bool               `json:"complete"`
+}
+
+// DryRun is returned by the generation tools instead of calling the API when
+// dry_run is set.
+type DryRun struct {
+	Prompt   string       `json:"prompt"`
+	Config   any          `json:"config,omitempty"`
+	Files    []DryRunFile `json:"files,omitempty"`
+	Estimate CostEstimate `json:"estimate"`
+}
+
+// DryRunFile is an input file of a dry run, measured locally without reading
+// it into a request or uploading it. Tokens is 0 if they depend on the length
+// of the media, in which case the estimate is incomplete.
+type DryRunFile struct {
+	Path      string `json:"path"`
+	MIMEType  string `json:"mime_type,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	Upload    bool   `json:"upload,omitempty"`
+	Tokens    int    `json:"tokens,omitempty"`
+}
+
+func (s *Server) registerCostTools(server *mcp.Server) {
+	// Register estimate_cost tool
+	addTool(server, &mcp.Tool{
+		Name:        "estimate_cost",
+		Description: "Estimate the cost of a Gemini, Imagen or Veo request before running it. Counts prompt tokens with the Gemini API, estimates attachments locally without uploading them, and prices the tokens, images and video seconds from the configured price table. The estimate is marked incomplete when a count is approximate, e.g. for videos or audio. To see the exact prompt and config a generation tool would send, call it with dry_run set instead.",
+	}, s.handleEstimateCost)
+}
+
+func (s *Server) handleEstimateCost(ctx context.Context, req *mcp.CallToolRequest, input EstimateCostInput) (*mcp.CallToolResult, CostEstimate, error) {
+	if input.Model == "" {
+		return nil, CostEstimate{}, fmt.Errorf("model is required")
+	}
+
+	numImages := input.NumImages
+	if numImages == 0 {
+		numImages = 1
+	}
+
+	var usage pricing.Usage
+	complete := true
+	switch {
+	case strings.HasPrefix(input.Model, "imagen"):
+		usage = pricing.Usage{Model: input.Model, Images: numImages}
+
+	case strings.HasPrefix(input.Model, "veo"):
+		resolution := input.Resolution
+		if resolution == "" {
+			resolution = "720p"
+		}
+		seconds := input.VideoSeconds
+		if seconds == 0 {
+			seconds = veoVideoSeconds
+		}
+		usage = pricing.Usage{Model: input.Model, Resolution: resolution, VideoSeconds: seconds}
+
+	default:
+		var err error
+		usage, _, complete, err = s.contentUsage(ctx, input.Model, nil, input.Prompt, input.AttachmentPaths, input.ExpectedOutputTokens)
+		if err != nil {
+			return nil, CostEstimate{}, err
+		}
+		if isImageModel(input.Model) {
+			usage.Images = numImages
+		}
+	}
+
+	estimate := newCostEstimate(s.prices.Estimate(usage))
+	estimate.Complete = estimate.Complete && complete
+	return nil, estimate, nil
+}
+
+// countTokens counts the input tokens of a request. If the API call fails,
+// it falls back to a rough estimate from the length of the text parts and
+// reports that the count is not exact.
+func (s *Server) countTokens(ctx context.Context, model string, contents []*genai.Content) (int, bool) {
+	response, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.CountTokensResponse, error) {
+		return s.client.Models.CountTokens(ctx, model, contents, nil)
+	})
+	if err == nil {
+		return int(response.TotalTokens), true
+	}
+	log.Printf("Error counting tokens, estimating from text length: %v", err)
+
+	chars := 0
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			chars += len(part.Text)
+		}
+	}
+	return (chars + 3) / 4, false
+}
+
+// contentUsage measures a GenerateContent request with a text prompt and
+// input files, following the turns of history if there are any. The history
+// and prompt tokens are counted by the API, the files are estimated locally
+// by mediaSizes so that nothing is uploaded. It reports whether every token
+// was counted.
+func (s *Server) contentUsage(ctx context.Context, model string, history []*genai.Content, prompt string, paths []string, outputTokens int) (pricing.Usage, []DryRunFile, bool, error) {
+	files, err := s.mediaSizes(paths)
+	if err != nil {
+		return pricing.Usage{}, nil, false, err
+	}
+	contents := append(slices.Clip(history), genai.NewContentFromText(prompt, genai.RoleUser))
+	tokens, complete := s.countTokens(ctx, model, contents)
+	usage := pricing.Usage{Model: model, InputTokens: tokens, OutputTokens: outputTokens}
+	for _, file := range files {
+		usage.InputTokens += file.Tokens
+		complete = complete && file.Tokens > 0
+	}
+	return usage, files, complete, nil
+}
+
+// dryRun builds the result returned by a generation tool in dry-run mode.
+func (s *Server) dryRun(prompt string, config any, items ...pricing.Estimate) *DryRun {
+	log.Printf("Dry run: skipping generation")
+	return &DryRun{
+		Prompt:   prompt,
+		Config:   config,
+		Estimate: newCostEstimate(items...),
+	}
+}
+
+// dryRunContent builds the dry run of a GenerateContent request with a text
+// prompt and input files, measured by contentUsage. Image models are assumed
+// to return a single image.
+func (s *Server) dryRunContent(ctx context.Context, model string, history []*genai.Content, prompt string, config any, paths []string, outputTokens int) (*DryRun, error) {
+	usage, files, complete, err := s.contentUsage(ctx, model, history, prompt, paths, outputTokens)
+	if err != nil {
+		return nil, err
+	}
+	if isImageModel(model) {
+		usage.Images = 1
+	}
+
+	dryRun := s.dryRun(prompt, config, s.prices.Estimate(usage))
+	dryRun.Files = files
+	dryRun.Estimate.Complete = dryRun.Estimate.Complete && complete
+	return dryRun, nil
+}
+
+func newCostEstimate(items ...pricing.Estimate) CostEstimate {
+	estimate := CostEstimate{Items: items, Complete: true}
+	for _, item := range items {
+		estimate.TotalUSD += item.CostUSD
+		if !item.Priced {
+			estimate.Complete = false
+		}
+	}
+	estimate.TotalUSD = roundUSD(estimate.TotalUSD)
+	return estimate
+}
+
+// roundUSD rounds to a millionth of a dollar to hide floating point noise.
+func roundUSD(usd float64) float64 {
+	return math.Round(usd*1e6) / 1e6
+}
+
+// videoConfig returns the settings of a Veo request, which dry runs report
+// as they are sent. A seed of 0 leaves the choice of seed to the API. The SDK
+// refuses the Seed field for the Gemini API, whose Veo models take it as a
+// request parameter, so it is added to the request body instead.
+func videoConfig(aspectRatio, resolution string, seed int) *genai.GenerateVideosConfig {
+	config := &genai.GenerateVideosConfig{AspectRatio: aspectRatio, Resolution: resolution}
+	if seed > 0 {
+		config.HTTPOptions = &genai.HTTPOptions{
+			ExtraBody: map[string]any{"parameters": map[string]any{"seed": seed}},
+		}
+	}
+	return config
+}
+
+// isImageModel reports whether a Gemini model generates images.
+func isImageModel(model string) bool {
+	return strings.Contains(model, "image")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// ToolError is the structured content of a tool result for a failed API
+// call.
+type ToolError struct {
+	Kind      retry.Kind `json:"kind"`
+	Message   string     `json:"message"`
+	Code      int        `json:"code,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	Retryable bool       `json:"retryable"`
+	Attempts  int        `json:"attempts,omitempty"`
+	// Suggestions lists valid values resembling an invalid argument.
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// toolErrorKey is the context key of the toolErrorSlot of a tool call.
+type toolErrorKey struct{}
+
+// toolErrorSlot receives the classified API error returned by a tool handler,
+// which the SDK otherwise flattens to text.
+type toolErrorSlot struct {
+	err *retry.Error
+}
+
+// addTool registers a tool like mcp.AddTool, making the request available to
+// notifyProgress and passing classified API errors returned by its handler on
+// to errorMiddleware.
+func addTool[In, Out any](server *mcp.Server, tool *mcp.Tool, handler mcp.ToolHandlerFor[In, Out]) {
+	mcp.AddTool(server, tool, func(ctx context.Context, req *mcp.CallToolRequest, input In) (*mcp.CallToolResult, Out, error) {
+		ctx = context.WithValue(ctx, progressKey{}, &progressReporter{req: req})
+		result, output, err := handler(ctx, req, input)
+		var apiErr *retry.Error
+		if errors.As(err, &apiErr) {
+			if slot, ok := ctx.Value(toolErrorKey{}).(*toolErrorSlot); ok {
+				slot.err = apiErr
+			}
+		}
+		return result, output, err
+	})
+}
+
+// errorMiddleware adds the classification of API errors to the results of
+// failed tool calls as structured content.
+func (s *Server) errorMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		if _, ok := req.(*mcp.CallToolRequest); !ok {
+			return next(ctx, method, req)
+		}
+
+		slot := &toolErrorSlot{}
+		result, err := next(context.WithValue(ctx, toolErrorKey{}, slot), method, req)
+		if res, ok := result.(*mcp.CallToolResult); ok && err == nil && res.IsError && slot.err != nil {
+			res.StructuredContent = map[string]any{"error": ToolError{
+				Kind:      slot.err.Kind,
+				Message:   slot.err.Message,
+				Code:      slot.err.Code,
+				Status:    slot.err.Status,
+				Retryable: slot.err.Retryable,
+				Attempts:  slot.err.Attempts,
+			}}
+		}
+		return result, err
+	}
+}
+
+// retryPolicy returns the retry policy for API calls.
+func (s *Server) retryPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: s.config.RetryMaxAttempts,
+		BaseDelay:   s.config.RetryBaseDelay,
+		MaxDelay:    s.config.RetryMaxDelay,
+		OnRetry: func(attempt int, err *retry.Error, delay time.Duration) {
+			log.Printf("Attempt %d failed (%v), retrying in %s", attempt, err, delay.Round(time.Millisecond))
+		},
+	}
+}
+
+// generateContent calls GenerateContent with retries, scheduling each attempt
+// and falling back to other models, and reports responses blocked by safety
+// filters as errors. It returns the model that served the request.
+func (s *Server) generateContent(ctx context.Context, model string, contents []*genai.Content, config *genai.GenerateContentConfig) (*genai.GenerateContentResponse, string, error) {
+	call := func(model string) (*genai.GenerateContentResponse, error) {
+		return retry.Do(ctx, s.retryPolicy(), func() (*genai.GenerateContentResponse, error) {
+			release, err := s.schedule(ctx, model)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			return s.client.Models.GenerateContent(ctx, model, contents, config)
+		})
+	}
+
+	// Cached content belongs to one model, so there is nothing to fall back to.
+	var response *genai.GenerateContentResponse
+	var err error
+	if config != nil && config.CachedContent != "" {
+		response, err = call(model)
+	} else {
+		response, model, err = withFallback(s, model, call)
+	}
+	if err != nil {
+		return nil, model, err
+	}
+	if err := blockedError(response); err != nil {
+		return nil, model, err
+	}
+	return response, model, nil
+}
+
+// sendChat sends a chat message to model with retries, scheduling each
+// attempt, and reports responses blocked by safety filters as errors.
+func (s *Server) sendChat(ctx context.Context, model string, chat *genai.Chat, parts []*genai.Part) (*genai.GenerateContentResponse, error) {
+	response, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.GenerateContentResponse, error) {
+		release, err := s.schedule(ctx, model)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return chat.Send(ctx, parts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := blockedError(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// generateImages calls GenerateImages with retries, scheduling each attempt
+// and falling back to other models, and reports requests whose images were all
+// filtered out as safety errors. It returns the model that served the request.
+func (s *Server) generateImages(ctx context.Context, model, prompt string, config *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, string, error) {
+	response, model, err := withFallback(s, model, func(model string) (*genai.GenerateImagesResponse, error) {
+		return retry.Do(ctx, s.retryPolicy(), func() (*genai.GenerateImagesResponse, error) {
+			release, err := s.schedule(ctx, model)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			return s.client.Models.GenerateImages(ctx, model, prompt, config)
+		})
+	})
+	if err != nil {
+		return nil, model, err
+	}
+
+	var filtered string
+	for _, image := range response.GeneratedImages {
+		if image.Image != nil {
+			return response, model, nil
+		}
+		if image.RAIFilteredReason != "" {
+			filtered = image.RAIFilteredReason
+		}
+	}
+	if filtered != "" {
+		return nil, model, retry.Safety(filtered)
+	}
+	return response, model, nil
+}
+
+// generateVideos starts a video generation operation with retries, falling
+// back to other models, and returns the model that serves it. Unlike the other
+// calls, it is not scheduled here: callers hold a slot from schedule until
+// the operation is done.
+func (s *Server) generateVideos(ctx context.Context, model, prompt string, image *genai.Image, config *genai.GenerateVideosConfig) (*genai.GenerateVideosOperation, string, error) {
+	return withFallback(s, model, func(model string) (*genai.GenerateVideosOperation, error) {
+		return retry.Do(ctx, s.retryPolicy(), func() (*genai.GenerateVideosOperation, error) {
+			return s.client.Models.GenerateVideos(ctx, model, prompt, image, config)
+		})
+	})
+}
+
+// getVideosOperation refreshes a video generation operation with retries.
+func (s *Server) getVideosOperation(ctx context.Context, operation *genai.GenerateVideosOperation) (*genai.GenerateVideosOperation, error) {
+	return retry.Do(ctx, s.retryPolicy(), func() (*genai.GenerateVideosOperation, error) {
+		return s.client.Operations.GetVideosOperation(ctx, operation, nil)
+	})
+}
+
+// blockedError returns a safety error if the prompt or the only candidate of
+// a response was blocked.
+func blockedError(response *genai.GenerateContentResponse) error {
+	if response == nil {
+		return nil
+	}
+	if feedback := response.PromptFeedback; feedback != nil && feedback.BlockReason != "" {
+		reason := string(feedback.BlockReason)
+		if feedback.BlockReasonMessage != "" {
+			reason += " (" + feedback.BlockReasonMessage + ")"
+		}
+		return retry.Safety(reason)
+	}
+	if len(response.Candidates) != 1 {
+		return nil
+	}
+
+	candidate := response.Candidates[0]
+	switch candidate.FinishReason {
+	case genai.FinishReasonSafety, genai.FinishReasonProhibitedContent, genai.FinishReasonBlocklist,
+		genai.FinishReasonSPII, genai.FinishReasonImageSafety:
+		if candidate.Content == nil || len(candidate.Content.Parts) == 0 {
+			return retry.Safety(string(candidate.FinishReason))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+
+	"gemini-mcp/internal/retry"
+)
+
+// withFallback calls fn with model and, while the calls fail with quota or
+// availability errors, with each of the configured fallbacks of model. It
+// returns the model that served the call.
+func withFallback[T any](s *Server, model string, fn func(model string) (T, error)) (T, string, error) {
+	candidates := append([]string{model}, s.config.ModelFallbacks[model]...)
+
+	var result T
+	var err error
+	for i, candidate := range candidates {
+		result, err = fn(candidate)
+		if err == nil {
+			if candidate != model {
+				log.Printf("Request for %s was served by fallback model %s", model, candidate)
+			}
+			return result, candidate, nil
+		}
+
+		// Only quota and availability errors are retryable, and other
+		// models will not fare better with any other error.
+		if !retry.Classify(err).Retryable {
+			break
+		}
+		if i+1 < len(candidates) {
+			log.Printf("Model %s failed (%v), falling back to %s", candidate, err, candidates[i+1])
+		}
+	}
+	return result, model, err
+}
+
+// fallbackFrom returns the requested model if another model served the
+// request, for the fallback_from field of tool outputs.
+func fallbackFrom(requested, served string) string {
+	if requested == served {
+		return ""
+	}
+	return requested
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gemini-mcp/internal/imaging"
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// mediaMIMETypes maps the media extensions accepted by the tools to MIME
+// types, since minimal container images often lack a system MIME table.
+var mediaMIMETypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+	".gif":  "image/gif",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+	".avi":  "video/x-msvideo",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+}
+
+// fileActiveTimeout bounds how long to wait for an uploaded file to finish
+// processing.
+const fileActiveTimeout = 5 * time.Minute
+
+// mediaMIMEType returns the MIME type for a local media file based on its
+// extension, or an empty string if it is unknown.
+func mediaMIMEType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := mediaMIMETypes[ext]; ok {
+		return mimeType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// imageMIMEType sniffs the MIME type of image data, falling back to PNG for
+// anything that is not recognised as an image.
+func imageMIMEType(data []byte) string {
+	if mimeType := http.DetectContentType(data); strings.HasPrefix(mimeType, "image/") {
+		return mimeType
+	}
+	return "image/png"
+}
+
+// mediaParts turns input paths into request parts, in order. Files larger
+// than the configured upload threshold are sent through the Files API, smaller
+// ones inline. A path of the form 'files/<id>' that does not exist locally
+// refers to a file uploaded earlier.
+func (s *Server) mediaParts(ctx context.Context, paths []string) ([]*genai.Part, error) {
+	var parts []*genai.Part
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) && strings.HasPrefix(path, "files/") {
+			file, err := s.getActiveFile(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image %d (%s): %v", i+1, path, err)
+		}
+
+		if s.config.FileUploadThreshold > 0 && info.Size() > s.config.FileUploadThreshold {
+			file, err := s.uploadFile(ctx, path, "")
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image %d (%s): %v", i+1, path, err)
+		}
+		parts = append(parts, inlinePart(path, data))
+	}
+	return parts, nil
+}
+
+// dataPart is mediaParts for a local file the caller has read into data
+// already: it is uploaded if it is larger than FILE_UPLOAD_THRESHOLD and
+// sent inline from data otherwise, without reading it again.
+func (s *Server) dataPart(ctx context.Context, path string, data []byte) (*genai.Part, error) {
+	if s.config.FileUploadThreshold > 0 && int64(len(data)) > s.config.FileUploadThreshold {
+		file, err := s.uploadFile(ctx, path, "")
+		if err != nil {
+			return nil, err
+		}
+		return genai.NewPartFromURI(file.URI, file.MIMEType), nil
+	}
+	return inlinePart(path, data), nil
+}
+
+// inlinePart returns the inline part of the file at path with content data.
+func inlinePart(path string, data []byte) *genai.Part {
+	mimeType := mediaMIMEType(path)
+	if mimeType == "" || strings.HasPrefix(mimeType, "image/") {
+		mimeType = imageMIMEType(data)
+	}
+	return &genai.Part{
+		InlineData: &genai.Blob{
+			MIMEType: mimeType,
+			Data:     data,
+		},
+	}
+}
+
+// mediaSizes describes input paths the way mediaParts would send them,
+// without reading or uploading them. Images are estimated from their size in
+// pixels; the tokens of audio and video depend on their length and are left
+// at 0, as are those of files uploaded earlier.
+func (s *Server) mediaSizes(paths []string) ([]DryRunFile, error) {
+	var files []DryRunFile
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) && strings.HasPrefix(path, "files/") {
+			files = append(files, DryRunFile{Path: path})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image %d (%s): %v", i+1, path, err)
+		}
+
+		file := DryRunFile{
+			Path:      path,
+			MIMEType:  mediaMIMEType(path),
+			SizeBytes: info.Size(),
+			Upload:    s.config.FileUploadThreshold > 0 && info.Size() > s.config.FileUploadThreshold,
+		}
+		if file.MIMEType == "" || strings.HasPrefix(file.MIMEType, "image/") {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read image %d (%s): %v", i+1, path, err)
+			}
+			width, height, err := imaging.Size(f)
+			f.Close()
+			if err == nil {
+				file.Tokens = imaging.Tokens(width, height)
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// uploadFile uploads a local file through the Files API and waits until it
+// is ready to be referenced in a request. The display name defaults to the
+// file name.
+func (s *Server) uploadFile(ctx context.Context, path, displayName string) (*genai.File, error) {
+	mimeType := mediaMIMEType(path)
+	if mimeType == "" {
+		return nil, fmt.Errorf("unsupported file type: %s", path)
+	}
+
+	if displayName == "" {
+		displayName = filepath.Base(path)
+	}
+	displayName = uploadPrefix(ctx) + displayName
+
+	log.Printf("Uploading %s (%s) to the Files API", path, mimeType)
+
+	file, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.File, error) {
+		return s.client.Files.UploadFromPath(ctx, path, &genai.UploadFileConfig{
+			MIMEType:    mimeType,
+			DisplayName: displayName,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error uploading file: %w", err)
+	}
+
+	return s.waitForFileActive(ctx, file)
+}
+
+// waitForFileActive polls an uploaded file until processing completes.
+func (s *Server) waitForFileActive(ctx context.Context, file *genai.File) (*genai.File, error) {
+	deadline := time.Now().Add(fileActiveTimeout)
+	for file.State != genai.FileStateActive {
+		if file.State == genai.FileStateFailed {
+			if file.Error != nil {
+				return nil, fmt.Errorf("file processing failed for %s: %s", file.Name, file.Error.Message)
+			}
+			return nil, fmt.Errorf("file processing failed for %s", file.Name)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for file %s to become active", file.Name)
+		}
+
+		log.Printf("Waiting for file %s to be processed (state: %s)", file.Name, file.State)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+
+		var err error
+		file, err = retry.Do(ctx, s.retryPolicy(), func() (*genai.File, error) {
+			return s.client.Files.Get(ctx, file.Name, nil)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error checking file status: %w", err)
+		}
+	}
+	return file, nil
+}
+
+// getActiveFile looks up a previously uploaded file by name and waits until
+// it is ready to be used.
+func (s *Server) getActiveFile(ctx context.Context, name string) (*genai.File, error) {
+	if !strings.HasPrefix(name, "files/") {
+		name = "files/" + name
+	}
+	file, err := s.getFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.waitForFileActive(ctx, file)
+}
+
+// getFile looks up a previously uploaded file by its full name.
+func (s *Server) getFile(ctx context.Context, name string) (*genai.File, error) {
+	file, err := retry.Do(ctx, s.retryPolicy(), func() (*genai.File, error) {
+		return s.client.Files.Get(ctx, name, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting file %s: %w", name, err)
+	}
+	if !ownsUpload(ctx, file.DisplayName) {
+		return nil, fmt.Errorf("file %s not found", name)
+	}
+	return file, nil
+}
+
+// uploadPrefix returns the prefix of the display names of the files and
+// caches the caller creates, or "" if outputs are not isolated. Both are
+// shared by every caller of the API key, so with isolation their display
+// names record the tenant that created them, and tenants only see their own.
+func uploadPrefix(ctx context.Context) string {
+	if id, ok := ctx.Value(tenantKey{}).(string); ok {
+		return id + "/"
+	}
+	return ""
+}
+
+// ownsUpload reports whether the caller may see an uploaded file or cache
+// with the given display name.
+func ownsUpload(ctx context.Context, displayName string) bool {
+	return strings.HasPrefix(displayName, uploadPrefix(ctx))
+}
+
+// Files API management
+type FilesUploadInput struct {
+	Path        string `json:"path" jsonschema:"description:Path to the local file to upload (image, video or audio)"`
+	DisplayName string `json:"display_name,omitempty" jsonschema:"description:Optional display name for the uploaded file. Defaults to the file name."`
+}
+
+type FilesListInput struct {
+	PageSize  int    `json:"page_size,omitempty" jsonschema:"description:Maximum number of files to return,default:50"`
+	PageToken string `json:"page_token,omitempty" jsonschema:"description:Token from a previous call to fetch the next page"`
+}
+
+type FilesGetInput struct {
+	Name string `json:"name" jsonschema:"description:Name of the uploaded file (e.g. 'files/abc123')"`
+}
+
+type FilesDeleteInput struct {
+	Names []string `json:"names" jsonschema:"description:Names of the uploaded files to delete (e.g. 'files/abc123')"`
+}
+
+type UploadedFile struct {
+	Name           string `json:"name"`
+	DisplayName    string `json:"display_name,omitempty"`
+	MIMEType       string `json:"mime_type,omitempty"`
+	SizeBytes      int64  `json:"size_bytes,omitempty"`
+	State          string `json:"state,omitempty"`
+	URI            string `json:"uri,omitempty"`
+	CreateTime     string `json:"create_time,omitempty"`
+	ExpirationTime string `json:"expiration_time,omitempty"`
+}
+
+type FilesListOutput struct {
+	Files         []UploadedFile `json:"files"`
+	Count         int            `json:"count"`
+	NextPageToken string         `json:"next_page_token,omitempty"`
+}
+
+type FilesDeleteOutput struct {
+	Deleted []string          `json:"deleted"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+func (s *Server) registerFileTools(server *mcp.Server) {
+	// Register files_upload tool
+	addTool(server, &mcp.Tool{
+		Name:        "files_upload",
+		Description: "Upload a local image, video or audio file to the Gemini Files API and wait until it is ready. The returned name (e.g. 'files/abc123') can be passed wherever the tools accept an input path, so the same asset is not uploaded again. Uploaded files expire after 48 hours.",
+	}, s.handleFilesUpload)
+
+	// Register files_list tool
+	addTool(server, &mcp.Tool{
+		Name:        "files_list",
+		Description: "List files uploaded to the Gemini Files API with their names, sizes, states and expiration times. With isolation, only the caller's own uploads are listed, so a page may hold fewer than page_size files.",
+	}, s.handleFilesList)
+
+	// Register files_get tool
+	addTool(server, &mcp.Tool{
+		Name:        "files_get",
+		Description: "Get the details of a file uploaded to the Gemini Files API, including its processing state and URI.",
+	}, s.handleFilesGet)
+
+	// Register files_delete tool
+	addTool(server, &mcp.Tool{
+		Name:        "files_delete",
+		Description: "Delete files from the Gemini Files API to free up storage quota.",
+	}, s.handleFilesDelete)
+}
+
+func (s *Server) handleFilesUpload(ctx context.Context, req *mcp.CallToolRequest, input FilesUploadInput) (*mcp.CallToolResult, UploadedFile, error) {
+	if input.Path == "" {
+		return nil, UploadedFile{}, fmt.Errorf("path is required")
+	}
+
+	file, err := s.uploadFile(ctx, input.Path, input.DisplayName)
+	if err != nil {
+		return nil, UploadedFile{}, err
+	}
+	return nil, uploadedFile(ctx, file), nil
+}
+
+func (s *Server) handleFilesList(ctx context.Context, req *mcp.CallToolRequest, input FilesListInput) (*mcp.CallToolResult, FilesListOutput, error) {
+	pageSize := input.PageSize
+	if pageSize == 0 {
+		pageSize = 50
+	}
+
+	page, err := retry.Do(ctx, s.retryPolicy(), func() (genai.Page[genai.File], error) {
+		return s.client.Files.List(ctx, &genai.ListFilesConfig{
+			PageSize:  int32(pageSize),
+			PageToken: input.PageToken,
+		})
+	})
+	if err != nil {
+		return nil, FilesListOutput{}, fmt.Errorf("error listing files: %w", err)
+	}
+
+	files := make([]UploadedFile, 0, len(page.Items))
+	for _, file := range page.Items {
+		if ownsUpload(ctx, file.DisplayName) {
+			files = append(files, uploadedFile(ctx, file))
+		}
+	}
+
+	return nil, FilesListOutput{
+		Files:         files,
+		Count:         len(files),
+		NextPageToken: page.NextPageToken,
+	}, nil
+}
+
+func (s *Server) handleFilesGet(ctx context.Context, req *mcp.CallToolRequest, input FilesGetInput) (*mcp.CallToolResult, UploadedFile, error) {
+	if input.Name == "" {
+		return nil, UploadedFile{}, fmt.Errorf("name is required")
+	}
+
+	name := input.Name
+	if !strings.HasPrefix(name, "files/") {
+		name = "files/" + name
+	}
+
+	file, err := s.getFile(ctx, name)
+	if err != nil {
+		return nil, UploadedFile{}, err
+	}
+	return nil, uploadedFile(ctx, file), nil
+}
+
+func (s *Server) handleFilesDelete(ctx context.Context, req *mcp.CallToolRequest, input FilesDeleteInput) (*mcp.CallToolResult, FilesDeleteOutput, error) {
+	if len(input.Names) == 0 {
+		return nil, FilesDeleteOutput{}, fmt.Errorf("at least 1 file name is required")
+	}
+
+	output := FilesDeleteOutput{Deleted: []string{}}
+	for _, name := range input.Names {
+		if !strings.HasPrefix(name, "files/") {
+			name = "files/" + name
+		}
+		var err error
+		if uploadPrefix(ctx) != "" {
+			// Only delete the caller's own uploads
+			_, err = s.getFile(ctx, name)
+		}
+		if err == nil {
+			_, err = retry.Do(ctx, s.retryPolicy(), func() (*genai.DeleteFileResponse, error) {
+				return s.client.Files.Delete(ctx, name, nil)
+			})
+		}
+		if err != nil {
+			if output.Errors == nil {
+				output.Errors = make(map[string]string)
+			}
+			output.Errors[name] = err.Error()
+			continue
+		}
+		log.Printf("Deleted uploaded file %s", name)
+		output.Deleted = append(output.Deleted, name)
+	}
+	return nil, output, nil
+}
+
+func uploadedFile(ctx context.Context, file *genai.File) UploadedFile {
+	f := UploadedFile{
+		Name:        file.Name,
+		DisplayName: strings.TrimPrefix(file.DisplayName, uploadPrefix(ctx)),
+		MIMEType:    file.MIMEType,
+		State:       string(file.State),
+		URI:         file.URI,
+	}
+	if file.SizeBytes != nil {
+		f.SizeBytes = *file.SizeBytes
+	}
+	if !file.CreateTime.IsZero() {
+		f.CreateTime = file.CreateTime.Format(time.RFC3339)
+	}
+	if !file.ExpirationTime.IsZero() {
+		f.ExpirationTime = file.ExpirationTime.Format(time.RFC3339)
+	}
+	return f
+}
@@ -0,0 +1,232 @@
+// Package auth authenticates callers of the HTTP transports with static
+// bearer tokens or JWTs signed by keys in a local JWKS file, and decides
+// which tools the scopes of their tokens allow.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	mcpauth "github.com/modelcontextprotocol/go-sdk/auth"
+)
+
+// Config is the auth section of the configuration file.
+type Config struct {
+	// Tokens are static bearer tokens.
+	Tokens []Token `yaml:"tokens,omitempty"`
+
+	// JWKSFile is a local JWKS file with the keys that sign accepted JWTs.
+	JWKSFile string `yaml:"jwks_file,omitempty"`
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string `yaml:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty"`
+
+	// Resource is the URL of the server and AuthorizationServers the OAuth
+	// servers issuing its tokens. They are published as protected resource
+	// metadata, so that clients can discover where to get tokens. JWTs must
+	// be for the audience Resource unless Audience is set.
+	Resource             string   `yaml:"resource,omitempty"`
+	AuthorizationServers []string `yaml:"authorization_servers,omitempty"`
+
+	// Scopes names groups of tool name patterns, such as video: [veo_*].
+	Scopes map[string][]string `yaml:"scopes,omitempty"`
+}
+
+// Token is a static bearer token.
+type Token struct {
+	Token    string `yaml:"token,omitempty"`
+	ClientID string `yaml:"client_id,omitempty"`
+	// Scopes limit the tools the token may call. A token without scopes may
+	// call every tool.
+	Scopes []string `yaml:"scopes,omitempty"`
+}
+
+// Enabled reports whether any way of authenticating is configured.
+func (c *Config) Enabled() bool {
+	return len(c.Tokens) > 0 || c.JWKSFile != ""
+}
+
+// Validate checks the tokens and scopes.
+func (c *Config) Validate() error {
+	clients := make(map[string]bool)
+	for i, token := range c.Tokens {
+		if len(token.Token) < 16 {
+			return fmt.Errorf("auth.tokens[%d]: token must be at least 16 characters", i)
+		}
+		if token.ClientID == "" {
+			return fmt.Errorf("auth.tokens[%d]: client_id is required", i)
+		}
+		if clients[token.ClientID] {
+			return fmt.Errorf("auth.tokens[%d]: duplicate client_id %s", i, token.ClientID)
+		}
+		clients[token.ClientID] = true
+	}
+	for name, patterns := range c.Scopes {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("auth.scopes.%s: invalid pattern %q", name, pattern)
+			}
+		}
+	}
+	if c.JWKSFile == "" && (c.Issuer != "" || c.Audience != "") {
+		return fmt.Errorf("auth: issuer and audience require jwks_file")
+	}
+	if c.Resource != "" {
+		if u, err := url.Parse(c.Resource); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("auth.resource: %q is not an absolute URL", c.Resource)
+		}
+	}
+	return nil
+}
+
+// allScopes is the scope of static tokens without scopes.
+const allScopes = "*"
+
+// staticTokenTTL is the expiration given to static tokens on each request,
+// as the SDK refuses tokens without one.
+const staticTokenTTL = time.Hour
+
+// Authenticator verifies bearer tokens.
+type Authenticator struct {
+	config Config
+	// tokens are the static tokens by SHA-256 hash, so that looking them up
+	// does not leak them through timing.
+	tokens map[[sha256.Size]byte]Token
+	keys   *KeySet
+	now    func() time.Time
+}
+
+// New returns an authenticator for config, loading its JWKS file.
+func New(config Config) (*Authenticator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		config: config,
+		tokens: make(map[[sha256.Size]byte]Token),
+		now:    time.Now,
+	}
+	if config.Audience == "" {
+		a.config.Audience = config.Resource
+	}
+	for _, token := range config.Tokens {
+		a.tokens[sha256.Sum256([]byte(token.Token))] = token
+	}
+	if config.JWKSFile != "" {
+		keys, err := LoadKeySet(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	return a, nil
+}
+
+// Verify is a TokenVerifier for mcpauth.RequireBearerToken. The client_id of
+// the returned TokenInfo identifies the caller for per-client budgets.
+func (a *Authenticator) Verify(ctx context.Context, token string, req *http.Request) (*mcpauth.TokenInfo, error) {
+	sum := sha256.Sum256([]byte(token))
+	if static, ok := a.tokens[sum]; ok {
+		scopes := static.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{allScopes}
+		}
+		return &mcpauth.TokenInfo{
+			Scopes:     scopes,
+			Expiration: a.now().Add(staticTokenTTL),
+			Extra:      map[string]any{"client_id": static.ClientID},
+		}, nil
+	}
+
+	if a.keys == nil {
+		return nil, fmt.Errorf("%w: unknown token", mcpauth.ErrInvalidToken)
+	}
+	claims, err := a.keys.Verify(token, a.now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", mcpauth.ErrInvalidToken, err)
+	}
+	if a.config.Issuer != "" && claims.Issuer != a.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", mcpauth.ErrInvalidToken, claims.Issuer)
+	}
+	if a.config.Audience != "" && !slices.Contains(claims.Audience, a.config.Audience) {
+		return nil, fmt.Errorf("%w: token is not for audience %s", mcpauth.ErrInvalidToken, a.config.Audience)
+	}
+	return &mcpauth.TokenInfo{
+		Scopes:     claims.Scopes,
+		Expiration: claims.Expiration,
+		Extra:      map[string]any{"client_id": claims.ClientID(), "subject": claims.Subject},
+	}, nil
+}
+
+// Allowed reports whether a token with scopes may call tool. A scope allows
+// the tools matching the patterns of the named scope in the configuration,
+// or, if there is none of that name, the tools matching the scope itself.
+func (a *Authenticator) Allowed(scopes []string, tool string) bool {
+	for _, scope := range scopes {
+		patterns, ok := a.config.Scopes[scope]
+		if !ok {
+			patterns = []string{scope}
+		}
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, tool); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResourceMetadataURL returns the URL of the protected resource metadata, or
+// "" if no resource is configured. As RFC 9728 specifies, the well-known path
+// goes between the host and the path of the resource.
+func (a *Authenticator) ResourceMetadataURL() string {
+	if a.config.Resource == "" {
+		return ""
+	}
+	u, _ := url.Parse(a.config.Resource)
+	u.Path = a.ResourceMetadataPath()
+	u.RawPath = ""
+	return u.String()
+}
+
+// ResourceMetadataPath returns the path the protected resource metadata is
+// served at.
+func (a *Authenticator) ResourceMetadataPath() string {
+	u, err := url.Parse(a.config.Resource)
+	if err != nil {
+		return wellKnownPath
+	}
+	return wellKnownPath + strings.TrimSuffix(u.Path, "/")
+}
+
+const wellKnownPath = "/.well-known/oauth-protected-resource"
+
+// ResourceMetadata is OAuth 2.0 protected resource metadata (RFC 9728).
+type ResourceMetadata struct {
+	Resource               string   `json:"resource"`
+	AuthorizationServers   []string `json:"authorization_servers,omitempty"`
+	BearerMethodsSupported []string `json:"bearer_methods_supported"`
+	ScopesSupported        []string `json:"scopes_supported,omitempty"`
+}
+
+// Metadata returns the protected resource metadata of the server.
+func (a *Authenticator) Metadata() ResourceMetadata {
+	var scopes []string
+	for name := range a.config.Scopes {
+		scopes = append(scopes, name)
+	}
+	slices.Sort(scopes)
+	return ResourceMetadata{
+		Resource:               a.config.Resource,
+		AuthorizationServers:   a.config.AuthorizationServers,
+		BearerMethodsSupported: []string{"header"},
+		ScopesSupported:        scopes,
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	mcpauth "github.com/modelcontextprotocol/go-sdk/auth"
+)
+
+var now = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func encode(v any) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a compact JWT with claims signed by key.
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, digest[:])
+		err = signErr
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path,
+		map[string]string{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	)
+	a, err := New(Config{JWKSFile: path, Issuer: "https://auth.example.com", Resource: "https://mcp.example.com/mcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":       "https://auth.example.com",
+			"sub":       "user-1",
+			"aud":       "https://mcp.example.com/mcp",
+			"exp":       now.Add(time.Hour).Unix(),
+			"scope":     "image text",
+			"client_id": "app",
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tt := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{{"RS256", "rsa", rsaKey}, {"ES256", "ec", ecKey}, {"EdDSA", "ed", edKey}} {
+		info, err := a.Verify(context.Background(), sign(t, tt.alg, tt.kid, tt.key, claims(nil)), nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.alg, err)
+			continue
+		}
+		if !slices.Equal(info.Scopes, []string{"image", "text"}) || info.Extra["client_id"] != "app" || !info.Expiration.Equal(now.Add(time.Hour)) {
+			t.Errorf("%s: unexpected token info %+v", tt.alg, info)
+		}
+	}
+
+	invalid := map[string]string{
+		"expired":       sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})),
+		"no expiration": sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": nil})),
+		"not yet valid": sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong issuer":  sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"iss": "https://evil.example.com"})),
+		"wrong aud":     sign(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": []string{"https://other.example.com"}})),
+		"unknown key":   sign(t, "RS256", "other", rsaKey, claims(nil)),
+		"wrong alg":     sign(t, "ES256", "rsa", ecKey, claims(nil)),
+		"wrong key":     sign(t, "ES256", "ec", mustECKey(), claims(nil)),
+		"tampered":      tamper(sign(t, "RS256", "rsa", rsaKey, claims(nil)), claims(map[string]any{"scope": "*"})),
+		"static":        "not-a-configured-token",
+	}
+	for name, token := range invalid {
+		if _, err := a.Verify(context.Background(), token, nil); !errors.Is(err, mcpauth.ErrInvalidToken) {
+			t.Errorf("%s: expected invalid token error, got %v", name, err)
+		}
+	}
+
+	// Keys are read again when the file changes
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writeJWKS(t, path, map[string]string{"kty": "RSA", "kid": "rotated", "n": b64(rotated.N.Bytes()), "e": "AQAB"})
+	os.Chtimes(path, now, now.Add(time.Minute))
+	if _, err := a.Verify(context.Background(), sign(t, "RS256", "rotated", rotated, claims(nil)), nil); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+}
+
+// tamper replaces the claims of token, keeping its signature.
+func tamper(token string, claims map[string]any) string {
+	parts := strings.Split(token, ".")
+	parts[1] = encode(claims)
+	return strings.Join(parts, ".")
+}
+
+func mustECKey() *ecdsa.PrivateKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return key
+}
+
+func TestStaticTokens(t *testing.T) {
+	a, err := New(Config{Tokens: []Token{
+		{Token: "full-access-token-0001", ClientID: "admin"},
+		{Token: "image-only-token-0002", ClientID: "designer", Scopes: []string{"image"}},
+	}, Scopes: map[string][]string{"image": {"imagen_*", "gemini_image_*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := a.Verify(context.Background(), "image-only-token-0002", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Extra["client_id"] != "designer" || info.Expiration.IsZero() {
+		t.Errorf("unexpected token info %+v", info)
+	}
+	if !a.Allowed(info.Scopes, "imagen_t2i") || a.Allowed(info.Scopes, "veo_text_to_video") {
+		t.Errorf("image scope allows the wrong tools")
+	}
+
+	info, err = a.Verify(context.Background(), "full-access-token-0001", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Allowed(info.Scopes, "veo_text_to_video") {
+		t.Error("token without scopes should allow every tool")
+	}
+
+	// Scopes that are not named in the configuration are tool patterns
+	if !a.Allowed([]string{"veo_*"}, "veo_image_to_video") || a.Allowed([]string{"mcp"}, "imagen_t2i") {
+		t.Error("unnamed scopes should match tool names")
+	}
+
+	if _, err := New(Config{Tokens: []Token{{Token: "short", ClientID: "x"}}}); err == nil {
+		t.Error("expected error for short token")
+	}
+}
+
+func TestResourceMetadataURL(t *testing.T) {
+	a, err := New(Config{Tokens: []Token{{Token: "full-access-token-0001", ClientID: "admin"}}, Resource: "https://mcp.example.com/mcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.ResourceMetadataURL(), "https://mcp.example.com/.well-known/oauth-protected-resource/mcp"; got != want {
+		t.Errorf("ResourceMetadataURL() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,339 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is how far the clocks of the server and the token issuer may
+// disagree.
+const clockSkew = time.Minute
+
+// Claims are the claims of a verified JWT that the server uses.
+type Claims struct {
+	Issuer     string
+	Subject    string
+	Audience   []string
+	Expiration time.Time
+	Scopes     []string
+	// Client is the client_id or azp claim.
+	Client string
+}
+
+// ClientID identifies the caller: the client of the token, or its subject.
+func (c *Claims) ClientID() string {
+	if c.Client != "" {
+		return c.Client
+	}
+	return c.Subject
+}
+
+// KeySet holds the public keys of a JWKS file by key ID. The file is read
+// again when it changes, so that keys can be rotated without a restart.
+type KeySet struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    map[string]crypto.PublicKey
+}
+
+// LoadKeySet reads the JWKS file at path.
+func LoadKeySet(path string) (*KeySet, error) {
+	k := &KeySet{path: path}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// jwk is a JSON Web Key with the members of RSA, EC and OKP public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// reload reads the file if it changed since it was last read. It must be
+// called with k.mu held or before k is shared.
+func (k *KeySet) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("error reading JWKS file: %w", err)
+	}
+	if k.keys != nil && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("error reading JWKS file: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("error parsing JWKS file %s: %w", k.path, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			return fmt.Errorf("JWKS file %s: key %d: %w", k.path, i, err)
+		}
+		keys[key.Kid] = pub
+	}
+	k.keys = keys
+	k.modTime = info.ModTime()
+	return nil
+}
+
+func (key *jwk) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeInt(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeInt(key.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := decodeInt(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeInt(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", key.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if key.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// key returns the key with ID kid, reading the file again if it changed.
+// Tokens without a key ID may use the only key of the set.
+func (k *KeySet) key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// Verify checks the signature and validity period of a compact JWT and
+// returns its claims.
+func (k *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	key, err := k.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Iss      string          `json:"iss"`
+		Sub      string          `json:"sub"`
+		Aud      json.RawMessage `json:"aud"`
+		Exp      *float64        `json:"exp"`
+		Nbf      *float64        `json:"nbf"`
+		Scope    string          `json:"scope"`
+		Scp      json.RawMessage `json:"scp"`
+		ClientID string          `json:"client_id"`
+		Azp      string          `json:"azp"`
+	}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if raw.Exp == nil {
+		return nil, errors.New("token has no expiration")
+	}
+	claims := &Claims{
+		Issuer:     raw.Iss,
+		Subject:    raw.Sub,
+		Audience:   stringOrList(raw.Aud),
+		Expiration: time.Unix(int64(*raw.Exp), 0),
+		Scopes:     strings.Fields(raw.Scope),
+		Client:     raw.ClientID,
+	}
+	if claims.Client == "" {
+		claims.Client = raw.Azp
+	}
+	if len(claims.Scopes) == 0 {
+		claims.Scopes = stringOrList(raw.Scp)
+	}
+	if now.After(claims.Expiration.Add(clockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if raw.Nbf != nil && now.Add(clockSkew).Before(time.Unix(int64(*raw.Nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a claim that is a string or a list of strings. Scope
+// strings are split at spaces.
+func stringOrList(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return strings.Fields(s)
+	}
+	return nil
+}
+
+// verifySignature checks the signature of signed with key under the JWS
+// algorithm alg, which must suit the type of key.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	valid := false
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			valid = rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+		case "PS":
+			valid = rsa.VerifyPSS(pub, hash, digest, signature, nil) == nil
+		default:
+			return fmt.Errorf("algorithm %s does not suit an RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return fmt.Errorf("algorithm %s does not suit an EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		valid = ecdsa.Verify(pub, digest, r, s)
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s does not suit an Ed25519 key", alg)
+		}
+		valid = ed25519.Verify(pub, signed, signature)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+// Package cas keeps output files in a content-addressed store, where each
+// distinct content is stored once under its SHA-256 hash and readable names
+// are hard links to it, and records which inputs each output was made from.
+package cas
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Dir is the directory of the store inside an output directory.
+const Dir = ".objects"
+
+// lineageFile is the log of lineage records inside the store.
+const lineageFile = "lineage.jsonl"
+
+// File is a file with the hash of its content.
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Describe hashes the file at path.
+func Describe(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return File{}, fmt.Errorf("error hashing %s: %w", path, err)
+	}
+	return File{Path: path, SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}, nil
+}
+
+// Record is the lineage of the outputs of one tool call.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Tool    string    `json:"tool"`
+	Inputs  []File    `json:"inputs,omitempty"`
+	Outputs []File    `json:"outputs"`
+}
+
+// Store is a content-addressed store in a directory. Stores opened on the
+// same directory may be used at the same time, also by several processes.
+type Store struct {
+	root string
+}
+
+// Open returns the store in dir, which is created when the first file is
+// added.
+func Open(dir string) *Store {
+	return &Store{root: dir}
+}
+
+// ObjectPath returns where content with the given hash and file extension
+// is stored, sharded by the first two hex digits of the hash.
+func (s *Store) ObjectPath(hash, ext string) string {
+	return filepath.Join(s.root, hash[:2], hash+strings.ToLower(ext))
+}
+
+// Add moves the file at path into the store and leaves a hard link to the
+// stored object in its place. If the store holds the same content already,
+// the file is replaced by a link to that object, so that its content is kept
+// once. Files on another file system than the store are left as they are.
+// It reports whether the content was stored already.
+func (s *Store) Add(path string) (File, bool, error) {
+	file, err := Describe(path)
+	if err != nil {
+		return File{}, false, err
+	}
+	object := s.ObjectPath(file.SHA256, filepath.Ext(path))
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return file, false, fmt.Errorf("error creating object directory: %w", err)
+	}
+	err = os.Link(path, object)
+	switch {
+	case err == nil:
+		return file, false, nil
+	case isCrossDevice(err):
+		return file, false, nil
+	case !errors.Is(err, fs.ErrExist):
+		return file, false, fmt.Errorf("error storing %s: %w", path, err)
+	}
+	if same, err := sameFile(path, object); err != nil || same {
+		return file, true, err
+	}
+
+	// Replace the file with a link to the stored object
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".link")
+	os.Remove(tmp)
+	if err := os.Link(object, tmp); err != nil {
+		if isCrossDevice(err) {
+			return file, false, nil
+		}
+		return file, false, fmt.Errorf("error linking %s to its object: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return file, false, fmt.Errorf("error linking %s to its object: %w", path, err)
+	}
+	return file, true, nil
+}
+
+// WriteFile writes data to the file at path like os.WriteFile, but through a
+// temporary file renamed over it. A name linked into a store shares its inode
+// with the stored object and every other copy of the content, so writing it
+// in place would change them all; renaming replaces only the link.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+// isCrossDevice reports whether a link failed because its target is on
+// another file system.
+func isCrossDevice(err error) bool {
+	var linkErr *os.LinkError
+	return errors.As(err, &linkErr) && errors.Is(linkErr.Err, syscall.EXDEV)
+}
+
+func sameFile(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+// Record appends a lineage record to the log of the store.
+func (s *Store) Record(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return fmt.Errorf("error creating object store: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(s.root, lineageFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening lineage log: %w", err)
+	}
+	defer f.Close()
+	// A single appended write keeps concurrent records from interleaving
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing lineage log: %w", err)
+	}
+	return nil
+}
+
+// Records returns the lineage records of the store, oldest first.
+func (s *Store) Records() ([]Record, error) {
+	f, err := os.Open(filepath.Join(s.root, lineageFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening lineage log: %w", err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// Skip lines torn by a crash
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Lineage returns the record of the latest tool call that produced content
+// with the given hash, followed by those that produced its inputs, and so
+// on back to inputs that no recorded call produced.
+func (s *Store) Lineage(hash string) ([]Record, error) {
+	records, err := s.Records()
+	if err != nil {
+		return nil, err
+	}
+	producer := make(map[string]int)
+	for i, r := range records {
+		for _, out := range r.Outputs {
+			producer[out.SHA256] = i
+		}
+	}
+
+	var lineage []Record
+	seen := make(map[int]bool)
+	queue := []string{hash}
+	for len(queue) > 0 {
+		i, ok := producer[queue[0]]
+		queue = queue[1:]
+		if !ok || seen[i] {
+			continue
+		}
+		seen[i] = true
+		lineage = append(lineage, records[i])
+		for _, in := range records[i].Inputs {
+			queue = append(queue, in.SHA256)
+		}
+	}
+	return lineage, nil
+}
+
+// Sweep removes the stored objects that none of the files at paths are
+// linked to, and returns how many bytes that freed.
+func (s *Store) Sweep(paths []string) (int64, error) {
+	bySize := make(map[int64][]fs.FileInfo)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			bySize[info.Size()] = append(bySize[info.Size()], info)
+		}
+	}
+
+	var freed int64
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// Objects are the files of the shard directories
+		if d.IsDir() || filepath.Dir(path) == s.root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		for _, name := range bySize[info.Size()] {
+			if os.SameFile(info, name) {
+				return nil
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing object %s: %w", path, err)
+		}
+		freed += info.Size()
+		return nil
+	})
+	return freed, err
+}
@@ -0,0 +1,144 @@
+package cas
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddDeduplicates(t *testing.T) {
+	dir := t.TempDir()
+	store := Open(filepath.Join(dir, Dir))
+	first := filepath.Join(dir, "cat_1.png")
+	second := filepath.Join(dir, "cat_2.PNG")
+	os.WriteFile(first, []byte("cat"), 0644)
+	os.WriteFile(second, []byte("cat"), 0644)
+
+	file, existed, err := store.Add(first)
+	if err != nil || existed {
+		t.Fatalf("Add() = %v, %v", existed, err)
+	}
+	// SHA-256 of "cat"
+	const hash = "77af778b51abd4a3c51c5ddd97204a9c3ae614ebccb75a606c3b6865aed6744e"
+	if file.SHA256 != hash || file.Size != 3 {
+		t.Errorf("Add() = %+v", file)
+	}
+	object := store.ObjectPath(hash, ".png")
+	if object != filepath.Join(dir, Dir, "77", hash+".png") {
+		t.Errorf("ObjectPath() = %s", object)
+	}
+
+	if _, existed, err := store.Add(second); err != nil || !existed {
+		t.Fatalf("Add() of a copy = %v, %v", existed, err)
+	}
+	for _, path := range []string{first, second} {
+		if same, err := sameFile(path, object); err != nil || !same {
+			t.Errorf("%s is not linked to its object: %v", path, err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != "cat" {
+			t.Errorf("%s holds %q", path, data)
+		}
+	}
+
+	// Adding a file again changes nothing
+	if _, existed, err := store.Add(first); err != nil || !existed {
+		t.Errorf("Add() again = %v, %v", existed, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("%d entries left in the directory, want 3", len(entries))
+	}
+}
+
+func TestWriteFileKeepsObjects(t *testing.T) {
+	dir := t.TempDir()
+	store := Open(filepath.Join(dir, Dir))
+	first := filepath.Join(dir, "cat.srt")
+	second := filepath.Join(dir, "cat_copy.srt")
+	WriteFile(first, []byte("cat"), 0644)
+	WriteFile(second, []byte("cat"), 0644)
+	file, _, err := store.Add(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Add(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving a linked name again replaces the link, not the shared content
+	if err := WriteFile(first, []byte("dog"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	object := store.ObjectPath(file.SHA256, ".srt")
+	for path, want := range map[string]string{first: "dog", second: "cat", object: "cat"} {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s holds %q, want %q", path, data, want)
+		}
+	}
+	if info, err := os.Stat(first); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("%d entries left in the directory, want 3", len(entries))
+	}
+}
+
+func TestLineage(t *testing.T) {
+	store := Open(filepath.Join(t.TempDir(), Dir))
+	if records, err := store.Lineage("missing"); err != nil || records != nil {
+		t.Errorf("Lineage() of an empty store = %v, %v", records, err)
+	}
+
+	now := time.Now().UTC()
+	photo := File{Path: "photo.png", SHA256: "aa"}
+	edited := File{Path: "edited.png", SHA256: "bb"}
+	video := File{Path: "video.mp4", SHA256: "cc"}
+	for _, r := range []Record{
+		{Time: now, Tool: "gemini_image_edit", Inputs: []File{photo}, Outputs: []File{edited}},
+		{Time: now, Tool: "gemini_image_generation", Outputs: []File{{Path: "other.png", SHA256: "dd"}}},
+		{Time: now, Tool: "veo_image_to_video", Inputs: []File{edited}, Outputs: []File{video}},
+	} {
+		if err := store.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := store.Lineage("cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Tool != "veo_image_to_video" || records[1].Tool != "gemini_image_edit" {
+		t.Errorf("Lineage() = %+v", records)
+	}
+	if records[1].Inputs[0] != photo {
+		t.Errorf("first input = %+v, want %+v", records[1].Inputs[0], photo)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	store := Open(filepath.Join(dir, Dir))
+	kept := filepath.Join(dir, "kept.png")
+	deleted := filepath.Join(dir, "deleted.png")
+	os.WriteFile(kept, []byte("kept"), 0644)
+	os.WriteFile(deleted, []byte("gone"), 0644)
+	for _, path := range []string{kept, deleted} {
+		if _, _, err := store.Add(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Record(Record{Tool: "imagen_t2i"})
+	os.Remove(deleted)
+
+	freed, err := store.Sweep([]string{kept})
+	if err != nil || freed != 4 {
+		t.Errorf("Sweep() = %d, %v, want 4", freed, err)
+	}
+	keptFile, _ := Describe(kept)
+	if _, err := os.Stat(store.ObjectPath(keptFile.SHA256, ".png")); err != nil {
+		t.Errorf("object of a kept file was removed: %v", err)
+	}
+	if records, _ := store.Records(); len(records) != 1 {
+		t.Error("the lineage log was removed")
+	}
+}
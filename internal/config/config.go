@@ -1,44 +1,568 @@
+// Package config loads the server configuration from built-in defaults, a
+// YAML configuration file, environment variables and command-line flags, in
+// increasing order of precedence.
+//
+// Every setting is a field of Config tagged with its environment variable,
+// default and description. The YAML file sets them by environment variable
+// name under settings, and each one that is not secret has a flag named after
+// its environment variable, such as -output-dir for OUTPUT_DIR.
 package config
 
 import (
+	"bytes"
+	"encoding"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gemini-mcp/internal/auth"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of configuration values, in increasing order of precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Transports the server can serve.
+var Transports = []string{"stdio", "http", "sse"}
+
+// StorageBackends are the places saved files can be stored.
+var StorageBackends = []string{"local", "s3", "gcs"}
+
+// Isolation modes: outputs are shared, or separated by MCP session or by
+// tenant, the client of the bearer token.
+const (
+	IsolationNone    = "none"
+	IsolationSession = "session"
+	IsolationTenant  = "tenant"
+)
+
+// Output layouts: files are saved under their names only, or also kept once
+// per distinct content under its SHA-256 hash.
+const (
+	LayoutPlain   = "plain"
+	LayoutContent = "content"
 )
 
 type Config struct {
-	APIKey    string
-	ProjectID string
-	Location  string
-	OutputDir string
-	Transport string // "stdio" or "sse"
-	SSEPort   int
+	// Gemini API Configuration
+	APIKey    string `env:"GOOGLE_API_KEY" secret:"true" help:"Gemini API key (required)"`
+	ProjectID string `env:"GOOGLE_PROJECT_ID" help:"Google Cloud project ID"`
+	Location  string `env:"GOOGLE_LOCATION" default:"us-central1" help:"Google Cloud location"`
+
+	// Server Configuration
+	Port      int    `env:"PORT" default:"8080" help:"Port of the HTTP and SSE transports"`
+	Transport string `env:"TRANSPORT" default:"stdio" help:"Transport type (stdio, http, or sse)"`
+	OutputDir string `env:"OUTPUT_DIR" default:"./output" help:"Directory generated files are saved in"`
+
+	// Keep each distinct output once, under its SHA-256 hash
+	OutputLayout string `env:"OUTPUT_LAYOUT" default:"plain" help:"Layout of saved files (plain, or content for content-addressed)"`
+
+	// Retention rules the janitor applies to the output directory
+	RetentionMaxAge   time.Duration `env:"RETENTION_MAX_AGE" default:"0s" help:"Age after which output files are deleted, 0 to keep them"`
+	RetentionMaxBytes int64         `env:"RETENTION_MAX_BYTES" default:"0" help:"Total bytes of output files, beyond which the oldest are deleted, 0 for unlimited"`
+	RetentionKeepLast int           `env:"RETENTION_KEEP_LAST" default:"0" help:"Latest generations kept per tool, 0 to keep all"`
+	RetentionInterval time.Duration `env:"RETENTION_INTERVAL" default:"1h" help:"How often the janitor applies the retention rules"`
+
+	// Caption and embed generated images for find_similar
+	Embeddings          bool   `env:"EMBEDDINGS" default:"false" help:"Caption and embed each generation so find_similar can search them"`
+	EmbeddingModel      string `env:"EMBEDDING_MODEL" default:"gemini-embedding-001" help:"Model that embeds prompts and captions"`
+	EmbeddingDimensions int    `env:"EMBEDDING_DIMENSIONS" default:"768" help:"Length of the embedding vectors"`
+	CaptionModel        string `env:"CAPTION_MODEL" default:"gemini-2.5-flash" help:"Model that captions generated images"`
+
+	// Storage backend saved files are also uploaded to, with its credentials
+	StorageBackend    string        `env:"STORAGE_BACKEND" default:"local" help:"Where saved files are stored (local, s3, or gcs)"`
+	GenmediaBucket    string        `env:"GENMEDIA_BUCKET" help:"Bucket of the s3 and gcs storage backends"`
+	StoragePrefix     string        `env:"STORAGE_PREFIX" help:"Prefix of the object keys of uploaded files"`
+	StoragePresignTTL time.Duration `env:"STORAGE_PRESIGN_TTL" default:"0s" help:"Lifetime of presigned download URLs of uploaded files, 0 for none"`
+	S3Endpoint        string        `env:"S3_ENDPOINT" help:"URL of an S3-compatible service such as MinIO, empty for AWS S3"`
+	S3Region          string        `env:"S3_REGION" default:"us-east-1" help:"Region of the S3 bucket"`
+	S3AccessKeyID     string        `env:"S3_ACCESS_KEY_ID" help:"Access key ID of the S3 bucket"`
+	S3SecretAccessKey string        `env:"S3_SECRET_ACCESS_KEY" secret:"true" help:"Secret access key of the S3 bucket"`
+	GCSHMACAccessID   string        `env:"GCS_HMAC_ACCESS_ID" help:"HMAC access ID for the GCS bucket, empty for application default credentials"`
+	GCSHMACSecret     string        `env:"GCS_HMAC_SECRET" secret:"true" help:"HMAC secret for the GCS bucket"`
+
+	// Image Session Configuration
+	ImageSessionTTL time.Duration `env:"IMAGE_SESSION_TTL" default:"1h" help:"Idle time after which image editing sessions expire"`
+	ImageSessionMax int           `env:"IMAGE_SESSION_MAX" default:"100" help:"Maximum number of image editing sessions kept"`
+
+	// Inputs larger than this many bytes are sent through the Files API
+	// instead of inline. Zero disables automatic uploads.
+	FileUploadThreshold int64 `env:"FILE_UPLOAD_THRESHOLD" default:"15728640" help:"Input size in bytes above which files are uploaded through the Files API, 0 to disable"`
+
+	// Optional JSON file overriding the built-in price table used for cost
+	// estimates
+	PriceTablePath string `env:"PRICE_TABLE" help:"JSON file overriding the built-in price table"`
+
+	// Spending limits in US dollars, zero for unlimited. Client limits apply
+	// to each MCP session or API token separately.
+	BudgetDailyUSD         float64 `env:"BUDGET_DAILY_USD" default:"0" help:"Daily spending limit in USD, 0 for unlimited"`
+	BudgetMonthlyUSD       float64 `env:"BUDGET_MONTHLY_USD" default:"0" help:"Monthly spending limit in USD, 0 for unlimited"`
+	BudgetClientDailyUSD   float64 `env:"BUDGET_CLIENT_DAILY_USD" default:"0" help:"Daily spending limit per client in USD, 0 for unlimited"`
+	BudgetClientMonthlyUSD float64 `env:"BUDGET_CLIENT_MONTHLY_USD" default:"0" help:"Monthly spending limit per client in USD, 0 for unlimited"`
+
+	// Retry policy for transient API errors
+	RetryMaxAttempts int           `env:"RETRY_MAX_ATTEMPTS" default:"4" help:"Attempts per API call, including the first"`
+	RetryBaseDelay   time.Duration `env:"RETRY_BASE_DELAY" default:"1s" help:"Delay before the first retry, doubled for each further retry"`
+	RetryMaxDelay    time.Duration `env:"RETRY_MAX_DELAY" default:"30s" help:"Maximum delay between retries"`
+
+	// Scheduler limits per model family: calls running at once and calls
+	// started per minute. Zero means unlimited.
+	GeminiConcurrency int `env:"GEMINI_CONCURRENCY" default:"8" help:"Gemini calls running at once, 0 for unlimited"`
+	GeminiRPM         int `env:"GEMINI_RPM" default:"0" help:"Gemini calls started per minute, 0 for unlimited"`
+	ImagenConcurrency int `env:"IMAGEN_CONCURRENCY" default:"4" help:"Imagen calls running at once, 0 for unlimited"`
+	ImagenRPM         int `env:"IMAGEN_RPM" default:"0" help:"Imagen calls started per minute, 0 for unlimited"`
+	VeoConcurrency    int `env:"VEO_CONCURRENCY" default:"2" help:"Veo jobs running at once, 0 for unlimited"`
+	VeoRPM            int `env:"VEO_RPM" default:"0" help:"Veo jobs started per minute, 0 for unlimited"`
+
+	// Models to try in order when a model fails with quota or availability
+	// errors, by model
+	ModelFallbacks Fallbacks `env:"MODEL_FALLBACKS" default:"imagen-4.0-ultra-generate-001>imagen-4.0-generate-001>imagen-4.0-fast-generate-001,veo-3.0-generate-001>veo-3.0-fast-generate-001" help:"Fallback chains such as a>b>c,d>e, or none"`
+
+	// Check model arguments against the list of available models
+	ValidateModels bool `env:"VALIDATE_MODELS" default:"true" help:"Check model arguments against the list of available models"`
+
+	// Directories tools may read input files from and write output files to.
+	// Empty lists allow any path.
+	AllowedReadRoots  List `env:"ALLOWED_READ_ROOTS" help:"Comma-separated directories tools may read files from, empty for any"`
+	AllowedWriteRoots List `env:"ALLOWED_WRITE_ROOTS" help:"Comma-separated directories tools may write files to, empty for any"`
+
+	// Also confine paths to the roots the MCP client declares
+	ClientRoots bool `env:"CLIENT_ROOTS" default:"false" help:"Confine file arguments to the roots declared by the MCP client"`
+
+	// Separate output directories for each MCP session or authenticated
+	// client, and the space each of them may fill
+	Isolation        string `env:"ISOLATION" default:"none" help:"Output isolation (none, session, or tenant)"`
+	TenantQuotaBytes int64  `env:"TENANT_QUOTA_BYTES" default:"0" help:"Bytes of output files per session or client, 0 for unlimited"`
+
+	// Model aliases such as "fast-image", and settings by tool name, from the
+	// configuration file
+	Aliases map[string]string
+	Tools   map[string]ToolConfig
+
+	// Authentication of the HTTP transports, from the configuration file
+	Auth auth.Config
+
+	// sources records where each setting came from, by environment variable
+	sources map[string]string
 }
 
-func Load() (*Config, error) {
-	config := &Config{
-		APIKey:    os.Getenv("GOOGLE_API_KEY"),
-		ProjectID: os.Getenv("GOOGLE_PROJECT_ID"),
-		Location:  getEnvOrDefault("GOOGLE_LOCATION", "us-central1"),
-		OutputDir: getEnvOrDefault("OUTPUT_DIR", "./output"),
-		Transport: getEnvOrDefault("TRANSPORT", "stdio"),
-		SSEPort:   8080,
+// FileConfig is the layout of the YAML configuration file.
+type FileConfig struct {
+	// Settings by environment variable name. Environment variables and flags
+	// that are set take precedence.
+	Settings map[string]string     `yaml:"settings,omitempty"`
+	Aliases  map[string]string     `yaml:"aliases,omitempty"`
+	Tools    map[string]ToolConfig `yaml:"tools,omitempty"`
+	Auth     auth.Config           `yaml:"auth,omitempty"`
+}
+
+// ToolConfig holds the settings of one tool.
+type ToolConfig struct {
+	// Enabled set to false removes the tool.
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Model is the default model or model alias of the tool.
+	Model string `yaml:"model,omitempty"`
+	// Defaults are default values of other arguments, by argument name.
+	Defaults map[string]any `yaml:"defaults,omitempty"`
+}
+
+// Fallbacks maps models to the models to try after them, in order.
+type Fallbacks map[string][]string
+
+// UnmarshalText parses fallback chains in the format of ParseModelFallbacks.
+func (f *Fallbacks) UnmarshalText(text []byte) error {
+	*f = ParseModelFallbacks(string(text))
+	return nil
+}
+
+// String formats the fallbacks in the format of ParseModelFallbacks, one
+// chain per model that no other model falls back to, sorted by model.
+func (f Fallbacks) String() string {
+	if len(f) == 0 {
+		return "none"
 	}
+	inner := make(map[string]bool)
+	for _, fallbacks := range f {
+		if len(fallbacks) > 0 && slices.Equal(f[fallbacks[0]], fallbacks[1:]) {
+			inner[fallbacks[0]] = true
+		}
+	}
+	var chains []string
+	for model, fallbacks := range f {
+		if !inner[model] {
+			chains = append(chains, strings.Join(append([]string{model}, fallbacks...), ">"))
+		}
+	}
+	slices.Sort(chains)
+	return strings.Join(chains, ",")
+}
+
+// List is a comma-separated list of values.
+type List []string
 
-	if config.APIKey == "" {
-		return nil, fmt.Errorf("GOOGLE_API_KEY environment variable is required")
+// UnmarshalText splits text at commas, dropping empty values.
+func (l *List) UnmarshalText(text []byte) error {
+	*l = nil
+	for _, value := range strings.Split(string(text), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			*l = append(*l, value)
+		}
 	}
+	return nil
+}
+
+func (l List) String() string {
+	return strings.Join(l, ",")
+}
 
-	// Create output directory if it doesn't exist
-	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create output directory: %w", err)
+// ParseModelFallbacks parses comma-separated fallback chains of models
+// separated by '>', such as "a>b>c,d>e". Each model in a chain falls back to
+// the models after it. "none" disables fallbacks.
+func ParseModelFallbacks(value string) map[string][]string {
+	fallbacks := make(map[string][]string)
+	if value == "none" {
+		return fallbacks
 	}
+	for _, chain := range strings.Split(value, ",") {
+		var models []string
+		for _, model := range strings.Split(chain, ">") {
+			if model = strings.TrimSpace(model); model != "" {
+				models = append(models, model)
+			}
+		}
+		for i := 0; i+1 < len(models); i++ {
+			fallbacks[models[i]] = models[i+1:]
+		}
+	}
+	return fallbacks
+}
+
+// Setting describes one setting of Config.
+type Setting struct {
+	Env     string
+	Flag    string
+	Default string
+	Help    string
+	Secret  bool
+
+	index int
+}
+
+// Settings lists the settings of Config in declaration order.
+func Settings() []Setting {
+	t := reflect.TypeOf(Config{})
+	var settings []Setting
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		setting := Setting{
+			Env:     env,
+			Default: field.Tag.Get("default"),
+			Help:    field.Tag.Get("help"),
+			Secret:  field.Tag.Get("secret") == "true",
+			index:   i,
+		}
+		if !setting.Secret {
+			setting.Flag = strings.ReplaceAll(strings.ToLower(env), "_", "-")
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// DefineFlags defines a string flag on fs for every setting that is not
+// secret. Load reads the flags that were set.
+func DefineFlags(fs *flag.FlagSet) {
+	for _, setting := range Settings() {
+		if setting.Flag != "" {
+			fs.String(setting.Flag, setting.Default, fmt.Sprintf("%s (%s)", setting.Help, setting.Env))
+		}
+	}
+}
 
+// Load returns the configuration given by the defaults, the YAML
+// configuration file at path if path is not empty, the environment and the
+// flags set on fs if fs is not nil. Values that cannot be parsed are errors.
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	var file FileConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&file); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	}
+
+	flags := make(map[string]string)
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			flags[f.Name] = f.Value.String()
+		})
+	}
+
+	config := &Config{
+		Aliases: file.Aliases,
+		Tools:   file.Tools,
+		Auth:    file.Auth,
+		sources: make(map[string]string),
+	}
+	v := reflect.ValueOf(config).Elem()
+	known := make(map[string]bool)
+	for _, setting := range Settings() {
+		known[setting.Env] = true
+
+		value, source := setting.Default, SourceDefault
+		if fileValue, ok := file.Settings[setting.Env]; ok {
+			value, source = fileValue, SourceFile
+		}
+		if envValue := os.Getenv(setting.Env); envValue != "" {
+			value, source = envValue, SourceEnv
+		}
+		if flagValue, ok := flags[setting.Flag]; ok && setting.Flag != "" {
+			value, source = flagValue, SourceFlag
+		}
+
+		if err := setValue(v.Field(setting.index), value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q from %s: %w", setting.Env, value, source, err)
+		}
+		config.sources[setting.Env] = source
+	}
+
+	for key := range file.Settings {
+		if !known[key] {
+			return nil, fmt.Errorf("config file %s: unknown setting %s", path, key)
+		}
+	}
 	return config, nil
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// setValue parses value into field according to its type.
+func setValue(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch field.Interface().(type) {
+	case time.Duration:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a duration")
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		if value == "" {
+			value = "0"
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		if value == "" {
+			value = "0"
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("not a number")
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Source returns where the setting with environment variable env came from,
+// or SourceDefault if the configuration was not loaded.
+func (c *Config) Source(env string) string {
+	if source, ok := c.sources[env]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// Print writes the effective configuration to w: every setting with its
+// source and, if it is not the default, the default it replaced, followed by
+// the aliases, tool and auth settings of the configuration file. Secrets and
+// tokens are redacted.
+func (c *Config) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE\tDEFAULT")
+	v := reflect.ValueOf(c).Elem()
+	for _, setting := range Settings() {
+		value := fmt.Sprint(v.Field(setting.index).Interface())
+		if setting.Secret {
+			value = Redact(value)
+		}
+		source, defaultValue := c.Source(setting.Env), ""
+		if source != SourceDefault {
+			defaultValue = orDash(setting.Default)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", setting.Env, orDash(value), source, defaultValue)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(c.Aliases) == 0 && len(c.Tools) == 0 && !c.Auth.Enabled() {
+		return nil
+	}
+	file := FileConfig{Aliases: c.Aliases, Tools: c.Tools, Auth: c.Auth}
+	file.Auth.Tokens = slices.Clone(c.Auth.Tokens)
+	for i := range file.Auth.Tokens {
+		file.Auth.Tokens[i].Token = Redact(file.Auth.Tokens[i].Token)
+	}
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n%s", data)
+	return err
+}
+
+// Redact hides a secret, keeping the last four characters of long secrets so
+// that they can be told apart.
+func Redact(secret string) string {
+	switch {
+	case secret == "":
+		return ""
+	case len(secret) < 12:
+		return "****"
+	default:
+		return "****" + secret[len(secret)-4:]
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
-	return defaultValue
+	return s
+}
+
+func (c *Config) Validate() error {
+	if c.APIKey == "" {
+		return fmt.Errorf("GOOGLE_API_KEY environment variable is required")
+	}
+	if !slices.Contains(Transports, c.Transport) {
+		return fmt.Errorf("TRANSPORT must be one of %s", strings.Join(Transports, ", "))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("PORT must be between 1 and 65535")
+	}
+	if !slices.Contains(StorageBackends, c.StorageBackend) {
+		return fmt.Errorf("STORAGE_BACKEND must be one of %s", strings.Join(StorageBackends, ", "))
+	}
+	if c.StorageBackend != "local" && c.GenmediaBucket == "" {
+		return fmt.Errorf("GENMEDIA_BUCKET is required by the %s storage backend", c.StorageBackend)
+	}
+	if c.StoragePresignTTL < 0 || c.StoragePresignTTL > 7*24*time.Hour {
+		return fmt.Errorf("STORAGE_PRESIGN_TTL must be between 0 and 7 days")
+	}
+	if !slices.Contains([]string{LayoutPlain, LayoutContent}, c.OutputLayout) {
+		return fmt.Errorf("OUTPUT_LAYOUT must be one of %s, %s", LayoutPlain, LayoutContent)
+	}
+	if c.RetentionMaxAge < 0 || c.RetentionMaxBytes < 0 || c.RetentionKeepLast < 0 {
+		return fmt.Errorf("retention rules must not be negative")
+	}
+	if c.RetentionInterval <= 0 {
+		return fmt.Errorf("RETENTION_INTERVAL must be positive")
+	}
+	if c.EmbeddingDimensions <= 0 {
+		return fmt.Errorf("EMBEDDING_DIMENSIONS must be positive")
+	}
+	if !slices.Contains([]string{IsolationNone, IsolationSession, IsolationTenant}, c.Isolation) {
+		return fmt.Errorf("ISOLATION must be one of %s, %s, %s", IsolationNone, IsolationSession, IsolationTenant)
+	}
+	if c.TenantQuotaBytes < 0 {
+		return fmt.Errorf("TENANT_QUOTA_BYTES must not be negative")
+	}
+	if c.ImageSessionTTL <= 0 {
+		return fmt.Errorf("IMAGE_SESSION_TTL must be positive")
+	}
+	if c.ImageSessionMax < 0 {
+		return fmt.Errorf("IMAGE_SESSION_MAX must not be negative")
+	}
+	if c.FileUploadThreshold < 0 {
+		return fmt.Errorf("FILE_UPLOAD_THRESHOLD must not be negative")
+	}
+	if c.BudgetDailyUSD < 0 || c.BudgetMonthlyUSD < 0 || c.BudgetClientDailyUSD < 0 || c.BudgetClientMonthlyUSD < 0 {
+		return fmt.Errorf("budget limits must not be negative")
+	}
+	if c.RetryMaxAttempts < 1 {
+		return fmt.Errorf("RETRY_MAX_ATTEMPTS must be at least 1")
+	}
+	if c.RetryBaseDelay < 0 || c.RetryMaxDelay < 0 {
+		return fmt.Errorf("retry delays must not be negative")
+	}
+	if c.GeminiConcurrency < 0 || c.GeminiRPM < 0 || c.ImagenConcurrency < 0 || c.ImagenRPM < 0 || c.VeoConcurrency < 0 || c.VeoRPM < 0 {
+		return fmt.Errorf("concurrency and RPM limits must not be negative")
+	}
+	for alias, model := range c.Aliases {
+		if alias == "" || model == "" {
+			return fmt.Errorf("aliases: alias and model must not be empty")
+		}
+		if _, ok := c.Aliases[model]; ok {
+			return fmt.Errorf("aliases: %s refers to another alias, %s", alias, model)
+		}
+	}
+	for model, fallbacks := range c.ModelFallbacks {
+		if slices.Contains(fallbacks, model) {
+			return fmt.Errorf("MODEL_FALLBACKS: %s falls back to itself", model)
+		}
+	}
+	return c.Auth.Validate()
+}
+
+// ResolveModel returns the model an alias stands for, or name itself if it is
+// not an alias.
+func (c *Config) ResolveModel(name string) string {
+	if model, ok := c.Aliases[name]; ok {
+		return model
+	}
+	return name
+}
+
+// ToolEnabled reports whether the tool is enabled. Tools are enabled unless
+// the configuration file disables them.
+func (c *Config) ToolEnabled(name string) bool {
+	tool, ok := c.Tools[name]
+	return !ok || tool.Enabled == nil || *tool.Enabled
 }
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+settings:
+  GOOGLE_LOCATION: europe-west4
+  IMAGE_SESSION_TTL: 30m
+  VEO_CONCURRENCY: 1
+  PORT: 9000
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_API_KEY", "")
+	t.Setenv("IMAGE_SESSION_TTL", "")
+	t.Setenv("VEO_CONCURRENCY", "3")
+	t.Setenv("PORT", "9001")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	DefineFlags(fs)
+	if err := fs.Parse([]string{"-port", "9002"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env    string
+		got    any
+		want   any
+		source string
+	}{
+		{"OUTPUT_DIR", cfg.OutputDir, "./output", SourceDefault},
+		{"GOOGLE_LOCATION", cfg.Location, "europe-west4", SourceFile},
+		{"IMAGE_SESSION_TTL", cfg.ImageSessionTTL, 30 * time.Minute, SourceFile},
+		{"VEO_CONCURRENCY", cfg.VeoConcurrency, 3, SourceEnv},
+		{"PORT", cfg.Port, 9002, SourceFlag},
+		{"VALIDATE_MODELS", cfg.ValidateModels, true, SourceDefault},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want || cfg.Source(tt.env) != tt.source {
+			t.Errorf("%s = %v from %s, want %v from %s", tt.env, tt.got, cfg.Source(tt.env), tt.want, tt.source)
+		}
+	}
+	if got := cfg.ModelFallbacks["veo-3.0-generate-001"]; len(got) != 1 || got[0] != "veo-3.0-fast-generate-001" {
+		t.Errorf("default fallbacks of veo-3.0-generate-001 = %v", got)
+	}
+}
+
+func TestLoadInvalidValue(t *testing.T) {
+	t.Setenv("RETRY_MAX_ATTEMPTS", "four")
+	_, err := Load("", nil)
+	if err == nil || !strings.Contains(err.Error(), "RETRY_MAX_ATTEMPTS") {
+		t.Errorf("expected invalid RETRY_MAX_ATTEMPTS error, got %v", err)
+	}
+}
+
+func TestSecretsHaveNoFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	DefineFlags(fs)
+	if fs.Lookup("google-api-key") != nil {
+		t.Error("secret setting has a flag")
+	}
+	if fs.Lookup("output-dir") == nil {
+		t.Error("OUTPUT_DIR has no flag")
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	t.Setenv("GOOGLE_API_KEY", "AIzaSyExampleKey1234")
+	cfg, err := Load("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "AIzaSyExampleKey") {
+		t.Errorf("printed configuration contains the API key:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "****1234") {
+		t.Errorf("printed configuration lacks the redacted API key:\n%s", out.String())
+	}
+}
+
+func TestPrintRedactsTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+auth:
+  tokens:
+    - token: static-token-abcdefgh
+      client_id: ci
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "static-token") || !strings.Contains(out.String(), "client_id: ci") {
+		t.Errorf("unexpected auth settings in printed configuration:\n%s", out.String())
+	}
+	if cfg.Auth.Tokens[0].Token != "static-token-abcdefgh" {
+		t.Error("printing redacted the token of the configuration")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"short":                "****",
+		"AIzaSyExampleKey1234": "****1234",
+	}
+	for secret, want := range tests {
+		if got := Redact(secret); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", secret, got, want)
+		}
+	}
+}
+
+func TestFallbacksString(t *testing.T) {
+	for _, value := range []string{"a>b>c,d>e", "none"} {
+		var f Fallbacks
+		f.UnmarshalText([]byte(value))
+		if got := f.String(); got != value {
+			t.Errorf("Fallbacks(%q).String() = %q", value, got)
+		}
+	}
+}
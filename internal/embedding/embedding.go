@@ -0,0 +1,34 @@
+// Package embedding compares generations by embedding vectors of their
+// prompts and captions.
+package embedding
+
+import (
+	"context"
+	"math"
+)
+
+// Backend captions images and embeds texts.
+type Backend interface {
+	// Caption describes the image at path in words.
+	Caption(ctx context.Context, path string) (string, error)
+	// Embed returns a vector for each text.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Cosine returns the cosine similarity of two vectors, or 0 if their
+// lengths differ or either is zero.
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
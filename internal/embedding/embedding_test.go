@@ -0,0 +1,45 @@
+package embedding
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCosine(t *testing.T) {
+	tests := []struct {
+		a, b []float32
+		want float64
+	}{
+		{[]float32{1, 0}, []float32{2, 0}, 1},
+		{[]float32{1, 0}, []float32{0, 1}, 0},
+		{[]float32{1, 1}, []float32{-1, -1}, -1},
+		{[]float32{1, 0}, []float32{1, 0, 0}, 0},
+		{[]float32{0, 0}, []float32{1, 0}, 0},
+	}
+	for _, tt := range tests {
+		if got := Cosine(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Cosine(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	fake := &Fake{}
+	ctx := context.Background()
+	vectors, err := fake.Embed(ctx, []string{"a red fox", "A fox, red!", "a blue whale"})
+	if err != nil || len(vectors) != 3 || len(vectors[0]) != 64 {
+		t.Fatalf("Embed() = %d vectors, %v", len(vectors), err)
+	}
+	if same, other := Cosine(vectors[0], vectors[1]), Cosine(vectors[0], vectors[2]); same < 0.99 || other >= same {
+		t.Errorf("similarities %v and %v", same, other)
+	}
+
+	path := filepath.Join(t.TempDir(), "fox.png")
+	os.WriteFile(path, []byte("a red fox\n"), 0644)
+	if caption, err := fake.Caption(ctx, path); err != nil || caption != "a red fox" {
+		t.Errorf("Caption() = %q, %v", caption, err)
+	}
+}
@@ -0,0 +1,45 @@
+package embedding
+
+import (
+	"context"
+	"hash/fnv"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Fake is a Backend for tests that calls no API. It captions an image with
+// the text its file holds, and embeds texts as hashed bags of words, so that
+// texts sharing words are similar.
+type Fake struct {
+	// Dimensions is the length of the vectors, 64 if zero.
+	Dimensions int
+}
+
+func (f *Fake) Caption(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (f *Fake) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	dims := f.Dimensions
+	if dims == 0 {
+		dims = 64
+	}
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float32, dims)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			vectors[i][h.Sum32()%uint32(dims)]++
+		}
+	}
+	return vectors, nil
+}
@@ -0,0 +1,193 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+// normalizedScale is the range Gemini uses for normalized box coordinates.
+const normalizedScale = 1000
+
+// maskThreshold is the probability value above which a mask pixel is
+// considered part of the object.
+const maskThreshold = 127
+
+// Detection is a single object returned by Gemini detection or segmentation.
+// Box2D is [ymin, xmin, ymax, xmax] normalized to 0-1000.
+type Detection struct {
+	Box2D [4]int `json:"box_2d"`
+	Label string `json:"label"`
+	Mask  string `json:"mask,omitempty"`
+}
+
+// ParseDetections parses the JSON list of detections returned by the model,
+// tolerating a surrounding markdown code fence.
+func ParseDetections(text string) ([]Detection, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+
+	var detections []Detection
+	if err := json.Unmarshal([]byte(text), &detections); err != nil {
+		return nil, fmt.Errorf("failed to parse detections: %w", err)
+	}
+	return detections, nil
+}
+
+// PixelBox converts a normalized [ymin, xmin, ymax, xmax] box to pixel
+// coordinates of an image with the given bounds.
+func PixelBox(box [4]int, bounds image.Rectangle) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	r := image.Rect(
+		box[1]*w/normalizedScale,
+		box[0]*h/normalizedScale,
+		box[3]*w/normalizedScale,
+		box[2]*h/normalizedScale,
+	)
+	return r.Add(bounds.Min).Intersect(bounds)
+}
+
+// DecodeMask decodes a base64 PNG mask (optionally a data URI) covering box
+// and places it into a binary mask with the given image bounds. Pixels inside
+// the object are white.
+func DecodeMask(mask string, box image.Rectangle, bounds image.Rectangle) (*image.Gray, error) {
+	if i := strings.Index(mask, ","); strings.HasPrefix(mask, "data:") && i >= 0 {
+		mask = mask[i+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(mask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mask data: %w", err)
+	}
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mask image: %w", err)
+	}
+
+	out := image.NewGray(bounds)
+	if box.Empty() {
+		return out, nil
+	}
+
+	// Scale the mask to the box with nearest-neighbour sampling
+	sb := src.Bounds()
+	for y := box.Min.Y; y < box.Max.Y; y++ {
+		sy := sb.Min.Y + (y-box.Min.Y)*sb.Dy()/box.Dy()
+		for x := box.Min.X; x < box.Max.X; x++ {
+			sx := sb.Min.X + (x-box.Min.X)*sb.Dx()/box.Dx()
+			if color.GrayModel.Convert(src.At(sx, sy)).(color.Gray).Y > maskThreshold {
+				out.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return out, nil
+}
+
+// palette holds the colors used to distinguish objects in overlays.
+var palette = []color.RGBA{
+	{R: 230, G: 25, B: 75, A: 255},
+	{R: 60, G: 180, B: 75, A: 255},
+	{R: 0, G: 130, B: 200, A: 255},
+	{R: 255, G: 225, B: 25, A: 255},
+	{R: 145, G: 30, B: 180, A: 255},
+	{R: 245, G: 130, B: 48, A: 255},
+	{R: 70, G: 240, B: 240, A: 255},
+	{R: 240, G: 50, B: 230, A: 255},
+}
+
+// Annotate draws the boxes, and the masks where present, over a copy of src.
+// masks may be nil or contain nil entries for objects without a mask.
+func Annotate(src image.Image, boxes []image.Rectangle, masks []*image.Gray) *image.RGBA {
+	out := image.NewRGBA(src.Bounds())
+	draw.Draw(out, out.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	for i, box := range boxes {
+		c := palette[i%len(palette)]
+
+		if i < len(masks) && masks[i] != nil {
+			tint := color.RGBA{R: c.R / 2, G: c.G / 2, B: c.B / 2, A: 128}
+			draw.DrawMask(out, out.Bounds(), image.NewUniform(tint), image.Point{}, halfMask{masks[i]}, out.Bounds().Min, draw.Over)
+		}
+
+		strokeRect(out, box, c, 3)
+	}
+	return out
+}
+
+// halfMask adapts a binary mask for use as a draw mask.
+type halfMask struct {
+	*image.Gray
+}
+
+func (m halfMask) ColorModel() color.Model { return color.AlphaModel }
+
+func (m halfMask) At(x, y int) color.Color {
+	return color.Alpha{A: m.GrayAt(x, y).Y}
+}
+
+func strokeRect(img *image.RGBA, r image.Rectangle, c color.RGBA, width int) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+	u := image.NewUniform(c)
+	for i := 0; i < width; i++ {
+		draw.Draw(img, image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1).Intersect(r), u, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(r.Min.X, r.Max.Y-i-1, r.Max.X, r.Max.Y-i).Intersect(r), u, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(r.Min.X+i, r.Min.Y, r.Min.X+i+1, r.Max.Y).Intersect(r), u, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(r.Max.X-i-1, r.Min.Y, r.Max.X-i, r.Max.Y).Intersect(r), u, image.Point{}, draw.Src)
+	}
+}
+
+// Decode decodes a PNG, JPEG, GIF or WebP image.
+func Decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// Size returns the dimensions of a PNG, JPEG, GIF or WebP image from its
+// header, without decoding it.
+func Size(r io.Reader) (width, height int, err error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// Tokens estimates the input tokens Gemini counts for an image: 258 if both
+// sides are at most 384 pixels, and 258 per 768x768 tile otherwise.
+func Tokens(width, height int) int {
+	const tokensPerTile = 258
+	if width <= 384 && height <= 384 {
+		return tokensPerTile
+	}
+	tiles := ((width + 767) / 768) * ((height + 767) / 768)
+	return tiles * tokensPerTile
+}
+
+// EncodePNG encodes img as PNG.
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
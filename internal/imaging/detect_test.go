@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseDetections(t *testing.T) {
+	text := "```json\n[{\"box_2d\": [100, 200, 500, 600], \"label\": \"cat\"}]\n```"
+	detections, err := ParseDetections(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || detections[0].Label != "cat" || detections[0].Box2D != [4]int{100, 200, 500, 600} {
+		t.Errorf("unexpected detections: %+v", detections)
+	}
+
+	if _, err := ParseDetections("not json"); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestPixelBox(t *testing.T) {
+	bounds := image.Rect(0, 0, 800, 400)
+	got := PixelBox([4]int{100, 200, 500, 1100}, bounds)
+	want := image.Rect(160, 40, 800, 200)
+	if got != want {
+		t.Errorf("PixelBox = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeMask(t *testing.T) {
+	// A 2x2 mask whose left column is set
+	src := image.NewGray(image.Rect(0, 0, 2, 2))
+	src.SetGray(0, 0, color.Gray{Y: 255})
+	src.SetGray(0, 1, color.Gray{Y: 255})
+	data, err := EncodePNG(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+
+	bounds := image.Rect(0, 0, 10, 10)
+	box := image.Rect(2, 2, 6, 6)
+	mask, err := DecodeMask(encoded, box, bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask.Bounds() != bounds {
+		t.Fatalf("mask bounds = %v, want %v", mask.Bounds(), bounds)
+	}
+
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			want := x >= 2 && x < 4 && y >= 2 && y < 6
+			if got := mask.GrayAt(x, y).Y == 255; got != want {
+				t.Errorf("mask(%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		width, height, want int
+	}{
+		{384, 384, 258},
+		{385, 100, 258},
+		{1024, 1024, 4 * 258},
+		{1536, 768, 2 * 258},
+	}
+	for _, test := range tests {
+		if got := Tokens(test.width, test.height); got != test.want {
+			t.Errorf("Tokens(%d, %d) = %d, want %d", test.width, test.height, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Package index keeps a searchable record of every generation: the tool
+// call, its prompt, tags and model, and the files it saved with their
+// hashes. Records are stored as JSON lines and searched in memory.
+package index
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/embedding"
+)
+
+// Filename is the name of the index in an output directory.
+const Filename = "index.jsonl"
+
+// Entry is one generation.
+type Entry struct {
+	// ID identifies the run, and is also written to its metadata file.
+	ID     string     `json:"id"`
+	Time   time.Time  `json:"time"`
+	Tool   string     `json:"tool"`
+	Model  string     `json:"model,omitempty"`
+	Prompt string     `json:"prompt,omitempty"`
+	Tags   []string   `json:"tags,omitempty"`
+	Files  []cas.File `json:"files"`
+	// Arguments are the arguments of the tool call.
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	// Parent is the ID of the run this one remixes.
+	Parent string `json:"parent,omitempty"`
+	// Caption describes the first image saved, and Embedding is the vector
+	// of the prompt and caption, if embeddings are enabled.
+	Caption   string    `json:"caption,omitempty"`
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+// NewID returns a new run ID, which sorts by time.
+func NewID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return t.UTC().Format("20060102-150405-") + hex.EncodeToString(b)
+}
+
+// Query selects entries. Zero fields match everything.
+type Query struct {
+	// Text must appear in the prompt, tags or caption, word by word. Words match
+	// words they begin, so "water" matches "watercolor".
+	Text  string
+	Tool  string
+	Model string
+	Tag   string
+	Since time.Time
+	Until time.Time
+	// Offset and Limit select a page of the results.
+	Offset int
+	Limit  int
+}
+
+// Index is an index file. Entries written by other processes are read when
+// the file changes.
+type Index struct {
+	path string
+
+	mu      sync.Mutex
+	entries []Entry
+	tokens  [][]string
+	byID    map[string]int
+	size    int64
+	modTime time.Time
+}
+
+// Open returns the index at path, which is created by the first Put.
+func Open(path string) *Index {
+	return &Index{path: path}
+}
+
+// load reads the file again if it changed since it was last read or
+// written. Later lines replace earlier ones with the same ID.
+func (ix *Index) load() error {
+	info, err := os.Stat(ix.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		ix.reset()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	if ix.byID != nil && info.Size() == ix.size && info.ModTime().Equal(ix.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(ix.path)
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	defer f.Close()
+	ix.reset()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.ID == "" {
+			// Skip lines torn by a crash
+			continue
+		}
+		ix.set(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	ix.size, ix.modTime = info.Size(), info.ModTime()
+	return nil
+}
+
+func (ix *Index) reset() {
+	ix.entries, ix.tokens = nil, nil
+	ix.byID = make(map[string]int)
+	ix.size, ix.modTime = 0, time.Time{}
+}
+
+func (ix *Index) set(e Entry) {
+	tokens := Tokenize(e.Prompt + " " + strings.Join(e.Tags, " ") + " " + e.Caption)
+	if i, ok := ix.byID[e.ID]; ok {
+		ix.entries[i], ix.tokens[i] = e, tokens
+		return
+	}
+	ix.byID[e.ID] = len(ix.entries)
+	ix.entries = append(ix.entries, e)
+	ix.tokens = append(ix.tokens, tokens)
+}
+
+// Put adds an entry, or replaces the one with the same ID.
+func (ix *Index) Put(e Entry) error {
+	if e.ID == "" {
+		return errors.New("index entry has no ID")
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return fmt.Errorf("error creating index directory: %w", err)
+	}
+	f, err := os.OpenFile(ix.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening index: %w", err)
+	}
+	defer f.Close()
+	// A single appended write keeps concurrent entries from interleaving
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	ix.set(e)
+
+	// Skip reading the file again unless another process wrote to it too
+	if info, err := f.Stat(); err == nil && info.Size() == ix.size+int64(len(data))+1 {
+		ix.size, ix.modTime = info.Size(), info.ModTime()
+	}
+	return nil
+}
+
+// Get returns the entry with the given ID.
+func (ix *Index) Get(id string) (Entry, bool, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return Entry{}, false, err
+	}
+	i, ok := ix.byID[id]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	return ix.entries[i], true, nil
+}
+
+// ByFile returns the latest entry that saved a file at path or, failing
+// that, a file with the given content hash.
+func (ix *Index) ByFile(path, hash string) (Entry, bool, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return Entry{}, false, err
+	}
+	for _, match := range []func(cas.File) bool{
+		func(f cas.File) bool { return path != "" && f.Path == path },
+		func(f cas.File) bool { return hash != "" && f.SHA256 == hash },
+	} {
+		for i := len(ix.entries) - 1; i >= 0; i-- {
+			if slices.ContainsFunc(ix.entries[i].Files, match) {
+				return ix.entries[i], true, nil
+			}
+		}
+	}
+	return Entry{}, false, nil
+}
+
+// Entries returns all entries, oldest first.
+func (ix *Index) Entries() ([]Entry, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(ix.entries), nil
+}
+
+// Search returns a page of the entries matching q and the number of matches.
+// Text searches rank entries by how well their words match, and other
+// queries list the newest entries first.
+func (ix *Index) Search(q Query) ([]Entry, int, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return nil, 0, err
+	}
+
+	type match struct {
+		i     int
+		score int
+	}
+	terms := Tokenize(q.Text)
+	var matches []match
+	for i, e := range ix.entries {
+		if !q.matches(e) {
+			continue
+		}
+		score := 0
+		if len(terms) > 0 {
+			if score = Score(terms, ix.tokens[i]); score == 0 {
+				continue
+			}
+		}
+		matches = append(matches, match{i, score})
+	}
+	slices.SortStableFunc(matches, func(a, b match) int {
+		if a.score != b.score {
+			return b.score - a.score
+		}
+		return ix.entries[b.i].Time.Compare(ix.entries[a.i].Time)
+	})
+
+	total := len(matches)
+	start := min(max(q.Offset, 0), total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+	page := []Entry{}
+	for _, m := range matches[start:end] {
+		page = append(page, ix.entries[m.i])
+	}
+	return page, total, nil
+}
+
+// Match is an entry found by Nearest and its similarity to the vector.
+type Match struct {
+	Entry
+	Score float64
+}
+
+// Nearest returns up to limit entries matching q whose embeddings are the
+// most similar to vector by cosine similarity, most similar first. Entries
+// without embeddings, or with embeddings of another length, are skipped.
+func (ix *Index) Nearest(vector []float32, q Query, limit int) ([]Match, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil {
+		return nil, err
+	}
+
+	var matches []Match
+	for _, e := range ix.entries {
+		if len(e.Embedding) != len(vector) || !q.matches(e) {
+			continue
+		}
+		matches = append(matches, Match{Entry: e, Score: embedding.Cosine(vector, e.Embedding)})
+	}
+	slices.SortStableFunc(matches, func(a, b Match) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+func (q Query) matches(e Entry) bool {
+	switch {
+	case q.Tool != "" && e.Tool != q.Tool:
+		return false
+	case q.Model != "" && !strings.EqualFold(e.Model, q.Model):
+		return false
+	case q.Tag != "" && !slices.ContainsFunc(e.Tags, func(tag string) bool { return strings.EqualFold(tag, q.Tag) }):
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// Retain rewrites the index with the entries keep returns true for.
+func (ix *Index) Retain(keep func(Entry) bool) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(); err != nil || ix.entries == nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ix.path), "."+Filename+".*")
+	if err != nil {
+		return fmt.Errorf("error rewriting index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, e := range ix.entries {
+		if !keep(e) {
+			continue
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	err = w.Flush()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ix.path)
+	}
+	if err != nil {
+		return fmt.Errorf("error rewriting index: %w", err)
+	}
+	// Read the rewritten file on next use
+	ix.byID = nil
+	return nil
+}
+
+// Tokenize splits text into lower-case words. Chinese and Japanese
+// characters are words of their own.
+func Tokenize(text string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// Score rates how well the words of a document match the terms of a query:
+// two points for each word equal to a term and one for each word the term
+// begins. It returns 0 unless every term matches.
+func Score(terms, words []string) int {
+	score := 0
+	for _, term := range terms {
+		termScore := 0
+		for _, word := range words {
+			switch {
+			case word == term:
+				termScore += 2
+			case strings.HasPrefix(word, term):
+				termScore++
+			}
+		}
+		if termScore == 0 {
+			return 0
+		}
+		score += termScore
+	}
+	return score
+}
@@ -0,0 +1,127 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-mcp/internal/cas"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("A watercolor fox, 狐狸 in the snow!")
+	want := []string{"a", "watercolor", "fox", "狐", "狸", "in", "the", "snow"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Tokenize() = %q, want %q", got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), Filename)
+	ix := Open(path)
+	base := time.Date(2025, 6, 3, 9, 0, 0, 0, time.UTC)
+	for i, e := range []Entry{
+		{Tool: "gemini_image_generation", Model: "gemini-2.5-flash-image-preview", Prompt: "A watercolor fox in the snow", Tags: []string{"fox"}},
+		{Tool: "imagen_t2i", Model: "imagen-4.0-generate-001", Prompt: "An oil painting of a fox"},
+		{Tool: "imagen_t2i", Model: "imagen-4.0-generate-001", Prompt: "Watercolor lighthouse", Tags: []string{"Sea"}},
+	} {
+		e.ID = NewID(base)
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		e.Files = []cas.File{{Path: "/out/" + e.Tool + ".png", SHA256: strings.Repeat("a", 63) + string(rune('0'+i))}}
+		if err := ix.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prompts := func(entries []Entry) []string {
+		var p []string
+		for _, e := range entries {
+			p = append(p, e.Prompt)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+		total int
+	}{
+		{"all newest first", Query{}, []string{"Watercolor lighthouse", "An oil painting of a fox", "A watercolor fox in the snow"}, 3},
+		{"text", Query{Text: "water fox"}, []string{"A watercolor fox in the snow"}, 1},
+		{"ranked", Query{Text: "fox"}, []string{"A watercolor fox in the snow", "An oil painting of a fox"}, 2},
+		{"tool and tag", Query{Tool: "imagen_t2i", Tag: "sea"}, []string{"Watercolor lighthouse"}, 1},
+		{"time range", Query{Since: base.Add(30 * time.Minute), Until: base.Add(90 * time.Minute)}, []string{"An oil painting of a fox"}, 1},
+		{"page", Query{Offset: 1, Limit: 1}, []string{"An oil painting of a fox"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total, err := ix.Search(tt.query)
+			if err != nil || !slices.Equal(prompts(got), tt.want) || total != tt.total {
+				t.Errorf("Search() = %q, %d, %v, want %q, %d", prompts(got), total, err, tt.want, tt.total)
+			}
+		})
+	}
+
+	// Entries written by another process are read
+	other := Open(path)
+	all, _, _ := other.Search(Query{})
+	updated := all[0]
+	updated.Tags = append(updated.Tags, "favorite")
+	if err := other.Put(updated); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, err := ix.Get(updated.ID); err != nil || !ok || !slices.Contains(e.Tags, "favorite") {
+		t.Errorf("Get() after an update elsewhere = %+v, %v, %v", e, ok, err)
+	}
+	if e, ok, _ := ix.ByFile("", strings.Repeat("a", 63)+"1"); !ok || e.Tool != "imagen_t2i" {
+		t.Errorf("ByFile() by hash = %+v, %v", e, ok)
+	}
+
+	if err := ix.Retain(func(e Entry) bool { return e.Tool == "imagen_t2i" }); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := other.Entries(); len(entries) != 2 {
+		t.Errorf("%d entries after Retain(), want 2", len(entries))
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Retain() did not compact the file:\n%s", data)
+	}
+}
+
+func TestNearest(t *testing.T) {
+	ix := Open(filepath.Join(t.TempDir(), Filename))
+	for _, e := range []Entry{
+		{ID: "north", Tool: "imagen_t2i", Embedding: []float32{1, 0}},
+		{ID: "northeast", Tool: "gemini_image_generation", Embedding: []float32{1, 1}},
+		{ID: "south", Tool: "imagen_t2i", Embedding: []float32{-1, 0}},
+		{ID: "unembedded", Tool: "imagen_t2i"},
+	} {
+		if err := ix.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(matches []Match) []string {
+		var ids []string
+		for _, m := range matches {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	matches, err := ix.Nearest([]float32{1, 0.1}, Query{}, 0)
+	if err != nil || !slices.Equal(ids(matches), []string{"north", "northeast", "south"}) {
+		t.Errorf("Nearest() = %q, %v", ids(matches), err)
+	}
+	if matches[2].Score > -0.99 {
+		t.Errorf("score of the opposite vector = %f", matches[2].Score)
+	}
+	if matches, _ := ix.Nearest([]float32{0, 1}, Query{Tool: "imagen_t2i"}, 1); !slices.Equal(ids(matches), []string{"north"}) {
+		t.Errorf("Nearest() by tool = %q", ids(matches))
+	}
+	if matches, _ := ix.Nearest([]float32{1, 0, 0}, Query{}, 0); len(matches) != 0 {
+		t.Errorf("Nearest() of another length = %q", ids(matches))
+	}
+}
@@ -0,0 +1,333 @@
+// Package ledger records the usage and estimated cost of tool calls and
+// enforces spending limits.
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gemini-mcp/internal/pricing"
+)
+
+// Entry is the usage of a single API call made by a tool.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Tool   string    `json:"tool"`
+	Client string    `json:"client"`
+	pricing.Estimate
+}
+
+// Limits are spending caps in US dollars. Zero means unlimited. Client limits
+// apply to each client separately.
+type Limits struct {
+	DailyUSD         float64 `json:"daily_usd,omitempty"`
+	MonthlyUSD       float64 `json:"monthly_usd,omitempty"`
+	ClientDailyUSD   float64 `json:"client_daily_usd,omitempty"`
+	ClientMonthlyUSD float64 `json:"client_monthly_usd,omitempty"`
+}
+
+// BudgetError is returned by Check when a spending limit has been reached.
+type BudgetError struct {
+	Client   string
+	Period   string
+	LimitUSD float64
+	SpentUSD float64
+}
+
+func (e *BudgetError) Error() string {
+	scope := "overall"
+	if e.Client != "" {
+		scope = "client " + e.Client
+	}
+	return fmt.Sprintf("budget exceeded: %s %s spend of $%.2f has reached the limit of $%.2f", scope, e.Period, e.SpentUSD, e.LimitUSD)
+}
+
+// Ledger is an append-only record of usage, persisted as JSON lines.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	limits  Limits
+	entries []Entry
+	now     func() time.Time
+
+	// reserved holds the estimated cost of the calls in progress
+	reserved map[*reservation]struct{}
+}
+
+// reservation is the estimated cost of a call in progress.
+type reservation struct {
+	client  string
+	costUSD float64
+}
+
+// Open loads the ledger stored at path, creating it on first use. An empty
+// path keeps the ledger in memory only.
+func Open(path string, limits Limits) (*Ledger, error) {
+	l := &Ledger{path: path, limits: limits, now: time.Now}
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage ledger: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid usage ledger entry at %s:%d: %v", path, line, err)
+		}
+		l.entries = append(l.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage ledger: %v", err)
+	}
+	return l, nil
+}
+
+// Limits returns the configured spending limits.
+func (l *Ledger) Limits() Limits {
+	return l.limits
+}
+
+// Record appends an entry, stamping it with the current time if it has none.
+func (l *Ledger) Record(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = l.now()
+	}
+	l.entries = append(l.entries, entry)
+
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to write usage ledger: %v", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write usage ledger: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write usage ledger: %v", err)
+	}
+	return nil
+}
+
+// Check returns a *BudgetError if the overall spend or the client's spend for
+// the current day or month has reached its limit. The estimated cost of calls
+// in progress counts as spent.
+func (l *Ledger) Check(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkLocked(client)
+}
+
+// Reserve checks the limits like Check and, if none is reached, holds the
+// estimated cost of a call for client until release is called, once the
+// usage of the call is recorded. Checking and holding under one lock keeps
+// concurrent calls from getting past a limit together.
+func (l *Ledger) Reserve(client string, costUSD float64) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkLocked(client); err != nil {
+		return nil, err
+	}
+
+	r := &reservation{client: client, costUSD: costUSD}
+	if l.reserved == nil {
+		l.reserved = make(map[*reservation]struct{})
+	}
+	l.reserved[r] = struct{}{}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.reserved, r)
+	}, nil
+}
+
+func (l *Ledger) checkLocked(client string) error {
+	day, month := l.periodStarts()
+	checks := []struct {
+		client string
+		period string
+		since  time.Time
+		limit  float64
+	}{
+		{"", "daily", day, l.limits.DailyUSD},
+		{"", "monthly", month, l.limits.MonthlyUSD},
+		{client, "daily", day, l.limits.ClientDailyUSD},
+		{client, "monthly", month, l.limits.ClientMonthlyUSD},
+	}
+	for _, c := range checks {
+		if c.limit <= 0 {
+			continue
+		}
+		spent := l.spentLocked(c.since, c.client) + l.reservedLocked(c.client)
+		if spent >= c.limit {
+			return &BudgetError{Client: c.client, Period: c.period, LimitUSD: c.limit, SpentUSD: spent}
+		}
+	}
+	return nil
+}
+
+// reservedLocked returns the cost held for calls in progress, for one client
+// or, if client is empty, overall.
+func (l *Ledger) reservedLocked(client string) float64 {
+	var total float64
+	for r := range l.reserved {
+		if client == "" || r.client == client {
+			total += r.costUSD
+		}
+	}
+	return total
+}
+
+// Spent returns the spend since a time, for one client or, if client is
+// empty, overall.
+func (l *Ledger) Spent(since time.Time, client string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.spentLocked(since, client)
+}
+
+func (l *Ledger) spentLocked(since time.Time, client string) float64 {
+	var total float64
+	for _, entry := range l.entries {
+		if entry.Time.Before(since) || (client != "" && entry.Client != client) {
+			continue
+		}
+		total += entry.CostUSD
+	}
+	return total
+}
+
+// PeriodStart returns the start of the current "day" or "month", or the zero
+// time for any other period.
+func (l *Ledger) PeriodStart(period string) time.Time {
+	day, month := l.periodStarts()
+	switch period {
+	case "day":
+		return day
+	case "month":
+		return month
+	}
+	return time.Time{}
+}
+
+func (l *Ledger) periodStarts() (day, month time.Time) {
+	now := l.now()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return day, month
+}
+
+// Summary aggregates the usage of a group of entries.
+type Summary struct {
+	Name         string  `json:"name"`
+	Calls        int     `json:"calls"`
+	InputTokens  int     `json:"input_tokens,omitempty"`
+	OutputTokens int     `json:"output_tokens,omitempty"`
+	Images       int     `json:"images,omitempty"`
+	VideoSeconds float64 `json:"video_seconds,omitempty"`
+	CostUSD      float64 `json:"cost_usd"`
+}
+
+// Report summarizes spend.
+type Report struct {
+	TotalUSD float64   `json:"total_usd"`
+	Calls    int       `json:"calls"`
+	Unpriced int       `json:"unpriced_calls,omitempty"`
+	ByModel  []Summary `json:"by_model"`
+	ByTool   []Summary `json:"by_tool"`
+	ByClient []Summary `json:"by_client"`
+}
+
+// Report summarizes the entries since a time, optionally for a single client.
+// Groups are sorted by cost, highest first.
+func (l *Ledger) Report(since time.Time, client string) Report {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byModel := map[string]*Summary{}
+	byTool := map[string]*Summary{}
+	byClient := map[string]*Summary{}
+	var report Report
+
+	for _, entry := range l.entries {
+		if entry.Time.Before(since) || (client != "" && entry.Client != client) {
+			continue
+		}
+		report.Calls++
+		report.TotalUSD += entry.CostUSD
+		if !entry.Priced {
+			report.Unpriced++
+		}
+		add(byModel, entry.Model, entry)
+		add(byTool, entry.Tool, entry)
+		add(byClient, entry.Client, entry)
+	}
+
+	report.TotalUSD = round(report.TotalUSD)
+	report.ByModel = sorted(byModel)
+	report.ByTool = sorted(byTool)
+	report.ByClient = sorted(byClient)
+	return report
+}
+
+func add(groups map[string]*Summary, name string, entry Entry) {
+	summary, ok := groups[name]
+	if !ok {
+		summary = &Summary{Name: name}
+		groups[name] = summary
+	}
+	summary.Calls++
+	summary.InputTokens += entry.InputTokens
+	summary.OutputTokens += entry.OutputTokens
+	summary.Images += entry.Images
+	summary.VideoSeconds += entry.VideoSeconds
+	summary.CostUSD += entry.CostUSD
+}
+
+func sorted(groups map[string]*Summary) []Summary {
+	summaries := make([]Summary, 0, len(groups))
+	for _, summary := range groups {
+		summary.CostUSD = round(summary.CostUSD)
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].CostUSD != summaries[j].CostUSD {
+			return summaries[i].CostUSD > summaries[j].CostUSD
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// round rounds to a millionth of a dollar to hide floating point noise.
+func round(usd float64) float64 {
+	return math.Round(usd*1e6) / 1e6
+}
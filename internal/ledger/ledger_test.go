@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-mcp/internal/pricing"
+)
+
+func entry(tool, client, model string, cost float64) Entry {
+	return Entry{
+		Tool:     tool,
+		Client:   client,
+		Estimate: pricing.Estimate{Usage: pricing.Usage{Model: model}, CostUSD: cost, Priced: true},
+	}
+}
+
+func TestLedgerPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	l, err := Open(path, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(entry("veo_text_to_video", "a", "veo-3.0-generate-001", 3.2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(entry("imagen_t2i", "b", "imagen-4.0-generate-001", 0.04)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reopened.Report(time.Time{}, "")
+	if report.Calls != 2 || report.TotalUSD != 3.24 {
+		t.Fatalf("unexpected report after reopening: %+v", report)
+	}
+	if report.ByTool[0].Name != "veo_text_to_video" {
+		t.Errorf("expected most expensive tool first, got %s", report.ByTool[0].Name)
+	}
+	if got := reopened.Report(time.Time{}, "b").TotalUSD; got != 0.04 {
+		t.Errorf("client report total = %v, want 0.04", got)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	now := time.Date(2025, 3, 31, 12, 0, 0, 0, time.UTC)
+	l, _ := Open("", Limits{DailyUSD: 10, ClientMonthlyUSD: 5})
+	l.now = func() time.Time { return now }
+
+	l.Record(entry("veo_text_to_video", "a", "veo", 3.2))
+	if err := l.Check("a"); err != nil {
+		t.Fatalf("unexpected error under the limits: %v", err)
+	}
+
+	l.Record(entry("veo_text_to_video", "a", "veo", 3.2))
+	var budgetErr *BudgetError
+	if err := l.Check("a"); !errors.As(err, &budgetErr) || budgetErr.Client != "a" || budgetErr.Period != "monthly" {
+		t.Fatalf("expected client monthly budget error, got %v", err)
+	}
+	if err := l.Check("b"); err != nil {
+		t.Fatalf("other clients should not be limited: %v", err)
+	}
+
+	l.Record(entry("veo_text_to_video", "b", "veo", 4))
+	if err := l.Check("b"); !errors.As(err, &budgetErr) || budgetErr.Client != "" || budgetErr.Period != "daily" {
+		t.Fatalf("expected overall daily budget error, got %v", err)
+	}
+
+	// Spend from previous days no longer counts against the daily limit,
+	// and a new month resets the monthly limits.
+	now = now.Add(24 * time.Hour)
+	if err := l.Check("a"); err != nil {
+		t.Errorf("limits should reset in a new month: %v", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	l, _ := Open("", Limits{DailyUSD: 5})
+
+	// Concurrent calls cannot all start on the same remaining budget
+	release, err := l.Reserve("a", 3.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reserve("b", 3.2); err != nil {
+		t.Fatalf("second call under the limit was refused: %v", err)
+	}
+	var budgetErr *BudgetError
+	if _, err := l.Reserve("c", 3.2); !errors.As(err, &budgetErr) || budgetErr.SpentUSD != 6.4 {
+		t.Fatalf("expected the reserved spend to reach the limit, got %v", err)
+	}
+
+	// Once recorded, the usage replaces the reservation
+	l.Record(entry("veo_text_to_video", "a", "veo", 0.5))
+	release()
+	if got := l.Spent(time.Time{}, ""); got != 0.5 {
+		t.Errorf("Spent = %v, want only the recorded usage", got)
+	}
+	if err := l.Check("c"); err != nil {
+		t.Errorf("released reservation still counts: %v", err)
+	}
+}
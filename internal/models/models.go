@@ -0,0 +1,201 @@
+// Package models caches the list of available models, groups them by
+// capability and checks model names against it.
+package models
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Capabilities of models, in the order they are listed.
+const (
+	CapabilityImage     = "image"
+	CapabilityVideo     = "video"
+	CapabilityTTS       = "tts"
+	CapabilityText      = "text"
+	CapabilityEmbedding = "embedding"
+	CapabilityOther     = "other"
+)
+
+// Capabilities lists every capability in display order.
+var Capabilities = []string{CapabilityImage, CapabilityVideo, CapabilityTTS, CapabilityText, CapabilityEmbedding, CapabilityOther}
+
+// Info describes an available model.
+type Info struct {
+	Name             string   `json:"name"`
+	DisplayName      string   `json:"display_name,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	Capability       string   `json:"capability"`
+	SupportedActions []string `json:"supported_actions,omitempty"`
+	InputTokenLimit  int      `json:"input_token_limit,omitempty"`
+	OutputTokenLimit int      `json:"output_token_limit,omitempty"`
+}
+
+// NewInfo converts a model returned by the API.
+func NewInfo(m *genai.Model) Info {
+	name := strings.TrimPrefix(m.Name, "models/")
+	return Info{
+		Name:             name,
+		DisplayName:      m.DisplayName,
+		Description:      m.Description,
+		Capability:       Capability(name, m.SupportedActions),
+		SupportedActions: m.SupportedActions,
+		InputTokenLimit:  int(m.InputTokenLimit),
+		OutputTokenLimit: int(m.OutputTokenLimit),
+	}
+}
+
+// Capability returns what a model produces, judging by its name and the
+// actions it supports.
+func Capability(name string, actions []string) string {
+	switch {
+	case strings.HasPrefix(name, "veo") || slices.Contains(actions, "predictLongRunning"):
+		return CapabilityVideo
+	case strings.HasPrefix(name, "imagen") || strings.Contains(name, "-image"):
+		return CapabilityImage
+	case strings.Contains(name, "tts"):
+		return CapabilityTTS
+	case slices.Contains(actions, "embedContent"):
+		return CapabilityEmbedding
+	case slices.Contains(actions, "generateContent"):
+		return CapabilityText
+	default:
+		return CapabilityOther
+	}
+}
+
+// UnknownModelError reports a model name that is not in the model list.
+type UnknownModelError struct {
+	Name        string
+	Suggestions []string
+}
+
+func (e *UnknownModelError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("unknown model %q; use list_models to see the available models", e.Name)
+	}
+	return fmt.Sprintf("unknown model %q; did you mean %s?", e.Name, strings.Join(e.Suggestions, " or "))
+}
+
+// Catalog caches the model list, fetching it again once it is older than
+// its time to live.
+type Catalog struct {
+	list func(ctx context.Context) ([]Info, error)
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	models  []Info
+	fetched time.Time
+}
+
+// NewCatalog returns a catalog that fetches the model list with list.
+func NewCatalog(list func(ctx context.Context) ([]Info, error), ttl time.Duration) *Catalog {
+	return &Catalog{list: list, ttl: ttl, now: time.Now}
+}
+
+// Models returns the cached model list, fetching it if it is missing, stale
+// or refresh is set.
+func (c *Catalog) Models(ctx context.Context, refresh bool) ([]Info, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !refresh && c.models != nil && c.now().Sub(c.fetched) < c.ttl {
+		return c.models, nil
+	}
+	models, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.models = models
+	c.fetched = c.now()
+	return models, nil
+}
+
+// Validate returns an *UnknownModelError if name is not in the model list.
+// Names of tuned models and other resources are not checked.
+func (c *Catalog) Validate(ctx context.Context, name string) error {
+	name = strings.TrimPrefix(name, "models/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil
+	}
+
+	models, err := c.Models(ctx, false)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(models))
+	for i, m := range models {
+		if m.Name == name {
+			return nil
+		}
+		names[i] = m.Name
+	}
+	return &UnknownModelError{Name: name, Suggestions: Suggest(name, names, 3)}
+}
+
+// Suggest returns up to n candidates resembling name: those containing it,
+// shortest first, then those within a few edits of it, closest first.
+func Suggest(name string, candidates []string, n int) []string {
+	type match struct {
+		name      string
+		contained bool
+		score     int
+	}
+
+	threshold := max(2, len(name)/4)
+	var matches []match
+	for _, candidate := range candidates {
+		if strings.Contains(candidate, name) {
+			matches = append(matches, match{candidate, true, len(candidate)})
+		} else if d := distance(name, candidate); d <= threshold {
+			matches = append(matches, match{candidate, false, d})
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b match) int {
+		switch {
+		case a.contained != b.contained:
+			if a.contained {
+				return -1
+			}
+			return 1
+		case a.score != b.score:
+			return a.score - b.score
+		default:
+			return strings.Compare(a.name, b.name)
+		}
+	})
+	var suggestions []string
+	for _, m := range matches[:min(n, len(matches))] {
+		suggestions = append(suggestions, m.name)
+	}
+	return suggestions
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
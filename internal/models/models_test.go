@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testModels = []Info{
+	{Name: "gemini-2.5-flash", Capability: CapabilityText},
+	{Name: "gemini-2.5-flash-lite", Capability: CapabilityText},
+	{Name: "gemini-2.5-pro", Capability: CapabilityText},
+	{Name: "gemini-2.5-flash-image-preview", Capability: CapabilityImage},
+	{Name: "imagen-4.0-generate-001", Capability: CapabilityImage},
+	{Name: "veo-3.0-generate-001", Capability: CapabilityVideo},
+	{Name: "veo-3.0-fast-generate-001", Capability: CapabilityVideo},
+}
+
+func TestCapability(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		want    string
+	}{
+		{"veo-3.0-generate-001", []string{"predictLongRunning"}, CapabilityVideo},
+		{"imagen-4.0-ultra-generate-001", []string{"predict"}, CapabilityImage},
+		{"gemini-2.5-flash-image-preview", []string{"generateContent", "countTokens"}, CapabilityImage},
+		{"gemini-2.5-flash-preview-tts", []string{"generateContent"}, CapabilityTTS},
+		{"gemini-embedding-001", []string{"embedContent"}, CapabilityEmbedding},
+		{"gemini-2.5-pro", []string{"generateContent", "createCachedContent"}, CapabilityText},
+		{"aqa", []string{"generateAnswer"}, CapabilityOther},
+	}
+	for _, tt := range tests {
+		if got := Capability(tt.name, tt.actions); got != tt.want {
+			t.Errorf("Capability(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	var names []string
+	for _, m := range testModels {
+		names = append(names, m.Name)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"gemini-2.5-flahs", []string{"gemini-2.5-flash"}},
+		{"veo-3.0", []string{"veo-3.0-generate-001", "veo-3.0-fast-generate-001"}},
+		{"imagen-4-generate-001", []string{"imagen-4.0-generate-001"}},
+		{"dall-e-3", nil},
+	}
+	for _, tt := range tests {
+		if got := Suggest(tt.name, names, 3); !slices.Equal(got, tt.want) {
+			t.Errorf("Suggest(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogValidate(t *testing.T) {
+	calls := 0
+	catalog := NewCatalog(func(context.Context) ([]Info, error) {
+		calls++
+		return testModels, nil
+	}, time.Hour)
+	ctx := context.Background()
+
+	for _, name := range []string{"gemini-2.5-pro", "models/veo-3.0-generate-001", "tunedModels/my-model", ""} {
+		if err := catalog.Validate(ctx, name); err != nil {
+			t.Errorf("Validate(%q) = %v", name, err)
+		}
+	}
+
+	var unknown *UnknownModelError
+	err := catalog.Validate(ctx, "gemini-2.5-flahs")
+	if !errors.As(err, &unknown) || !slices.Equal(unknown.Suggestions, []string{"gemini-2.5-flash"}) {
+		t.Fatalf("Validate = %v, want a suggestion of gemini-2.5-flash", err)
+	}
+	if calls != 1 {
+		t.Errorf("model list fetched %d times, want once", calls)
+	}
+}
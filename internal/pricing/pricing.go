@@ -0,0 +1,144 @@
+// Package pricing estimates the cost of Gemini, Imagen and Veo requests from
+// a table of list prices.
+package pricing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Price is the list price of a model in US dollars. Entries only need the
+// fields that apply to the model.
+type Price struct {
+	InputPerMillion  float64 `json:"input_per_million,omitempty"`
+	OutputPerMillion float64 `json:"output_per_million,omitempty"`
+	PerImage         float64 `json:"per_image,omitempty"`
+	PerVideoSecond   float64 `json:"per_video_second,omitempty"`
+}
+
+// Table maps model names to prices. A key may be a model name prefix such as
+// 'imagen-4.0-generate', and may end in '@<resolution>' to price a resolution
+// differently, e.g. 'veo-3.0-generate@1080p'.
+type Table map[string]Price
+
+// DefaultTable returns the built-in prices, based on the published Gemini API
+// prices at the time of writing.
+func DefaultTable() Table {
+	return Table{
+		"gemini-2.5-pro":        {InputPerMillion: 1.25, OutputPerMillion: 10},
+		"gemini-2.5-flash":      {InputPerMillion: 0.30, OutputPerMillion: 2.50},
+		"gemini-2.5-flash-lite": {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+		"gemini-2.0-flash":      {InputPerMillion: 0.10, OutputPerMillion: 0.40},
+		"gemini-2.0-flash-lite": {InputPerMillion: 0.075, OutputPerMillion: 0.30},
+
+		"gemini-2.5-flash-image":                    {InputPerMillion: 0.30, PerImage: 0.039},
+		"gemini-2.0-flash-preview-image-generation": {InputPerMillion: 0.10, PerImage: 0.039},
+
+		"imagen-4.0-generate":       {PerImage: 0.04},
+		"imagen-4.0-ultra-generate": {PerImage: 0.06},
+		"imagen-4.0-fast-generate":  {PerImage: 0.02},
+		"imagen-3.0-generate":       {PerImage: 0.03},
+
+		"veo-3.0-generate":      {PerVideoSecond: 0.40},
+		"veo-3.0-fast-generate": {PerVideoSecond: 0.15},
+		"veo-2.0-generate":      {PerVideoSecond: 0.35},
+	}
+}
+
+// LoadTable returns the default prices overridden by the entries of the JSON
+// file at path, if one is given.
+func LoadTable(path string) (Table, error) {
+	table := DefaultTable()
+	if path == "" {
+		return table, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table: %v", err)
+	}
+	var overrides Table
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("invalid price table %s: %v", path, err)
+	}
+	for key, price := range overrides {
+		table[key] = price
+	}
+	return table, nil
+}
+
+// Lookup returns the price of a model at a resolution. An entry for the exact
+// model wins over the longest matching prefix, and a resolution-specific entry
+// wins over one without a resolution.
+func (t Table) Lookup(model, resolution string) (Price, bool) {
+	model = strings.TrimPrefix(model, "models/")
+	if resolution != "" {
+		if price, ok := t.lookup(model, resolution); ok {
+			return price, true
+		}
+	}
+	return t.lookup(model, "")
+}
+
+func (t Table) lookup(model, resolution string) (Price, bool) {
+	suffix := ""
+	if resolution != "" {
+		suffix = "@" + resolution
+	}
+	if price, ok := t[model+suffix]; ok {
+		return price, true
+	}
+
+	var best string
+	for key := range t {
+		name, ok := strings.CutSuffix(key, suffix)
+		if !ok || (suffix == "" && strings.Contains(key, "@")) {
+			continue
+		}
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return t[best+suffix], true
+}
+
+// Usage describes the billable units of a request.
+type Usage struct {
+	Model        string  `json:"model"`
+	Resolution   string  `json:"resolution,omitempty"`
+	InputTokens  int     `json:"input_tokens,omitempty"`
+	OutputTokens int     `json:"output_tokens,omitempty"`
+	Images       int     `json:"images,omitempty"`
+	VideoSeconds float64 `json:"video_seconds,omitempty"`
+}
+
+// Estimate is the estimated cost of a request. Priced is false when the table
+// has no entry for the model, in which case the cost is zero.
+type Estimate struct {
+	Usage
+	CostUSD float64 `json:"cost_usd"`
+	Priced  bool    `json:"priced"`
+}
+
+// Estimate prices usage with the table.
+func (t Table) Estimate(u Usage) Estimate {
+	price, ok := t.Lookup(u.Model, u.Resolution)
+	if !ok {
+		return Estimate{Usage: u}
+	}
+	cost := float64(u.InputTokens)*price.InputPerMillion/1e6 +
+		float64(u.OutputTokens)*price.OutputPerMillion/1e6 +
+		float64(u.Images)*price.PerImage +
+		u.VideoSeconds*price.PerVideoSecond
+	return Estimate{
+		Usage:   u,
+		CostUSD: math.Round(cost*1e6) / 1e6,
+		Priced:  true,
+	}
+}
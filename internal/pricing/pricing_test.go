@@ -0,0 +1,92 @@
+package pricing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupPrefersLongestPrefix(t *testing.T) {
+	table := DefaultTable()
+
+	tests := []struct {
+		model string
+		want  Price
+	}{
+		{"gemini-2.5-flash", table["gemini-2.5-flash"]},
+		{"models/gemini-2.5-flash-lite", table["gemini-2.5-flash-lite"]},
+		{"gemini-2.5-flash-image-preview", table["gemini-2.5-flash-image"]},
+		{"imagen-4.0-ultra-generate-001", table["imagen-4.0-ultra-generate"]},
+		{"veo-3.0-fast-generate-001", table["veo-3.0-fast-generate"]},
+	}
+	for _, tt := range tests {
+		got, ok := table.Lookup(tt.model, "")
+		if !ok || got != tt.want {
+			t.Errorf("Lookup(%q) = %+v, %v; want %+v", tt.model, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := table.Lookup("unknown-model", ""); ok {
+		t.Error("expected no price for unknown model")
+	}
+}
+
+func TestLookupResolution(t *testing.T) {
+	table := Table{
+		"veo-3.0-generate":       {PerVideoSecond: 0.40},
+		"veo-3.0-generate@1080p": {PerVideoSecond: 0.50},
+	}
+
+	if p, _ := table.Lookup("veo-3.0-generate-001", "1080p"); p.PerVideoSecond != 0.50 {
+		t.Errorf("1080p price = %v, want 0.50", p.PerVideoSecond)
+	}
+	if p, _ := table.Lookup("veo-3.0-generate-001", "720p"); p.PerVideoSecond != 0.40 {
+		t.Errorf("720p price = %v, want 0.40", p.PerVideoSecond)
+	}
+	if p, _ := table.Lookup("veo-3.0-generate-001", ""); p.PerVideoSecond != 0.40 {
+		t.Errorf("default price = %v, want 0.40", p.PerVideoSecond)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	table := Table{
+		"text":  {InputPerMillion: 1, OutputPerMillion: 10},
+		"video": {PerVideoSecond: 0.5},
+	}
+
+	est := table.Estimate(Usage{Model: "text", InputTokens: 2000, OutputTokens: 500})
+	if !est.Priced || est.CostUSD != 0.007 {
+		t.Errorf("text estimate = %+v, want 0.007", est)
+	}
+
+	est = table.Estimate(Usage{Model: "video", VideoSeconds: 8})
+	if est.CostUSD != 4 {
+		t.Errorf("video estimate = %v, want 4", est.CostUSD)
+	}
+
+	if est := table.Estimate(Usage{Model: "other", Images: 1}); est.Priced || est.CostUSD != 0 {
+		t.Errorf("unpriced estimate = %+v", est)
+	}
+}
+
+func TestLoadTableOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	data := `{"veo-3.0-generate": {"per_video_second": 0.75}, "my-model": {"per_image": 1}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table["veo-3.0-generate"].PerVideoSecond != 0.75 {
+		t.Error("override was not applied")
+	}
+	if _, ok := table["imagen-4.0-generate"]; !ok {
+		t.Error("defaults were not kept")
+	}
+	if _, ok := table["my-model"]; !ok {
+		t.Error("new entry was not added")
+	}
+}
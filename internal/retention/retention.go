@@ -0,0 +1,110 @@
+// Package retention decides which output files to delete under rules on
+// their age, their total size and the number kept per tool.
+package retention
+
+import (
+	"slices"
+	"time"
+)
+
+// Reasons for removing a generation.
+const (
+	ReasonMaxAge   = "max_age"
+	ReasonKeepLast = "keep_last"
+	ReasonMaxBytes = "max_total_bytes"
+)
+
+// Policy holds the retention rules. Zero values disable a rule.
+type Policy struct {
+	// MaxAge is how long generations are kept.
+	MaxAge time.Duration
+	// MaxBytes is the total size the files may take up. The oldest
+	// generations are removed until they fit.
+	MaxBytes int64
+	// KeepLast is the number of the latest generations kept per tool.
+	KeepLast int
+}
+
+// Active reports whether any rule is set.
+func (p Policy) Active() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0 || p.KeepLast > 0
+}
+
+// File is an output file.
+type File struct {
+	Path string
+	Size int64
+}
+
+// Generation is the files saved by one tool call, which are kept or removed
+// together. Files whose tool call is unknown are generations of their own
+// with no tool.
+type Generation struct {
+	Tool  string
+	Time  time.Time
+	Files []File
+	// Protected generations are never removed, but count towards the total
+	// size.
+	Protected bool
+}
+
+// Size returns the total size of the files of g.
+func (g Generation) Size() int64 {
+	var size int64
+	for _, f := range g.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// Removal is a generation to remove and the rule that removes it.
+type Removal struct {
+	Generation
+	Reason string
+}
+
+// Plan returns the generations p removes, oldest first. Generations are
+// removed for their age first, then beyond the latest KeepLast of their tool,
+// then from the oldest until the rest fit in MaxBytes.
+func Plan(generations []Generation, p Policy, now time.Time) []Removal {
+	sorted := slices.Clone(generations)
+	slices.SortStableFunc(sorted, func(a, b Generation) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	// Protected generations take up their space wherever they are
+	var total int64
+	for _, g := range sorted {
+		if g.Protected {
+			total += g.Size()
+		}
+	}
+
+	var removals []Removal
+	perTool := make(map[string]int)
+	full := false
+	for _, g := range sorted {
+		if g.Protected {
+			perTool[g.Tool]++
+			continue
+		}
+		reason := ""
+		switch {
+		case p.MaxAge > 0 && now.Sub(g.Time) > p.MaxAge:
+			reason = ReasonMaxAge
+		case p.KeepLast > 0 && g.Tool != "" && perTool[g.Tool] >= p.KeepLast:
+			reason = ReasonKeepLast
+		case p.MaxBytes > 0 && (full || total+g.Size() > p.MaxBytes):
+			reason = ReasonMaxBytes
+			full = true
+		}
+		if reason != "" {
+			removals = append(removals, Removal{Generation: g, Reason: reason})
+			continue
+		}
+		perTool[g.Tool]++
+		total += g.Size()
+	}
+	slices.Reverse(removals)
+	return removals
+}
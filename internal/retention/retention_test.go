@@ -0,0 +1,57 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	gen := func(tool string, hoursAgo int, size int64) Generation {
+		return Generation{
+			Tool:  tool,
+			Time:  now.Add(-time.Duration(hoursAgo) * time.Hour),
+			Files: []File{{Path: fmt.Sprintf("%s_%d.png", tool, hoursAgo), Size: size}},
+		}
+	}
+	generations := []Generation{
+		gen("imagen_t2i", 1, 10),
+		gen("imagen_t2i", 2, 10),
+		gen("imagen_t2i", 3, 10),
+		gen("veo_text_to_video", 4, 100),
+		gen("", 5, 10),
+		gen("veo_text_to_video", 50, 100),
+	}
+	paths := func(removals []Removal) string {
+		var s []string
+		for _, r := range removals {
+			s = append(s, r.Files[0].Path+":"+r.Reason)
+		}
+		return fmt.Sprint(s)
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{"none", Policy{}, "[]"},
+		{"max age", Policy{MaxAge: 48 * time.Hour}, "[veo_text_to_video_50.png:max_age]"},
+		{"keep last", Policy{KeepLast: 1}, "[veo_text_to_video_50.png:keep_last imagen_t2i_3.png:keep_last imagen_t2i_2.png:keep_last]"},
+		{"max bytes", Policy{MaxBytes: 135}, "[veo_text_to_video_50.png:max_total_bytes _5.png:max_total_bytes]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := paths(Plan(generations, tt.policy, now)); got != tt.want {
+				t.Errorf("Plan() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Protected generations are kept and take up their space
+	generations[5].Protected = true
+	if got := paths(Plan(generations, Policy{MaxAge: 48 * time.Hour, MaxBytes: 225}, now)); got != "[_5.png:max_total_bytes veo_text_to_video_4.png:max_total_bytes]" {
+		t.Errorf("Plan() with a protected generation = %s", got)
+	}
+}
@@ -0,0 +1,127 @@
+// Package retry retries failed Gemini API calls with exponential backoff and
+// classifies the errors that remain.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Kind is the class of an API error.
+type Kind string
+
+const (
+	KindQuota           Kind = "quota"
+	KindSafety          Kind = "safety"
+	KindInvalidArgument Kind = "invalid_argument"
+	KindAuth            Kind = "auth"
+	KindUnavailable     Kind = "unavailable"
+	KindUnknown         Kind = "unknown"
+)
+
+// Error is a classified API error.
+type Error struct {
+	Kind       Kind
+	Code       int
+	Status     string
+	Message    string
+	Retryable  bool
+	RetryAfter time.Duration
+	Attempts   int
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Safety returns an error for a request or response blocked by safety
+// filters.
+func Safety(reason string) *Error {
+	return &Error{Kind: KindSafety, Message: "blocked by safety filters: " + reason}
+}
+
+// Classify returns err as an *Error. Errors that already are one are returned
+// unchanged.
+func Classify(err error) *Error {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return classifyAPIError(apiErr, err)
+	}
+	var apiErrPtr *genai.APIError
+	if errors.As(err, &apiErrPtr) {
+		return classifyAPIError(*apiErrPtr, err)
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: KindUnavailable, Message: err.Error(), Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &Error{Kind: KindUnavailable, Message: err.Error(), Retryable: true, Err: err}
+	}
+	return &Error{Kind: KindUnknown, Message: err.Error(), Err: err}
+}
+
+func classifyAPIError(apiErr genai.APIError, err error) *Error {
+	e := &Error{
+		Code:    apiErr.Code,
+		Status:  apiErr.Status,
+		Message: apiErr.Message,
+		Err:     err,
+	}
+	if e.Message == "" {
+		e.Message = err.Error()
+	}
+
+	switch {
+	case apiErr.Code == 429 || apiErr.Status == "RESOURCE_EXHAUSTED":
+		e.Kind = KindQuota
+		e.Retryable = true
+		e.RetryAfter = retryDelay(apiErr.Details)
+	case apiErr.Code == 401 || apiErr.Code == 403 ||
+		apiErr.Status == "UNAUTHENTICATED" || apiErr.Status == "PERMISSION_DENIED" ||
+		strings.Contains(apiErr.Message, "API key"):
+		e.Kind = KindAuth
+	case apiErr.Code >= 500 || apiErr.Status == "UNAVAILABLE" || apiErr.Status == "DEADLINE_EXCEEDED":
+		e.Kind = KindUnavailable
+		e.Retryable = true
+		e.RetryAfter = retryDelay(apiErr.Details)
+	case apiErr.Code >= 400:
+		e.Kind = KindInvalidArgument
+	default:
+		e.Kind = KindUnknown
+	}
+	return e
+}
+
+// retryDelay returns the delay requested by a google.rpc.RetryInfo detail, or
+// zero if there is none.
+func retryDelay(details []map[string]any) time.Duration {
+	for _, detail := range details {
+		if kind, _ := detail["@type"].(string); !strings.HasSuffix(kind, "google.rpc.RetryInfo") {
+			continue
+		}
+		if delay, ok := detail["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(delay); err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package retry
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy controls how failed calls are retried. Only quota and unavailable
+// errors are retried.
+type Policy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles with every
+	// retry, up to MaxDelay, and a random jitter is applied.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// OnRetry, if set, is called before waiting to retry.
+	OnRetry func(attempt int, err *Error, delay time.Duration)
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable,
+// or the attempts run out. Errors are returned classified as *Error.
+//
+// A delay requested by the server is honored instead of the backoff, unless it
+// is longer than MaxDelay, in which case the error is returned immediately.
+func Do[T any](ctx context.Context, p Policy, fn func() (T, error)) (T, error) {
+	attempts := max(p.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+		if err == nil {
+			return result, nil
+		}
+
+		apiErr := Classify(err)
+		apiErr.Attempts = attempt
+		if !apiErr.Retryable || attempt >= attempts || ctx.Err() != nil {
+			return result, apiErr
+		}
+
+		delay := p.backoff(attempt)
+		if apiErr.RetryAfter > 0 {
+			if p.MaxDelay > 0 && apiErr.RetryAfter > p.MaxDelay {
+				return result, apiErr
+			}
+			delay = apiErr.RetryAfter
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, apiErr, delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, apiErr
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the jittered delay before the given retry.
+func (p Policy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Equal jitter: wait between half and all of the delay.
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		kind      Kind
+		retryable bool
+	}{
+		{genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"}, KindQuota, true},
+		{genai.APIError{Code: 503, Status: "UNAVAILABLE"}, KindUnavailable, true},
+		{genai.APIError{Code: 400, Status: "INVALID_ARGUMENT", Message: "bad aspect ratio"}, KindInvalidArgument, false},
+		{genai.APIError{Code: 400, Status: "INVALID_ARGUMENT", Message: "API key not valid. Please pass a valid API key."}, KindAuth, false},
+		{genai.APIError{Code: 403, Status: "PERMISSION_DENIED"}, KindAuth, false},
+		{fmt.Errorf("error generating content: %w", genai.APIError{Code: 500}), KindUnavailable, true},
+		{Safety("IMAGE_SAFETY"), KindSafety, false},
+		{errors.New("something else"), KindUnknown, false},
+	}
+	for _, tt := range tests {
+		got := Classify(tt.err)
+		if got.Kind != tt.kind || got.Retryable != tt.retryable {
+			t.Errorf("Classify(%v) = %s (retryable %v), want %s (retryable %v)", tt.err, got.Kind, got.Retryable, tt.kind, tt.retryable)
+		}
+	}
+}
+
+func TestRetryDelayFromDetails(t *testing.T) {
+	err := genai.APIError{
+		Code:   429,
+		Status: "RESOURCE_EXHAUSTED",
+		Details: []map[string]any{
+			{"@type": "type.googleapis.com/google.rpc.QuotaFailure"},
+			{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "12s"},
+		},
+	}
+	if got := Classify(err).RetryAfter; got != 12*time.Second {
+		t.Errorf("RetryAfter = %v, want 12s", got)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED"}}`)
+	}))
+	defer api.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+	_, err := client.Get(api.URL)
+	got := Classify(err)
+	if got.Kind != KindQuota || got.Message != "Quota exceeded" || got.RetryAfter != 7*time.Second {
+		t.Errorf("Classify = %+v, want a quota error retried after 7s", got)
+	}
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d, ok := parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now); !ok || d != 90*time.Second {
+		t.Errorf("parseRetryAfter(date) = %v, %v, want 90s", d, ok)
+	}
+}
+
+func TestDoRetriesTransientErrors(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	calls := 0
+	result, err := Do(context.Background(), policy, func() (string, error) {
+		calls++
+		if calls < 3 {
+			return "", genai.APIError{Code: 503, Status: "UNAVAILABLE"}
+		}
+		return "ok", nil
+	})
+	if err != nil || result != "ok" || calls != 3 {
+		t.Fatalf("Do = %q, %v after %d calls; want ok after 3", result, err, calls)
+	}
+
+	calls = 0
+	_, err = Do(context.Background(), policy, func() (string, error) {
+		calls++
+		return "", genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"}
+	})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Kind != KindQuota || apiErr.Attempts != 3 || calls != 3 {
+		t.Fatalf("expected quota error after 3 attempts, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoDoesNotRetryPermanentErrors(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+
+	calls := 0
+	_, err := Do(context.Background(), policy, func() (int, error) {
+		calls++
+		return 0, genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}
+	})
+	if calls != 1 || Classify(err).Kind != KindInvalidArgument {
+		t.Fatalf("expected a single attempt with invalid_argument, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoGivesUpOnLongRetryAfter(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	calls := 0
+	_, err := Do(context.Background(), policy, func() (int, error) {
+		calls++
+		return 0, genai.APIError{
+			Code:    429,
+			Details: []map[string]any{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "3600s"}},
+		}
+	})
+	if calls != 1 || err == nil {
+		t.Fatalf("expected to give up immediately, got %v after %d calls", err, calls)
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	policy := Policy{BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		if d := policy.backoff(attempt); d < 0 || d > 4*time.Second {
+			t.Errorf("backoff(%d) = %v, want at most 4s", attempt, d)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package retry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Transport is an http.RoundTripper for the genai client that keeps the
+// Retry-After header of failed responses, which the SDK drops. A failed
+// response with the header is returned as an *Error whose RetryAfter is the
+// delay it asks for, unless the body has a RetryInfo detail, which wins.
+type Transport struct {
+	// Base makes the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Decode the error the way the SDK does
+	apiErr := genai.APIError{Code: resp.StatusCode, Status: resp.Status, Message: string(body)}
+	var wrapped struct {
+		Error *genai.APIError `json:"error"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && wrapped.Error != nil {
+		apiErr = *wrapped.Error
+	}
+
+	e := classifyAPIError(apiErr, apiErr)
+	if e.Retryable && e.RetryAfter == 0 {
+		e.RetryAfter = delay
+	}
+	return nil, e
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or
+// an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,152 @@
+// Package sandbox confines the files that tools read and write to allowed
+// root directories.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Access is the kind of access to a path.
+type Access string
+
+const (
+	Read  Access = "read"
+	Write Access = "write"
+)
+
+// OutsideError reports a path outside the allowed roots.
+type OutsideError struct {
+	Path   string
+	Access Access
+	// Client is set if the path is outside the roots declared by the client
+	// rather than those of the server.
+	Client bool
+	// Tenant is set if the path belongs to another session or client.
+	Tenant bool
+}
+
+func (e *OutsideError) Error() string {
+	if e.Client {
+		return fmt.Sprintf("%s is outside the roots declared by the client", e.Path)
+	}
+	if e.Tenant {
+		return fmt.Sprintf("%s is outside the output directory of this session or client", e.Path)
+	}
+	return fmt.Sprintf("%s is outside the allowed %s roots", e.Path, e.Access)
+}
+
+// Sandbox checks paths against allowed read and write roots. A Sandbox
+// without roots for an access allows any path for it.
+type Sandbox struct {
+	read  []string
+	write []string
+}
+
+// New returns a sandbox with the given roots. Write roots are also readable
+// if reads are restricted.
+func New(readRoots, writeRoots []string) (*Sandbox, error) {
+	s := &Sandbox{}
+	for _, root := range writeRoots {
+		resolved, err := Resolve(root)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving write root %s: %w", root, err)
+		}
+		s.write = append(s.write, resolved)
+	}
+	for _, root := range readRoots {
+		resolved, err := Resolve(root)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving read root %s: %w", root, err)
+		}
+		s.read = append(s.read, resolved)
+	}
+	if len(s.read) > 0 {
+		s.read = append(s.read, s.write...)
+	}
+	return s, nil
+}
+
+// Roots returns the roots for access, or nil if any path is allowed.
+func (s *Sandbox) Roots(access Access) []string {
+	if access == Write {
+		return s.write
+	}
+	return s.read
+}
+
+// Check resolves path and returns it if it is inside the roots for access
+// and, if clientRoots is not empty, inside one of the client roots, which
+// must be resolved already.
+func (s *Sandbox) Check(path string, access Access, clientRoots []string) (string, error) {
+	resolved, err := Resolve(path)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %w", path, err)
+	}
+	if roots := s.Roots(access); len(roots) > 0 && !Within(resolved, roots) {
+		return "", &OutsideError{Path: path, Access: access}
+	}
+	if len(clientRoots) > 0 && !Within(resolved, clientRoots) {
+		return "", &OutsideError{Path: path, Access: access, Client: true}
+	}
+	return resolved, nil
+}
+
+// Resolve returns the absolute path with symbolic links and ".." elements
+// resolved. Elements that do not exist yet, such as those of an output
+// directory to be created, are appended to the resolved path of the longest
+// existing prefix.
+func Resolve(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	dir, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// RootPath returns the resolved local path of a file:// root URI.
+func RootPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported root URI %s", uri)
+	}
+	return Resolve(filepath.FromSlash(u.Path))
+}
+
+// Within reports whether path is one of roots or inside one of them. Both
+// must be resolved already.
+func Within(path string, roots []string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)) {
+			return true
+		}
+	}
+	return false
+}
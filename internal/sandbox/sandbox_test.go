@@ -0,0 +1,91 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := filepath.Join(dir, "inputs")
+	outputs := filepath.Join(dir, "outputs")
+	secret := filepath.Join(dir, "secret")
+	for _, d := range []string{inputs, outputs, secret} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(inputs, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New([]string{inputs}, []string{outputs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		access Access
+		want   string
+	}{
+		{filepath.Join(inputs, "cat.png"), Read, filepath.Join(inputs, "cat.png")},
+		{filepath.Join(outputs, "cat.png"), Read, filepath.Join(outputs, "cat.png")},
+		{filepath.Join(outputs, "new", "dir"), Write, filepath.Join(outputs, "new", "dir")},
+		{filepath.Join(inputs, "..", "secret", "key"), Read, ""},
+		{filepath.Join(inputs, "link", "key"), Read, ""},
+		{filepath.Join(inputs, "link", "new", "dir"), Write, ""},
+		{inputs + "2", Read, ""},
+		{inputs, Write, ""},
+	}
+	for _, tt := range tests {
+		got, err := s.Check(tt.path, tt.access, nil)
+		if tt.want == "" {
+			var outside *OutsideError
+			if !errors.As(err, &outside) {
+				t.Errorf("Check(%s, %s) = %q, %v, want outside error", tt.path, tt.access, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Check(%s, %s) = %q, %v, want %q", tt.path, tt.access, got, err, tt.want)
+		}
+	}
+
+	// Client roots confine paths further
+	_, err = s.Check(filepath.Join(inputs, "cat.png"), Read, []string{outputs})
+	var outside *OutsideError
+	if !errors.As(err, &outside) || !outside.Client {
+		t.Errorf("expected client root error, got %v", err)
+	}
+}
+
+func TestUnrestricted(t *testing.T) {
+	s, err := New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Check("/etc/hosts", Read, nil); err != nil {
+		t.Errorf("sandbox without roots refused a read: %v", err)
+	}
+	if _, err := s.Check("/tmp/out", Write, nil); err != nil {
+		t.Errorf("sandbox without roots refused a write: %v", err)
+	}
+}
+
+func TestRootPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := RootPath("file://" + filepath.ToSlash(dir)); err != nil || got != dir {
+		t.Errorf("RootPath = %q, %v, want %q", got, err, dir)
+	}
+	if _, err := RootPath("https://example.com/"); err == nil {
+		t.Error("expected error for non-file root")
+	}
+}
@@ -0,0 +1,299 @@
+// Package scheduler limits the concurrency and request rate of API calls per
+// model family, queueing waiting calls fairly across sessions.
+package scheduler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Model families with separate limits.
+const (
+	FamilyGemini = "gemini"
+	FamilyImagen = "imagen"
+	FamilyVeo    = "veo"
+)
+
+// Limit bounds the calls to a model family. Zero values mean unlimited.
+type Limit struct {
+	// Concurrency is the number of calls that may run at once.
+	Concurrency int
+	// RPM is the number of calls that may start in any one minute.
+	RPM int
+}
+
+// Family returns the family whose limits apply to calls to model.
+func Family(model string) string {
+	model = strings.TrimPrefix(model, "models/")
+	switch {
+	case strings.HasPrefix(model, "veo"):
+		return FamilyVeo
+	case strings.HasPrefix(model, "imagen"):
+		return FamilyImagen
+	default:
+		return FamilyGemini
+	}
+}
+
+// Scheduler admits calls within the limits of their family. Waiting calls
+// are queued first in, first out per session, and sessions take turns, so
+// one session queueing many calls does not hold up the others.
+type Scheduler struct {
+	mu       sync.Mutex
+	limits   map[string]Limit
+	families map[string]*queue
+	window   time.Duration
+	now      func() time.Time
+}
+
+// New returns a scheduler with the given limits per family. Families without
+// limits are unlimited.
+func New(limits map[string]Limit) *Scheduler {
+	return &Scheduler{
+		limits:   limits,
+		families: make(map[string]*queue),
+		window:   time.Minute,
+		now:      time.Now,
+	}
+}
+
+// Acquire waits until a call to family may start and returns the function
+// that must be called when it finishes. While the call waits, onQueued, if
+// set, is called with its 1-based position in the queue whenever it changes.
+func (s *Scheduler) Acquire(ctx context.Context, family, session string, onQueued func(position int)) (func(), error) {
+	w := &waiter{
+		session: session,
+		ready:   make(chan struct{}),
+		moved:   make(chan struct{}, 1),
+	}
+	w.moved <- struct{}{}
+
+	s.mu.Lock()
+	q := s.queue(family)
+	q.push(w)
+	q.notify()
+	s.dispatch(q)
+	s.mu.Unlock()
+
+	position := 0
+	for {
+		select {
+		case <-w.ready:
+			return s.releaseFunc(q), nil
+		case <-w.moved:
+			s.mu.Lock()
+			p := q.position(w)
+			s.mu.Unlock()
+			if p > 0 && p != position && onQueued != nil {
+				onQueued(p)
+			}
+			position = p
+		case <-ctx.Done():
+			s.mu.Lock()
+			if w.granted {
+				s.mu.Unlock()
+				s.releaseFunc(q)()
+			} else {
+				q.remove(w)
+				q.notify()
+				s.mu.Unlock()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Scheduler) queue(family string) *queue {
+	q, ok := s.families[family]
+	if !ok {
+		q = &queue{limit: s.limits[family], waiting: make(map[string][]*waiter)}
+		s.families[family] = q
+	}
+	return q
+}
+
+// dispatch starts as many waiting calls as the limits allow. If the rate
+// limit holds calls back, it is called again once the oldest start leaves
+// the window. It must be called with s.mu held.
+func (s *Scheduler) dispatch(q *queue) {
+	started := false
+	for len(q.sessions) > 0 {
+		if q.limit.Concurrency > 0 && q.running >= q.limit.Concurrency {
+			break
+		}
+		now := s.now()
+		if wait := q.rateDelay(now, s.window); wait > 0 {
+			if q.timer == nil {
+				q.timer = time.AfterFunc(wait, func() {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					q.timer = nil
+					s.dispatch(q)
+				})
+			}
+			break
+		}
+
+		w := q.pop()
+		w.granted = true
+		close(w.ready)
+		q.running++
+		if q.limit.RPM > 0 {
+			q.starts = append(q.starts, now)
+		}
+		started = true
+	}
+	if started {
+		q.notify()
+	}
+}
+
+func (s *Scheduler) releaseFunc(q *queue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			q.running--
+			s.dispatch(q)
+		})
+	}
+}
+
+type waiter struct {
+	session string
+	// ready is closed when the call may start.
+	ready   chan struct{}
+	granted bool
+	// moved is signalled when the position of the call may have changed.
+	moved chan struct{}
+}
+
+// queue holds the state of one family. Sessions with waiting calls take
+// turns in the order of sessions, starting at next.
+type queue struct {
+	limit    Limit
+	running  int
+	starts   []time.Time
+	timer    *time.Timer
+	sessions []string
+	waiting  map[string][]*waiter
+	next     int
+}
+
+func (q *queue) push(w *waiter) {
+	if len(q.waiting[w.session]) == 0 {
+		q.sessions = append(q.sessions, w.session)
+	}
+	q.waiting[w.session] = append(q.waiting[w.session], w)
+}
+
+// pop removes the first waiter of the session whose turn it is.
+func (q *queue) pop() *waiter {
+	session := q.sessions[q.next]
+	waiters := q.waiting[session]
+	w := waiters[0]
+	if len(waiters) == 1 {
+		delete(q.waiting, session)
+		q.sessions = append(q.sessions[:q.next], q.sessions[q.next+1:]...)
+	} else {
+		q.waiting[session] = waiters[1:]
+		q.next++
+	}
+	if q.next >= len(q.sessions) {
+		q.next = 0
+	}
+	return w
+}
+
+func (q *queue) remove(w *waiter) {
+	waiters := q.waiting[w.session]
+	for i, other := range waiters {
+		if other == w {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		q.waiting[w.session] = waiters
+		return
+	}
+
+	delete(q.waiting, w.session)
+	for i, session := range q.sessions {
+		if session != w.session {
+			continue
+		}
+		q.sessions = append(q.sessions[:i], q.sessions[i+1:]...)
+		if i < q.next {
+			q.next--
+		}
+		break
+	}
+	if q.next >= len(q.sessions) {
+		q.next = 0
+	}
+}
+
+// position returns the 1-based position of w in the order calls will start,
+// or zero if it is not waiting.
+func (q *queue) position(w *waiter) int {
+	index := -1
+	for i, other := range q.waiting[w.session] {
+		if other == w {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0
+	}
+
+	// Every session starts up to index calls in the turns before the one of
+	// w, and the sessions ahead of w in its turn start one more.
+	position := 1
+	ahead := true
+	for i := range q.sessions {
+		session := q.sessions[(q.next+i)%len(q.sessions)]
+		if session == w.session {
+			ahead = false
+			position += index
+			continue
+		}
+		n := len(q.waiting[session])
+		position += min(n, index)
+		if ahead && n > index {
+			position++
+		}
+	}
+	return position
+}
+
+// notify signals every waiting call that its position may have changed.
+func (q *queue) notify() {
+	for _, waiters := range q.waiting {
+		for _, w := range waiters {
+			select {
+			case w.moved <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// rateDelay returns how long to wait before another call may start under the
+// rate limit, dropping starts that have left the window.
+func (q *queue) rateDelay(now time.Time, window time.Duration) time.Duration {
+	if q.limit.RPM <= 0 {
+		return 0
+	}
+	for len(q.starts) > 0 && now.Sub(q.starts[0]) >= window {
+		q.starts = q.starts[1:]
+	}
+	if len(q.starts) < q.limit.RPM {
+		return 0
+	}
+	return q.starts[0].Add(window).Sub(now)
+}
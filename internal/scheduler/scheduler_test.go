@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFamily(t *testing.T) {
+	tests := map[string]string{
+		"veo-3.0-fast-generate-001":      FamilyVeo,
+		"models/imagen-4.0-generate-001": FamilyImagen,
+		"gemini-2.5-flash-image-preview": FamilyGemini,
+		"gemini-2.5-pro":                 FamilyGemini,
+	}
+	for model, want := range tests {
+		if got := Family(model); got != want {
+			t.Errorf("Family(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
+
+// queued starts a call in the background, returns once it is queued and sends
+// its release function on started once it may start.
+func queued(t *testing.T, s *Scheduler, name, session string, started chan<- func()) {
+	t.Helper()
+	waiting := make(chan struct{})
+	go func() {
+		release, err := s.Acquire(context.Background(), FamilyVeo, session, func(int) {
+			select {
+			case <-waiting:
+			default:
+				close(waiting)
+			}
+		})
+		if err != nil {
+			t.Errorf("Acquire(%s) failed: %v", name, err)
+			return
+		}
+		started <- release
+	}()
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatalf("%s was not queued", name)
+	}
+}
+
+func TestSessionsTakeTurns(t *testing.T) {
+	s := New(map[string]Limit{FamilyVeo: {Concurrency: 1}})
+	release, err := s.Acquire(context.Background(), FamilyVeo, "x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each session gets its own channel so the start order can be observed.
+	a, b := make(chan func()), make(chan func())
+	queued(t, s, "a1", "a", a)
+	queued(t, s, "a2", "a", a)
+	queued(t, s, "a3", "a", a)
+	queued(t, s, "b1", "b", b)
+
+	s.mu.Lock()
+	q := s.families[FamilyVeo]
+	var positions []int
+	for _, session := range []string{"a", "b"} {
+		for _, w := range q.waiting[session] {
+			positions = append(positions, q.position(w))
+		}
+	}
+	s.mu.Unlock()
+	if want := []int{1, 3, 4, 2}; !slices.Equal(positions, want) {
+		t.Errorf("positions of a1, a2, a3, b1 = %v, want %v", positions, want)
+	}
+
+	order := []chan func(){a, b, a, a}
+	for i, ch := range order {
+		release()
+		select {
+		case release = <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("call %d did not start", i+1)
+		}
+	}
+	release()
+}
+
+func TestRateLimit(t *testing.T) {
+	s := New(map[string]Limit{FamilyImagen: {RPM: 2}})
+	s.window = 100 * time.Millisecond
+
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := s.Acquire(context.Background(), FamilyImagen, "a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(begin); elapsed < s.window {
+		t.Errorf("third call started after %v, want at least %v", elapsed, s.window)
+	}
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	s := New(map[string]Limit{FamilyVeo: {Concurrency: 1}})
+	release, err := s.Acquire(context.Background(), FamilyVeo, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := s.Acquire(ctx, FamilyVeo, "b", func(int) { cancel() })
+		result <- err
+	}()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire = %v, want context.Canceled", err)
+	}
+
+	release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Acquire(ctx, FamilyVeo, "c", nil); err != nil {
+		t.Fatalf("Acquire after cancellation = %v", err)
+	}
+}
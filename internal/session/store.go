@@ -0,0 +1,271 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Turn records a single edit exchange within an image session.
+type Turn struct {
+	Index      int // 1-based position of the turn within the session
+	Prompt     string
+	Text       string
+	ImagePaths []string
+	CreatedAt  time.Time
+
+	// historyLen is the length of the chat history after this turn, used to
+	// truncate the history when branching.
+	historyLen int
+}
+
+// Session holds the chat history and saved turns of a conversational image
+// editing session.
+type Session struct {
+	ID              string
+	Model           string
+	OutputDirectory string
+	ParentID        string
+	ParentTurn      int
+	CreatedAt       time.Time
+	LastUsedAt      time.Time
+	History         []*genai.Content
+	Turns           []Turn
+}
+
+// ExpiresAt returns the time at which the session expires if left unused.
+func (s *Session) ExpiresAt(ttl time.Duration) time.Time {
+	return s.LastUsedAt.Add(ttl)
+}
+
+// Store keeps image sessions in memory and expires them after a period of
+// inactivity.
+type Store struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	ttl         time.Duration
+	maxSessions int
+	now         func() time.Time
+}
+
+// NewStore creates a session store. Sessions unused for longer than ttl are
+// discarded, and the least recently used session is evicted once more than
+// maxSessions are held. A zero maxSessions disables the limit.
+func NewStore(ttl time.Duration, maxSessions int) *Store {
+	return &Store{
+		sessions:    make(map[string]*Session),
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		now:         time.Now,
+	}
+}
+
+// TTL returns the inactivity period after which sessions expire.
+func (st *Store) TTL() time.Duration {
+	return st.ttl
+}
+
+// Create starts a new empty session.
+func (st *Store) Create(model, outputDir string) (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+
+	now := st.now()
+	sess := &Session{
+		ID:              id,
+		Model:           model,
+		OutputDirectory: outputDir,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+	}
+	st.sessions[id] = sess
+	st.evictLocked()
+	return sess.clone(), nil
+}
+
+// Get returns a snapshot of the session with the given ID.
+func (st *Store) Get(id string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+
+	sess, ok := st.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %q not found or expired", id)
+	}
+	return sess.clone(), nil
+}
+
+// AppendTurn replaces the session history with history and records turn.
+// turn.Index must be the session's next turn index; if another turn was
+// recorded since the caller's snapshot was taken, an error is returned.
+func (st *Store) AppendTurn(id string, history []*genai.Content, turn Turn) (Turn, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+
+	sess, ok := st.sessions[id]
+	if !ok {
+		return Turn{}, fmt.Errorf("session %q not found or expired", id)
+	}
+	if turn.Index != len(sess.Turns)+1 {
+		return Turn{}, fmt.Errorf("session %q was modified by a concurrent edit", id)
+	}
+
+	turn.historyLen = len(history)
+	if turn.CreatedAt.IsZero() {
+		turn.CreatedAt = st.now()
+	}
+	sess.History = cloneHistory(history)
+	sess.Turns = append(sess.Turns, turn)
+	sess.LastUsedAt = st.now()
+	return turn, nil
+}
+
+// Branch creates a new session whose history ends at the given turn of an
+// existing session. Turn 0 branches from the start of the session, before
+// any edits were made.
+func (st *Store) Branch(id string, turn int) (*Session, error) {
+	newSessID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, err := st.branchLocked(id, turn)
+	if err != nil {
+		return nil, err
+	}
+	sess.ID = newSessID
+	st.sessions[sess.ID] = sess
+	st.evictLocked()
+	return sess.clone(), nil
+}
+
+// PreviewBranch returns the session Branch would create, without an ID,
+// and without storing it.
+func (st *Store) PreviewBranch(id string, turn int) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, err := st.branchLocked(id, turn)
+	if err != nil {
+		return nil, err
+	}
+	return sess.clone(), nil
+}
+
+func (st *Store) branchLocked(id string, turn int) (*Session, error) {
+	st.pruneLocked()
+
+	parent, ok := st.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %q not found or expired", id)
+	}
+	if turn < 0 || turn > len(parent.Turns) {
+		return nil, fmt.Errorf("turn %d out of range (session has %d turns)", turn, len(parent.Turns))
+	}
+
+	historyLen := 0
+	if turn > 0 {
+		historyLen = parent.Turns[turn-1].historyLen
+	}
+
+	now := st.now()
+	parent.LastUsedAt = now
+	return &Session{
+		Model:           parent.Model,
+		OutputDirectory: parent.OutputDirectory,
+		ParentID:        parent.ID,
+		ParentTurn:      turn,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+		History:         cloneHistory(parent.History[:historyLen]),
+		Turns:           append([]Turn(nil), parent.Turns[:turn]...),
+	}, nil
+}
+
+// Delete removes a session. It reports whether the session existed.
+func (st *Store) Delete(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, ok := st.sessions[id]
+	delete(st.sessions, id)
+	return ok
+}
+
+// List returns snapshots of all live sessions, most recently used first.
+func (st *Store) List() []*Session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+
+	sessions := make([]*Session, 0, len(st.sessions))
+	for _, sess := range st.sessions {
+		sessions = append(sessions, sess.clone())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions
+}
+
+// pruneLocked removes expired sessions. st.mu must be held.
+func (st *Store) pruneLocked() {
+	if st.ttl <= 0 {
+		return
+	}
+	cutoff := st.now().Add(-st.ttl)
+	for id, sess := range st.sessions {
+		if sess.LastUsedAt.Before(cutoff) {
+			delete(st.sessions, id)
+		}
+	}
+}
+
+// evictLocked drops least recently used sessions until the store is within
+// its size limit. st.mu must be held.
+func (st *Store) evictLocked() {
+	for st.maxSessions > 0 && len(st.sessions) > st.maxSessions {
+		var oldest *Session
+		for _, sess := range st.sessions {
+			if oldest == nil || sess.LastUsedAt.Before(oldest.LastUsedAt) {
+				oldest = sess
+			}
+		}
+		delete(st.sessions, oldest.ID)
+	}
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.History = cloneHistory(s.History)
+	c.Turns = append([]Turn(nil), s.Turns...)
+	return &c
+}
+
+// cloneHistory copies the history slice so that appends by the genai chat
+// never alias the stored history.
+func cloneHistory(history []*genai.Content) []*genai.Content {
+	return append([]*genai.Content(nil), history...)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
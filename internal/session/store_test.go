@@ -0,0 +1,103 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+func addTurn(t *testing.T, st *Store, id, prompt string) {
+	t.Helper()
+	sess, err := st.Get(id)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", id, err)
+	}
+	history := append(sess.History,
+		genai.NewContentFromText(prompt, genai.RoleUser),
+		genai.NewContentFromText("ok", genai.RoleModel),
+	)
+	if _, err := st.AppendTurn(id, history, Turn{Index: len(sess.Turns) + 1, Prompt: prompt}); err != nil {
+		t.Fatalf("AppendTurn: %v", err)
+	}
+}
+
+func TestBranchTruncatesHistory(t *testing.T) {
+	st := NewStore(time.Hour, 0)
+	sess, err := st.Create("model", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTurn(t, st, sess.ID, "first")
+	addTurn(t, st, sess.ID, "second")
+	addTurn(t, st, sess.ID, "third")
+
+	preview, err := st.PreviewBranch(sess.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.ID != "" || len(preview.History) != 2 || len(st.List()) != 1 {
+		t.Errorf("PreviewBranch stored a session or kept the wrong history")
+	}
+
+	branch, err := st.Branch(sess.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch.ParentID != sess.ID || branch.ParentTurn != 1 {
+		t.Errorf("unexpected parent %s/%d", branch.ParentID, branch.ParentTurn)
+	}
+	if len(branch.Turns) != 1 || len(branch.History) != 2 {
+		t.Fatalf("expected 1 turn and 2 history entries, got %d and %d", len(branch.Turns), len(branch.History))
+	}
+
+	// Editing the branch must not affect the parent session.
+	addTurn(t, st, branch.ID, "alternative")
+	parent, err := st.Get(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parent.Turns) != 3 || parent.Turns[1].Prompt != "second" {
+		t.Errorf("parent session was modified by branch edit")
+	}
+
+	if _, err := st.Branch(sess.ID, 4); err == nil {
+		t.Error("expected error for out of range turn")
+	}
+}
+
+func TestAppendTurnRejectsStaleIndex(t *testing.T) {
+	st := NewStore(time.Hour, 0)
+	sess, _ := st.Create("model", "")
+	addTurn(t, st, sess.ID, "first")
+
+	if _, err := st.AppendTurn(sess.ID, nil, Turn{Index: 1}); err == nil {
+		t.Error("expected error for stale turn index")
+	}
+}
+
+func TestExpiryAndEviction(t *testing.T) {
+	now := time.Now()
+	st := NewStore(time.Minute, 2)
+	st.now = func() time.Time { return now }
+
+	a, _ := st.Create("model", "")
+	now = now.Add(time.Second)
+	b, _ := st.Create("model", "")
+	now = now.Add(time.Second)
+	c, _ := st.Create("model", "")
+
+	if _, err := st.Get(a.ID); err == nil {
+		t.Error("expected least recently used session to be evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if got := len(st.List()); got != 0 {
+		t.Errorf("expected all sessions to expire, %d left", got)
+	}
+	for _, id := range []string{b.ID, c.ID} {
+		if _, err := st.Get(id); err == nil {
+			t.Errorf("session %s should have expired", id)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/auth/credentials"
+)
+
+// DefaultPartSize is the size of the parts large objects are uploaded in.
+// S3 requires parts other than the last to be at least 5 MiB.
+const DefaultPartSize = 8 << 20
+
+// gcsEndpoint is the XML API of Cloud Storage, which is compatible with S3.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// S3Config configures an S3-compatible bucket.
+type S3Config struct {
+	// Endpoint is the URL of an S3-compatible service such as MinIO, whose
+	// buckets are addressed by path. Empty means AWS S3 in Region.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// GCSConfig configures a Cloud Storage bucket. Without HMAC keys, requests
+// are authorized with application default credentials, which cannot
+// presign URLs.
+type GCSConfig struct {
+	Bucket       string
+	HMACAccessID string
+	HMACSecret   string
+}
+
+// Bucket stores objects through the S3 API, which Cloud Storage also offers.
+type Bucket struct {
+	scheme   string
+	endpoint *url.URL
+	// virtualHost addresses the bucket as a subdomain of endpoint rather
+	// than as the first element of the path.
+	virtualHost bool
+	bucket      string
+	signer      *signer
+	token       func(ctx context.Context) (string, error)
+
+	PartSize   int
+	HTTPClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3 returns an S3-compatible bucket.
+func NewS3(cfg S3Config) (*Bucket, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 storage requires a bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("S3 storage requires an access key ID and secret access key")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	b := newBucket("s3", cfg.Bucket)
+	b.signer = &signer{accessKey: cfg.AccessKeyID, secretKey: cfg.SecretAccessKey, region: cfg.Region, service: "s3"}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+		b.virtualHost = true
+	}
+	if err := b.setEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewGCS returns a Cloud Storage bucket.
+func NewGCS(cfg GCSConfig) (*Bucket, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("GCS storage requires a bucket")
+	}
+	b := newBucket("gs", cfg.Bucket)
+	if err := b.setEndpoint(gcsEndpoint); err != nil {
+		return nil, err
+	}
+
+	if cfg.HMACAccessID != "" || cfg.HMACSecret != "" {
+		if cfg.HMACAccessID == "" || cfg.HMACSecret == "" {
+			return nil, errors.New("GCS HMAC keys require both an access ID and a secret")
+		}
+		b.signer = &signer{accessKey: cfg.HMACAccessID, secretKey: cfg.HMACSecret, region: "auto", service: "s3"}
+		return b, nil
+	}
+
+	creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+		Scopes: []string{"https://www.googleapis.com/auth/devstorage.read_write"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error finding Google credentials for GCS storage: %w", err)
+	}
+	b.token = func(ctx context.Context) (string, error) {
+		token, err := creds.Token(ctx)
+		if err != nil {
+			return "", err
+		}
+		return token.Value, nil
+	}
+	return b, nil
+}
+
+func newBucket(scheme, bucket string) *Bucket {
+	return &Bucket{
+		scheme:     scheme,
+		bucket:     bucket,
+		PartSize:   DefaultPartSize,
+		HTTPClient: http.DefaultClient,
+		now:        time.Now,
+	}
+}
+
+func (b *Bucket) setEndpoint(endpoint string) error {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid storage endpoint %q", endpoint)
+	}
+	b.endpoint = u
+	return nil
+}
+
+// URI returns the URI of key, such as s3://bucket/key.
+func (b *Bucket) URI(key string) string {
+	return b.scheme + "://" + b.bucket + "/" + key
+}
+
+// objectURL returns the URL of key, or of the bucket if key is empty.
+func (b *Bucket) objectURL(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	if b.virtualHost {
+		u.Host = b.bucket + "." + u.Host
+		u.Path += "/" + key
+	} else {
+		u.Path += "/" + b.bucket + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// Put uploads the object in one request if it fits in a part, and as a
+// multipart upload otherwise, so that at most one part is held in memory.
+func (b *Bucket) Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	part := make([]byte, b.PartSize)
+	n, err := io.ReadFull(r, part)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		header := http.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		if _, err := b.do(ctx, http.MethodPut, key, nil, header, part[:n]); err != nil {
+			return nil, fmt.Errorf("error uploading %s: %w", key, err)
+		}
+		return &Object{Key: key, URI: b.URI(key), Size: int64(n)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", key, err)
+	}
+
+	size, err := b.putMultipart(ctx, key, part, r, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error uploading %s: %w", key, err)
+	}
+	return &Object{Key: key, URI: b.URI(key), Size: size}, nil
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads first, a full part, and the rest of r in parts, and
+// aborts the upload if that fails.
+func (b *Bucket) putMultipart(ctx context.Context, key string, first []byte, r io.Reader, contentType string) (int64, error) {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return 0, fmt.Errorf("unexpected response to starting a multipart upload: %s", resp)
+	}
+	uploadID := initiated.UploadID
+
+	abort := func(err error) (int64, error) {
+		if _, abortErr := b.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr != nil {
+			err = fmt.Errorf("%w (aborting the upload failed too: %v)", err, abortErr)
+		}
+		return 0, err
+	}
+
+	var complete completeUpload
+	var size int64
+	part, n := first, len(first)
+	for n > 0 {
+		number := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		etag, err := b.doETag(ctx, http.MethodPut, key, query, part[:n])
+		if err != nil {
+			return abort(err)
+		}
+		complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: etag})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return abort(fmt.Errorf("error reading part %d: %w", number+1, err))
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return abort(err)
+	}
+	if _, err := b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body); err != nil {
+		return abort(err)
+	}
+	return size, nil
+}
+
+// doETag sends a request and returns the ETag of the response.
+func (b *Bucket) doETag(ctx context.Context, method, key string, query url.Values, body []byte) (string, error) {
+	resp, err := b.send(ctx, method, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// do sends a request and returns the body of the response.
+func (b *Bucket) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) ([]byte, error) {
+	resp, err := b.send(ctx, method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// send sends an authorized request and turns error responses into errors.
+// Some services report errors of completed multipart uploads in the body of
+// a 200 response.
+func (b *Bucket) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if b.signer != nil {
+		b.signer.sign(req, hashHex(body), b.now())
+	} else if b.token != nil {
+		token, err := b.token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := b.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, responseError(resp.Status, data)
+	}
+	if method == http.MethodPost && query.Has("uploadId") {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(data, []byte("<Error>")) {
+			return nil, responseError(resp.Status, data)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	return resp, nil
+}
+
+func responseError(status string, data []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s: %s: %s", status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s", status)
+}
+
+// PresignGet returns a URL that allows downloading key for ttl. Buckets
+// authorized with access tokens cannot presign URLs.
+func (b *Bucket) PresignGet(key string, ttl time.Duration) (string, error) {
+	if b.signer == nil {
+		return "", ErrPresignUnsupported
+	}
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return b.signer.presign(http.MethodGet, b.objectURL(key, nil), ttl, b.now()), nil
+}
@@ -0,0 +1,105 @@
+// Package storage saves output files on local disk or in S3-compatible or
+// Google Cloud Storage buckets.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrPresignUnsupported is returned by storages that cannot presign URLs.
+var ErrPresignUnsupported = errors.New("storage does not support presigned URLs")
+
+// Object is a stored file.
+type Object struct {
+	Key string `json:"key"`
+	// URI identifies the object, such as s3://bucket/key or gs://bucket/key.
+	URI  string `json:"uri"`
+	Size int64  `json:"size"`
+	// URL is a presigned download URL, if requested.
+	URL string `json:"url,omitempty"`
+}
+
+// Storage saves objects by key. Keys are slash-separated paths.
+type Storage interface {
+	// Put stores what r yields under key. r is read in parts, so it may be
+	// larger than memory.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error)
+	// PresignGet returns a URL that allows downloading key for ttl.
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// CleanKey checks that key is a relative path without ".." elements and
+// returns it cleaned.
+func CleanKey(key string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(key, "/"))
+	if key == "" || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return cleaned, nil
+}
+
+// Local stores objects as files under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a storage that saves objects under root.
+func NewLocal(root string) (*Local, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving storage root %s: %w", root, err)
+	}
+	return &Local{root: abs}, nil
+}
+
+// Put writes the object to a temporary file first, so that readers never see
+// a partial file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) (*Object, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("error saving %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error saving %s: %w", key, err)
+	}
+	return &Object{Key: key, URI: FileURI(target), Size: size}, nil
+}
+
+// PresignGet is not supported for local files.
+func (l *Local) PresignGet(key string, ttl time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+// FileURI returns the file:// URI of an absolute path.
+func FileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
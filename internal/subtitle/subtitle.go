@@ -0,0 +1,66 @@
+package subtitle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Segment is a single timed piece of a transcript.
+type Segment struct {
+	Start   time.Duration
+	End     time.Duration
+	Speaker string
+	Text    string
+}
+
+// FromSeconds converts a time offset in seconds to a duration rounded to
+// the millisecond.
+func FromSeconds(seconds float64) time.Duration {
+	return time.Duration(seconds*1000+0.5) * time.Millisecond
+}
+
+// SRT renders segments in SubRip format. Speaker labels are prefixed to the
+// cue text.
+func SRT(segments []Segment) string {
+	var b strings.Builder
+	for i, seg := range segments {
+		fmt.Fprintf(&b, "%d\n", i+1)
+		fmt.Fprintf(&b, "%s --> %s\n", formatTimestamp(seg.Start, ","), formatTimestamp(seg.End, ","))
+		text := strings.TrimSpace(seg.Text)
+		if seg.Speaker != "" {
+			text = seg.Speaker + ": " + text
+		}
+		b.WriteString(text)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// VTT renders segments in WebVTT format. Speaker labels use voice spans.
+func VTT(segments []Segment) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, seg := range segments {
+		fmt.Fprintf(&b, "%s --> %s\n", formatTimestamp(seg.Start, "."), formatTimestamp(seg.End, "."))
+		text := strings.TrimSpace(seg.Text)
+		if seg.Speaker != "" {
+			text = fmt.Sprintf("<v %s>%s", seg.Speaker, text)
+		}
+		b.WriteString(text)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// formatTimestamp formats d as HH:MM:SS followed by sep and milliseconds.
+func formatTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	h := ms / 3600000
+	m := ms / 60000 % 60
+	s := ms / 1000 % 60
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, sep, ms%1000)
+}
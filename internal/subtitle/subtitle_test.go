@@ -0,0 +1,34 @@
+package subtitle
+
+import (
+	"testing"
+	"time"
+)
+
+var segments = []Segment{
+	{Start: 0, End: FromSeconds(2.5), Speaker: "Speaker 1", Text: "Hello there. "},
+	{Start: FromSeconds(2.5), End: FromSeconds(3725.042), Text: "General Kenobi."},
+}
+
+func TestSRT(t *testing.T) {
+	want := "1\n00:00:00,000 --> 00:00:02,500\nSpeaker 1: Hello there.\n\n" +
+		"2\n00:00:02,500 --> 01:02:05,042\nGeneral Kenobi.\n\n"
+	if got := SRT(segments); got != want {
+		t.Errorf("SRT() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestVTT(t *testing.T) {
+	want := "WEBVTT\n\n" +
+		"00:00:00.000 --> 00:00:02.500\n<v Speaker 1>Hello there.\n\n" +
+		"00:00:02.500 --> 01:02:05.042\nGeneral Kenobi.\n\n"
+	if got := VTT(segments); got != want {
+		t.Errorf("VTT() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestFromSeconds(t *testing.T) {
+	if got := FromSeconds(1.2345); got != 1235*time.Millisecond {
+		t.Errorf("FromSeconds(1.2345) = %v", got)
+	}
+}
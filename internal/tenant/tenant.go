@@ -0,0 +1,100 @@
+// Package tenant keeps the output files of sessions or clients sharing a
+// server in separate directories and measures the space they use.
+package tenant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Subdir is the subdirectory of the output directory holding the directories
+// of tenants.
+const Subdir = "tenants"
+
+// Dir returns the directory of the tenant id inside root. IDs are made safe
+// as directory names; if that changes them, a hash of the ID is appended so
+// that different IDs never share a directory.
+func Dir(root, id string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if name != id || strings.Trim(name, ".") == "" {
+		sum := sha256.Sum256([]byte(id))
+		name += "-" + hex.EncodeToString(sum[:6])
+	}
+	return filepath.Join(root, Subdir, name)
+}
+
+// File is an output file of a tenant.
+type File struct {
+	// Path is relative to the directory of the tenant, with slashes.
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Files returns the regular files in dir and its subdirectories, newest
+// first. Names in skip, relative to dir, are left out. A missing directory
+// has no files.
+func Files(dir string, skip ...string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(skip, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	slices.SortFunc(files, func(a, b File) int {
+		if c := b.ModTime.Compare(a.ModTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return files, err
+}
+
+// Usage returns the total size of the files in dir, leaving out the
+// entries named by skip as Files does.
+func Usage(dir string, skip ...string) (int64, error) {
+	files, err := Files(dir, skip...)
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	return total, err
+}
@@ -0,0 +1,51 @@
+package tenant
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir(t *testing.T) {
+	if got, want := Dir("/out", "token-alice"), filepath.Join("/out", "tenants", "token-alice"); got != want {
+		t.Errorf("Dir() = %q, want %q", got, want)
+	}
+	for _, id := range []string{"token-a/b", "..", "token-a:b"} {
+		dir := Dir("/out", id)
+		if filepath.Dir(dir) != filepath.Join("/out", "tenants") || !strings.Contains(filepath.Base(dir), "-") {
+			t.Errorf("Dir(%q) = %q", id, dir)
+		}
+	}
+	if Dir("/out", "token-a/b") == Dir("/out", "token-a_b") {
+		t.Error("different IDs share a directory")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"old.png", "sub/new.png", "ledger.jsonl"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	files, err := Files(dir, "ledger.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Path != "sub/new.png" || files[1].Path != "old.png" {
+		t.Errorf("Files() = %+v", files)
+	}
+	if used, err := Usage(dir); err != nil || used != 6 {
+		t.Errorf("Usage() = %d, %v, want 6", used, err)
+	}
+	if files, err := Files(filepath.Join(dir, "missing")); err != nil || len(files) != 0 {
+		t.Errorf("Files() of a missing directory = %v, %v", files, err)
+	}
+}
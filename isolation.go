@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/session"
+	"gemini-mcp/internal/tenant"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// outputScheme is the URI scheme of output files exposed as resources, such
+// as output:///image_20250601_120000_0.png. Paths are relative to the output
+// directory of the caller.
+const outputScheme = "output"
+
+// outputPageSize is the number of output files listed per resources/list page.
+const outputPageSize = 100
+
+// connectionKey is the context key of the ID of an SSE connection, as the SDK
+// does not give SSE sessions IDs.
+type connectionKey struct{}
+
+// outputDirKey is the context key of the output directory of a tool call.
+type outputDirKey struct{}
+
+// tenantKey is the context key of the tenant ID of a tool call, if outputs are
+// isolated.
+type tenantKey struct{}
+
+// isolated reports whether outputs are separated by session or tenant.
+func (s *Server) isolated() bool {
+	return s.config.Isolation != "" && s.config.Isolation != config.IsolationNone
+}
+
+// tenantID identifies the owner of the outputs of a request: the client of
+// its bearer token in tenant mode, and otherwise its MCP session. Callers of
+// the stdio transport share the ID "local".
+func (s *Server) tenantID(ctx context.Context, sess *mcp.ServerSession, extra *mcp.RequestExtra) string {
+	if s.config.Isolation == config.IsolationTenant && extra != nil && extra.TokenInfo != nil {
+		if id, ok := extra.TokenInfo.Extra["client_id"].(string); ok && id != "" {
+			return "token-" + id
+		}
+	}
+	if id, ok := ctx.Value(connectionKey{}).(string); ok {
+		return "session-" + id
+	}
+	if sess != nil && sess.ID() != "" {
+		return "session-" + sess.ID()
+	}
+	return "local"
+}
+
+// outputSpace returns the directory holding the outputs of a request: a
+// subdirectory of OUTPUT_DIR for its session or tenant if outputs are
+// isolated, and OUTPUT_DIR itself otherwise.
+func (s *Server) outputSpace(ctx context.Context, sess *mcp.ServerSession, extra *mcp.RequestExtra) string {
+	if !s.isolated() {
+		return s.config.OutputDir
+	}
+	return tenant.Dir(s.config.OutputDir, s.tenantID(ctx, sess, extra))
+}
+
+// outputDir returns the directory tools save files in when no
+// output_directory is given.
+func (s *Server) outputDir(ctx context.Context) string {
+	if dir, ok := ctx.Value(outputDirKey{}).(string); ok {
+		return dir
+	}
+	return s.config.OutputDir
+}
+
+// ownsSession reports whether the caller of ctx may use an image session,
+// which is the case if the session saves its images in the caller's output
+// directory. Without isolation, every session may be used.
+func (s *Server) ownsSession(ctx context.Context, sess *session.Session) bool {
+	if !s.isolated() {
+		return true
+	}
+	space, err := sandbox.Resolve(s.outputDir(ctx))
+	if err != nil {
+		return false
+	}
+	dir, err := sandbox.Resolve(sess.OutputDirectory)
+	return err == nil && sandbox.Within(dir, []string{space})
+}
+
+// isolationMiddleware passes the output directory of the caller on to tool
+// calls, refuses billed calls once the caller's files fill its quota, and
+// lists the caller's output files as resources.
+func (s *Server) isolationMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		switch r := req.(type) {
+		case *mcp.CallToolRequest:
+			if !s.isolated() || r.Params == nil {
+				break
+			}
+			space := s.outputSpace(ctx, r.Session, r.Extra)
+			ctx = context.WithValue(ctx, outputDirKey{}, space)
+			ctx = context.WithValue(ctx, tenantKey{}, s.tenantID(ctx, r.Session, r.Extra))
+
+			if s.config.TenantQuotaBytes > 0 && isBilledTool(r.Params.Name) && !isDryRun(r) {
+				used, err := tenant.Usage(space, cas.Dir)
+				if err != nil {
+					log.Printf("Error measuring %s: %v", space, err)
+				} else if used >= s.config.TenantQuotaBytes {
+					err := fmt.Errorf("output files use %d bytes of the quota of %d bytes; delete some to generate more", used, s.config.TenantQuotaBytes)
+					log.Printf("Refusing %s for %s: %v", r.Params.Name, s.tenantID(ctx, r.Session, r.Extra), err)
+					return &mcp.CallToolResult{
+						IsError:           true,
+						Content:           []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+						StructuredContent: map[string]any{"error": ToolError{Kind: retry.KindQuota, Message: err.Error()}},
+					}, nil
+				}
+			}
+
+		case *mcp.ListResourcesRequest:
+			return s.listOutputs(ctx, r)
+		}
+		return next(ctx, method, req)
+	}
+}
+
+// hiddenOutputs are the entries of OUTPUT_DIR that are not output files.
+var hiddenOutputs = []string{ledgerFile, tenant.Subdir, cas.Dir, index.Filename, pinsFile}
+
+// listOutputs lists the output files of the caller, newest first.
+func (s *Server) listOutputs(ctx context.Context, req *mcp.ListResourcesRequest) (*mcp.ListResourcesResult, error) {
+	space := s.outputSpace(ctx, req.Session, req.Extra)
+	files, err := tenant.Files(space, hiddenOutputs...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing output files: %w", err)
+	}
+
+	start := 0
+	if req.Params != nil && req.Params.Cursor != "" {
+		if start, err = strconv.Atoi(req.Params.Cursor); err != nil || start < 0 || start > len(files) {
+			return nil, fmt.Errorf("invalid cursor %q", req.Params.Cursor)
+		}
+	}
+	end := min(start+outputPageSize, len(files))
+
+	result := &mcp.ListResourcesResult{Resources: []*mcp.Resource{}}
+	for _, f := range files[start:end] {
+		result.Resources = append(result.Resources, &mcp.Resource{
+			URI:      outputURI(f.Path),
+			Name:     f.Path,
+			MIMEType: mime.TypeByExtension(filepath.Ext(f.Path)),
+			Size:     f.Size,
+		})
+	}
+	if end < len(files) {
+		result.NextCursor = strconv.Itoa(end)
+	}
+	return result, nil
+}
+
+// outputURI returns the resource URI of an output file.
+func outputURI(path string) string {
+	return (&url.URL{Scheme: outputScheme, Path: "/" + path}).String()
+}
+
+// readOutput reads an output file of the caller. Files of other sessions or
+// tenants are reported as not found.
+func (s *Server) readOutput(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != outputScheme {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+
+	space, err := sandbox.Resolve(s.outputSpace(ctx, req.Session, req.Extra))
+	if err != nil {
+		return nil, err
+	}
+	path, err := sandbox.Resolve(filepath.Join(space, filepath.FromSlash(u.Path)))
+	if err != nil || !sandbox.Within(path, []string{space}) {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	rel, _ := filepath.Rel(space, path)
+	for _, hidden := range hiddenOutputs {
+		if sandbox.Within(path, []string{filepath.Join(space, hidden)}) {
+			return nil, mcp.ResourceNotFoundError(uri)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", rel, err)
+	}
+
+	contents := &mcp.ResourceContents{URI: uri, MIMEType: mime.TypeByExtension(filepath.Ext(path))}
+	if strings.HasPrefix(contents.MIMEType, "text/") || strings.HasPrefix(contents.MIMEType, "application/json") {
+		contents.Text = string(data)
+	} else {
+		contents.Blob = data
+	}
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{contents}}, nil
+}
+
+// registerOutputResources exposes output files as resources.
+func (s *Server) registerOutputResources(server *mcp.Server) {
+	server.AddResourceTemplate(&mcp.ResourceTemplate{
+		URITemplate: outputScheme + ":///{+path}",
+		Name:        "output",
+		Title:       "Output files",
+		Description: "Files saved by the tools, by path relative to the output directory. If outputs are isolated, each session or client sees only its own files.",
+	}, s.readOutput)
+}
+
+// newConnectionID returns a random ID for an SSE connection.
+func newConnectionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
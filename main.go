@@ -6,22 +6,42 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"gemini-mcp/internal/common"
+	"gemini-mcp/internal/auth"
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/embedding"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/ledger"
+	"gemini-mcp/internal/models"
+	"gemini-mcp/internal/pricing"
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/scheduler"
+	"gemini-mcp/internal/session"
+	"gemini-mcp/internal/storage"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 	"google.golang.org/genai"
 )
 
 var (
-	transport   = flag.String("transport", "", "Transport type (stdio, http, or sse)")
 	showVersion = flag.Bool("version", false, "Show version information")
+	configPath  = flag.String("config", "", "Path to a YAML configuration file")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration, with secrets redacted, and exit")
 )
 
+func init() {
+	// Every setting can also be given as a flag, such as -output-dir
+	config.DefineFlags(flag.CommandLine)
+}
+
 // Version information - these will be set during build
 var (
 	version   = "dev"
@@ -34,8 +54,30 @@ const (
 )
 
 type Server struct {
-	config *common.Config
-	client *genai.Client
+	config    *config.Config
+	client    *genai.Client
+	sessions  *session.Store
+	prices    pricing.Table
+	ledger    *ledger.Ledger
+	scheduler *scheduler.Scheduler
+	catalog   *models.Catalog
+	sandbox   *sandbox.Sandbox
+	storage   storage.Storage
+	auth      *auth.Authenticator
+
+	// running tracks the files of tool calls in progress, and outputsMu
+	// serializes pruning and changes to pinned files
+	running   runningCalls
+	outputsMu sync.Mutex
+
+	// indexes holds the open output indexes by directory
+	indexMu sync.Mutex
+	indexes map[string]*index.Index
+
+	// embeddings captions and embeds generations if EMBEDDINGS is set, and
+	// embedding tracks those in progress
+	embeddings embedding.Backend
+	embedding  sync.WaitGroup
 }
 
 // Input types for tools
@@ -50,20 +92,25 @@ type GeminiImageGenerationInput struct {
 	IncludeText     bool     `json:"include_text,omitempty" jsonschema:"description:Whether to include high-fidelity text rendering in the image. Enable for images that need clear text elements.,default:false"`
 	Tags            []string `json:"tags,omitempty" jsonschema:"description:Optional tags to help categorize or describe the generated image"`
 	OutputDirectory string   `json:"output_directory,omitempty" jsonschema:"description:Optional. Local directory path where the generated image and metadata will be saved. If not provided, files will be saved to the default output directory."`
+	CacheName       string   `json:"cache_name,omitempty" jsonschema:"description:Optional context cache (name or display name from cache_create) holding reference images and instructions to apply. The model defaults to the cache's model."`
+	DryRun          bool     `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 type GeminiImageGenerationOutput struct {
 	Description   string            `json:"description"`
 	Model         string            `json:"model"`
+	FallbackFrom  string            `json:"fallback_from,omitempty"`
 	Style         string            `json:"style,omitempty"`
 	AspectRatio   string            `json:"aspect_ratio,omitempty"`
 	Quality       string            `json:"quality,omitempty"`
 	Language      string            `json:"language,omitempty"`
 	Tags          []string          `json:"tags,omitempty"`
 	SavedFiles    []string          `json:"saved_files,omitempty"`
+	StoredFiles   []storage.Object  `json:"stored_files,omitempty"`
 	Metadata      map[string]string `json:"metadata,omitempty"`
 	GeneratedAt   string            `json:"generated_at"`
 	ImagesCreated int               `json:"images_created"`
+	DryRun        *DryRun           `json:"dry_run,omitempty"`
 }
 
 type GeminiImageEditInput struct {
@@ -74,7 +121,10 @@ type GeminiImageEditInput struct {
 	PreserveStyle   bool   `json:"preserve_style,omitempty" jsonschema:"description:Whether to preserve the original image style during editing,default:true"`
 	EditType        string `json:"edit_type,omitempty" jsonschema:"description:Type of edit: 'modify' (change elements), 'add' (add new elements), 'remove' (remove elements), 'style' (change style),default:modify"`
 	MaskArea        string `json:"mask_area,omitempty" jsonschema:"description:Specific area to focus edits on (e.g., 'background', 'foreground', 'top-left', 'center')"`
+	MaskImagePath   string `json:"mask_image_path,omitempty" jsonschema:"description:Optional path to a mask image, such as one saved by gemini_image_detect in segment mode. Only the white region of the mask is edited."`
+	CacheName       string `json:"cache_name,omitempty" jsonschema:"description:Optional context cache (name or display name from cache_create) holding reference images and instructions to apply. The model defaults to the cache's model."`
 	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Optional. Local directory path where the edited image will be saved."`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 type GeminiImageEditOutput struct {
@@ -83,9 +133,12 @@ type GeminiImageEditOutput struct {
 	EditType      string            `json:"edit_type"`
 	AspectRatio   string            `json:"aspect_ratio,omitempty"`
 	Model         string            `json:"model"`
+	FallbackFrom  string            `json:"fallback_from,omitempty"`
 	SavedFiles    []string          `json:"saved_files,omitempty"`
+	StoredFiles   []storage.Object  `json:"stored_files,omitempty"`
 	Metadata      map[string]string `json:"metadata,omitempty"`
 	GeneratedAt   string            `json:"generated_at"`
+	DryRun        *DryRun           `json:"dry_run,omitempty"`
 }
 
 type GeminiMultiImageInput struct {
@@ -96,6 +149,7 @@ type GeminiMultiImageInput struct {
 	BlendMode       string   `json:"blend_mode,omitempty" jsonschema:"description:How to blend images: 'merge', 'collage', 'overlay', 'sequence',default:merge"`
 	OutputStyle     string   `json:"output_style,omitempty" jsonschema:"description:Style for the combined image: 'photorealistic', 'artistic', 'seamless'"`
 	OutputDirectory string   `json:"output_directory,omitempty" jsonschema:"description:Optional. Local directory path where the combined image will be saved."`
+	DryRun          bool     `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 type GeminiMultiImageOutput struct {
@@ -104,10 +158,13 @@ type GeminiMultiImageOutput struct {
 	BlendMode       string            `json:"blend_mode"`
 	AspectRatio     string            `json:"aspect_ratio,omitempty"`
 	Model           string            `json:"model"`
+	FallbackFrom    string            `json:"fallback_from,omitempty"`
 	SavedFiles      []string          `json:"saved_files,omitempty"`
+	StoredFiles     []storage.Object  `json:"stored_files,omitempty"`
 	Metadata        map[string]string `json:"metadata,omitempty"`
 	GeneratedAt     string            `json:"generated_at"`
 	ImagesProcessed int               `json:"images_processed"`
+	DryRun          *DryRun           `json:"dry_run,omitempty"`
 }
 
 type ImagenGenerationInput struct {
@@ -116,12 +173,16 @@ type ImagenGenerationInput struct {
 	NumImages       int    `json:"num_images,omitempty" jsonschema:"description:Number of images to generate in a single request (1-4),default:1"`
 	AspectRatio     string `json:"aspect_ratio,omitempty" jsonschema:"description:Aspect ratio for generated images,default:1:1,enum:1:1,enum:16:9,enum:9:16,enum:4:3,enum:3:4"`
 	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Optional local directory path where generated images will be saved as PNG files"`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 type ImagenGenerationOutput struct {
-	ImagesGenerated int      `json:"images_generated"`
-	Model           string   `json:"model"`
-	SavedFiles      []string `json:"saved_files,omitempty"`
+	ImagesGenerated int              `json:"images_generated"`
+	Model           string           `json:"model"`
+	FallbackFrom    string           `json:"fallback_from,omitempty"`
+	SavedFiles      []string         `json:"saved_files,omitempty"`
+	StoredFiles     []storage.Object `json:"stored_files,omitempty"`
+	DryRun          *DryRun          `json:"dry_run,omitempty"`
 }
 
 // Text-to-Video Generation
@@ -133,6 +194,7 @@ type VeoTextToVideoInput struct {
 	Model           string `json:"model,omitempty" jsonschema:"description:Veo model version to use,default:veo-3.0-generate-001,enum:veo-3.0-generate-001,enum:veo-3.0-fast-generate-001,enum:veo-2.0-generate-001"`
 	Seed            int    `json:"seed,omitempty" jsonschema:"description:Optional seed value for slight reproducibility in generation"`
 	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Local directory path where the 8-second MP4 video will be saved. Videos have 2-day retention on server and include SynthID watermark."`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 // Image-to-Video Generation
@@ -145,6 +207,7 @@ type VeoImageToVideoInput struct {
 	Model           string `json:"model,omitempty" jsonschema:"description:Veo model version to use,default:veo-3.0-generate-001,enum:veo-3.0-generate-001,enum:veo-3.0-fast-generate-001,enum:veo-2.0-generate-001"`
 	Seed            int    `json:"seed,omitempty" jsonschema:"description:Optional seed value for slight reproducibility in generation"`
 	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Local directory path where the 8-second MP4 video will be saved. Videos have 2-day retention on server and include SynthID watermark."`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 // Legacy input type for backward compatibility
@@ -157,6 +220,7 @@ type VeoGenerationInput struct {
 	ImagePath       string `json:"image_path,omitempty" jsonschema:"description:Optional path to initial image file to animate as the starting frame of the video"`
 	Seed            int    `json:"seed,omitempty" jsonschema:"description:Optional seed value for slight reproducibility in generation"`
 	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Local directory path where the 8-second MP4 video will be saved. Videos have 2-day retention on server and include SynthID watermark."`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API,default:false"`
 }
 
 type VeoGenerationOutput struct {
@@ -164,12 +228,15 @@ type VeoGenerationOutput struct {
 	Status          string            `json:"status"`
 	VideoURL        string            `json:"video_url,omitempty"`
 	SavedFiles      []string          `json:"saved_files,omitempty"`
+	StoredFiles     []storage.Object  `json:"stored_files,omitempty"`
 	Model           string            `json:"model"`
+	FallbackFrom    string            `json:"fallback_from,omitempty"`
 	AspectRatio     string            `json:"aspect_ratio"`
 	Resolution      string            `json:"resolution"`
 	Metadata        map[string]string `json:"metadata,omitempty"`
 	GeneratedAt     string            `json:"generated_at"`
 	EstimatedLength string            `json:"estimated_length"`
+	DryRun          *DryRun           `json:"dry_run,omitempty"`
 }
 
 func main() {
@@ -184,21 +251,35 @@ func main() {
 	}
 
 	// Load configuration
-	config := common.LoadConfig()
-	if err := config.Validate(); err != nil {
+	cfg, err := config.Load(*configPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "\nConfiguration error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := cfg.Validate(); err != nil {
 		log.Fatalf("Configuration error: %v", err)
 	}
 
-	// Override transport if specified via flag
-	if *transport != "" {
-		config.Transport = *transport
+	// Create output directory if it doesn't exist
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
 	}
 
 	// Create Gemini client
 	ctx := context.Background()
 	clientConfig := &genai.ClientConfig{
-		APIKey:  config.APIKey,
-		Backend: genai.BackendGeminiAPI,
+		APIKey:     cfg.APIKey,
+		Backend:    genai.BackendGeminiAPI,
+		HTTPClient: &http.Client{Transport: &retry.Transport{}},
 	}
 
 	client, err := genai.NewClient(ctx, clientConfig)
@@ -206,21 +287,103 @@ func main() {
 		log.Fatalf("Failed to create Gemini client: %v", err)
 	}
 
+	prices, err := pricing.LoadTable(cfg.PriceTablePath)
+	if err != nil {
+		log.Fatalf("Failed to load price table: %v", err)
+	}
+
+	ledgerPath := ""
+	if cfg.OutputDir != "" {
+		ledgerPath = filepath.Join(cfg.OutputDir, ledgerFile)
+	}
+	usageLedger, err := ledger.Open(ledgerPath, ledger.Limits{
+		DailyUSD:         cfg.BudgetDailyUSD,
+		MonthlyUSD:       cfg.BudgetMonthlyUSD,
+		ClientDailyUSD:   cfg.BudgetClientDailyUSD,
+		ClientMonthlyUSD: cfg.BudgetClientMonthlyUSD,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open usage ledger: %v", err)
+	}
+
+	// Generated files are saved in OUTPUT_DIR, so it is always allowed
+	readRoots, writeRoots := cfg.AllowedReadRoots, cfg.AllowedWriteRoots
+	if len(readRoots) > 0 {
+		readRoots = append(readRoots, cfg.OutputDir)
+	}
+	if len(writeRoots) > 0 {
+		writeRoots = append(writeRoots, cfg.OutputDir)
+	}
+	fileSandbox, err := sandbox.New(readRoots, writeRoots)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if cfg.Transport != "stdio" && len(readRoots) == 0 {
+		log.Printf("Warning: ALLOWED_READ_ROOTS is not set, so clients can read any file the server can")
+	}
+
+	fileStorage, err := newStorage(cfg)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
 	server := &Server{
-		config: config,
-		client: client,
+		config:   cfg,
+		client:   client,
+		sessions: session.NewStore(cfg.ImageSessionTTL, cfg.ImageSessionMax),
+		prices:   prices,
+		ledger:   usageLedger,
+		scheduler: scheduler.New(map[string]scheduler.Limit{
+			scheduler.FamilyGemini: {Concurrency: cfg.GeminiConcurrency, RPM: cfg.GeminiRPM},
+			scheduler.FamilyImagen: {Concurrency: cfg.ImagenConcurrency, RPM: cfg.ImagenRPM},
+			scheduler.FamilyVeo:    {Concurrency: cfg.VeoConcurrency, RPM: cfg.VeoRPM},
+		}),
+		sandbox: fileSandbox,
+		storage: fileStorage,
+	}
+
+	if cfg.Auth.Enabled() {
+		if server.auth, err = auth.New(cfg.Auth); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+	}
+
+	server.catalog = models.NewCatalog(server.listModels, modelListTTL)
+	if cfg.ValidateModels {
+		// Fetch the model list in the background so the first call does not wait
+		go func() {
+			if _, err := server.catalog.Models(ctx, false); err != nil {
+				log.Printf("Failed to fetch model list: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Embeddings {
+		server.embeddings = geminiEmbeddings{s: server}
+	}
+
+	if server.retentionPolicy().Active() {
+		// Delete old output files in the background
+		go server.runJanitor(ctx)
 	}
 
 	// Create MCP server
-	mcpServer := mcp.NewServer(&mcp.Implementation{
-		Name:    serviceName,
-		Version: version,
-	}, nil)
+	mcpServer, err := server.newMCPServer(ctx)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
 
-	// Register tools
-	server.registerTools(mcpServer)
+	log.Printf("Starting %s v%s (Transport: %s)", serviceName, version, cfg.Transport)
 
-	log.Printf("Starting %s v%s (Transport: %s)", serviceName, version, config.Transport)
+	if cfg.Transport != "stdio" {
+		if err := server.serveHTTP(ctx, mcpServer); err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		return
+	}
+	if server.auth != nil {
+		log.Printf("Auth applies to the HTTP and SSE transports only")
+	}
 
 	// Run server with stdio transport
 	if err := mcpServer.Run(ctx, &mcp.StdioTransport{}); err != nil {
@@ -229,48 +392,107 @@ func main() {
 }
 
 func (s *Server) registerTools(server *mcp.Server) {
+	// Report classified API errors as structured tool errors
+	server.AddReceivingMiddleware(s.errorMiddleware)
+
 	// Register gemini_image_generation tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "gemini_image_generation",
 		Description: "Generate high-quality images using Google's latest Gemini image generation models. Supports text-to-image generation with advanced style control, quality settings, and multi-language prompts. Features include customizable aspect ratios, artistic styles, content safety levels, and high-fidelity text rendering.",
 	}, s.handleGeminiImageGeneration)
 
 	// Register gemini_image_edit tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "gemini_image_edit",
 		Description: "Edit existing images using Google's Gemini AI models. Supports targeted image modifications, style transfers, object addition/removal, and background changes. Provides precise control over edit types and can preserve original image characteristics while making specific alterations.",
 	}, s.handleGeminiImageEdit)
 
 	// Register gemini_multi_image tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "gemini_multi_image",
 		Description: "Combine and blend multiple images using Google's Gemini AI models. Supports merging 2-3 images into cohesive compositions, creating collages, overlays, and seamless blends. Ideal for character consistency across scenes, style unification, and creative image compositions.",
 	}, s.handleGeminiMultiImage)
 
 	// Register imagen_t2i tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "imagen_t2i",
 		Description: "Generate high-quality images using Google's state-of-the-art Imagen models via Gemini API. Imagen is Google's advanced text-to-image diffusion model capable of creating photorealistic and artistic images from detailed text descriptions. This tool supports multiple Imagen model variants optimized for different use cases, from fast generation to ultra-high quality output.",
 	}, s.handleImagenGeneration)
 
 	// Register veo_text_to_video tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "veo_text_to_video",
 		Description: "Generate 8-second videos from text prompts using Google's Veo 3.0 models. Create videos with detailed scene descriptions, camera movements, and realistic physics. Supports 16:9/9:16 aspect ratios, 720p/1080p resolution, negative prompts, and includes SynthID watermarking.",
 	}, s.handleVeoTextToVideo)
 
 	// Register veo_image_to_video tool
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "veo_image_to_video",
 		Description: "Animate static images into 8-second videos using Google's Veo 3.0 models. Transform photos into dynamic scenes with natural motion, camera movements, and realistic physics. Input image becomes the starting frame of the generated video.",
 	}, s.handleVeoImageToVideo)
 
 	// Register veo_generate_video tool (legacy)
-	mcp.AddTool(server, &mcp.Tool{
+	addTool(server, &mcp.Tool{
 		Name:        "veo_generate_video",
 		Description: "Generate high-quality 8-second videos using Google's Veo 3.0 video generation models. Supports both text-to-video and image-to-video creation with advanced scene composition, camera movements, and realistic physics. Features include 16:9 and 9:16 aspect ratios, 720p/1080p resolution, negative prompts for content exclusion, and automatic operation polling with video URL retrieval.",
 	}, s.handleVeoGeneration)
 
+	// Register image editing session tools
+	s.registerSessionTools(server)
+
+	// Register image and media understanding tools
+	s.registerAnalysisTools(server)
+
+	// Register Files API management tools
+	s.registerFileTools(server)
+
+	// Register context cache tools
+	s.registerCacheTools(server)
+
+	// Register text generation tools
+	s.registerTextTools(server)
+
+	// Register cost estimation tools
+	s.registerCostTools(server)
+
+	// Register usage tracking and budget tools
+	s.registerUsageTools(server)
+
+	// Register model discovery tools
+	s.registerModelTools(server)
+
+	// Register content-addressed output tools
+	s.registerContentTools(server)
+
+	// Register retention tools
+	s.registerRetentionTools(server)
+
+	// Register output index tools
+	s.registerIndexTools(server)
+
+	// Register similarity search tools
+	s.registerSimilarTools(server)
+
+	// Register remix tool
+	s.registerRemixTools(server)
+
+	// Register output files as resources
+	s.registerOutputResources(server)
+
+	// Confine file arguments to the allowed roots
+	server.AddReceivingMiddleware(s.sandboxMiddleware)
+
+	// Separate the outputs of sessions or tenants
+	server.AddReceivingMiddleware(s.isolationMiddleware)
+
+	// Apply configured tool defaults and model aliases
+	server.AddReceivingMiddleware(s.toolConfigMiddleware)
+
+	// Turn remix calls into calls of the tools they replay
+	server.AddReceivingMiddleware(s.remixMiddleware)
+
+	// Check tool calls against the scopes of bearer tokens
+	server.AddReceivingMiddleware(s.authMiddleware)
 }
 
 func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageGenerationInput) (*mcp.CallToolResult, GeminiImageGenerationOutput, error) {
@@ -279,7 +501,10 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 	}
 
 	// Set defaults
-	model := input.Model
+	config, model, err := s.cachedContentConfig(ctx, input.CacheName, input.Model, true)
+	if err != nil {
+		return nil, GeminiImageGenerationOutput{}, err
+	}
 	if model == "" {
 		model = "gemini-2.5-flash-image-preview"
 	}
@@ -323,11 +548,33 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 
 	promptText := strings.Join(promptParts, ". ")
 	contents := genai.Text(promptText)
-	response, err := s.client.Models.GenerateContent(ctx, model, contents, nil)
+
+	if input.DryRun {
+		dryRun, err := s.dryRunContent(ctx, model, nil, promptText, config, nil, 0)
+		if err != nil {
+			return nil, GeminiImageGenerationOutput{}, err
+		}
+		return nil, GeminiImageGenerationOutput{
+			Description: "Dry run: no image was generated",
+			Model:       model,
+			Style:       style,
+			AspectRatio: input.AspectRatio,
+			Quality:     quality,
+			Language:    language,
+			Tags:        input.Tags,
+			GeneratedAt: time.Now().Format("20060102_150405"),
+			DryRun:      dryRun,
+		}, nil
+	}
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
 	if err != nil {
-		return nil, GeminiImageGenerationOutput{}, fmt.Errorf("error generating content: %v", err)
+		return nil, GeminiImageGenerationOutput{}, fmt.Errorf("error generating content: %w", err)
 	}
 
+	s.recordUsage(ctx, contentUsage(model, response))
+
 	if response == nil || len(response.Candidates) == 0 {
 		return nil, GeminiImageGenerationOutput{}, fmt.Errorf("no content was generated")
 	}
@@ -355,7 +602,7 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 				// Save to local directory if specified, or use default output directory
 				outputDir := input.OutputDirectory
 				if outputDir == "" {
-					outputDir = s.config.OutputDir
+					outputDir = s.outputDir(ctx)
 				}
 
 				if outputDir != "" {
@@ -363,7 +610,7 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 						filename := fmt.Sprintf("gemini_generated_%s_%s_%d.png", style, timestamp, i)
 						outputPath := filepath.Join(outputDir, filename)
 
-						if err := os.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
+						if err := cas.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
 							savedFiles = append(savedFiles, outputPath)
 							log.Printf("Saved generated image to: %s", outputPath)
 						}
@@ -404,10 +651,16 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 				"tags":            input.Tags,
 				"generated_at":    timestamp,
 				"images_created":  imagesCreated,
+				"run_id":          runID(ctx),
+				"outputs":         fileHashes(savedFiles...),
+			}
+
+			if parent := parentRunID(ctx); parent != "" {
+				metadataContent["parent_run_id"] = parent
 			}
 
 			if jsonData, err := json.MarshalIndent(metadataContent, "", "  "); err == nil {
-				if err := os.WriteFile(outputPath, jsonData, 0644); err == nil {
+				if err := cas.WriteFile(outputPath, jsonData, 0644); err == nil {
 					savedFiles = append(savedFiles, outputPath)
 				}
 			}
@@ -417,12 +670,14 @@ func (s *Server) handleGeminiImageGeneration(ctx context.Context, req *mcp.CallT
 	return nil, GeminiImageGenerationOutput{
 		Description:   resultText,
 		Model:         model,
+		FallbackFrom:  fallbackFrom(requestedModel, model),
 		Style:         style,
 		AspectRatio:   input.AspectRatio,
 		Quality:       quality,
 		Language:      language,
 		Tags:          input.Tags,
 		SavedFiles:    savedFiles,
+		StoredFiles:   s.storeFiles(ctx, savedFiles),
 		Metadata:      metadata,
 		GeneratedAt:   timestamp,
 		ImagesCreated: imagesCreated,
@@ -437,7 +692,10 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 		return nil, GeminiImageEditOutput{}, fmt.Errorf("edit_prompt is required")
 	}
 
-	model := input.Model
+	config, model, err := s.cachedContentConfig(ctx, input.CacheName, input.Model, true)
+	if err != nil {
+		return nil, GeminiImageEditOutput{}, err
+	}
 	if model == "" {
 		model = "gemini-2.5-flash-image-preview"
 	}
@@ -449,12 +707,6 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 
 	log.Printf("Editing image %s with model %s: %s", input.InputImagePath, model, input.EditPrompt)
 
-	// Read input image
-	imgData, err := os.ReadFile(input.InputImagePath)
-	if err != nil {
-		return nil, GeminiImageEditOutput{}, fmt.Errorf("failed to read input image: %v", err)
-	}
-
 	// Build edit prompt with instructions
 	var promptParts []string
 	promptParts = append(promptParts, input.EditPrompt)
@@ -471,6 +723,10 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 		promptParts = append(promptParts, fmt.Sprintf("Focus changes on the %s area", input.MaskArea))
 	}
 
+	if input.MaskImagePath != "" {
+		promptParts = append(promptParts, "The second image is a mask: only change the region that is white in the mask and leave everything else unchanged")
+	}
+
 	switch editType {
 	case "add":
 		promptParts = append(promptParts, "Add the requested elements to the image")
@@ -484,26 +740,54 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 
 	promptText := strings.Join(promptParts, ". ")
 
+	if input.DryRun {
+		paths := []string{input.InputImagePath}
+		if input.MaskImagePath != "" {
+			paths = append(paths, input.MaskImagePath)
+		}
+		dryRun, err := s.dryRunContent(ctx, model, nil, promptText, config, paths, 0)
+		if err != nil {
+			return nil, GeminiImageEditOutput{}, err
+		}
+		return nil, GeminiImageEditOutput{
+			OriginalImage: input.InputImagePath,
+			EditType:      editType,
+			AspectRatio:   input.AspectRatio,
+			Model:         model,
+			GeneratedAt:   time.Now().Format("20060102_150405"),
+			DryRun:        dryRun,
+		}, nil
+	}
+
+	// Read input image
+	imageParts, err := s.mediaParts(ctx, []string{input.InputImagePath})
+	if err != nil {
+		return nil, GeminiImageEditOutput{}, err
+	}
+
 	// Create content parts with image and text
-	parts := []*genai.Part{
-		genai.NewPartFromText(promptText),
-		&genai.Part{
-			InlineData: &genai.Blob{
-				MIMEType: "image/png",
-				Data:     imgData,
-			},
-		},
+	parts := append([]*genai.Part{genai.NewPartFromText(promptText)}, imageParts...)
+
+	if input.MaskImagePath != "" {
+		maskParts, err := s.mediaParts(ctx, []string{input.MaskImagePath})
+		if err != nil {
+			return nil, GeminiImageEditOutput{}, fmt.Errorf("failed to read mask image: %v", err)
+		}
+		parts = append(parts, maskParts...)
 	}
 
 	contents := []*genai.Content{
 		genai.NewContentFromParts(parts, genai.RoleUser),
 	}
 
-	response, err := s.client.Models.GenerateContent(ctx, model, contents, nil)
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
 	if err != nil {
-		return nil, GeminiImageEditOutput{}, fmt.Errorf("error editing image: %v", err)
+		return nil, GeminiImageEditOutput{}, fmt.Errorf("error editing image: %w", err)
 	}
 
+	s.recordUsage(ctx, contentUsage(model, response))
+
 	if response == nil || len(response.Candidates) == 0 {
 		return nil, GeminiImageEditOutput{}, fmt.Errorf("no edited content was generated")
 	}
@@ -523,7 +807,7 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 				// Save edited image
 				outputDir := input.OutputDirectory
 				if outputDir == "" {
-					outputDir = s.config.OutputDir
+					outputDir = s.outputDir(ctx)
 				}
 
 				if outputDir != "" {
@@ -531,7 +815,7 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 						filename := fmt.Sprintf("gemini_edited_%s_%s_%d.png", editType, timestamp, i)
 						outputPath := filepath.Join(outputDir, filename)
 
-						if err := os.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
+						if err := cas.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
 							savedFiles = append(savedFiles, outputPath)
 							editedImagePath = outputPath
 							log.Printf("Saved edited image to: %s", outputPath)
@@ -552,13 +836,19 @@ func (s *Server) handleGeminiImageEdit(ctx context.Context, req *mcp.CallToolReq
 		"mask_area":      input.MaskArea,
 	}
 
+	if input.MaskImagePath != "" {
+		metadata["mask_image"] = input.MaskImagePath
+	}
+
 	return nil, GeminiImageEditOutput{
 		OriginalImage: input.InputImagePath,
 		EditedImage:   editedImagePath,
 		EditType:      editType,
 		AspectRatio:   input.AspectRatio,
 		Model:         model,
+		FallbackFrom:  fallbackFrom(requestedModel, model),
 		SavedFiles:    savedFiles,
+		StoredFiles:   s.storeFiles(ctx, savedFiles),
 		Metadata:      metadata,
 		GeneratedAt:   timestamp,
 	}, nil
@@ -611,32 +901,44 @@ func (s *Server) handleGeminiMultiImage(ctx context.Context, req *mcp.CallToolRe
 	}
 
 	promptText := strings.Join(promptParts, ". ")
-	parts := []*genai.Part{genai.NewPartFromText(promptText)}
 
-	// Add all input images to parts
-	for i, imagePath := range input.InputImagePaths {
-		imgData, err := os.ReadFile(imagePath)
+	if input.DryRun {
+		dryRun, err := s.dryRunContent(ctx, model, nil, promptText, nil, input.InputImagePaths, 0)
 		if err != nil {
-			return nil, GeminiMultiImageOutput{}, fmt.Errorf("failed to read image %d (%s): %v", i+1, imagePath, err)
+			return nil, GeminiMultiImageOutput{}, err
 		}
+		return nil, GeminiMultiImageOutput{
+			InputImages:     input.InputImagePaths,
+			BlendMode:       blendMode,
+			AspectRatio:     input.AspectRatio,
+			Model:           model,
+			GeneratedAt:     time.Now().Format("20060102_150405"),
+			ImagesProcessed: len(input.InputImagePaths),
+			DryRun:          dryRun,
+		}, nil
+	}
+
+	parts := []*genai.Part{genai.NewPartFromText(promptText)}
 
-		parts = append(parts, &genai.Part{
-			InlineData: &genai.Blob{
-				MIMEType: "image/png",
-				Data:     imgData,
-			},
-		})
+	// Add all input images to parts
+	imageParts, err := s.mediaParts(ctx, input.InputImagePaths)
+	if err != nil {
+		return nil, GeminiMultiImageOutput{}, err
 	}
+	parts = append(parts, imageParts...)
 
 	contents := []*genai.Content{
 		genai.NewContentFromParts(parts, genai.RoleUser),
 	}
 
-	response, err := s.client.Models.GenerateContent(ctx, model, contents, nil)
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, nil)
 	if err != nil {
-		return nil, GeminiMultiImageOutput{}, fmt.Errorf("error combining images: %v", err)
+		return nil, GeminiMultiImageOutput{}, fmt.Errorf("error combining images: %w", err)
 	}
 
+	s.recordUsage(ctx, contentUsage(model, response))
+
 	if response == nil || len(response.Candidates) == 0 {
 		return nil, GeminiMultiImageOutput{}, fmt.Errorf("no combined content was generated")
 	}
@@ -656,7 +958,7 @@ func (s *Server) handleGeminiMultiImage(ctx context.Context, req *mcp.CallToolRe
 				// Save combined image
 				outputDir := input.OutputDirectory
 				if outputDir == "" {
-					outputDir = s.config.OutputDir
+					outputDir = s.outputDir(ctx)
 				}
 
 				if outputDir != "" {
@@ -664,7 +966,7 @@ func (s *Server) handleGeminiMultiImage(ctx context.Context, req *mcp.CallToolRe
 						filename := fmt.Sprintf("gemini_combined_%s_%s_%d.png", blendMode, timestamp, i)
 						outputPath := filepath.Join(outputDir, filename)
 
-						if err := os.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
+						if err := cas.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
 							savedFiles = append(savedFiles, outputPath)
 							combinedImagePath = outputPath
 							log.Printf("Saved combined image to: %s", outputPath)
@@ -690,7 +992,9 @@ func (s *Server) handleGeminiMultiImage(ctx context.Context, req *mcp.CallToolRe
 		BlendMode:       blendMode,
 		AspectRatio:     input.AspectRatio,
 		Model:           model,
+		FallbackFrom:    fallbackFrom(requestedModel, model),
 		SavedFiles:      savedFiles,
+		StoredFiles:     s.storeFiles(ctx, savedFiles),
 		Metadata:        metadata,
 		GeneratedAt:     timestamp,
 		ImagesProcessed: len(input.InputImagePaths),
@@ -725,16 +1029,27 @@ func (s *Server) handleImagenGeneration(ctx context.Context, req *mcp.CallToolRe
 		AspectRatio:    aspectRatio,
 	}
 
+	if input.DryRun {
+		estimate := s.prices.Estimate(pricing.Usage{Model: model, Images: numImages})
+		return nil, ImagenGenerationOutput{
+			Model:  model,
+			DryRun: s.dryRun(input.Prompt, config, estimate),
+		}, nil
+	}
+
 	// Generate images using Gemini API
-	response, err := s.client.Models.GenerateImages(ctx, model, input.Prompt, config)
+	requestedModel := model
+	response, model, err := s.generateImages(ctx, requestedModel, input.Prompt, config)
 	if err != nil {
-		return nil, ImagenGenerationOutput{}, fmt.Errorf("error generating images: %v", err)
+		return nil, ImagenGenerationOutput{}, fmt.Errorf("error generating images: %w", err)
 	}
 
 	if response == nil || len(response.GeneratedImages) == 0 {
 		return nil, ImagenGenerationOutput{}, fmt.Errorf("no images were generated")
 	}
 
+	s.recordUsage(ctx, pricing.Usage{Model: model, Images: len(response.GeneratedImages)})
+
 	// Process generated images
 	var savedFiles []string
 	timestamp := time.Now().Format("20060102_150405")
@@ -751,7 +1066,7 @@ func (s *Server) handleImagenGeneration(ctx context.Context, req *mcp.CallToolRe
 
 			if err := os.MkdirAll(input.OutputDirectory, 0755); err == nil {
 				if len(generatedImage.Image.ImageBytes) > 0 {
-					if err := os.WriteFile(outputPath, generatedImage.Image.ImageBytes, 0644); err == nil {
+					if err := cas.WriteFile(outputPath, generatedImage.Image.ImageBytes, 0644); err == nil {
 						savedFiles = append(savedFiles, outputPath)
 						log.Printf("Saved image to: %s", outputPath)
 					}
@@ -763,7 +1078,9 @@ func (s *Server) handleImagenGeneration(ctx context.Context, req *mcp.CallToolRe
 	return nil, ImagenGenerationOutput{
 		ImagesGenerated: len(response.GeneratedImages),
 		Model:           model,
+		FallbackFrom:    fallbackFrom(requestedModel, model),
 		SavedFiles:      savedFiles,
+		StoredFiles:     s.storeFiles(ctx, savedFiles),
 	}, nil
 }
 
@@ -797,17 +1114,38 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 	if input.NegativePrompt != "" {
 		promptText = fmt.Sprintf("%s. Avoid: %s", input.Prompt, input.NegativePrompt)
 	}
+	veoConfig := videoConfig(aspectRatio, resolution, input.Seed)
+
+	if input.DryRun {
+		return nil, VeoGenerationOutput{
+			Status:          "dry_run",
+			Model:           model,
+			AspectRatio:     aspectRatio,
+			Resolution:      resolution,
+			GeneratedAt:     timestamp,
+			EstimatedLength: "8 seconds",
+			DryRun:          s.dryRun(promptText, veoConfig, s.prices.Estimate(pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds})),
+		}, nil
+	}
+
+	// Hold a video slot until the operation is done
+	release, err := s.schedule(ctx, model)
+	if err != nil {
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error waiting for video capacity: %w", err)
+	}
+	defer release()
 
 	// Generate video using Gemini API - correct signature from documentation
-	operation, err := s.client.Models.GenerateVideos(
+	requestedModel := model
+	operation, model, err := s.generateVideos(
 		ctx,
-		model,
+		requestedModel,
 		promptText,
 		nil, // image parameter (nil for text-only)
-		nil, // config parameter (nil to use defaults)
+		veoConfig,
 	)
 	if err != nil {
-		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting video generation: %v", err)
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting video generation: %w", err)
 	}
 
 	operationID := operation.Name
@@ -818,7 +1156,7 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 	for i := 0; i < maxAttempts && !operation.Done; i++ {
 		log.Printf("Waiting for video generation to complete... (attempt %d/%d)", i+1, maxAttempts)
 		time.Sleep(10 * time.Second)
-		operation, err = s.client.Operations.GetVideosOperation(ctx, operation, nil)
+		operation, err = s.getVideosOperation(ctx, operation)
 		if err != nil {
 			log.Printf("Error checking operation status: %v", err)
 			break
@@ -826,6 +1164,7 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 	}
 
 	var savedFiles []string
+	var storedFiles []storage.Object
 	var videoURL string
 	status := "generating"
 
@@ -836,6 +1175,7 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 		} else if len(operation.Response.GeneratedVideos) > 0 {
 			status = "completed"
 			video := operation.Response.GeneratedVideos[0]
+			s.recordUsage(ctx, pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds})
 			log.Printf("Video generation completed successfully")
 
 			// Download and save video if output directory is specified
@@ -844,15 +1184,14 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 					filename := fmt.Sprintf("veo_video_%s.mp4", timestamp)
 					outputPath := filepath.Join(input.OutputDirectory, filename)
 
-					// Download the video file following official documentation pattern
-					s.client.Files.Download(ctx, video.Video, nil)
-
-					// Save the video bytes to file
-					err = os.WriteFile(outputPath, video.Video.VideoBytes, 0644)
+					// Stream the video to disk, and to the storage bucket if
+					// one is configured
+					obj, err := s.saveVideo(ctx, video.Video, outputPath)
 					if err != nil {
 						log.Printf("Error saving video file: %v", err)
 					} else {
 						savedFiles = append(savedFiles, outputPath)
+						storedFiles = append(storedFiles, *obj)
 						videoURL = outputPath
 						log.Printf("Video saved to: %s", outputPath)
 					}
@@ -887,11 +1226,18 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 				"status":           status,
 				"generated_at":     timestamp,
 				"estimated_length": "8 seconds",
+				"run_id":           runID(ctx),
+				"outputs":          fileHashes(savedFiles...),
+			}
+
+			if parent := parentRunID(ctx); parent != "" {
+				metadataContent["parent_run_id"] = parent
 			}
 
 			if jsonData, err := json.MarshalIndent(metadataContent, "", "  "); err == nil {
-				if err := os.WriteFile(outputPath, jsonData, 0644); err == nil {
+				if err := cas.WriteFile(outputPath, jsonData, 0644); err == nil {
 					savedFiles = append(savedFiles, outputPath)
+					storedFiles = append(storedFiles, s.storeFiles(ctx, []string{outputPath})...)
 				}
 			}
 		}
@@ -902,7 +1248,9 @@ func (s *Server) handleVeoGeneration(ctx context.Context, req *mcp.CallToolReque
 		Status:          status,
 		VideoURL:        videoURL,
 		SavedFiles:      savedFiles,
+		StoredFiles:     storedFiles,
 		Model:           model,
+		FallbackFrom:    fallbackFrom(requestedModel, model),
 		AspectRatio:     aspectRatio,
 		Resolution:      resolution,
 		Metadata:        metadata,
@@ -941,17 +1289,38 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 	if input.NegativePrompt != "" {
 		promptText = fmt.Sprintf("%s. Avoid: %s", input.Prompt, input.NegativePrompt)
 	}
+	veoConfig := videoConfig(aspectRatio, resolution, input.Seed)
+
+	if input.DryRun {
+		return nil, VeoGenerationOutput{
+			Status:          "dry_run",
+			Model:           model,
+			AspectRatio:     aspectRatio,
+			Resolution:      resolution,
+			GeneratedAt:     timestamp,
+			EstimatedLength: "8 seconds",
+			DryRun:          s.dryRun(promptText, veoConfig, s.prices.Estimate(pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds})),
+		}, nil
+	}
+
+	// Hold a video slot until the operation is done
+	release, err := s.schedule(ctx, model)
+	if err != nil {
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error waiting for video capacity: %w", err)
+	}
+	defer release()
 
 	// Generate video using Gemini API - text-to-video (no image)
-	operation, err := s.client.Models.GenerateVideos(
+	requestedModel := model
+	operation, model, err := s.generateVideos(
 		ctx,
-		model,
+		requestedModel,
 		promptText,
 		nil, // No image for text-to-video
-		nil, // Use default config
+		veoConfig,
 	)
 	if err != nil {
-		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting text-to-video generation: %v", err)
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting text-to-video generation: %w", err)
 	}
 
 	operationID := operation.Name
@@ -962,7 +1331,7 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 	for i := 0; i < maxAttempts && !operation.Done; i++ {
 		log.Printf("Waiting for text-to-video generation to complete... (attempt %d/%d)", i+1, maxAttempts)
 		time.Sleep(10 * time.Second)
-		operation, err = s.client.Operations.GetVideosOperation(ctx, operation, nil)
+		operation, err = s.getVideosOperation(ctx, operation)
 		if err != nil {
 			log.Printf("Error checking operation status: %v", err)
 			break
@@ -970,6 +1339,7 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 	}
 
 	var savedFiles []string
+	var storedFiles []storage.Object
 	var videoURL string
 	status := "generating"
 
@@ -980,6 +1350,7 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 		} else if len(operation.Response.GeneratedVideos) > 0 {
 			status = "completed"
 			video := operation.Response.GeneratedVideos[0]
+			s.recordUsage(ctx, pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds})
 			log.Printf("Text-to-video generation completed successfully")
 
 			// Download and save video if output directory is specified
@@ -988,15 +1359,14 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 					filename := fmt.Sprintf("veo_text_to_video_%s.mp4", timestamp)
 					outputPath := filepath.Join(input.OutputDirectory, filename)
 
-					// Download the video file following official documentation pattern
-					s.client.Files.Download(ctx, video.Video, nil)
-
-					// Save the video bytes to file
-					err = os.WriteFile(outputPath, video.Video.VideoBytes, 0644)
+					// Stream the video to disk, and to the storage bucket if
+					// one is configured
+					obj, err := s.saveVideo(ctx, video.Video, outputPath)
 					if err != nil {
 						log.Printf("Error saving video file: %v", err)
 					} else {
 						savedFiles = append(savedFiles, outputPath)
+						storedFiles = append(storedFiles, *obj)
 						videoURL = outputPath
 						log.Printf("Text-to-video saved to: %s", outputPath)
 					}
@@ -1038,11 +1408,18 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 				"status":           status,
 				"generated_at":     timestamp,
 				"estimated_length": "8 seconds",
+				"run_id":           runID(ctx),
+				"outputs":          fileHashes(savedFiles...),
+			}
+
+			if parent := parentRunID(ctx); parent != "" {
+				metadataContent["parent_run_id"] = parent
 			}
 
 			if jsonData, err := json.MarshalIndent(metadataContent, "", "  "); err == nil {
-				if err := os.WriteFile(outputPath, jsonData, 0644); err == nil {
+				if err := cas.WriteFile(outputPath, jsonData, 0644); err == nil {
 					savedFiles = append(savedFiles, outputPath)
+					storedFiles = append(storedFiles, s.storeFiles(ctx, []string{outputPath})...)
 				}
 			}
 		}
@@ -1053,7 +1430,9 @@ func (s *Server) handleVeoTextToVideo(ctx context.Context, req *mcp.CallToolRequ
 		Status:          status,
 		VideoURL:        videoURL,
 		SavedFiles:      savedFiles,
+		StoredFiles:     storedFiles,
 		Model:           model,
+		FallbackFrom:    fallbackFrom(requestedModel, model),
 		AspectRatio:     aspectRatio,
 		Resolution:      resolution,
 		Metadata:        metadata,
@@ -1096,6 +1475,28 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 
 	timestamp := time.Now().Format("20060102_150405")
 
+	// Build prompt with negative prompt if specified
+	promptText := input.Prompt
+	if input.NegativePrompt != "" {
+		promptText = fmt.Sprintf("%s. Avoid: %s", input.Prompt, input.NegativePrompt)
+	}
+	veoConfig := videoConfig(aspectRatio, resolution, input.Seed)
+
+	if input.DryRun {
+		return nil, VeoGenerationOutput{
+			Status:          "dry_run",
+			Model:           model,
+			AspectRatio:     aspectRatio,
+			Resolution:      resolution,
+			GeneratedAt:     timestamp,
+			EstimatedLength: "8 seconds",
+			DryRun: s.dryRun(promptText, veoConfig,
+				s.prices.Estimate(pricing.Usage{Model: "imagen-4.0-generate-001", Images: 1}),
+				s.prices.Estimate(pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds}),
+			),
+		}, nil
+	}
+
 	// For image-to-video, we need to first generate the image using Imagen
 	// or provide the image in the correct format. Based on reference code,
 	// we should use Imagen to process the image for compatibility
@@ -1104,7 +1505,7 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 	imagePrompt := fmt.Sprintf("Transform this image: %s", input.Prompt)
 
 	// Generate image with Imagen (this processes the input image)
-	imagenResponse, err := s.client.Models.GenerateImages(
+	imagenResponse, imagenModel, err := s.generateImages(
 		ctx,
 		"imagen-4.0-generate-001",
 		imagePrompt,
@@ -1118,25 +1519,28 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 
 	var inputImage *genai.Image
 	if imagenResponse != nil && len(imagenResponse.GeneratedImages) > 0 {
+		s.recordUsage(ctx, pricing.Usage{Model: imagenModel, Images: len(imagenResponse.GeneratedImages)})
 		inputImage = imagenResponse.GeneratedImages[0].Image
 	}
 
-	// Build prompt with negative prompt if specified
-	promptText := input.Prompt
-	if input.NegativePrompt != "" {
-		promptText = fmt.Sprintf("%s. Avoid: %s", input.Prompt, input.NegativePrompt)
+	// Hold a video slot until the operation is done
+	release, err := s.schedule(ctx, model)
+	if err != nil {
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error waiting for video capacity: %w", err)
 	}
+	defer release()
 
 	// Generate video using Gemini API - image-to-video
-	operation, err := s.client.Models.GenerateVideos(
+	requestedModel := model
+	operation, model, err := s.generateVideos(
 		ctx,
-		model,
+		requestedModel,
 		promptText,
 		inputImage, // Pass the processed image
-		nil,        // Use default config
+		veoConfig,
 	)
 	if err != nil {
-		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting image-to-video generation: %v", err)
+		return nil, VeoGenerationOutput{}, fmt.Errorf("error starting image-to-video generation: %w", err)
 	}
 
 	operationID := operation.Name
@@ -1147,7 +1551,7 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 	for i := 0; i < maxAttempts && !operation.Done; i++ {
 		log.Printf("Waiting for image-to-video generation to complete... (attempt %d/%d)", i+1, maxAttempts)
 		time.Sleep(10 * time.Second)
-		operation, err = s.client.Operations.GetVideosOperation(ctx, operation, nil)
+		operation, err = s.getVideosOperation(ctx, operation)
 		if err != nil {
 			log.Printf("Error checking operation status: %v", err)
 			break
@@ -1155,6 +1559,7 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 	}
 
 	var savedFiles []string
+	var storedFiles []storage.Object
 	var videoURL string
 	status := "generating"
 
@@ -1165,6 +1570,7 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 		} else if len(operation.Response.GeneratedVideos) > 0 {
 			status = "completed"
 			video := operation.Response.GeneratedVideos[0]
+			s.recordUsage(ctx, pricing.Usage{Model: model, Resolution: resolution, VideoSeconds: veoVideoSeconds})
 			log.Printf("Image-to-video generation completed successfully")
 
 			// Download and save video if output directory is specified
@@ -1173,15 +1579,14 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 					filename := fmt.Sprintf("veo_image_to_video_%s.mp4", timestamp)
 					outputPath := filepath.Join(input.OutputDirectory, filename)
 
-					// Download the video file following official documentation pattern
-					s.client.Files.Download(ctx, video.Video, nil)
-
-					// Save the video bytes to file
-					err = os.WriteFile(outputPath, video.Video.VideoBytes, 0644)
+					// Stream the video to disk, and to the storage bucket if
+					// one is configured
+					obj, err := s.saveVideo(ctx, video.Video, outputPath)
 					if err != nil {
 						log.Printf("Error saving video file: %v", err)
 					} else {
 						savedFiles = append(savedFiles, outputPath)
+						storedFiles = append(storedFiles, *obj)
 						videoURL = outputPath
 						log.Printf("Image-to-video saved to: %s", outputPath)
 					}
@@ -1225,11 +1630,19 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 				"status":           status,
 				"generated_at":     timestamp,
 				"estimated_length": "8 seconds",
+				"inputs":           fileHashes(input.ImagePath),
+				"run_id":           runID(ctx),
+				"outputs":          fileHashes(savedFiles...),
+			}
+
+			if parent := parentRunID(ctx); parent != "" {
+				metadataContent["parent_run_id"] = parent
 			}
 
 			if jsonData, err := json.MarshalIndent(metadataContent, "", "  "); err == nil {
-				if err := os.WriteFile(outputPath, jsonData, 0644); err == nil {
+				if err := cas.WriteFile(outputPath, jsonData, 0644); err == nil {
 					savedFiles = append(savedFiles, outputPath)
+					storedFiles = append(storedFiles, s.storeFiles(ctx, []string{outputPath})...)
 				}
 			}
 		}
@@ -1240,7 +1653,9 @@ func (s *Server) handleVeoImageToVideo(ctx context.Context, req *mcp.CallToolReq
 		Status:          status,
 		VideoURL:        videoURL,
 		SavedFiles:      savedFiles,
+		StoredFiles:     storedFiles,
 		Model:           model,
+		FallbackFrom:    fallbackFrom(requestedModel, model),
 		AspectRatio:     aspectRatio,
 		Resolution:      resolution,
 		Metadata:        metadata,
@@ -1,7 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"gemini-mcp/internal/auth"
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/embedding"
+	"gemini-mcp/internal/ledger"
+	"gemini-mcp/internal/models"
+	"gemini-mcp/internal/pricing"
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/scheduler"
+	"gemini-mcp/internal/session"
+	"gemini-mcp/internal/storage"
+	"gemini-mcp/internal/tenant"
+
+	mcpauth "github.com/modelcontextprotocol/go-sdk/auth"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
 )
 
 func TestVersion(t *testing.T) {
@@ -23,3 +57,1694 @@ func TestMain(t *testing.T) {
 	// This is a basic smoke test
 	t.Log("Main function exists")
 }
+
+func TestRegisterTools(t *testing.T) {
+	// Registering tools derives JSON schemas from the input and output types,
+	// which panics if any of them cannot be represented.
+	server := &Server{config: &config.Config{}}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerTools(mcpServer)
+}
+
+func TestMediaPartsInline(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clip.mp4")
+	if err := os.WriteFile(path, []byte("not really a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{config: &config.Config{FileUploadThreshold: 1024}}
+	parts, err := server.mediaParts(context.Background(), []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0].InlineData == nil {
+		t.Fatalf("expected a single inline part, got %+v", parts)
+	}
+	if got := parts[0].InlineData.MIMEType; got != "video/mp4" {
+		t.Errorf("MIME type = %s, want video/mp4", got)
+	}
+
+	if _, err := server.mediaParts(context.Background(), []string{filepath.Join(dir, "missing.png")}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestDataPart(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	// The part is built from the data read already, not from the file
+	path := filepath.Join(t.TempDir(), "gone.png")
+	server := &Server{config: &config.Config{FileUploadThreshold: 1024}}
+	part, err := server.dataPart(context.Background(), path, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.InlineData == nil || part.InlineData.MIMEType != "image/png" || !bytes.Equal(part.InlineData.Data, buf.Bytes()) {
+		t.Errorf("dataPart() = %+v, want the PNG inline", part)
+	}
+}
+
+func TestUsageMiddlewareEnforcesBudget(t *testing.T) {
+	usageLedger, _ := ledger.Open("", ledger.Limits{DailyUSD: 1})
+	server := &Server{config: &config.Config{}, prices: pricing.DefaultTable(), ledger: usageLedger}
+
+	var calls int
+	handler := server.usageMiddleware(func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		calls++
+		server.recordUsage(ctx, pricing.Usage{Model: "veo-3.0-generate-001", VideoSeconds: veoVideoSeconds})
+		return &mcp.CallToolResult{}, nil
+	})
+
+	call := func(tool, args string) *mcp.CallToolResult {
+		t.Helper()
+		req := &mcp.CallToolRequest{Params: &mcp.CallToolParamsRaw{Name: tool, Arguments: []byte(args)}}
+		result, err := handler(context.Background(), "tools/call", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(*mcp.CallToolResult)
+	}
+
+	if result := call("veo_text_to_video", `{}`); result.IsError {
+		t.Fatal("first call should be allowed")
+	}
+	if report := usageLedger.Report(usageLedger.PeriodStart("day"), "local"); report.Calls != 1 || report.ByTool[0].Name != "veo_text_to_video" {
+		t.Fatalf("usage was not recorded against the tool: %+v", report)
+	}
+
+	if result := call("veo_text_to_video", `{}`); !result.IsError {
+		t.Error("expected budget exceeded error")
+	}
+	if result := call("veo_text_to_video", `{"dry_run":true}`); result.IsError {
+		t.Error("dry runs should not be refused")
+	}
+	if result := call("usage_report", `{}`); result.IsError {
+		t.Error("usage_report should not be refused")
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+}
+
+func TestUsageReportClients(t *testing.T) {
+	usageLedger, _ := ledger.Open("", ledger.Limits{})
+	usageLedger.Record(ledger.Entry{Time: time.Now(), Tool: "imagen_t2i", Client: "token:alice", Estimate: pricing.Estimate{CostUSD: 0.04, Priced: true}})
+	usageLedger.Record(ledger.Entry{Time: time.Now(), Tool: "imagen_t2i", Client: "token:bob", Estimate: pricing.Estimate{CostUSD: 0.06, Priced: true}})
+	server := &Server{config: &config.Config{}, ledger: usageLedger}
+
+	// A local operator sees every client
+	_, output, err := server.handleUsageReport(context.Background(), &mcp.CallToolRequest{}, UsageReportInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Report.ByClient) != 2 {
+		t.Errorf("local report by client = %+v, want both clients", output.Report.ByClient)
+	}
+
+	// An authenticated caller only sees its own usage
+	alice := &mcp.CallToolRequest{Extra: &mcp.RequestExtra{TokenInfo: &mcpauth.TokenInfo{Extra: map[string]any{"client_id": "alice"}}}}
+	_, output, err = server.handleUsageReport(context.Background(), alice, UsageReportInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Client != "token:alice" || len(output.Report.ByClient) != 1 || output.Report.ByClient[0].Name != "token:alice" {
+		t.Errorf("authenticated report = %+v, want only alice's usage", output)
+	}
+	if _, _, err := server.handleUsageReport(context.Background(), alice, UsageReportInput{Client: "token:bob"}); err == nil {
+		t.Error("an authenticated caller got the usage of another client")
+	}
+}
+
+func TestStructuredToolErrors(t *testing.T) {
+	ctx := context.Background()
+	server := &Server{config: &config.Config{RetryMaxAttempts: 2}}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	mcpServer.AddReceivingMiddleware(server.errorMiddleware)
+
+	calls := 0
+	addTool(mcpServer, &mcp.Tool{Name: "quota_tool"}, func(ctx context.Context, req *mcp.CallToolRequest, input struct{}) (*mcp.CallToolResult, struct{}, error) {
+		_, err := retry.Do(ctx, retry.Policy{MaxAttempts: 2}, func() (int, error) {
+			calls++
+			return 0, genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED", Message: "quota exceeded"}
+		})
+		return nil, struct{}{}, fmt.Errorf("error generating content: %w", err)
+	})
+
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	if _, err := mcpServer.Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	client := mcp.NewClient(&mcp.Implementation{Name: "test"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "quota_tool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsError || calls != 2 {
+		t.Fatalf("expected an error result after 2 attempts, got IsError=%v after %d calls", result.IsError, calls)
+	}
+
+	data, _ := json.Marshal(result.StructuredContent)
+	var structured struct {
+		Error ToolError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &structured); err != nil {
+		t.Fatal(err)
+	}
+	if got := structured.Error; got.Kind != retry.KindQuota || !got.Retryable || got.Attempts != 2 || got.Code != 429 {
+		t.Errorf("unexpected structured error: %+v", got)
+	}
+}
+
+func TestQueuePositionProgress(t *testing.T) {
+	ctx := context.Background()
+	server := &Server{
+		config:    &config.Config{},
+		scheduler: scheduler.New(map[string]scheduler.Limit{scheduler.FamilyVeo: {Concurrency: 1}}),
+	}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	addTool(mcpServer, &mcp.Tool{Name: "veo_test"}, func(ctx context.Context, req *mcp.CallToolRequest, input struct{}) (*mcp.CallToolResult, struct{}, error) {
+		release, err := server.schedule(ctx, "veo-3.0-generate-001")
+		if err != nil {
+			return nil, struct{}{}, err
+		}
+		release()
+		return nil, struct{}{}, nil
+	})
+
+	// Take the only video slot so the tool call has to queue.
+	release, err := server.schedule(ctx, "veo-3.0-generate-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := make(chan string, 1)
+	client := mcp.NewClient(&mcp.Implementation{Name: "test"}, &mcp.ClientOptions{
+		ProgressNotificationHandler: func(ctx context.Context, req *mcp.ProgressNotificationClientRequest) {
+			progress <- req.Params.Message
+		},
+	})
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	if _, err := mcpServer.Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	params := &mcp.CallToolParams{Name: "veo_test", Meta: mcp.Meta{"progressToken": "queue"}}
+	result := make(chan error, 1)
+	go func() {
+		_, err := session.CallTool(ctx, params)
+		result <- err
+	}()
+
+	select {
+	case message := <-progress:
+		if !strings.Contains(message, "position 1") {
+			t.Errorf("unexpected progress message %q", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no progress notification while queued")
+	}
+
+	release()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	server := &Server{config: &config.Config{ModelFallbacks: config.ParseModelFallbacks("ultra>standard>fast")}}
+
+	var tried []string
+	failures := map[string]error{
+		"ultra":    genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"},
+		"standard": genai.APIError{Code: 503, Status: "UNAVAILABLE"},
+	}
+	result, model, err := withFallback(server, "ultra", func(model string) (string, error) {
+		tried = append(tried, model)
+		return "image", failures[model]
+	})
+	if err != nil || result != "image" || model != "fast" || len(tried) != 3 {
+		t.Fatalf("withFallback = %q from %s, %v after trying %v", result, model, err, tried)
+	}
+	if got := fallbackFrom("ultra", model); got != "ultra" {
+		t.Errorf("fallbackFrom = %q, want ultra", got)
+	}
+
+	tried = nil
+	_, model, err = withFallback(server, "ultra", func(model string) (string, error) {
+		tried = append(tried, model)
+		return "", genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}
+	})
+	if err == nil || model != "ultra" || len(tried) != 1 {
+		t.Fatalf("expected no fallback for invalid arguments, got %v from %s after trying %v", err, model, tried)
+	}
+}
+
+func TestModelMiddlewareSuggestsModels(t *testing.T) {
+	catalog := models.NewCatalog(func(context.Context) ([]models.Info, error) {
+		return []models.Info{{Name: "gemini-2.5-flash"}, {Name: "imagen-4.0-generate-001"}}, nil
+	}, time.Hour)
+	server := &Server{config: &config.Config{ValidateModels: true}, catalog: catalog}
+
+	var calls int
+	handler := server.modelMiddleware(func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		calls++
+		return &mcp.CallToolResult{}, nil
+	})
+
+	call := func(args string) *mcp.CallToolResult {
+		t.Helper()
+		req := &mcp.CallToolRequest{Params: &mcp.CallToolParamsRaw{Name: "gemini_generate_text", Arguments: []byte(args)}}
+		result, err := handler(context.Background(), "tools/call", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(*mcp.CallToolResult)
+	}
+
+	if result := call(`{"model":"gemini-2.5-flash"}`); result.IsError {
+		t.Error("known model should be allowed")
+	}
+	if result := call(`{"prompt":"hi"}`); result.IsError {
+		t.Error("calls without a model should be allowed")
+	}
+
+	result := call(`{"model":"gemini-2.5-flahs"}`)
+	if !result.IsError {
+		t.Fatal("expected unknown model error")
+	}
+	toolErr := result.StructuredContent.(map[string]any)["error"].(ToolError)
+	if toolErr.Kind != retry.KindInvalidArgument || len(toolErr.Suggestions) != 1 || toolErr.Suggestions[0] != "gemini-2.5-flash" {
+		t.Errorf("unexpected error: %+v", toolErr)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	write(`
+settings:
+  OUTPUT_DIR: ` + t.TempDir() + `
+  VEO_CONCURRENCY: 1
+aliases:
+  fast-image: imagen-4.0-fast-generate-001
+tools:
+  imagen_t2i:
+    model: fast-image
+    defaults:
+      aspect_ratio: "16:9"
+      num_images: 2
+  gemini_image_session_start:
+    enabled: false
+`)
+	cfg, err := config.Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VeoConcurrency != 1 {
+		t.Errorf("VeoConcurrency = %d, want 1 from the config file", cfg.VeoConcurrency)
+	}
+
+	server := &Server{config: cfg}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerTools(mcpServer)
+	if err := server.configureTools(ctx, mcpServer); err != nil {
+		t.Fatal(err)
+	}
+	tools, err := listTools(ctx, mcpServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tools["gemini_image_session_start"]; ok {
+		t.Error("disabled tool is still registered")
+	}
+
+	args, err := server.toolArguments("imagen_t2i", json.RawMessage(`{"prompt":"a cat","num_images":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	json.Unmarshal(args, &got)
+	if got["model"] != "imagen-4.0-fast-generate-001" || got["aspect_ratio"] != "16:9" || got["num_images"] != 1.0 {
+		t.Errorf("unexpected arguments with defaults: %v", got)
+	}
+
+	write(`
+tools:
+  imagen_t2i:
+    defaults:
+      num_images: two
+  no_such_tool:
+    enabled: false
+`)
+	if cfg, err = config.Load(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	server = &Server{config: cfg}
+	mcpServer = mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerTools(mcpServer)
+	err = server.configureTools(ctx, mcpServer)
+	if err == nil || !strings.Contains(err.Error(), "tools.imagen_t2i.defaults.num_images") || !strings.Contains(err.Error(), "tools.no_such_tool: unknown tool") {
+		t.Errorf("expected invalid default and unknown tool errors, got %v", err)
+	}
+
+	write("settings:\n  NO_SUCH_SETTING: 1\n")
+	if _, err := config.Load(path, nil); err == nil {
+		t.Error("expected unknown setting error")
+	}
+}
+
+func TestSandboxMiddleware(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := filepath.Join(dir, "inputs")
+	outputs := filepath.Join(dir, "outputs")
+	for _, d := range []string{inputs, outputs} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	box, err := sandbox.New([]string{inputs}, []string{outputs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{ClientRoots: true}, sandbox: box}
+
+	type filesInput struct {
+		ImagePaths      []string `json:"image_paths,omitempty"`
+		OutputDirectory string   `json:"output_directory,omitempty"`
+	}
+	var got filesInput
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "files"}, func(ctx context.Context, req *mcp.CallToolRequest, input filesInput) (*mcp.CallToolResult, struct{}, error) {
+		got = input
+		return nil, struct{}{}, nil
+	})
+	mcpServer.AddReceivingMiddleware(server.sandboxMiddleware)
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(args map[string]any) *mcp.CallToolResult {
+		t.Helper()
+		got = filesInput{}
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "files", Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := call(map[string]any{
+		"image_paths":      []string{filepath.Join(inputs, "sub", "..", "cat.png"), "files/abc123"},
+		"output_directory": filepath.Join(outputs, "new"),
+	})
+	if result.IsError {
+		t.Fatalf("allowed paths refused: %v", result.Content)
+	}
+	want := filesInput{ImagePaths: []string{filepath.Join(inputs, "cat.png"), "files/abc123"}, OutputDirectory: filepath.Join(outputs, "new")}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("tool got %+v, want %+v", got, want)
+	}
+
+	for _, args := range []map[string]any{
+		{"image_paths": []string{filepath.Join(inputs, "..", "secret.txt")}},
+		{"output_directory": inputs},
+	} {
+		if result := call(args); !result.IsError || got.ImagePaths != nil || got.OutputDirectory != "" {
+			t.Errorf("call with %v was not refused", args)
+		}
+	}
+
+	// Roots declared by the client confine paths further
+	client.AddRoots(&mcp.Root{URI: "file://" + filepath.ToSlash(outputs)})
+	if result := call(map[string]any{"image_paths": []string{filepath.Join(inputs, "cat.png")}}); !result.IsError {
+		t.Error("path outside the client roots was not refused")
+	}
+	if result := call(map[string]any{"image_paths": []string{filepath.Join(outputs, "cat.png")}}); result.IsError {
+		t.Errorf("path inside the client roots refused: %v", result.Content)
+	}
+}
+
+// bearerTransport adds a bearer token to HTTP requests.
+type bearerTransport struct {
+	token string
+}
+
+func (b bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPAuth(t *testing.T) {
+	authConfig := auth.Config{
+		Tokens: []auth.Token{
+			{Token: "image-only-token-0001", ClientID: "designer", Scopes: []string{"image"}},
+		},
+		Scopes:   map[string][]string{"image": {"imagen_*", "list_models"}},
+		Resource: "https://mcp.example.com",
+	}
+	authenticator, err := auth.New(authConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, transport := range []string{"http", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			server := &Server{config: &config.Config{Transport: transport, Auth: authConfig}, auth: authenticator}
+			ctx := context.Background()
+			mcpServer, err := server.newMCPServer(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler, err := server.httpHandler(mcpServer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpServer := httptest.NewServer(handler)
+			defer httpServer.Close()
+
+			connect := func(token string) (*mcp.ClientSession, error) {
+				httpClient := &http.Client{Transport: bearerTransport{token}}
+				var clientTransport mcp.Transport = &mcp.StreamableClientTransport{Endpoint: httpServer.URL, HTTPClient: httpClient, MaxRetries: -1}
+				if transport == "sse" {
+					clientTransport = &mcp.SSEClientTransport{Endpoint: httpServer.URL, HTTPClient: httpClient}
+				}
+				client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+				return client.Connect(ctx, clientTransport, nil)
+			}
+
+			resp, err := http.Get(httpServer.URL + "/.well-known/oauth-protected-resource")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata auth.ResourceMetadata
+			err = json.NewDecoder(resp.Body).Decode(&metadata)
+			resp.Body.Close()
+			if err != nil || metadata.Resource != "https://mcp.example.com" {
+				t.Errorf("unexpected resource metadata %+v, %v", metadata, err)
+			}
+
+			if session, err := connect("wrong-token"); err == nil {
+				session.Close()
+				t.Fatal("connected with an invalid token")
+			}
+
+			session, err := connect("image-only-token-0001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			var names []string
+			for tool, err := range session.Tools(ctx, nil) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, tool.Name)
+			}
+			if !slices.Contains(names, "imagen_t2i") || slices.Contains(names, "veo_text_to_video") {
+				t.Errorf("tools visible to the image token: %v", names)
+			}
+
+			result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "veo_text_to_video", Arguments: map[string]any{"prompt": "a cat"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.IsError || !strings.Contains(result.Content[0].(*mcp.TextContent).Text, "scopes") {
+				t.Errorf("call outside the token scopes was not refused: %v", result.Content)
+			}
+		})
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authConfig := auth.Config{Tokens: []auth.Token{
+		{Token: "alice-token-000001", ClientID: "alice"},
+		{Token: "bob-token-00000002", ClientID: "bob"},
+	}}
+	authenticator, err := auth.New(authConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := sandbox.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		config: &config.Config{
+			Transport:        "http",
+			OutputDir:        dir,
+			Isolation:        config.IsolationTenant,
+			TenantQuotaBytes: 10,
+			Auth:             authConfig,
+		},
+		auth:    authenticator,
+		sandbox: box,
+	}
+
+	ctx := context.Background()
+	mcpServer, err := server.newMCPServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gemini_write saves its text in output_directory, or the default one,
+	// and counts as billed
+	billedTools["gemini_write"] = billedTool{}
+	t.Cleanup(func() { delete(billedTools, "gemini_write") })
+	type writeInput struct {
+		Text            string `json:"text"`
+		ImagePath       string `json:"image_path,omitempty"`
+		OutputDirectory string `json:"output_directory,omitempty"`
+	}
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "gemini_write"}, func(ctx context.Context, req *mcp.CallToolRequest, input writeInput) (*mcp.CallToolResult, struct{}, error) {
+		outputDir := input.OutputDirectory
+		if outputDir == "" {
+			outputDir = server.outputDir(ctx)
+		}
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return nil, struct{}{}, err
+		}
+		return nil, struct{}{}, os.WriteFile(filepath.Join(outputDir, "note.txt"), []byte(input.Text), 0644)
+	})
+	handler, err := server.httpHandler(mcpServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	connect := func(token string) *mcp.ClientSession {
+		t.Helper()
+		httpClient := &http.Client{Transport: bearerTransport{token}}
+		client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+		session, err := client.Connect(ctx, &mcp.StreamableClientTransport{Endpoint: httpServer.URL, HTTPClient: httpClient, MaxRetries: -1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	alice, bob := connect("alice-token-000001"), connect("bob-token-00000002")
+	defer alice.Close()
+	defer bob.Close()
+
+	write := func(session *mcp.ClientSession, args map[string]any) *mcp.CallToolResult {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "gemini_write", Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := write(alice, map[string]any{"text": "alice"}); result.IsError {
+		t.Fatalf("write refused: %v", result.Content)
+	}
+	if result := write(bob, map[string]any{"text": "bob", "output_directory": "drafts"}); result.IsError {
+		t.Fatalf("write refused: %v", result.Content)
+	}
+	aliceDir, bobDir := filepath.Join(dir, "tenants", "token-alice"), filepath.Join(dir, "tenants", "token-bob")
+	if data, err := os.ReadFile(filepath.Join(aliceDir, "note.txt")); err != nil || string(data) != "alice" {
+		t.Errorf("alice's note: %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(bobDir, "drafts", "note.txt")); err != nil || string(data) != "bob" {
+		t.Errorf("bob's note: %q, %v", data, err)
+	}
+
+	// Other tenants' directories are out of reach
+	for _, args := range []map[string]any{
+		{"text": "x", "output_directory": aliceDir},
+		{"text": "x", "output_directory": "../token-alice"},
+		{"text": "x", "output_directory": dir},
+		{"text": "x", "image_path": filepath.Join(aliceDir, "note.txt")},
+	} {
+		if result := write(bob, args); !result.IsError || !strings.Contains(result.Content[0].(*mcp.TextContent).Text, "output directory of this session") {
+			t.Errorf("call with %v was not refused: %v", args, result.Content)
+		}
+	}
+
+	// Resources list and read only the caller's files
+	var uris []string
+	for resource, err := range bob.Resources(ctx, nil) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, resource.URI)
+	}
+	if !slices.Equal(uris, []string{"output:///drafts/note.txt"}) {
+		t.Errorf("bob's resources: %v", uris)
+	}
+	read, err := bob.ReadResource(ctx, &mcp.ReadResourceParams{URI: "output:///drafts/note.txt"})
+	if err != nil || read.Contents[0].Text != "bob" {
+		t.Errorf("reading bob's note: %v, %v", read, err)
+	}
+	for _, uri := range []string{"output:///note.txt", "output:///../token-alice/note.txt", "output:///%2e%2e/token-alice/note.txt"} {
+		if _, err := bob.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri}); err == nil {
+			t.Errorf("bob read %s", uri)
+		}
+	}
+
+	// Billed calls are refused once the files fill the quota
+	write(alice, map[string]any{"text": "more than ten bytes"})
+	result := write(alice, map[string]any{"text": "again"})
+	if !result.IsError || !strings.Contains(result.Content[0].(*mcp.TextContent).Text, "quota") {
+		t.Errorf("call over quota was not refused: %v", result.Content)
+	}
+}
+
+// memoryStorage keeps stored objects in memory.
+type memoryStorage struct {
+	objects map[string][]byte
+}
+
+func (m *memoryStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) (*storage.Object, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[key] = data
+	return &storage.Object{Key: key, URI: "mem://bucket/" + key, Size: int64(len(data))}, nil
+}
+
+func (m *memoryStorage) PresignGet(key string, ttl time.Duration) (string, error) {
+	return "https://bucket.example.com/" + key + "?expires=" + ttl.String(), nil
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &memoryStorage{objects: map[string][]byte{}}
+	server := &Server{
+		config:  &config.Config{APIKey: "test-key", OutputDir: dir, StoragePrefix: "media", StoragePresignTTL: time.Hour},
+		storage: bucket,
+	}
+	ctx := context.Background()
+
+	video := bytes.Repeat([]byte("frame"), 100000)
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("x-goog-api-key") != "test-key" {
+			http.Error(w, "no key", http.StatusUnauthorized)
+			return
+		}
+		w.Write(video)
+	}))
+	defer download.Close()
+
+	outputPath := filepath.Join(dir, "videos", "veo.mp4")
+	obj, err := server.saveVideo(ctx, &genai.Video{URI: download.URL + "/files/abc:download?alt=media"}, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(outputPath); err != nil || !bytes.Equal(data, video) {
+		t.Errorf("local copy of the video: %d bytes, %v", len(data), err)
+	}
+	if !bytes.Equal(bucket.objects["media/videos/veo.mp4"], video) {
+		t.Errorf("video was not uploaded: %v", obj)
+	}
+	if obj.URI != "mem://bucket/media/videos/veo.mp4" || obj.URL == "" {
+		t.Errorf("unexpected video object %+v", obj)
+	}
+
+	// Files outside OUTPUT_DIR are stored by name
+	other := filepath.Join(t.TempDir(), "notes.srt")
+	os.WriteFile(other, []byte("1"), 0644)
+	objects := server.storeFiles(ctx, []string{other, filepath.Join(dir, "missing.png")})
+	if len(objects) != 1 || objects[0].Key != "media/notes.srt" || string(bucket.objects["media/notes.srt"]) != "1" {
+		t.Errorf("storeFiles() = %+v", objects)
+	}
+
+	// Without a bucket, files are described by their local URIs
+	server.storage = nil
+	objects = server.storeFiles(ctx, []string{outputPath})
+	if len(objects) != 1 || objects[0].URI != "file://"+filepath.ToSlash(outputPath) || objects[0].URL != "" {
+		t.Errorf("storeFiles() without a bucket = %+v", objects)
+	}
+}
+
+func TestContentLayout(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: dir, OutputLayout: config.LayoutContent}}
+
+	type copyInput struct {
+		ImagePath string `json:"image_path"`
+		Name      string `json:"name"`
+	}
+	type copyOutput struct {
+		SavedFiles []string `json:"saved_files"`
+	}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerContentTools(mcpServer)
+	// gemini_copy saves its input again under a new name
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "gemini_copy"}, func(ctx context.Context, req *mcp.CallToolRequest, input copyInput) (*mcp.CallToolResult, copyOutput, error) {
+		data, err := os.ReadFile(input.ImagePath)
+		if err != nil {
+			return nil, copyOutput{}, err
+		}
+		path := filepath.Join(dir, input.Name)
+		return nil, copyOutput{SavedFiles: []string{path}}, os.WriteFile(path, append(data, '!'), 0644)
+	})
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(name string, args map[string]any) *mcp.CallToolResult {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+		if err != nil || result.IsError {
+			t.Fatalf("%s: %v, %v", name, err, result)
+		}
+		return result
+	}
+
+	photo := filepath.Join(dir, "photo.png")
+	os.WriteFile(photo, []byte("photo"), 0644)
+	call("gemini_copy", map[string]any{"image_path": photo, "name": "edit_1.png"})
+	call("gemini_copy", map[string]any{"image_path": filepath.Join(dir, "edit_1.png"), "name": "edit_2.png"})
+	// The same output again shares its content with the first
+	call("gemini_copy", map[string]any{"image_path": photo, "name": "edit_3.png"})
+
+	first, _ := os.Stat(filepath.Join(dir, "edit_1.png"))
+	third, _ := os.Stat(filepath.Join(dir, "edit_3.png"))
+	if !os.SameFile(first, third) {
+		t.Error("identical outputs were not deduplicated")
+	}
+	if used, _ := tenant.Usage(dir, cas.Dir); used != int64(len("photo")+2*len("photo!")+len("photo!!")) {
+		t.Errorf("usage without the store = %d", used)
+	}
+
+	result := call("outputs_lineage", map[string]any{"path": filepath.Join(dir, "edit_2.png")})
+	data, _ := json.Marshal(result.StructuredContent)
+	var lineage OutputsLineageOutput
+	json.Unmarshal(data, &lineage)
+	if len(lineage.Records) != 2 || lineage.Records[1].Inputs[0].Path != photo {
+		t.Errorf("lineage of edit_2.png = %s", data)
+	}
+
+	// Metadata files record hashes of existing files only
+	hashes := fileHashes(photo, "files/abc123", "")
+	if len(hashes) != 1 || hashes[0].Size != 5 {
+		t.Errorf("fileHashes() = %+v", hashes)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: dir}}
+
+	type saveInput struct {
+		Name string `json:"name"`
+	}
+	type saveOutput struct {
+		SavedFiles []string `json:"saved_files"`
+	}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerRetentionTools(mcpServer)
+	server.registerIndexTools(mcpServer)
+	// gemini_save saves an image and its metadata file
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "gemini_save"}, func(ctx context.Context, req *mcp.CallToolRequest, input saveInput) (*mcp.CallToolResult, saveOutput, error) {
+		var output saveOutput
+		for _, ext := range []string{".png", ".json"} {
+			path := filepath.Join(dir, "images", input.Name+ext)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			os.WriteFile(path, []byte(input.Name), 0644)
+			output.SavedFiles = append(output.SavedFiles, path)
+		}
+		return nil, output, nil
+	})
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(name string, args map[string]any) *mcp.CallToolResult {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	prune := func(args map[string]any) []string {
+		t.Helper()
+		result := call("outputs_prune", args)
+		if result.IsError {
+			t.Fatalf("outputs_prune: %v", result.Content[0].(*mcp.TextContent).Text)
+		}
+		data, _ := json.Marshal(result.StructuredContent)
+		var output OutputsPruneOutput
+		json.Unmarshal(data, &output)
+		var deleted []string
+		for _, f := range output.Deleted {
+			rel, _ := filepath.Rel(dir, f.Path)
+			deleted = append(deleted, rel)
+		}
+		return deleted
+	}
+	exists := func(rel string) bool {
+		_, err := os.Stat(filepath.Join(dir, rel))
+		return err == nil
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		call("gemini_save", map[string]any{"name": name})
+	}
+	os.WriteFile(filepath.Join(dir, "stray.txt"), []byte("x"), 0644)
+	if result := call("outputs_pin", map[string]any{"path": "images/a.png"}); result.IsError {
+		t.Fatalf("outputs_pin: %v", result.Content)
+	}
+
+	if result := call("outputs_prune", map[string]any{}); !result.IsError {
+		t.Error("outputs_prune without rules was not refused")
+	}
+
+	// Generations of a tool are deleted together, except pinned ones
+	want := []string{"images/b.png", "images/b.json"}
+	if deleted := prune(map[string]any{"keep_last": 1, "dry_run": true}); !slices.Equal(deleted, want) || !exists("images/b.png") {
+		t.Errorf("dry run deleted %v, want %v", deleted, want)
+	}
+	if deleted := prune(map[string]any{"keep_last": 1}); !slices.Equal(deleted, want) || exists("images/b.png") || !exists("images/a.json") {
+		t.Errorf("prune deleted %v, want %v", deleted, want)
+	}
+
+	// Files used by running calls are kept
+	id := server.running.add(runningCall{inputs: []string{filepath.Join(dir, "images", "c.png")}, started: time.Now()})
+	want = []string{"stray.txt"}
+	if deleted := prune(map[string]any{"max_total_bytes": 1}); !slices.Equal(deleted, want) {
+		t.Errorf("prune with a running call deleted %v, want %v", deleted, want)
+	}
+	server.running.remove(id)
+	call("outputs_pin", map[string]any{"path": "images/a.png", "unpin": true})
+	if deleted := prune(map[string]any{"max_total_bytes": 1}); len(deleted) != 4 || exists("images") {
+		t.Errorf("prune deleted %v, leaving the images directory", deleted)
+	}
+	if entries, _ := server.indexAt(dir).Entries(); len(entries) != 0 {
+		t.Errorf("index still lists %+v", entries)
+	}
+}
+
+func TestOutputIndex(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: dir}}
+
+	type generateInput struct {
+		Prompt string   `json:"prompt"`
+		Model  string   `json:"model,omitempty"`
+		Tags   []string `json:"tags,omitempty"`
+		DryRun bool     `json:"dry_run,omitempty"`
+	}
+	type generateOutput struct {
+		Model      string   `json:"model"`
+		SavedFiles []string `json:"saved_files,omitempty"`
+	}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerIndexTools(mcpServer)
+	// gemini_generate saves its prompt and a metadata file with its run ID
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "gemini_generate"}, func(ctx context.Context, req *mcp.CallToolRequest, input generateInput) (*mcp.CallToolResult, generateOutput, error) {
+		output := generateOutput{Model: "gemini-2.5-flash-image-preview"}
+		if input.DryRun {
+			return nil, output, nil
+		}
+		image := filepath.Join(dir, runID(ctx)+".png")
+		metadata := filepath.Join(dir, runID(ctx)+".json")
+		os.WriteFile(image, []byte(input.Prompt), 0644)
+		os.WriteFile(metadata, []byte(`{"run_id": "`+runID(ctx)+`"}`), 0644)
+		output.SavedFiles = []string{image, metadata}
+		return nil, output, nil
+	})
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(name string, args map[string]any, output any) {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+		if err != nil || result.IsError {
+			t.Fatalf("%s: %v, %v", name, err, result)
+		}
+		data, _ := json.Marshal(result.StructuredContent)
+		json.Unmarshal(data, output)
+	}
+	prompts := func(page OutputsPage) []string {
+		var p []string
+		for _, o := range page.Outputs {
+			p = append(p, o.Prompt)
+		}
+		return p
+	}
+
+	var generated generateOutput
+	call("gemini_generate", map[string]any{"prompt": "A watercolor fox", "tags": []string{"fox", "winter"}}, &generated)
+	call("gemini_generate", map[string]any{"prompt": "A neon city at night"}, &generateOutput{})
+	call("gemini_generate", map[string]any{"prompt": "A watercolor lighthouse"}, &generateOutput{})
+	call("gemini_generate", map[string]any{"prompt": "Not saved", "dry_run": true}, &generateOutput{})
+
+	var page OutputsPage
+	call("outputs_list", map[string]any{"limit": 2}, &page)
+	if got := prompts(page); !slices.Equal(got, []string{"A watercolor lighthouse", "A neon city at night"}) || page.Total != 3 || page.NextOffset != 2 {
+		t.Errorf("outputs_list = %q, total %d, next %d", got, page.Total, page.NextOffset)
+	}
+	page = OutputsPage{}
+	call("outputs_list", map[string]any{"tag": "winter", "since": time.Now().Format(time.DateOnly)}, &page)
+	if got := prompts(page); !slices.Equal(got, []string{"A watercolor fox"}) || page.NextOffset != 0 {
+		t.Errorf("outputs_list by tag = %q", got)
+	}
+	call("outputs_search", map[string]any{"query": "water fox"}, &page)
+	if got := prompts(page); !slices.Equal(got, []string{"A watercolor fox"}) {
+		t.Errorf("outputs_search = %q", got)
+	}
+	record := page.Outputs[0]
+	if record.Tool != "gemini_generate" || record.Model != "gemini-2.5-flash-image-preview" || len(record.Files) != 2 || record.Files[0].SHA256 == "" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	// The metadata file and the index share the run ID
+	if data, _ := os.ReadFile(generated.SavedFiles[1]); !strings.Contains(string(data), record.ID) {
+		t.Errorf("metadata file %s does not hold run ID %s", data, record.ID)
+	}
+	os.Remove(generated.SavedFiles[1])
+	var got OutputRecord
+	call("outputs_get", map[string]any{"path": generated.SavedFiles[0]}, &got)
+	if got.ID != record.ID || got.Arguments["prompt"] != "A watercolor fox" || !slices.Equal(got.Missing, generated.SavedFiles[1:]) {
+		t.Errorf("outputs_get = %+v", got)
+	}
+}
+
+func TestFindSimilar(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: dir}, embeddings: &embedding.Fake{Dimensions: 1024}}
+
+	// draw saves an image whose fake caption is its scene
+	type drawInput struct {
+		Prompt string `json:"prompt"`
+		Scene  string `json:"scene"`
+	}
+	type drawOutput struct {
+		SavedFiles []string `json:"saved_files"`
+	}
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerIndexTools(mcpServer)
+	server.registerSimilarTools(mcpServer)
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "draw"}, func(ctx context.Context, req *mcp.CallToolRequest, input drawInput) (*mcp.CallToolResult, drawOutput, error) {
+		image := filepath.Join(dir, runID(ctx)+".png")
+		os.WriteFile(image, []byte(input.Scene), 0644)
+		return nil, drawOutput{SavedFiles: []string{image}}, nil
+	})
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(name string, args map[string]any, output any) {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+		if err != nil || result.IsError {
+			t.Fatalf("%s: %v, %v", name, err, result)
+		}
+		data, _ := json.Marshal(result.StructuredContent)
+		json.Unmarshal(data, output)
+	}
+	prompts := func(output FindSimilarOutput) []string {
+		var p []string
+		for _, o := range output.Outputs {
+			p = append(p, o.Prompt)
+		}
+		return p
+	}
+
+	var fox drawOutput
+	call("draw", map[string]any{"prompt": "Poster for the winter fair", "scene": "a red fox asleep in deep snow"}, &fox)
+	call("draw", map[string]any{"prompt": "Logo for a bakery", "scene": "a loaf of bread and a wheat sheaf"}, &drawOutput{})
+	call("draw", map[string]any{"prompt": "Book cover", "scene": "a fox cub in the snow under pine trees"}, &drawOutput{})
+	server.embedding.Wait()
+
+	// Captions are searched by meaning, though no prompt mentions a fox
+	var similar FindSimilarOutput
+	call("find_similar", map[string]any{"query": "red fox asleep", "limit": 2}, &similar)
+	if got := prompts(similar); !slices.Equal(got, []string{"Poster for the winter fair", "Book cover"}) {
+		t.Errorf("find_similar by query = %q", got)
+	}
+	if o := similar.Outputs[0]; o.Caption != "a red fox asleep in deep snow" || o.Score <= similar.Outputs[1].Score || o.Score <= 0 {
+		t.Errorf("unexpected match %+v", o)
+	}
+
+	// An image finds the others like it, but not itself
+	similar = FindSimilarOutput{}
+	call("find_similar", map[string]any{"image_path": fox.SavedFiles[0]}, &similar)
+	if got := prompts(similar); len(got) != 2 || got[0] != "Book cover" {
+		t.Errorf("find_similar by image = %q", got)
+	}
+
+	// An image that was never indexed is captioned
+	other := filepath.Join(t.TempDir(), "bread.png")
+	os.WriteFile(other, []byte("bread from the bakery"), 0644)
+	call("find_similar", map[string]any{"image_path": other, "limit": 1}, &similar)
+	if got := prompts(similar); !slices.Equal(got, []string{"Logo for a bakery"}) {
+		t.Errorf("find_similar by a new image = %q", got)
+	}
+
+	result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "find_similar", Arguments: map[string]any{}})
+	if err != nil || !result.IsError {
+		t.Errorf("find_similar without a query = %v, %v", result, err)
+	}
+}
+
+func TestRemix(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: dir}}
+
+	// veo_text_to_video saves a video and a metadata file like the real tool
+	type videoInput struct {
+		Prompt          string `json:"prompt"`
+		Model           string `json:"model,omitempty"`
+		AspectRatio     string `json:"aspect_ratio,omitempty"`
+		Seed            int    `json:"seed,omitempty"`
+		OutputDirectory string `json:"output_directory,omitempty"`
+	}
+	type videoOutput struct {
+		Model      string   `json:"model"`
+		SavedFiles []string `json:"saved_files"`
+	}
+	var calls []videoInput
+	mcpServer := mcp.NewServer(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	server.registerIndexTools(mcpServer)
+	server.registerRemixTools(mcpServer)
+	mcpServer.AddReceivingMiddleware(server.remixMiddleware)
+	mcp.AddTool(mcpServer, &mcp.Tool{Name: "veo_text_to_video"}, func(ctx context.Context, req *mcp.CallToolRequest, input videoInput) (*mcp.CallToolResult, videoOutput, error) {
+		calls = append(calls, input)
+		video := filepath.Join(input.OutputDirectory, runID(ctx)+".mp4")
+		os.WriteFile(video, []byte(input.Prompt), 0644)
+		metadata := map[string]any{
+			"generation_type": "text-to-video",
+			"model":           input.Model,
+			"prompt":          input.Prompt,
+			"seed":            input.Seed,
+			"run_id":          runID(ctx),
+		}
+		if parent := parentRunID(ctx); parent != "" {
+			metadata["parent_run_id"] = parent
+		}
+		path := filepath.Join(input.OutputDirectory, runID(ctx)+".json")
+		data, _ := json.Marshal(metadata)
+		os.WriteFile(path, data, 0644)
+		return nil, videoOutput{Model: input.Model, SavedFiles: []string{video, path}}, nil
+	})
+
+	ctx := context.Background()
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := mcpServer.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSession.Close()
+	client := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "1"}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	call := func(name string, args map[string]any) videoOutput {
+		t.Helper()
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: args})
+		if err != nil || result.IsError {
+			t.Fatalf("%s: %v, %v", name, err, result)
+		}
+		var output videoOutput
+		data, _ := json.Marshal(result.StructuredContent)
+		json.Unmarshal(data, &output)
+		return output
+	}
+	metadata := func(path string) map[string]any {
+		var m map[string]any
+		data, _ := os.ReadFile(path)
+		json.Unmarshal(data, &m)
+		return m
+	}
+
+	original := call("veo_text_to_video", map[string]any{"prompt": "A fox in the snow", "model": "veo-3.0-generate-001", "aspect_ratio": "9:16", "seed": 1, "output_directory": dir})
+	originalID := metadata(original.SavedFiles[1])["run_id"].(string)
+
+	// By run ID, with a new seed and prompt
+	remixed := call("remix", map[string]any{"run_id": originalID, "seed": 2, "prompt": "A fox in the rain"})
+	want := videoInput{Prompt: "A fox in the rain", Model: "veo-3.0-generate-001", AspectRatio: "9:16", Seed: 2, OutputDirectory: dir}
+	if calls[1] != want {
+		t.Errorf("remix by run ID called %+v, want %+v", calls[1], want)
+	}
+	remixedMetadata := metadata(remixed.SavedFiles[1])
+	if remixedMetadata["parent_run_id"] != originalID {
+		t.Errorf("metadata of the remix = %v, want parent %s", remixedMetadata, originalID)
+	}
+	if entry, _, _ := server.indexAt(dir).Get(remixedMetadata["run_id"].(string)); entry.Parent != originalID || entry.Tool != "veo_text_to_video" {
+		t.Errorf("index entry of the remix = %+v", entry)
+	}
+
+	// By metadata file, with a different model and any other argument
+	call("remix", map[string]any{"metadata_path": remixed.SavedFiles[1], "model": "veo-3.0-fast-generate-001", "arguments": map[string]any{"aspect_ratio": "16:9"}})
+	want = videoInput{Prompt: "A fox in the rain", Model: "veo-3.0-fast-generate-001", AspectRatio: "16:9", Seed: 2, OutputDirectory: dir}
+	if calls[2] != want {
+		t.Errorf("remix by metadata file called %+v, want %+v", calls[2], want)
+	}
+
+	// Metadata files of runs missing from the index are replayed from their fields
+	other := filepath.Join(t.TempDir(), "veo_text_to_video_metadata_20250101_120000.json")
+	os.WriteFile(other, []byte(`{"generation_type": "text-to-video", "model": "veo-3.0-generate-001", "prompt": "A lighthouse", "seed": 7, "status": "completed", "run_id": "20250101-120000-00000000"}`), 0644)
+	lighthouse := call("remix", map[string]any{"metadata_path": other})
+	want = videoInput{Prompt: "A lighthouse", Model: "veo-3.0-generate-001", Seed: 7, OutputDirectory: filepath.Dir(other)}
+	if calls[3] != want {
+		t.Errorf("remix of an unindexed metadata file called %+v, want %+v", calls[3], want)
+	}
+	if parent := metadata(lighthouse.SavedFiles[1])["parent_run_id"]; parent != "20250101-120000-00000000" {
+		t.Errorf("parent of the remix = %v", parent)
+	}
+
+	for _, args := range []map[string]any{{"run_id": "missing"}, {}} {
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "remix", Arguments: args})
+		if err != nil || !result.IsError {
+			t.Errorf("remix %v = %v, %v", args, result, err)
+		}
+	}
+
+	// Arguments the tool does not take are named
+	for _, args := range []map[string]any{
+		{"run_id": originalID, "style": "watercolor"},
+		{"run_id": originalID, "arguments": map[string]any{"style": "watercolor"}},
+	} {
+		result, err := session.CallTool(ctx, &mcp.CallToolParams{Name: "remix", Arguments: args})
+		if err != nil || !result.IsError || !strings.Contains(result.Content[0].(*mcp.TextContent).Text, "veo_text_to_video has no style argument") {
+			t.Errorf("remix %v = %v, %v", args, result, err)
+		}
+	}
+	if len(calls) != 4 {
+		t.Errorf("%d calls of veo_text_to_video, want 4", len(calls))
+	}
+}
+
+// fakeGeminiAPI serves the Gemini API with handler and returns a client of it.
+func fakeGeminiAPI(t *testing.T, handler http.HandlerFunc) *genai.Client {
+	t.Helper()
+	api := httptest.NewServer(handler)
+	t.Cleanup(api.Close)
+	client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
+		APIKey:      "test-key",
+		Backend:     genai.BackendGeminiAPI,
+		HTTPOptions: genai.HTTPOptions{BaseURL: api.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestVeoConfig(t *testing.T) {
+	var requests []map[string]any
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		json.NewDecoder(req.Body).Decode(&body)
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name": "operations/1", "done": true, "response": {"generateVideoResponse": {"generatedSamples": []}}}`)
+	})
+	server := &Server{config: &config.Config{}, client: client}
+	ctx := context.Background()
+
+	input := VeoTextToVideoInput{Prompt: "A fox", AspectRatio: "9:16", Resolution: "1080p", Seed: 42}
+	_, _, err := server.handleVeoTextToVideo(ctx, nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"aspectRatio": "9:16", "resolution": "1080p", "seed": float64(42)}
+	if len(requests) != 1 || !reflect.DeepEqual(requests[0]["parameters"], want) {
+		t.Errorf("parameters sent = %v, want %v", requests, want)
+	}
+
+	// A dry run reports the config the call sends
+	input.DryRun = true
+	_, output, err := server.handleVeoTextToVideo(ctx, nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("dry run sent a request")
+	}
+	if output.DryRun == nil || !reflect.DeepEqual(output.DryRun.Config, videoConfig("9:16", "1080p", 42)) {
+		t.Errorf("dry run config = %+v, want the config sent", output.DryRun)
+	}
+}
+
+func TestDryRunFiles(t *testing.T) {
+	var paths []string
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"totalTokens": 5}`)
+	})
+	server := &Server{config: &config.Config{FileUploadThreshold: 100}, client: client}
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 800, 400))); err != nil {
+		t.Fatal(err)
+	}
+	imagePath := filepath.Join(dir, "photo.png")
+	audioPath := filepath.Join(dir, "talk.mp3")
+	os.WriteFile(imagePath, buf.Bytes(), 0o644)
+	os.WriteFile(audioPath, make([]byte, 1000), 0o644)
+
+	input := GeminiGenerateTextInput{Prompt: "Describe", AttachmentPaths: []string{imagePath, audioPath}, DryRun: true}
+	_, output, err := server.handleGeminiGenerateText(context.Background(), nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the prompt is counted by the API; nothing is uploaded
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], ":countTokens") {
+		t.Errorf("dry run requests = %v, want a single countTokens", paths)
+	}
+	want := []DryRunFile{
+		{Path: imagePath, MIMEType: "image/png", SizeBytes: int64(buf.Len()), Upload: buf.Len() > 100, Tokens: 2 * 258},
+		{Path: audioPath, MIMEType: "audio/mpeg", SizeBytes: 1000, Upload: true},
+	}
+	if !reflect.DeepEqual(output.DryRun.Files, want) {
+		t.Errorf("dry run files = %+v, want %+v", output.DryRun.Files, want)
+	}
+	if got := output.DryRun.Estimate.Items[0].InputTokens; got != 5+2*258 {
+		t.Errorf("input tokens = %d, want %d", got, 5+2*258)
+	}
+	if output.DryRun.Estimate.Complete {
+		t.Error("estimate should be incomplete without the length of the audio")
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	var paths []string
+	countFails := false
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if countFails {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error": {"code": 400, "message": "bad request", "status": "INVALID_ARGUMENT"}}`)
+			return
+		}
+		io.WriteString(w, `{"totalTokens": 5}`)
+	})
+	server := &Server{config: &config.Config{FileUploadThreshold: 100}, client: client, prices: pricing.DefaultTable()}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 800, 400))); err != nil {
+		t.Fatal(err)
+	}
+	imagePath := filepath.Join(t.TempDir(), "photo.png")
+	os.WriteFile(imagePath, buf.Bytes(), 0o644)
+	input := EstimateCostInput{Model: "gemini-2.5-flash", Prompt: "Describe this photo", AttachmentPaths: []string{imagePath}}
+
+	_, estimate, err := server.handleEstimateCost(context.Background(), nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The attachment is measured locally, not uploaded
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], ":countTokens") {
+		t.Errorf("estimate requests = %v, want a single countTokens", paths)
+	}
+	if got := estimate.Items[0].InputTokens; got != 5+2*258 || !estimate.Complete {
+		t.Errorf("estimate = %d tokens, complete %v, want %d and complete", got, estimate.Complete, 5+2*258)
+	}
+
+	// A count estimated from the text length is not exact
+	countFails = true
+	_, estimate, err = server.handleEstimateCost(context.Background(), nil, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := estimate.Items[0].InputTokens; got != 5+2*258 || estimate.Complete {
+		t.Errorf("fallback estimate = %d tokens, complete %v, want %d and incomplete", got, estimate.Complete, 5+2*258)
+	}
+}
+
+func TestImageSessionDryRun(t *testing.T) {
+	var requests []map[string]any
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, ":countTokens") {
+			t.Errorf("dry run called %s", req.URL.Path)
+		}
+		var body map[string]any
+		json.NewDecoder(req.Body).Decode(&body)
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"totalTokens": 5}`)
+	})
+	server := &Server{config: &config.Config{}, client: client, sessions: session.NewStore(time.Hour, 0)}
+	ctx := context.Background()
+
+	_, output, err := server.handleGeminiImageSessionStart(ctx, nil, GeminiImageSessionStartInput{Prompt: "A fox", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.DryRun == nil || output.Turn != 1 || len(server.sessions.List()) != 0 {
+		t.Errorf("start dry run = %+v with %d sessions, want turn 1 and no session", output, len(server.sessions.List()))
+	}
+
+	sess, err := server.sessions.Create("gemini-2.5-flash-image-preview", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := []*genai.Content{
+		genai.NewContentFromText("A fox", genai.RoleUser),
+		genai.NewContentFromText("Here it is", genai.RoleModel),
+	}
+	if _, err := server.sessions.AppendTurn(sess.ID, history, session.Turn{Index: 1, Prompt: "A fox"}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests = nil
+	input := GeminiImageSessionEditInput{SessionID: sess.ID, EditPrompt: "Darker sky", DryRun: true}
+	if _, output, err = server.handleGeminiImageSessionEdit(ctx, nil, input); err != nil {
+		t.Fatal(err)
+	}
+	// The history is counted along with the new prompt
+	if contents, _ := requests[0]["contents"].([]any); len(requests) != 1 || len(contents) != 3 {
+		t.Errorf("dry run counted %v, want the history and the prompt", requests)
+	}
+	if output.Turn != 2 || output.DryRun.Prompt != "Darker sky" {
+		t.Errorf("edit dry run = %+v, want turn 2", output)
+	}
+
+	branch := GeminiImageSessionBranchInput{SessionID: sess.ID, Turn: 1, EditPrompt: "Add snow", DryRun: true}
+	if _, output, err = server.handleGeminiImageSessionBranch(ctx, nil, branch); err != nil {
+		t.Fatal(err)
+	}
+	if output.ParentSessionID != sess.ID || output.Turn != 2 || len(server.sessions.List()) != 1 {
+		t.Errorf("branch dry run = %+v, want a preview of turn 2 and no new session", output)
+	}
+	if got, _ := server.sessions.Get(sess.ID); len(got.Turns) != 1 {
+		t.Errorf("dry runs changed the session: %d turns", len(got.Turns))
+	}
+}
+
+func TestSubtitleDir(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := filepath.Join(dir, "inputs")
+	outputs := filepath.Join(dir, "outputs")
+	box, err := sandbox.New([]string{inputs}, []string{outputs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: &config.Config{OutputDir: outputs}, sandbox: box}
+	ctx := context.Background()
+
+	// Media that may only be read gets its subtitles in the output directory
+	if got := server.subtitleDir(ctx, &mcp.CallToolRequest{}, inputs); got != "" {
+		t.Errorf("subtitleDir(%s) = %q, want the output directory", inputs, got)
+	}
+	clips := filepath.Join(outputs, "clips")
+	if got := server.subtitleDir(ctx, &mcp.CallToolRequest{}, clips); got != clips {
+		t.Errorf("subtitleDir(%s) = %q, want it unchanged", clips, got)
+	}
+}
+
+func TestSubtitleBase(t *testing.T) {
+	dir := t.TempDir()
+	if got := subtitleBase(dir, "talk", "en", "20250101_120000"); got != "talk.en" {
+		t.Errorf("subtitleBase() = %q, want talk.en", got)
+	}
+	if got := subtitleBase(dir, "talk", "../es MX", "20250101_120000"); got != "talk.esMX" {
+		t.Errorf("subtitleBase() of an unsafe language = %q, want talk.esMX", got)
+	}
+
+	// Existing subtitles are kept
+	os.WriteFile(filepath.Join(dir, "talk.en.vtt"), []byte("WEBVTT"), 0o644)
+	if got := subtitleBase(dir, "talk", "en", "20250101_120000"); got != "talk_20250101_120000.en" {
+		t.Errorf("subtitleBase() with existing subtitles = %q", got)
+	}
+	os.WriteFile(filepath.Join(dir, "talk_20250101_120000.en.srt"), nil, 0o644)
+	if got := subtitleBase(dir, "talk", "en", "20250101_120000"); got != "talk_20250101_120000_2.en" {
+		t.Errorf("subtitleBase() with existing timestamped subtitles = %q", got)
+	}
+}
+
+func TestFilesRetry(t *testing.T) {
+	calls := 0
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error": {"code": 503, "message": "Try again", "status": "UNAVAILABLE"}}`)
+			return
+		}
+		io.WriteString(w, `{"name": "files/abc", "mimeType": "video/mp4", "state": "ACTIVE"}`)
+	})
+	server := &Server{config: &config.Config{RetryMaxAttempts: 2}, client: client}
+
+	_, file, err := server.handleFilesGet(context.Background(), nil, FilesGetInput{Name: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || file.Name != "files/abc" {
+		t.Errorf("files_get made %d calls and returned %+v, want a retry and files/abc", calls, file)
+	}
+}
+
+func TestBilledTools(t *testing.T) {
+	server := &Server{config: &config.Config{OutputDir: t.TempDir()}}
+	ctx := context.Background()
+	mcpServer, err := server.newMCPServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools, err := listTools(ctx, mcpServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range billedTools {
+		if _, ok := tools[name]; !ok {
+			t.Errorf("billed tool %s is not registered", name)
+		}
+	}
+	for _, name := range []string{"cache_create", "find_similar", "gemini_transcribe"} {
+		if !isBilledTool(name) {
+			t.Errorf("%s should be billed", name)
+		}
+	}
+	if isBilledTool("gemini_image_session_list") {
+		t.Error("gemini_image_session_list should not be billed")
+	}
+}
+
+func TestCacheModel(t *testing.T) {
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name": "cachedContents/1", "model": "models/gemini-2.5-flash"}`)
+	})
+	server := &Server{config: &config.Config{}, client: client}
+	ctx := context.Background()
+
+	_, model, err := server.cachedContentConfig(ctx, "cachedContents/1", "", false)
+	if err != nil || model != "gemini-2.5-flash" {
+		t.Errorf("text tool got model %q, %v, want the cache's model", model, err)
+	}
+	// Image tools cannot use a cache of a text model
+	if _, _, err := server.cachedContentConfig(ctx, "cachedContents/1", "", true); err == nil || !strings.Contains(err.Error(), "does not generate images") {
+		t.Errorf("image tool with a text model cache: %v, want an error", err)
+	}
+	// The system instruction of a cached request belongs to the cache
+	var apiErr *retry.Error
+	_, _, err = server.handleGeminiGenerateText(ctx, nil, GeminiGenerateTextInput{Prompt: "Hi", CacheName: "cachedContents/1", SystemInstruction: "Be brief"})
+	if !errors.As(err, &apiErr) || apiErr.Kind != retry.KindInvalidArgument || !strings.Contains(apiErr.Message, "cache_create") {
+		t.Errorf("system_instruction with cache_name: %v, want an invalid_argument error", err)
+	}
+}
+
+func TestUploadOwners(t *testing.T) {
+	files := map[string]string{"files/a": "token-alice/a.png", "files/b": "token-bob/b.png"}
+	var deleted []string
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		name := "files/" + filepath.Base(req.URL.Path)
+		switch {
+		case req.Method == http.MethodDelete:
+			deleted = append(deleted, name)
+			io.WriteString(w, `{}`)
+		case strings.HasSuffix(req.URL.Path, "/files"):
+			io.WriteString(w, `{"files": [{"name": "files/a", "displayName": "token-alice/a.png"}, {"name": "files/b", "displayName": "token-bob/b.png"}]}`)
+		default:
+			fmt.Fprintf(w, `{"name": %q, "displayName": %q}`, name, files[name])
+		}
+	})
+	server := &Server{config: &config.Config{}, client: client}
+	ctx := context.WithValue(context.Background(), tenantKey{}, "token-alice")
+
+	_, list, err := server.handleFilesList(ctx, nil, FilesListInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 1 || list.Files[0].Name != "files/a" || list.Files[0].DisplayName != "a.png" {
+		t.Errorf("files_list = %+v, want only alice's upload", list.Files)
+	}
+	if _, _, err := server.handleFilesGet(ctx, nil, FilesGetInput{Name: "files/b"}); err == nil {
+		t.Error("files_get returned another tenant's upload")
+	}
+	_, output, err := server.handleFilesDelete(ctx, nil, FilesDeleteInput{Names: []string{"files/a", "files/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(deleted, []string{"files/a"}) || output.Errors["files/b"] == "" {
+		t.Errorf("files_delete deleted %v with errors %v, want only files/a", deleted, output.Errors)
+	}
+}
+
+func TestCacheOwners(t *testing.T) {
+	caches := map[string]string{"cachedContents/a": "token-alice/brand", "cachedContents/b": "token-bob/brand"}
+	var created map[string]any
+	var deleted []string
+	client := fakeGeminiAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		name := "cachedContents/" + filepath.Base(req.URL.Path)
+		switch {
+		case req.Method == http.MethodPost:
+			json.NewDecoder(req.Body).Decode(&created)
+			io.WriteString(w, `{"name": "cachedContents/c", "displayName": "token-alice/logo", "model": "models/gemini-2.5-flash"}`)
+		case req.Method == http.MethodDelete:
+			deleted = append(deleted, name)
+			io.WriteString(w, `{}`)
+		case strings.HasSuffix(req.URL.Path, "/cachedContents"):
+			io.WriteString(w, `{"cachedContents": [{"name": "cachedContents/a", "displayName": "token-alice/brand"}, {"name": "cachedContents/b", "displayName": "token-bob/brand"}]}`)
+		default:
+			fmt.Fprintf(w, `{"name": %q, "displayName": %q}`, name, caches[name])
+		}
+	})
+	server := &Server{config: &config.Config{}, client: client}
+	ctx := context.WithValue(context.Background(), tenantKey{}, "token-alice")
+
+	_, info, err := server.handleCacheCreate(ctx, nil, CacheCreateInput{Name: "logo", SystemInstruction: "Use the logo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created["displayName"] != "token-alice/logo" || info.DisplayName != "logo" {
+		t.Errorf("created %v as %q, want it recorded as alice's", created["displayName"], info.DisplayName)
+	}
+
+	_, list, err := server.handleCacheList(ctx, nil, CacheListInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Caches) != 1 || list.Caches[0].Name != "cachedContents/a" || list.Caches[0].DisplayName != "brand" {
+		t.Errorf("cache_list = %+v, want only alice's cache", list.Caches)
+	}
+	// Bob's cache cannot be found by name, used, extended or deleted
+	if cache, err := server.findCache(ctx, "brand"); err != nil || cache.Name != "cachedContents/a" {
+		t.Errorf("findCache(brand) = %v, %v, want alice's cache", cache, err)
+	}
+	if _, _, err := server.cachedContentConfig(ctx, "cachedContents/b", "", false); err == nil {
+		t.Error("another tenant's cache was used")
+	}
+	if _, _, err := server.handleCacheUpdate(ctx, nil, CacheUpdateInput{CacheName: "cachedContents/b", TTL: "2h"}); err == nil {
+		t.Error("another tenant's cache was updated")
+	}
+	if _, _, err := server.handleCacheDelete(ctx, nil, CacheDeleteInput{CacheName: "cachedContents/b"}); err == nil || len(deleted) != 0 {
+		t.Errorf("another tenant's cache was deleted: %v", deleted)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gemini-mcp/internal/models"
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// modelListTTL is how long the model list used for validation is cached.
+const modelListTTL = time.Hour
+
+// Model discovery
+type ListModelsInput struct {
+	Capability string `json:"capability,omitempty" jsonschema:"description:Only list models with this capability,enum:image,enum:video,enum:tts,enum:text,enum:embedding,enum:other"`
+	Refresh    bool   `json:"refresh,omitempty" jsonschema:"description:Fetch the model list again instead of using the cached copy,default:false"`
+}
+
+type ModelGroup struct {
+	Capability string        `json:"capability"`
+	Models     []models.Info `json:"models"`
+}
+
+type ListModelsOutput struct {
+	Groups []ModelGroup `json:"groups"`
+	Count  int          `json:"count"`
+}
+
+func (s *Server) registerModelTools(server *mcp.Server) {
+	// Check model arguments against the model list
+	server.AddReceivingMiddleware(s.modelMiddleware)
+
+	// Register list_models tool
+	addTool(server, &mcp.Tool{
+		Name:        "list_models",
+		Description: "List the models available to the configured API key, grouped by capability (image, video, tts, text, embedding), with the API actions each supports and its token limits. Use it to find valid values for the model argument of the other tools.",
+	}, s.handleListModels)
+}
+
+// modelMiddleware refuses tool calls whose model argument is not in the model
+// list, suggesting similar model names. Calls go ahead if the list cannot be
+// fetched.
+func (s *Server) modelMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil || s.catalog == nil || !s.config.ValidateModels {
+			return next(ctx, method, req)
+		}
+
+		var args struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(callReq.Params.Arguments, &args) != nil || args.Model == "" {
+			return next(ctx, method, req)
+		}
+
+		err := s.catalog.Validate(ctx, args.Model)
+		var unknown *models.UnknownModelError
+		if errors.As(err, &unknown) {
+			return &mcp.CallToolResult{
+				IsError: true,
+				Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+				StructuredContent: map[string]any{"error": ToolError{
+					Kind:        retry.KindInvalidArgument,
+					Message:     err.Error(),
+					Suggestions: unknown.Suggestions,
+				}},
+			}, nil
+		}
+		if err != nil {
+			log.Printf("Not validating model %s: %v", args.Model, err)
+		}
+		return next(ctx, method, req)
+	}
+}
+
+// listModels fetches the models available to the API key.
+func (s *Server) listModels(ctx context.Context) ([]models.Info, error) {
+	var infos []models.Info
+	for model, err := range s.client.Models.All(ctx) {
+		if err != nil {
+			return nil, fmt.Errorf("error listing models: %w", err)
+		}
+		infos = append(infos, models.NewInfo(model))
+	}
+	return infos, nil
+}
+
+func (s *Server) handleListModels(ctx context.Context, req *mcp.CallToolRequest, input ListModelsInput) (*mcp.CallToolResult, ListModelsOutput, error) {
+	if input.Capability != "" && !slices.Contains(models.Capabilities, input.Capability) {
+		return nil, ListModelsOutput{}, fmt.Errorf("unsupported capability: %s", input.Capability)
+	}
+
+	if s.catalog == nil {
+		return nil, ListModelsOutput{}, fmt.Errorf("model list is not available")
+	}
+
+	available, err := s.catalog.Models(ctx, input.Refresh)
+	if err != nil {
+		return nil, ListModelsOutput{}, err
+	}
+
+	output := ListModelsOutput{Groups: []ModelGroup{}}
+	for _, capability := range models.Capabilities {
+		if input.Capability != "" && capability != input.Capability {
+			continue
+		}
+		group := ModelGroup{Capability: capability}
+		for _, model := range available {
+			if model.Capability == capability {
+				group.Models = append(group.Models, model)
+			}
+		}
+		if len(group.Models) > 0 {
+			output.Groups = append(output.Groups, group)
+			output.Count += len(group.Models)
+		}
+	}
+	return nil, output, nil
+}
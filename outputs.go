@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/sandbox"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// outputsPageSize is the default number of entries outputs_list and
+// outputs_search return, and outputsMaxPageSize the most they return.
+const (
+	outputsPageSize    = 20
+	outputsMaxPageSize = 100
+)
+
+// promptArgs are the tool arguments indexed as the prompt of a generation,
+// in order of preference.
+var promptArgs = []string{"prompt", "edit_prompt", "combine_prompt", "question"}
+
+// runIDKey is the context key of the run ID of a tool call.
+type runIDKey struct{}
+
+// runID returns the run ID of the current tool call, which its entry in the
+// output index and its metadata file share.
+func runID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// indexAt returns the output index of an output directory.
+func (s *Server) indexAt(dir string) *index.Index {
+	path := filepath.Join(dir, index.Filename)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexes == nil {
+		s.indexes = make(map[string]*index.Index)
+	}
+	ix, ok := s.indexes[path]
+	if !ok {
+		ix = index.Open(path)
+		s.indexes[path] = ix
+	}
+	return ix
+}
+
+// outputIndex returns the output index of the caller.
+func (s *Server) outputIndex(ctx context.Context) *index.Index {
+	return s.indexAt(s.outputDir(ctx))
+}
+
+// indexMiddleware gives each tool call a run ID and adds the calls that save
+// files to the output index of the caller.
+func (s *Server) indexMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil {
+			return next(ctx, method, req)
+		}
+		id := index.NewID(time.Now())
+		ctx = context.WithValue(ctx, runIDKey{}, id)
+
+		result, err := next(ctx, method, req)
+		output := parseOutput(result)
+		if err != nil || len(output.SavedFiles) == 0 {
+			return result, err
+		}
+
+		var args map[string]any
+		json.Unmarshal(callReq.Params.Arguments, &args)
+		entry := index.Entry{
+			ID:        id,
+			Time:      time.Now().UTC(),
+			Tool:      callReq.Params.Name,
+			Model:     output.Model,
+			Files:     fileHashes(output.SavedFiles...),
+			Arguments: callReq.Params.Arguments,
+			Parent:    parentRunID(ctx),
+		}
+		if entry.Model == "" {
+			entry.Model = stringArg(args, "model")
+		}
+		for _, name := range promptArgs {
+			if entry.Prompt = stringArg(args, name); entry.Prompt != "" {
+				break
+			}
+		}
+		if tags, ok := args["tags"].([]any); ok {
+			for _, tag := range tags {
+				if tag, ok := tag.(string); ok && tag != "" {
+					entry.Tags = append(entry.Tags, tag)
+				}
+			}
+		}
+		ix := s.outputIndex(ctx)
+		if err := ix.Put(entry); err != nil {
+			log.Printf("Error indexing %s: %v", callReq.Params.Name, err)
+		} else {
+			s.embedInBackground(ctx, ix, entry)
+		}
+		return result, nil
+	}
+}
+
+// OutputRecord is a generation in the output index.
+type OutputRecord struct {
+	ID     string     `json:"id"`
+	Time   time.Time  `json:"time"`
+	Tool   string     `json:"tool"`
+	Model  string     `json:"model,omitempty"`
+	Prompt string     `json:"prompt,omitempty"`
+	Tags   []string   `json:"tags,omitempty"`
+	Files  []cas.File `json:"files"`
+	// Caption describes the first image, if embeddings are enabled.
+	Caption string `json:"caption,omitempty"`
+	// Parent is the run ID of the generation this one remixes.
+	Parent string `json:"parent,omitempty"`
+	// Arguments and Missing are only returned by outputs_get.
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Missing   []string       `json:"missing,omitempty"`
+}
+
+func outputRecord(e index.Entry) OutputRecord {
+	files := e.Files
+	if files == nil {
+		files = []cas.File{}
+	}
+	return OutputRecord{ID: e.ID, Time: e.Time, Tool: e.Tool, Model: e.Model, Prompt: e.Prompt, Tags: e.Tags, Files: files, Caption: e.Caption, Parent: e.Parent}
+}
+
+// OutputsFilter narrows down the generations outputs_list and
+// outputs_search return.
+type OutputsFilter struct {
+	Tool   string `json:"tool,omitempty" jsonschema:"description:Only generations of this tool, e.g. 'imagen_t2i'"`
+	Model  string `json:"model,omitempty" jsonschema:"description:Only generations of this model"`
+	Tag    string `json:"tag,omitempty" jsonschema:"description:Only generations with this tag"`
+	Since  string `json:"since,omitempty" jsonschema:"description:Only generations at or after this time, as RFC 3339 (2025-06-01T12:00:00Z) or a date (2025-06-01)"`
+	Until  string `json:"until,omitempty" jsonschema:"description:Only generations at or before this time, as RFC 3339 or a date, which includes the whole day"`
+	Offset int    `json:"offset,omitempty" jsonschema:"description:Number of results to skip, for paging,default:0"`
+	Limit  int    `json:"limit,omitempty" jsonschema:"description:Maximum number of results, at most 100,default:20"`
+}
+
+// query returns the index query of f.
+func (f OutputsFilter) query() (index.Query, error) {
+	q := index.Query{Tool: f.Tool, Model: f.Model, Tag: f.Tag, Offset: f.Offset, Limit: f.Limit}
+	var err error
+	if q.Since, err = parseTime(f.Since, false); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(f.Until, true); err != nil {
+		return q, err
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return q, fmt.Errorf("offset and limit must not be negative")
+	}
+	if q.Limit == 0 {
+		q.Limit = outputsPageSize
+	}
+	q.Limit = min(q.Limit, outputsMaxPageSize)
+	return q, nil
+}
+
+// parseTime parses an RFC 3339 time or a date, which stands for its start or,
+// if end is set, its end.
+func parseTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339 or YYYY-MM-DD", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// OutputsListInput selects a page of generations.
+type OutputsListInput struct {
+	OutputsFilter
+}
+
+// OutputsSearchInput is a full-text search of generations.
+type OutputsSearchInput struct {
+	Query string `json:"query" jsonschema:"description:Words to find in prompts, tags and image captions, e.g. 'watercolor fox'. Every word must match; words also match longer words they begin."`
+	OutputsFilter
+}
+
+// OutputsPage is a page of generations.
+type OutputsPage struct {
+	Outputs []OutputRecord `json:"outputs"`
+	Total   int            `json:"total"`
+	// NextOffset is the offset of the next page, if there is one.
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// OutputsGetInput selects a generation by run ID or file.
+type OutputsGetInput struct {
+	ID   string `json:"id,omitempty" jsonschema:"description:Run ID of the generation, as returned by outputs_list and outputs_search or written to its metadata file"`
+	Path string `json:"path,omitempty" jsonschema:"description:A file the generation saved, instead of its run ID"`
+}
+
+func (s *Server) registerIndexTools(server *mcp.Server) {
+	// Index the generations of tool calls
+	server.AddReceivingMiddleware(s.indexMiddleware)
+
+	// Register outputs_list tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_list",
+		Description: "List past generations, newest first, with their tool, model, prompt, tags, time and saved files with SHA-256 hashes. Filter by tool, model, tag and time range, and page with offset and limit.",
+	}, s.handleOutputsList)
+
+	// Register outputs_search tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_search",
+		Description: "Search past generations by the words of their prompts and tags, such as 'watercolor fox', best matches first. Takes the same filters and paging as outputs_list, e.g. since '2025-06-03' to find last Tuesday's images.",
+	}, s.handleOutputsSearch)
+
+	// Register outputs_get tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_get",
+		Description: "Get a past generation by run ID or by one of its files, with the full arguments of the tool call and the files that no longer exist.",
+	}, s.handleOutputsGet)
+}
+
+func (s *Server) searchOutputs(ctx context.Context, q index.Query) (OutputsPage, error) {
+	entries, total, err := s.outputIndex(ctx).Search(q)
+	if err != nil {
+		return OutputsPage{}, err
+	}
+	page := OutputsPage{Outputs: []OutputRecord{}, Total: total}
+	for _, e := range entries {
+		page.Outputs = append(page.Outputs, outputRecord(e))
+	}
+	if next := q.Offset + len(entries); next < total {
+		page.NextOffset = next
+	}
+	return page, nil
+}
+
+func (s *Server) handleOutputsList(ctx context.Context, req *mcp.CallToolRequest, input OutputsListInput) (*mcp.CallToolResult, OutputsPage, error) {
+	q, err := input.query()
+	if err != nil {
+		return nil, OutputsPage{}, err
+	}
+	page, err := s.searchOutputs(ctx, q)
+	return nil, page, err
+}
+
+func (s *Server) handleOutputsSearch(ctx context.Context, req *mcp.CallToolRequest, input OutputsSearchInput) (*mcp.CallToolResult, OutputsPage, error) {
+	if len(index.Tokenize(input.Query)) == 0 {
+		return nil, OutputsPage{}, fmt.Errorf("query is required")
+	}
+	q, err := input.query()
+	if err != nil {
+		return nil, OutputsPage{}, err
+	}
+	q.Text = input.Query
+	page, err := s.searchOutputs(ctx, q)
+	return nil, page, err
+}
+
+func (s *Server) handleOutputsGet(ctx context.Context, req *mcp.CallToolRequest, input OutputsGetInput) (*mcp.CallToolResult, OutputRecord, error) {
+	ix := s.outputIndex(ctx)
+	var entry index.Entry
+	var found bool
+	var err error
+	switch {
+	case input.ID != "":
+		entry, found, err = ix.Get(input.ID)
+	case input.Path != "":
+		path, hash := input.Path, ""
+		if resolved, err := sandbox.Resolve(path); err == nil {
+			path = resolved
+		}
+		if file, err := cas.Describe(path); err == nil {
+			hash = file.SHA256
+		}
+		entry, found, err = ix.ByFile(path, hash)
+	default:
+		return nil, OutputRecord{}, fmt.Errorf("id or path is required")
+	}
+	if err != nil {
+		return nil, OutputRecord{}, err
+	}
+	if !found {
+		return nil, OutputRecord{}, fmt.Errorf("no generation found for %s%s", input.ID, input.Path)
+	}
+
+	record := outputRecord(entry)
+	json.Unmarshal(entry.Arguments, &record.Arguments)
+	for _, f := range entry.Files {
+		if _, err := os.Stat(f.Path); err != nil {
+			record.Missing = append(record.Missing, f.Path)
+		}
+	}
+	return nil, record, nil
+}
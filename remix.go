@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+
+	"github.com/google/jsonschema-go/jsonschema"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// parentRunIDKey is the context key of the run ID a tool call remixes.
+type parentRunIDKey struct{}
+
+// parentRunID returns the run ID of the generation the current tool call
+// remixes, if it is a remix.
+func parentRunID(ctx context.Context) string {
+	id, _ := ctx.Value(parentRunIDKey{}).(string)
+	return id
+}
+
+// sidecarArgs are the fields of the metadata files of each tool that are
+// arguments of the tool, for metadata files whose run is not in the index.
+var sidecarArgs = map[string][]string{
+	"gemini_image_generation": {"model", "prompt", "style", "aspect_ratio", "quality", "language", "include_text", "tags"},
+	"veo_generate_video":      {"model", "prompt", "negative_prompt", "aspect_ratio", "resolution"},
+	"veo_text_to_video":       {"model", "prompt", "negative_prompt", "aspect_ratio", "resolution", "seed"},
+	"veo_image_to_video":      {"model", "prompt", "negative_prompt", "aspect_ratio", "resolution", "seed", "input_image"},
+}
+
+// sidecarTool returns the tool that wrote a metadata file.
+func sidecarTool(metadata map[string]any) string {
+	switch {
+	case metadata["generation_type"] == "text-to-video":
+		return "veo_text_to_video"
+	case metadata["generation_type"] == "image-to-video":
+		return "veo_image_to_video"
+	case metadata["operation_id"] != nil:
+		return "veo_generate_video"
+	case metadata["enhanced_prompt"] != nil:
+		return "gemini_image_generation"
+	}
+	return ""
+}
+
+// RemixInput selects a generation to replay and the arguments to change.
+type RemixInput struct {
+	RunID        string         `json:"run_id,omitempty" jsonschema:"description:Run ID of the generation to replay, as returned by outputs_list or written to its metadata file"`
+	MetadataPath string         `json:"metadata_path,omitempty" jsonschema:"description:Metadata file of the generation to replay, such as gemini_metadata_<time>.json, instead of its run ID"`
+	Prompt       string         `json:"prompt,omitempty" jsonschema:"description:New prompt, replacing the one of the generation"`
+	Model        string         `json:"model,omitempty" jsonschema:"description:Different model to use"`
+	Seed         int            `json:"seed,omitempty" jsonschema:"description:New seed, for the tools that take one"`
+	Style        string         `json:"style,omitempty" jsonschema:"description:Different style, for the tools that take one"`
+	Arguments    map[string]any `json:"arguments,omitempty" jsonschema:"description:Any other arguments of the tool to change, e.g. {\"aspect_ratio\": \"9:16\"}"`
+}
+
+// remix is the run ID, tool and arguments of a replayed generation, and the
+// names of the arguments the caller changed.
+type remix struct {
+	parent  string
+	tool    string
+	args    map[string]any
+	changed []string
+}
+
+func (s *Server) registerRemixTools(server *mcp.Server) {
+	// Register remix tool
+	addTool(server, &mcp.Tool{
+		Name:        "remix",
+		Description: "Replay a past generation, found by run ID or metadata file, with the same tool and arguments, changing any of them: a new seed, a different model or style, a tweaked prompt. Returns the result of the replayed tool, and its metadata file records the run ID of the original as parent_run_id.",
+	}, s.handleRemix)
+}
+
+// handleRemix is only reached if remixMiddleware is not installed, since
+// the middleware turns remix calls into calls of the replayed tool.
+func (s *Server) handleRemix(ctx context.Context, req *mcp.CallToolRequest, input RemixInput) (*mcp.CallToolResult, any, error) {
+	return nil, nil, fmt.Errorf("remix is not available")
+}
+
+// remixMiddleware turns a remix call into a call of the tool it replays,
+// with the recorded arguments and the changes asked for. It runs before
+// tool settings, isolation and the sandbox, so the replayed call is treated
+// like any other call of its tool.
+func (s *Server) remixMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil || callReq.Params.Name != "remix" {
+			return next(ctx, method, req)
+		}
+
+		var input RemixInput
+		if err := json.Unmarshal(callReq.Params.Arguments, &input); err != nil {
+			return remixError(retry.KindInvalidArgument, fmt.Errorf("invalid remix arguments: %w", err)), nil
+		}
+		r, err := s.resolveRemix(ctx, callReq, input)
+		if err != nil {
+			log.Printf("Refusing remix: %v", err)
+			return remixError(retry.KindInvalidArgument, err), nil
+		}
+		// Arguments the tool does not take would fail its schema with a
+		// less helpful message
+		schema, err := toolInputSchema(ctx, next, callReq, r.tool)
+		if err != nil {
+			return remixError(retry.KindInvalidArgument, err), nil
+		}
+		for _, name := range r.changed {
+			if schema == nil || schema.Properties[name] == nil {
+				err := fmt.Errorf("%s has no %s argument to change", r.tool, name)
+				log.Printf("Refusing remix: %v", err)
+				return remixError(retry.KindInvalidArgument, err), nil
+			}
+		}
+		if s.auth != nil && callReq.Extra != nil && callReq.Extra.TokenInfo != nil && !s.auth.Allowed(callReq.Extra.TokenInfo.Scopes, r.tool) {
+			err := fmt.Errorf("the scopes of this token do not allow %s", r.tool)
+			log.Printf("Refusing remix for %s: %v", clientID(callReq), err)
+			return remixError(retry.KindAuth, err), nil
+		}
+
+		args, err := json.Marshal(r.args)
+		if err != nil {
+			return nil, err
+		}
+		params := *callReq.Params
+		params.Name, params.Arguments = r.tool, args
+		remixed := *callReq
+		remixed.Params = &params
+		log.Printf("Remixing %s as a call of %s", r.parent, r.tool)
+		return next(context.WithValue(ctx, parentRunIDKey{}, r.parent), method, &remixed)
+	}
+}
+
+// toolInputSchema returns the input schema of a registered tool. Remix calls
+// are rewritten before they reach the server, so the tools are listed
+// through next.
+func toolInputSchema(ctx context.Context, next mcp.MethodHandler, req *mcp.CallToolRequest, tool string) (*jsonschema.Schema, error) {
+	params := &mcp.ListToolsParams{}
+	for {
+		result, err := next(ctx, "tools/list", &mcp.ListToolsRequest{Session: req.Session, Params: params, Extra: req.Extra})
+		if err != nil {
+			return nil, fmt.Errorf("error listing tools: %w", err)
+		}
+		list, ok := result.(*mcp.ListToolsResult)
+		if !ok {
+			return nil, fmt.Errorf("error listing tools: unexpected result %T", result)
+		}
+		for _, t := range list.Tools {
+			if t.Name == tool {
+				return t.InputSchema, nil
+			}
+		}
+		if list.NextCursor == "" {
+			return nil, fmt.Errorf("tool %s is not available", tool)
+		}
+		params = &mcp.ListToolsParams{Cursor: list.NextCursor}
+	}
+}
+
+func remixError(kind retry.Kind, err error) *mcp.CallToolResult {
+	return &mcp.CallToolResult{
+		IsError:           true,
+		Content:           []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+		StructuredContent: map[string]any{"error": ToolError{Kind: kind, Message: err.Error()}},
+	}
+}
+
+// resolveRemix finds the generation input replays in the output index of
+// the caller or, failing that, in its metadata file, and applies the changes
+// of input to its arguments.
+func (s *Server) resolveRemix(ctx context.Context, req *mcp.CallToolRequest, input RemixInput) (remix, error) {
+	// Isolation has not run yet, so find the output directory of the caller
+	space := s.outputSpace(ctx, req.Session, req.Extra)
+	ix := s.indexAt(space)
+
+	var r remix
+	switch {
+	case input.RunID != "":
+		entry, found, err := ix.Get(input.RunID)
+		if err != nil {
+			return r, err
+		}
+		if !found {
+			return r, fmt.Errorf("no generation found for %s", input.RunID)
+		}
+		r = remix{parent: entry.ID, tool: entry.Tool}
+		json.Unmarshal(entry.Arguments, &r.args)
+
+	case input.MetadataPath != "":
+		path := input.MetadataPath
+		if s.sandbox != nil {
+			checker, err := s.newPathChecker(req, space)
+			if err != nil {
+				return r, err
+			}
+			checked, err := checker.check(ctx, path, sandbox.Read)
+			if err != nil {
+				return r, err
+			}
+			path = checked.(string)
+		}
+		var err error
+		if r, err = remixFromMetadata(ix, path); err != nil {
+			return r, err
+		}
+
+	default:
+		return r, fmt.Errorf("run_id or metadata_path is required")
+	}
+
+	if r.args == nil {
+		r.args = make(map[string]any)
+	}
+	change := func(name string, value any) {
+		r.args[name] = value
+		r.changed = append(r.changed, name)
+	}
+	if input.Prompt != "" {
+		name := "prompt"
+		for _, arg := range promptArgs {
+			if _, ok := r.args[arg]; ok {
+				name = arg
+				break
+			}
+		}
+		change(name, input.Prompt)
+	}
+	if input.Model != "" {
+		change("model", input.Model)
+	}
+	if input.Seed != 0 {
+		change("seed", input.Seed)
+	}
+	if input.Style != "" {
+		change("style", input.Style)
+	}
+	for name, value := range input.Arguments {
+		change(name, value)
+	}
+	return r, nil
+}
+
+// remixFromMetadata returns the generation of a metadata file: its entry in
+// the index if it has one, or else the tool and arguments the file records.
+func remixFromMetadata(ix *index.Index, path string) (remix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return remix{}, fmt.Errorf("error reading metadata file: %w", err)
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return remix{}, fmt.Errorf("error reading metadata file %s: %w", path, err)
+	}
+
+	parent, _ := metadata["run_id"].(string)
+	entry, found, err := ix.Get(parent)
+	if err == nil && !found {
+		file, _ := cas.Describe(path)
+		entry, found, err = ix.ByFile(path, file.SHA256)
+	}
+	if err != nil {
+		return remix{}, err
+	}
+	if found {
+		r := remix{parent: entry.ID, tool: entry.Tool}
+		json.Unmarshal(entry.Arguments, &r.args)
+		return r, nil
+	}
+
+	tool := sidecarTool(metadata)
+	if tool == "" {
+		return remix{}, fmt.Errorf("%s is not a metadata file of a generation", path)
+	}
+	r := remix{parent: parent, tool: tool, args: make(map[string]any)}
+	for _, name := range sidecarArgs[tool] {
+		value, ok := metadata[name]
+		if !ok || value == nil || value == "" {
+			continue
+		}
+		if name == "input_image" {
+			name = "image_path"
+		}
+		r.args[name] = value
+	}
+	// Metadata files are only written to an output_directory
+	r.args["output_directory"] = filepath.Dir(path)
+	return r, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/retention"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/tenant"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// pinsFile lists the pinned files of an output directory, which retention
+// rules never delete.
+const pinsFile = "pinned.json"
+
+// runningCalls tracks the files used by tool calls in progress, such as Veo
+// jobs that poll for minutes, so that the janitor leaves them alone.
+type runningCalls struct {
+	mu    sync.Mutex
+	next  int
+	calls map[int]runningCall
+}
+
+// runningCall holds the input files of a tool call and the directories it
+// saves files in.
+type runningCall struct {
+	inputs  []string
+	dirs    []string
+	started time.Time
+}
+
+func (r *runningCalls) add(call runningCall) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.calls == nil {
+		r.calls = make(map[int]runningCall)
+	}
+	r.next++
+	r.calls[r.next] = call
+	return r.next
+}
+
+func (r *runningCalls) remove(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.calls, id)
+}
+
+// uses reports whether a running call reads the file at path or may have
+// saved it.
+func (r *runningCalls) uses(path string, modTime time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		if slices.Contains(call.inputs, path) {
+			return true
+		}
+		for _, dir := range call.dirs {
+			if sandbox.Within(path, []string{dir}) && !modTime.Before(call.started) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retentionMiddleware registers the files of tool calls while they run.
+func (s *Server) retentionMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil {
+			return next(ctx, method, req)
+		}
+
+		var args map[string]any
+		json.Unmarshal(callReq.Params.Arguments, &args)
+		call := runningCall{started: time.Now()}
+		for _, path := range inputPaths(args) {
+			if resolved, err := sandbox.Resolve(path); err == nil {
+				call.inputs = append(call.inputs, resolved)
+			}
+		}
+		for _, dir := range []string{s.outputDir(ctx), stringArg(args, "output_directory")} {
+			if resolved, err := sandbox.Resolve(dir); dir != "" && err == nil {
+				call.dirs = append(call.dirs, resolved)
+			}
+		}
+		id := s.running.add(call)
+		defer s.running.remove(id)
+
+		return next(ctx, method, req)
+	}
+}
+
+func stringArg(args map[string]any, name string) string {
+	value, _ := args[name].(string)
+	return value
+}
+
+// retentionPolicy returns the configured retention rules.
+func (s *Server) retentionPolicy() retention.Policy {
+	return retention.Policy{
+		MaxAge:   s.config.RetentionMaxAge,
+		MaxBytes: s.config.RetentionMaxBytes,
+		KeepLast: s.config.RetentionKeepLast,
+	}
+}
+
+// runJanitor applies the retention rules to every output directory at
+// start-up and then every RETENTION_INTERVAL, until ctx is done.
+func (s *Server) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(s.config.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		for _, space := range s.outputSpaces() {
+			removals, err := s.pruneSpace(space, s.retentionPolicy(), false)
+			if err != nil {
+				log.Printf("Error applying retention rules to %s: %v", space, err)
+			}
+			for _, r := range removals {
+				for _, f := range r.Files {
+					log.Printf("Deleted %s (%s)", f.Path, r.Reason)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// outputSpaces returns OUTPUT_DIR and the output directories of the sessions
+// and tenants in it.
+func (s *Server) outputSpaces() []string {
+	spaces := []string{s.config.OutputDir}
+	entries, _ := os.ReadDir(filepath.Join(s.config.OutputDir, tenant.Subdir))
+	for _, e := range entries {
+		if e.IsDir() {
+			spaces = append(spaces, filepath.Join(s.config.OutputDir, tenant.Subdir, e.Name()))
+		}
+	}
+	return spaces
+}
+
+// pruneSpace applies policy to the output files in space and returns what it
+// deleted, or would delete if dryRun is set. Files are grouped by the tool
+// call that saved them, as the output index records; pinned files and those
+// used by running calls are kept along with the rest of their group.
+func (s *Server) pruneSpace(space string, policy retention.Policy, dryRun bool) ([]retention.Removal, error) {
+	root, err := sandbox.Resolve(space)
+	if err != nil {
+		return nil, err
+	}
+	s.outputsMu.Lock()
+	defer s.outputsMu.Unlock()
+
+	files, err := tenant.Files(root, hiddenOutputs...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing output files: %w", err)
+	}
+	byPath := make(map[string]tenant.File)
+	for _, f := range files {
+		// Dot files are partial writes and other temporary files
+		if !strings.HasPrefix(filepath.Base(f.Path), ".") {
+			byPath[f.Path] = f
+		}
+	}
+	pins, err := readPins(root)
+	if err != nil {
+		return nil, err
+	}
+	outputIndex := s.indexAt(root)
+	entries, err := outputIndex.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []retention.Generation
+	add := func(g retention.Generation, paths []string) {
+		for _, rel := range paths {
+			f := byPath[rel]
+			delete(byPath, rel)
+			abs := filepath.Join(root, filepath.FromSlash(rel))
+			g.Files = append(g.Files, retention.File{Path: abs, Size: f.Size})
+			if pins[rel] || s.running.uses(abs, f.ModTime) {
+				g.Protected = true
+			}
+		}
+		if len(g.Files) > 0 {
+			generations = append(generations, g)
+		}
+	}
+	// The latest call that saved a file owns it
+	for i := len(entries) - 1; i >= 0; i-- {
+		var paths []string
+		for _, f := range entries[i].Files {
+			if rel, ok := relativeTo(root, f.Path); ok {
+				if _, ok := byPath[rel]; ok && !slices.Contains(paths, rel) {
+					paths = append(paths, rel)
+				}
+			}
+		}
+		add(retention.Generation{Tool: entries[i].Tool, Time: entries[i].Time}, paths)
+	}
+	for _, f := range files {
+		if _, ok := byPath[f.Path]; ok {
+			add(retention.Generation{Time: f.ModTime}, []string{f.Path})
+		}
+	}
+
+	removals := retention.Plan(generations, policy, time.Now())
+	if dryRun || len(removals) == 0 {
+		return removals, nil
+	}
+
+	for _, r := range removals {
+		for _, f := range r.Files {
+			if err := os.Remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return removals, fmt.Errorf("error deleting %s: %w", f.Path, err)
+			}
+			removeEmptyParents(root, filepath.Dir(f.Path))
+		}
+	}
+
+	// Forget generations whose files are all gone
+	err = outputIndex.Retain(func(e index.Entry) bool {
+		return slices.ContainsFunc(e.Files, func(f cas.File) bool {
+			_, err := os.Stat(f.Path)
+			return err == nil
+		})
+	})
+	if err != nil {
+		return removals, err
+	}
+
+	if s.config.OutputLayout == config.LayoutContent {
+		var remaining []string
+		if files, err = tenant.Files(root, hiddenOutputs...); err != nil {
+			return removals, err
+		}
+		for _, f := range files {
+			remaining = append(remaining, filepath.Join(root, filepath.FromSlash(f.Path)))
+		}
+		if _, err := cas.Open(filepath.Join(root, cas.Dir)).Sweep(remaining); err != nil {
+			return removals, err
+		}
+	}
+	return removals, nil
+}
+
+// relativeTo returns path relative to root in slash form, if it is inside.
+func relativeTo(root, path string) (string, bool) {
+	resolved, err := sandbox.Resolve(path)
+	if err != nil || !sandbox.Within(resolved, []string{root}) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return filepath.ToSlash(rel), err == nil
+}
+
+// removeEmptyParents removes dir and its parents up to root while they are
+// empty.
+func removeEmptyParents(root, dir string) {
+	for dir != root && sandbox.Within(dir, []string{root}) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// readPins returns the pinned files of an output directory by relative path.
+func readPins(root string) (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(root, pinsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading pinned files: %w", err)
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("error reading pinned files: %w", err)
+	}
+	pins := make(map[string]bool)
+	for _, path := range paths {
+		pins[path] = true
+	}
+	return pins, nil
+}
+
+func writePins(root string, pins map[string]bool) error {
+	paths := []string{}
+	for path := range pins {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	data, err := json.MarshalIndent(paths, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(root, pinsFile), data, 0644); err != nil {
+		return fmt.Errorf("error saving pinned files: %w", err)
+	}
+	return nil
+}
+
+// OutputsPruneInput holds rules that override the configured ones for one
+// cleanup.
+type OutputsPruneInput struct {
+	DryRun        bool   `json:"dry_run,omitempty" jsonschema:"description:List the files that would be deleted without deleting them,default:false"`
+	MaxAge        string `json:"max_age,omitempty" jsonschema:"description:Delete generations older than this, e.g. '72h'. Defaults to RETENTION_MAX_AGE."`
+	MaxTotalBytes int64  `json:"max_total_bytes,omitempty" jsonschema:"description:Delete the oldest generations until the rest fit in this many bytes. Defaults to RETENTION_MAX_BYTES."`
+	KeepLast      int    `json:"keep_last,omitempty" jsonschema:"description:Keep only this many of the latest generations of each tool. Defaults to RETENTION_KEEP_LAST."`
+}
+
+// PrunedFile is a deleted output file.
+type PrunedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Tool   string `json:"tool,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// OutputsPruneOutput lists the deleted files.
+type OutputsPruneOutput struct {
+	DryRun     bool         `json:"dry_run"`
+	Deleted    []PrunedFile `json:"deleted"`
+	FreedBytes int64        `json:"freed_bytes"`
+}
+
+// OutputsPinInput selects a file to pin or unpin.
+type OutputsPinInput struct {
+	Path  string `json:"path" jsonschema:"description:Output file to protect from retention rules"`
+	Unpin bool   `json:"unpin,omitempty" jsonschema:"description:Remove the protection instead,default:false"`
+}
+
+// OutputsPinOutput lists the pinned files.
+type OutputsPinOutput struct {
+	Pinned []string `json:"pinned"`
+}
+
+func (s *Server) registerRetentionTools(server *mcp.Server) {
+	// Track the files of running calls
+	server.AddReceivingMiddleware(s.retentionMiddleware)
+
+	// Register outputs_prune tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_prune",
+		Description: "Delete old output files under retention rules: a maximum age, a maximum total size, and a number of latest generations to keep per tool. The files a tool call saved are deleted together. Uses the configured rules unless others are given; pinned files and files used by running calls such as pending Veo jobs are kept. Use dry_run to preview.",
+	}, s.handleOutputsPrune)
+
+	// Register outputs_pin tool
+	addTool(server, &mcp.Tool{
+		Name:        "outputs_pin",
+		Description: "Pin an output file so that retention rules and outputs_prune never delete it or the other files saved with it, or unpin it. Returns the pinned files.",
+	}, s.handleOutputsPin)
+}
+
+func (s *Server) handleOutputsPrune(ctx context.Context, req *mcp.CallToolRequest, input OutputsPruneInput) (*mcp.CallToolResult, OutputsPruneOutput, error) {
+	policy := s.retentionPolicy()
+	if input.MaxAge != "" {
+		maxAge, err := time.ParseDuration(input.MaxAge)
+		if err != nil || maxAge <= 0 {
+			return nil, OutputsPruneOutput{}, fmt.Errorf("invalid max_age %q: use a positive duration such as '72h'", input.MaxAge)
+		}
+		policy.MaxAge = maxAge
+	}
+	if input.MaxTotalBytes < 0 || input.KeepLast < 0 {
+		return nil, OutputsPruneOutput{}, fmt.Errorf("max_total_bytes and keep_last must not be negative")
+	}
+	if input.MaxTotalBytes > 0 {
+		policy.MaxBytes = input.MaxTotalBytes
+	}
+	if input.KeepLast > 0 {
+		policy.KeepLast = input.KeepLast
+	}
+	if !policy.Active() {
+		return nil, OutputsPruneOutput{}, fmt.Errorf("no retention rules are configured; give max_age, max_total_bytes or keep_last")
+	}
+
+	removals, err := s.pruneSpace(s.outputDir(ctx), policy, input.DryRun)
+	output := OutputsPruneOutput{DryRun: input.DryRun, Deleted: []PrunedFile{}}
+	for _, r := range removals {
+		for _, f := range r.Files {
+			output.Deleted = append(output.Deleted, PrunedFile{Path: f.Path, Size: f.Size, Tool: r.Tool, Reason: r.Reason})
+			output.FreedBytes += f.Size
+		}
+	}
+	if err != nil {
+		return nil, OutputsPruneOutput{}, err
+	}
+	return nil, output, nil
+}
+
+func (s *Server) handleOutputsPin(ctx context.Context, req *mcp.CallToolRequest, input OutputsPinInput) (*mcp.CallToolResult, OutputsPinOutput, error) {
+	if input.Path == "" {
+		return nil, OutputsPinOutput{}, fmt.Errorf("path is required")
+	}
+	root, err := sandbox.Resolve(s.outputDir(ctx))
+	if err != nil {
+		return nil, OutputsPinOutput{}, err
+	}
+	path := input.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	rel, ok := relativeTo(root, path)
+	if !ok {
+		return nil, OutputsPinOutput{}, fmt.Errorf("%s is not in the output directory", input.Path)
+	}
+
+	s.outputsMu.Lock()
+	defer s.outputsMu.Unlock()
+	pins, err := readPins(root)
+	if err != nil {
+		return nil, OutputsPinOutput{}, err
+	}
+	if input.Unpin {
+		delete(pins, rel)
+	} else {
+		if _, err := os.Stat(path); err != nil {
+			return nil, OutputsPinOutput{}, fmt.Errorf("error pinning %s: %w", input.Path, err)
+		}
+		pins[rel] = true
+	}
+	if err := writePins(root, pins); err != nil {
+		return nil, OutputsPinOutput{}, err
+	}
+
+	output := OutputsPinOutput{Pinned: []string{}}
+	for rel := range pins {
+		output.Pinned = append(output.Pinned, filepath.Join(root, filepath.FromSlash(rel)))
+	}
+	slices.Sort(output.Pinned)
+	return nil, output, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// pathAccess returns the access a tool argument needs if it holds file
+// paths: output_directory is written to, and path and arguments ending in
+// _path or _paths are read from.
+func pathAccess(name string) (sandbox.Access, bool) {
+	switch {
+	case name == "output_directory":
+		return sandbox.Write, true
+	case name == "path" || strings.HasSuffix(name, "_path") || strings.HasSuffix(name, "_paths"):
+		return sandbox.Read, true
+	default:
+		return "", false
+	}
+}
+
+// sandboxMiddleware refuses tool calls with file arguments outside the
+// allowed roots and replaces the paths of the others with their resolved
+// form, so that tools use the files that were checked. If outputs are
+// isolated, relative paths are taken relative to the output directory of the
+// caller, which is the only place it may write to, and the output
+// directories of others cannot be read.
+func (s *Server) sandboxMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil || s.sandbox == nil {
+			return next(ctx, method, req)
+		}
+
+		var args map[string]any
+		if json.Unmarshal(callReq.Params.Arguments, &args) != nil {
+			return next(ctx, method, req)
+		}
+
+		checker, err := s.newPathChecker(callReq, s.outputDir(ctx))
+		if err != nil {
+			return nil, err
+		}
+		changed := false
+		for name, value := range args {
+			access, ok := pathAccess(name)
+			if !ok {
+				continue
+			}
+			checked, err := checker.check(ctx, value, access)
+			if err != nil {
+				log.Printf("Refusing %s: %v", callReq.Params.Name, err)
+				var outside *sandbox.OutsideError
+				kind := retry.KindUnknown
+				if errors.As(err, &outside) {
+					kind = retry.KindInvalidArgument
+				}
+				return &mcp.CallToolResult{
+					IsError:           true,
+					Content:           []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+					StructuredContent: map[string]any{"error": ToolError{Kind: kind, Message: err.Error()}},
+				}, nil
+			}
+			args[name] = checked
+			changed = true
+		}
+		if !changed {
+			return next(ctx, method, req)
+		}
+
+		data, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		callReq.Params.Arguments = data
+		return next(ctx, method, req)
+	}
+}
+
+// pathChecker checks the file arguments of one tool call, fetching the roots
+// of the client when the first path needs them.
+type pathChecker struct {
+	server *Server
+	req    *mcp.CallToolRequest
+	// space is the resolved output directory of the caller and outputRoot
+	// that of all callers, if outputs are isolated.
+	space      string
+	outputRoot string
+
+	fetched     bool
+	clientRoots []string
+}
+
+// newPathChecker returns a pathChecker for the file arguments of req, whose
+// caller has the output directory space.
+func (s *Server) newPathChecker(req *mcp.CallToolRequest, space string) (*pathChecker, error) {
+	checker := &pathChecker{server: s, req: req}
+	if s.isolated() {
+		var err error
+		if checker.space, err = sandbox.Resolve(space); err != nil {
+			return nil, err
+		}
+		if checker.outputRoot, err = sandbox.Resolve(s.config.OutputDir); err != nil {
+			return nil, err
+		}
+	}
+	return checker, nil
+}
+
+// check checks a path or list of paths and returns them resolved. Names of
+// the form 'files/<id>' that do not exist locally refer to uploaded files and
+// are left as they are.
+func (c *pathChecker) check(ctx context.Context, value any, access sandbox.Access) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return v, nil
+		}
+		path := v
+		if c.space != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(c.space, path)
+		}
+		if strings.HasPrefix(v, "files/") {
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				return v, nil
+			}
+		}
+		roots, err := c.roots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := c.server.sandbox.Check(path, access, roots)
+		if err != nil {
+			return nil, err
+		}
+		if c.space != "" && !sandbox.Within(resolved, []string{c.space}) &&
+			(access == sandbox.Write || sandbox.Within(resolved, []string{c.outputRoot})) {
+			return nil, &sandbox.OutsideError{Path: v, Access: access, Tenant: true}
+		}
+		return resolved, nil
+	case []any:
+		checked := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if checked[i], err = c.check(ctx, item, access); err != nil {
+				return nil, err
+			}
+		}
+		return checked, nil
+	default:
+		// Leave arguments of the wrong type for the tool to report.
+		return value, nil
+	}
+}
+
+// roots returns the resolved roots declared by the client if CLIENT_ROOTS is
+// set. Clients that cannot list roots, or list none, are not confined further.
+func (c *pathChecker) roots(ctx context.Context) ([]string, error) {
+	if c.fetched || !c.server.config.ClientRoots || c.req.Session == nil {
+		return c.clientRoots, nil
+	}
+	c.fetched = true
+
+	result, err := c.req.Session.ListRoots(ctx, nil)
+	if err != nil {
+		log.Printf("Not confining paths to client roots: %v", err)
+		return nil, nil
+	}
+	for _, root := range result.Roots {
+		path, err := sandbox.RootPath(root.URI)
+		if err != nil {
+			log.Printf("Ignoring client root: %v", err)
+			continue
+		}
+		c.clientRoots = append(c.clientRoots, path)
+	}
+	if len(result.Roots) > 0 && len(c.clientRoots) == 0 {
+		return nil, errors.New("none of the roots declared by the client is a local directory")
+	}
+	return c.clientRoots, nil
+}
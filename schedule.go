@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"gemini-mcp/internal/scheduler"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// progressKey is the context key of the progressReporter of a tool call.
+type progressKey struct{}
+
+// progressReporter sends progress notifications for a tool call whose client
+// asked for them with a progress token.
+type progressReporter struct {
+	req *mcp.CallToolRequest
+
+	mu       sync.Mutex
+	progress float64
+}
+
+// notifyProgress sends a progress notification with message for the current
+// tool call, if its client asked for them.
+func notifyProgress(ctx context.Context, message string) {
+	reporter, ok := ctx.Value(progressKey{}).(*progressReporter)
+	if !ok || reporter.req.Session == nil || reporter.req.Params == nil {
+		return
+	}
+	token := reporter.req.Params.GetProgressToken()
+	if token == nil {
+		return
+	}
+
+	reporter.mu.Lock()
+	reporter.progress++
+	progress := reporter.progress
+	reporter.mu.Unlock()
+
+	err := reporter.req.Session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+		ProgressToken: token,
+		Progress:      progress,
+		Message:       message,
+	})
+	if err != nil {
+		log.Printf("Error sending progress notification: %v", err)
+	}
+}
+
+// schedule waits until the scheduler admits a call to model, reporting the
+// position of the tool call in the queue as progress, and returns the
+// function releasing its slot. Calls are queued per client.
+func (s *Server) schedule(ctx context.Context, model string) (func(), error) {
+	if s.scheduler == nil {
+		return func() {}, nil
+	}
+
+	client := "local"
+	if info, ok := ctx.Value(callInfoKey{}).(callInfo); ok {
+		client = info.client
+	}
+	family := scheduler.Family(model)
+	return s.scheduler.Acquire(ctx, family, client, func(position int) {
+		log.Printf("Queued %s call for %s at position %d", family, client, position)
+		notifyProgress(ctx, fmt.Sprintf("Waiting for %s capacity: position %d in queue", family, position))
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/session"
+	"gemini-mcp/internal/storage"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// Conversational image editing sessions
+type GeminiImageSessionStartInput struct {
+	Prompt          string `json:"prompt" jsonschema:"description:Instruction for the first turn of the session. Describe the image to create, or how to edit the input image if one is provided."`
+	InputImagePath  string `json:"input_image_path,omitempty" jsonschema:"description:Optional path to an image to start editing from (PNG, JPEG, WebP supported). If omitted, the first turn generates a new image."`
+	Model           string `json:"model,omitempty" jsonschema:"description:Gemini model to use for every turn of the session,default:gemini-2.5-flash-image-preview"`
+	AspectRatio     string `json:"aspect_ratio,omitempty" jsonschema:"description:Preferred aspect ratio for the first image. Common ratios: '1:1' (square), '16:9' (landscape), '9:16' (portrait), '4:3', '3:4'"`
+	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Optional. Local directory path where the image of every turn will be saved."`
+	DryRun          bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt and estimated cost of the turn without calling the API or changing the session,default:false"`
+}
+
+type GeminiImageSessionEditInput struct {
+	SessionID      string `json:"session_id" jsonschema:"description:ID of the session returned by gemini_image_session_start or gemini_image_session_branch"`
+	EditPrompt     string `json:"edit_prompt" jsonschema:"description:Follow-up instruction refining the latest image, e.g. 'now make the sky darker'. Earlier turns are kept as context."`
+	InputImagePath string `json:"input_image_path,omitempty" jsonschema:"description:Optional path to an additional reference image to include with this turn"`
+	AspectRatio    string `json:"aspect_ratio,omitempty" jsonschema:"description:Preferred aspect ratio for the edited image. Common ratios: '1:1' (square), '16:9' (landscape), '9:16' (portrait), '4:3', '3:4'"`
+	DryRun         bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt and estimated cost of the turn without calling the API or changing the session,default:false"`
+}
+
+type GeminiImageSessionBranchInput struct {
+	SessionID  string `json:"session_id" jsonschema:"description:ID of the session to branch from"`
+	Turn       int    `json:"turn" jsonschema:"description:Turn to branch from. The new session keeps the history up to and including this turn; use the previous turn number to undo the latest edit. 0 branches from the start of the session."`
+	EditPrompt string `json:"edit_prompt,omitempty" jsonschema:"description:Optional instruction to apply immediately as the first new turn of the branch"`
+	DryRun     bool   `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt and estimated cost of edit_prompt without calling the API or creating the branch,default:false"`
+}
+
+type GeminiImageSessionListInput struct {
+	SessionID string `json:"session_id,omitempty" jsonschema:"description:Optional. If provided, only this session is returned, including its full turn history."`
+}
+
+type ImageSessionTurn struct {
+	Turn        int      `json:"turn"`
+	Prompt      string   `json:"prompt"`
+	Description string   `json:"description,omitempty"`
+	ImagePaths  []string `json:"image_paths,omitempty"`
+	CreatedAt   string   `json:"created_at"`
+}
+
+type GeminiImageSessionOutput struct {
+	SessionID       string             `json:"session_id"`
+	ParentSessionID string             `json:"parent_session_id,omitempty"`
+	ParentTurn      int                `json:"parent_turn,omitempty"`
+	Turn            int                `json:"turn"`
+	Model           string             `json:"model"`
+	Description     string             `json:"description,omitempty"`
+	EditedImage     string             `json:"edited_image,omitempty"`
+	SavedFiles      []string           `json:"saved_files,omitempty"`
+	StoredFiles     []storage.Object   `json:"stored_files,omitempty"`
+	Turns           []ImageSessionTurn `json:"turns,omitempty"`
+	ExpiresAt       string             `json:"expires_at"`
+	GeneratedAt     string             `json:"generated_at"`
+	DryRun          *DryRun            `json:"dry_run,omitempty"`
+}
+
+type ImageSessionSummary struct {
+	SessionID       string             `json:"session_id"`
+	ParentSessionID string             `json:"parent_session_id,omitempty"`
+	ParentTurn      int                `json:"parent_turn,omitempty"`
+	Model           string             `json:"model"`
+	TurnCount       int                `json:"turn_count"`
+	LatestImage     string             `json:"latest_image,omitempty"`
+	Turns           []ImageSessionTurn `json:"turns,omitempty"`
+	CreatedAt       string             `json:"created_at"`
+	LastUsedAt      string             `json:"last_used_at"`
+	ExpiresAt       string             `json:"expires_at"`
+}
+
+type GeminiImageSessionListOutput struct {
+	Sessions []ImageSessionSummary `json:"sessions"`
+	Count    int                   `json:"count"`
+}
+
+func (s *Server) registerSessionTools(server *mcp.Server) {
+	// Register gemini_image_session_start tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_session_start",
+		Description: "Start a multi-turn image editing session with Google's Gemini AI models. Runs the first turn from a prompt and an optional starting image and returns a session ID. Follow-up edits made with gemini_image_session_edit keep the full conversation as context, so instructions like 'now make the sky darker' refine the latest image without re-uploading it.",
+	}, s.handleGeminiImageSessionStart)
+
+	// Register gemini_image_session_edit tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_session_edit",
+		Description: "Apply a follow-up edit within an existing image editing session. The model sees every previous turn of the session, and the image produced by each turn is saved to the output directory.",
+	}, s.handleGeminiImageSessionEdit)
+
+	// Register gemini_image_session_branch tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_session_branch",
+		Description: "Create a new image editing session that continues from an earlier turn of an existing session. Use it to undo edits or to explore alternative variations without losing the original session.",
+	}, s.handleGeminiImageSessionBranch)
+
+	// Register gemini_image_session_list tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_image_session_list",
+		Description: "List active image editing sessions with their turn counts, latest images and expiry times, or show the full turn history of a single session.",
+	}, s.handleGeminiImageSessionList)
+}
+
+func (s *Server) handleGeminiImageSessionStart(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageSessionStartInput) (*mcp.CallToolResult, GeminiImageSessionOutput, error) {
+	if input.Prompt == "" {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("prompt is required")
+	}
+
+	model := input.Model
+	if model == "" {
+		model = "gemini-2.5-flash-image-preview"
+	}
+
+	// Isolated sessions are tied to the output directory of their caller
+	outputDir := input.OutputDirectory
+	if outputDir == "" && s.isolated() {
+		outputDir = s.outputDir(ctx)
+	}
+
+	if input.DryRun {
+		sess := &session.Session{Model: model, OutputDirectory: outputDir}
+		output, err := s.dryRunImageSessionTurn(ctx, sess, input.Prompt, input.InputImagePath, input.AspectRatio)
+		return nil, output, err
+	}
+
+	sess, err := s.sessions.Create(model, outputDir)
+	if err != nil {
+		return nil, GeminiImageSessionOutput{}, err
+	}
+
+	log.Printf("Started image session %s with model %s", sess.ID, model)
+
+	output, err := s.runImageSessionTurn(ctx, sess, input.Prompt, input.InputImagePath, input.AspectRatio)
+	if err != nil {
+		s.sessions.Delete(sess.ID)
+		return nil, GeminiImageSessionOutput{}, err
+	}
+	return nil, output, nil
+}
+
+func (s *Server) handleGeminiImageSessionEdit(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageSessionEditInput) (*mcp.CallToolResult, GeminiImageSessionOutput, error) {
+	if input.SessionID == "" {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("session_id is required")
+	}
+	if input.EditPrompt == "" {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("edit_prompt is required")
+	}
+
+	sess, err := s.sessions.Get(input.SessionID)
+	if err != nil {
+		return nil, GeminiImageSessionOutput{}, err
+	}
+	if !s.ownsSession(ctx, sess) {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("session %q not found or expired", input.SessionID)
+	}
+
+	if input.DryRun {
+		output, err := s.dryRunImageSessionTurn(ctx, sess, input.EditPrompt, input.InputImagePath, input.AspectRatio)
+		return nil, output, err
+	}
+
+	output, err := s.runImageSessionTurn(ctx, sess, input.EditPrompt, input.InputImagePath, input.AspectRatio)
+	if err != nil {
+		return nil, GeminiImageSessionOutput{}, err
+	}
+	return nil, output, nil
+}
+
+func (s *Server) handleGeminiImageSessionBranch(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageSessionBranchInput) (*mcp.CallToolResult, GeminiImageSessionOutput, error) {
+	if input.SessionID == "" {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("session_id is required")
+	}
+
+	if parent, err := s.sessions.Get(input.SessionID); err == nil && !s.ownsSession(ctx, parent) {
+		return nil, GeminiImageSessionOutput{}, fmt.Errorf("session %q not found or expired", input.SessionID)
+	}
+
+	if input.DryRun {
+		sess, err := s.sessions.PreviewBranch(input.SessionID, input.Turn)
+		if err != nil {
+			return nil, GeminiImageSessionOutput{}, err
+		}
+		if input.EditPrompt == "" {
+			// Branching alone does not call the API
+			return nil, GeminiImageSessionOutput{
+				ParentSessionID: sess.ParentID,
+				ParentTurn:      sess.ParentTurn,
+				Turn:            len(sess.Turns),
+				Model:           sess.Model,
+				Turns:           imageSessionTurns(sess.Turns),
+				GeneratedAt:     time.Now().Format("20060102_150405"),
+				DryRun:          s.dryRun("", nil),
+			}, nil
+		}
+		output, err := s.dryRunImageSessionTurn(ctx, sess, input.EditPrompt, "", "")
+		return nil, output, err
+	}
+
+	sess, err := s.sessions.Branch(input.SessionID, input.Turn)
+	if err != nil {
+		return nil, GeminiImageSessionOutput{}, err
+	}
+
+	log.Printf("Branched image session %s from session %s at turn %d", sess.ID, input.SessionID, input.Turn)
+
+	if input.EditPrompt != "" {
+		output, err := s.runImageSessionTurn(ctx, sess, input.EditPrompt, "", "")
+		if err != nil {
+			return nil, GeminiImageSessionOutput{}, err
+		}
+		return nil, output, nil
+	}
+
+	output := GeminiImageSessionOutput{
+		SessionID:       sess.ID,
+		ParentSessionID: sess.ParentID,
+		ParentTurn:      sess.ParentTurn,
+		Turn:            len(sess.Turns),
+		Model:           sess.Model,
+		Turns:           imageSessionTurns(sess.Turns),
+		ExpiresAt:       sess.ExpiresAt(s.sessions.TTL()).Format(time.RFC3339),
+		GeneratedAt:     time.Now().Format("20060102_150405"),
+	}
+	if len(sess.Turns) > 0 {
+		if paths := sess.Turns[len(sess.Turns)-1].ImagePaths; len(paths) > 0 {
+			output.EditedImage = paths[len(paths)-1]
+		}
+	}
+	return nil, output, nil
+}
+
+func (s *Server) handleGeminiImageSessionList(ctx context.Context, req *mcp.CallToolRequest, input GeminiImageSessionListInput) (*mcp.CallToolResult, GeminiImageSessionListOutput, error) {
+	var sessions []*session.Session
+	if input.SessionID != "" {
+		sess, err := s.sessions.Get(input.SessionID)
+		if err != nil {
+			return nil, GeminiImageSessionListOutput{}, err
+		}
+		if !s.ownsSession(ctx, sess) {
+			return nil, GeminiImageSessionListOutput{}, fmt.Errorf("session %q not found or expired", input.SessionID)
+		}
+		sessions = append(sessions, sess)
+	} else {
+		for _, sess := range s.sessions.List() {
+			if s.ownsSession(ctx, sess) {
+				sessions = append(sessions, sess)
+			}
+		}
+	}
+
+	summaries := make([]ImageSessionSummary, 0, len(sessions))
+	for _, sess := range sessions {
+		summary := ImageSessionSummary{
+			SessionID:       sess.ID,
+			ParentSessionID: sess.ParentID,
+			ParentTurn:      sess.ParentTurn,
+			Model:           sess.Model,
+			TurnCount:       len(sess.Turns),
+			CreatedAt:       sess.CreatedAt.Format(time.RFC3339),
+			LastUsedAt:      sess.LastUsedAt.Format(time.RFC3339),
+			ExpiresAt:       sess.ExpiresAt(s.sessions.TTL()).Format(time.RFC3339),
+		}
+		for i := len(sess.Turns) - 1; i >= 0 && summary.LatestImage == ""; i-- {
+			if paths := sess.Turns[i].ImagePaths; len(paths) > 0 {
+				summary.LatestImage = paths[len(paths)-1]
+			}
+		}
+		if input.SessionID != "" {
+			summary.Turns = imageSessionTurns(sess.Turns)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return nil, GeminiImageSessionListOutput{
+		Sessions: summaries,
+		Count:    len(summaries),
+	}, nil
+}
+
+// runImageSessionTurn sends one turn to the model using the session's history,
+// saves any returned images and records the turn in the session store.
+func (s *Server) runImageSessionTurn(ctx context.Context, sess *session.Session, prompt, imagePath, aspectRatio string) (GeminiImageSessionOutput, error) {
+	turnIndex := len(sess.Turns) + 1
+
+	log.Printf("Image session %s turn %d with model %s: %s", sess.ID, turnIndex, sess.Model, prompt)
+
+	parts := []*genai.Part{genai.NewPartFromText(imageSessionPrompt(prompt, aspectRatio))}
+	if imagePath != "" {
+		imageParts, err := s.mediaParts(ctx, []string{imagePath})
+		if err != nil {
+			return GeminiImageSessionOutput{}, err
+		}
+		parts = append(parts, imageParts...)
+	}
+
+	chat, err := s.client.Chats.Create(ctx, sess.Model, nil, sess.History)
+	if err != nil {
+		return GeminiImageSessionOutput{}, fmt.Errorf("error creating chat session: %w", err)
+	}
+
+	response, err := s.sendChat(ctx, sess.Model, chat, parts)
+	if err != nil {
+		return GeminiImageSessionOutput{}, fmt.Errorf("error editing image in session: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(sess.Model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		return GeminiImageSessionOutput{}, fmt.Errorf("no content was generated")
+	}
+
+	// Save every image of the turn so earlier versions stay available
+	var resultText []string
+	var savedFiles []string
+	timestamp := time.Now().Format("20060102_150405")
+
+	outputDir := sess.OutputDirectory
+	if outputDir == "" {
+		outputDir = s.outputDir(ctx)
+	}
+
+	if candidate := response.Candidates[0]; candidate.Content != nil {
+		for i, part := range candidate.Content.Parts {
+			if part.Text != "" {
+				resultText = append(resultText, part.Text)
+			}
+
+			if part.InlineData != nil && len(part.InlineData.Data) > 0 && outputDir != "" {
+				if err := os.MkdirAll(outputDir, 0755); err == nil {
+					filename := fmt.Sprintf("gemini_session_%s_turn%d_%d.png", sess.ID, turnIndex, i)
+					outputPath := filepath.Join(outputDir, filename)
+
+					if err := cas.WriteFile(outputPath, part.InlineData.Data, 0644); err == nil {
+						savedFiles = append(savedFiles, outputPath)
+						log.Printf("Saved session image to: %s", outputPath)
+					}
+				}
+			}
+		}
+	}
+
+	turn, err := s.sessions.AppendTurn(sess.ID, chat.History(false), session.Turn{
+		Index:      turnIndex,
+		Prompt:     prompt,
+		Text:       strings.Join(resultText, "\n"),
+		ImagePaths: savedFiles,
+	})
+	if err != nil {
+		return GeminiImageSessionOutput{}, err
+	}
+
+	updated, err := s.sessions.Get(sess.ID)
+	if err != nil {
+		return GeminiImageSessionOutput{}, err
+	}
+
+	output := GeminiImageSessionOutput{
+		SessionID:       updated.ID,
+		ParentSessionID: updated.ParentID,
+		ParentTurn:      updated.ParentTurn,
+		Turn:            turn.Index,
+		Model:           updated.Model,
+		Description:     turn.Text,
+		SavedFiles:      savedFiles,
+		StoredFiles:     s.storeFiles(ctx, savedFiles),
+		Turns:           imageSessionTurns(updated.Turns),
+		ExpiresAt:       updated.ExpiresAt(s.sessions.TTL()).Format(time.RFC3339),
+		GeneratedAt:     timestamp,
+	}
+	if len(savedFiles) > 0 {
+		output.EditedImage = savedFiles[len(savedFiles)-1]
+	}
+	if output.Description == "" {
+		output.Description = "Image session turn completed successfully"
+	}
+	return output, nil
+}
+
+// dryRunImageSessionTurn builds the dry run of a session turn, which would
+// send the history of sess along with the prompt. sess is left unchanged.
+func (s *Server) dryRunImageSessionTurn(ctx context.Context, sess *session.Session, prompt, imagePath, aspectRatio string) (GeminiImageSessionOutput, error) {
+	var paths []string
+	if imagePath != "" {
+		paths = append(paths, imagePath)
+	}
+	dryRun, err := s.dryRunContent(ctx, sess.Model, sess.History, imageSessionPrompt(prompt, aspectRatio), nil, paths, 0)
+	if err != nil {
+		return GeminiImageSessionOutput{}, err
+	}
+	return GeminiImageSessionOutput{
+		SessionID:       sess.ID,
+		ParentSessionID: sess.ParentID,
+		ParentTurn:      sess.ParentTurn,
+		Turn:            len(sess.Turns) + 1,
+		Model:           sess.Model,
+		GeneratedAt:     time.Now().Format("20060102_150405"),
+		DryRun:          dryRun,
+	}, nil
+}
+
+// imageSessionPrompt returns the text sent for a session turn.
+func imageSessionPrompt(prompt, aspectRatio string) string {
+	if aspectRatio != "" {
+		return fmt.Sprintf("%s. Aspect ratio: %s", prompt, aspectRatio)
+	}
+	return prompt
+}
+
+func imageSessionTurns(turns []session.Turn) []ImageSessionTurn {
+	result := make([]ImageSessionTurn, 0, len(turns))
+	for _, turn := range turns {
+		result = append(result, ImageSessionTurn{
+			Turn:        turn.Index,
+			Prompt:      turn.Prompt,
+			Description: turn.Text,
+			ImagePaths:  turn.ImagePaths,
+			CreatedAt:   turn.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return result
+}
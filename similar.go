@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/index"
+	"gemini-mcp/internal/retry"
+	"gemini-mcp/internal/sandbox"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// similarLimit is the default number of generations find_similar returns.
+const similarLimit = 10
+
+// captionPrompt asks the caption model to describe a generated image.
+const captionPrompt = "Describe this image in one or two sentences: its subject, style, colors and composition. Reply with the description only."
+
+// geminiEmbeddings captions images with CAPTION_MODEL and embeds texts with
+// EMBEDDING_MODEL.
+type geminiEmbeddings struct {
+	s *Server
+}
+
+func (g geminiEmbeddings) Caption(ctx context.Context, path string) (string, error) {
+	parts, err := g.s.mediaParts(ctx, []string{path})
+	if err != nil {
+		return "", err
+	}
+	parts = append(parts, genai.NewPartFromText(captionPrompt))
+	contents := []*genai.Content{genai.NewContentFromParts(parts, genai.RoleUser)}
+	response, model, err := g.s.generateContent(ctx, g.s.config.CaptionModel, contents, nil)
+	if err != nil {
+		return "", fmt.Errorf("error captioning %s: %w", path, err)
+	}
+	g.s.recordUsage(ctx, contentUsage(model, response))
+	return strings.TrimSpace(response.Text()), nil
+}
+
+func (g geminiEmbeddings) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	model := g.s.config.EmbeddingModel
+	contents := make([]*genai.Content, len(texts))
+	for i, text := range texts {
+		contents[i] = genai.NewContentFromText(text, genai.RoleUser)
+	}
+	dimensions := int32(g.s.config.EmbeddingDimensions)
+	response, err := retry.Do(ctx, g.s.retryPolicy(), func() (*genai.EmbedContentResponse, error) {
+		release, err := g.s.schedule(ctx, model)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return g.s.client.Models.EmbedContent(ctx, model, contents, &genai.EmbedContentConfig{
+			TaskType:             "SEMANTIC_SIMILARITY",
+			OutputDimensionality: &dimensions,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error embedding text: %w", err)
+	}
+	if len(response.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("error embedding text: got %d embeddings for %d texts", len(response.Embeddings), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for i, e := range response.Embeddings {
+		if e == nil {
+			return nil, fmt.Errorf("error embedding text: embedding %d is missing", i+1)
+		}
+		vectors[i] = e.Values
+	}
+	return vectors, nil
+}
+
+// firstImage returns the first image among files, if there is one.
+func firstImage(files []cas.File) string {
+	for _, f := range files {
+		if strings.HasPrefix(mediaMIMEType(f.Path), "image/") {
+			return f.Path
+		}
+	}
+	return ""
+}
+
+// embedText returns the text embedded for a generation.
+func embedText(prompt, caption string) string {
+	return strings.TrimSpace(prompt + "\n" + caption)
+}
+
+// embedEntry captions the first image of a generation, embeds its prompt and
+// caption, and stores both in its index entry. Generations removed from the
+// index in the meantime are left out.
+func (s *Server) embedEntry(ctx context.Context, ix *index.Index, entry index.Entry) error {
+	if image := firstImage(entry.Files); image != "" {
+		caption, err := s.embeddings.Caption(ctx, image)
+		if err != nil {
+			return err
+		}
+		entry.Caption = caption
+	}
+	text := embedText(entry.Prompt, entry.Caption)
+	if text == "" {
+		return nil
+	}
+	vectors, err := s.embeddings.Embed(ctx, []string{text})
+	if err != nil {
+		return err
+	}
+	entry.Embedding = vectors[0]
+
+	if _, found, err := ix.Get(entry.ID); err != nil || !found {
+		return err
+	}
+	return ix.Put(entry)
+}
+
+// embedInBackground embeds a new generation without holding up its tool
+// call. Tests wait for it on s.embedding.
+func (s *Server) embedInBackground(ctx context.Context, ix *index.Index, entry index.Entry) {
+	if s.embeddings == nil {
+		return
+	}
+	s.embedding.Add(1)
+	go func() {
+		defer s.embedding.Done()
+		if err := s.embedEntry(context.WithoutCancel(ctx), ix, entry); err != nil {
+			log.Printf("Error embedding %s: %v", entry.ID, err)
+		}
+	}()
+}
+
+// FindSimilarInput is a query for generations like a text or an image.
+type FindSimilarInput struct {
+	Query     string `json:"query,omitempty" jsonschema:"description:A description of what to find, e.g. 'a fox in the snow at dusk'. Matched by meaning rather than by words."`
+	ImagePath string `json:"image_path,omitempty" jsonschema:"description:An image to find generations like, such as one saved earlier. Can be combined with query."`
+	Tool      string `json:"tool,omitempty" jsonschema:"description:Only generations of this tool, e.g. 'imagen_t2i'"`
+	Limit     int    `json:"limit,omitempty" jsonschema:"description:Maximum number of results, at most 100,default:10"`
+}
+
+// SimilarOutput is a generation and its similarity to the query, from -1
+// to 1.
+type SimilarOutput struct {
+	OutputRecord
+	Score float64 `json:"score"`
+}
+
+// FindSimilarOutput is the generations most similar to the query.
+type FindSimilarOutput struct {
+	Outputs []SimilarOutput `json:"outputs"`
+}
+
+func (s *Server) registerSimilarTools(server *mcp.Server) {
+	// Register find_similar tool
+	addTool(server, &mcp.Tool{
+		Name:        "find_similar",
+		Description: "Find past generations similar in meaning to a description or an image, most similar first, with a score from -1 to 1. Generations are compared by embeddings of their prompts and image captions. Requires EMBEDDINGS=true; generations made before it was enabled are not found.",
+	}, s.handleFindSimilar)
+}
+
+func (s *Server) handleFindSimilar(ctx context.Context, req *mcp.CallToolRequest, input FindSimilarInput) (*mcp.CallToolResult, FindSimilarOutput, error) {
+	if s.embeddings == nil {
+		return nil, FindSimilarOutput{}, fmt.Errorf("embeddings are disabled: set EMBEDDINGS=true")
+	}
+	if input.Limit < 0 {
+		return nil, FindSimilarOutput{}, fmt.Errorf("limit must not be negative")
+	}
+	limit := input.Limit
+	if limit == 0 {
+		limit = similarLimit
+	}
+	limit = min(limit, outputsMaxPageSize)
+
+	ix := s.outputIndex(ctx)
+	query := strings.TrimSpace(input.Query)
+	var vector []float32
+	var exclude string
+	if input.ImagePath != "" {
+		path := input.ImagePath
+		if resolved, err := sandbox.Resolve(path); err == nil {
+			path = resolved
+		}
+		file, err := cas.Describe(path)
+		if err != nil {
+			return nil, FindSimilarOutput{}, fmt.Errorf("error reading image: %w", err)
+		}
+		entry, found, err := ix.ByFile(path, file.SHA256)
+		if err != nil {
+			return nil, FindSimilarOutput{}, err
+		}
+		if found {
+			exclude = entry.ID
+		}
+		switch {
+		case found && query == "" && len(entry.Embedding) > 0:
+			// Reuse the embedding of the generation that saved the image
+			vector = entry.Embedding
+		case found && entry.Caption != "":
+			query = embedText(query, entry.Caption)
+		default:
+			caption, err := s.embeddings.Caption(ctx, path)
+			if err != nil {
+				return nil, FindSimilarOutput{}, err
+			}
+			query = embedText(query, caption)
+		}
+	}
+	if vector == nil {
+		if query == "" {
+			return nil, FindSimilarOutput{}, fmt.Errorf("query or image_path is required")
+		}
+		vectors, err := s.embeddings.Embed(ctx, []string{query})
+		if err != nil {
+			return nil, FindSimilarOutput{}, err
+		}
+		vector = vectors[0]
+	}
+
+	// Ask for one more in case the image's own generation is among them
+	matches, err := ix.Nearest(vector, index.Query{Tool: input.Tool}, limit+1)
+	if err != nil {
+		return nil, FindSimilarOutput{}, err
+	}
+	output := FindSimilarOutput{Outputs: []SimilarOutput{}}
+	for _, m := range matches {
+		if m.ID == exclude || len(output.Outputs) == limit {
+			continue
+		}
+		output.Outputs = append(output.Outputs, SimilarOutput{OutputRecord: outputRecord(m.Entry), Score: m.Score})
+	}
+	return nil, output, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gemini-mcp/internal/config"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/storage"
+
+	"google.golang.org/genai"
+)
+
+// newStorage returns the bucket of the configured storage backend, or nil if
+// saved files are only kept on local disk.
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.GenmediaBucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+		})
+	case "gcs":
+		return storage.NewGCS(storage.GCSConfig{
+			Bucket:       cfg.GenmediaBucket,
+			HMACAccessID: cfg.GCSHMACAccessID,
+			HMACSecret:   cfg.GCSHMACSecret,
+		})
+	default:
+		return nil, nil
+	}
+}
+
+// storageKey returns the object key of a saved file: its path relative to
+// OUTPUT_DIR, or its name if it is elsewhere, after STORAGE_PREFIX.
+func (s *Server) storageKey(file string) string {
+	key := filepath.Base(file)
+	root, err := sandbox.Resolve(s.config.OutputDir)
+	resolved, resolveErr := sandbox.Resolve(file)
+	if err == nil && resolveErr == nil && sandbox.Within(resolved, []string{root}) {
+		if rel, err := filepath.Rel(root, resolved); err == nil {
+			key = filepath.ToSlash(rel)
+		}
+	}
+	return path.Join(s.config.StoragePrefix, key)
+}
+
+// localObject describes a file that is only kept on local disk.
+func (s *Server) localObject(file string) (storage.Object, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return storage.Object{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return storage.Object{}, err
+	}
+	return storage.Object{Key: s.storageKey(file), URI: storage.FileURI(abs), Size: info.Size()}, nil
+}
+
+// storeFiles uploads saved files to the storage bucket, if one is
+// configured, and returns their URIs and presigned URLs. The files stay on
+// local disk, where tools read their inputs from. Files that cannot be
+// stored are logged and left out.
+func (s *Server) storeFiles(ctx context.Context, files []string) []storage.Object {
+	var objects []storage.Object
+	for _, file := range files {
+		obj, err := s.storeFile(ctx, file)
+		if err != nil {
+			log.Printf("Error storing %s: %v", file, err)
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+func (s *Server) storeFile(ctx context.Context, file string) (storage.Object, error) {
+	if s.storage == nil {
+		return s.localObject(file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return storage.Object{}, err
+	}
+	defer f.Close()
+	obj, err := s.storage.Put(ctx, s.storageKey(file), f, mime.TypeByExtension(filepath.Ext(file)))
+	if err != nil {
+		return storage.Object{}, err
+	}
+	s.presign(obj)
+	return *obj, nil
+}
+
+// presign adds a presigned download URL to obj if STORAGE_PRESIGN_TTL is set.
+func (s *Server) presign(obj *storage.Object) {
+	if s.config.StoragePresignTTL <= 0 {
+		return
+	}
+	url, err := s.storage.PresignGet(obj.Key, s.config.StoragePresignTTL)
+	if err != nil {
+		log.Printf("Not presigning %s: %v", obj.URI, err)
+		return
+	}
+	obj.URL = url
+}
+
+// geminiFilesURL is the prefix of the download URLs of Gemini API files.
+const geminiFilesURL = "https://generativelanguage.googleapis.com/v1beta/files/"
+
+// softWriter writes to w until that fails, so that a failed upload does not
+// stop the local copy of a stream.
+type softWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *softWriter) Write(p []byte) (int, error) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// saveVideo saves a generated video at outputPath and, if a storage bucket is
+// configured, uploads it at the same time. Videos with a download URI are
+// streamed rather than held in memory.
+func (s *Server) saveVideo(ctx context.Context, video *genai.Video, outputPath string) (*storage.Object, error) {
+	var body io.Reader
+	switch {
+	case len(video.VideoBytes) > 0:
+		body = bytes.NewReader(video.VideoBytes)
+	case video.URI != "":
+		uri := video.URI
+		if !strings.HasPrefix(uri, "https://") && !strings.HasPrefix(uri, "http://") {
+			uri = geminiFilesURL + strings.TrimPrefix(uri, "files/") + ":download?alt=media"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading video: %w", err)
+		}
+		req.Header.Set("x-goog-api-key", s.config.APIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading video: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error downloading video: %s", resp.Status)
+		}
+		body = resp.Body
+	default:
+		return nil, errors.New("the video has neither data nor a download URI")
+	}
+
+	local, err := storage.NewLocal(filepath.Dir(outputPath))
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(outputPath)
+	if s.storage == nil {
+		if _, err := local.Put(ctx, name, body, "video/mp4"); err != nil {
+			return nil, err
+		}
+		obj, err := s.localObject(outputPath)
+		return &obj, err
+	}
+
+	type upload struct {
+		obj *storage.Object
+		err error
+	}
+	uploaded := make(chan upload, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		obj, err := s.storage.Put(ctx, s.storageKey(outputPath), pr, "video/mp4")
+		pr.CloseWithError(err)
+		uploaded <- upload{obj, err}
+	}()
+
+	upstream := &softWriter{w: pw}
+	_, err = local.Put(ctx, name, io.TeeReader(body, upstream), "video/mp4")
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	result := <-uploaded
+	if err != nil {
+		return nil, err
+	}
+	if result.err != nil {
+		// The local copy is still usable
+		log.Printf("Error uploading video %s: %v", outputPath, result.err)
+		obj, err := s.localObject(outputPath)
+		return &obj, err
+	}
+	s.presign(result.obj)
+	return result.obj, nil
+}
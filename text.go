@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"gemini-mcp/internal/retry"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// Text generation
+type GeminiGenerateTextInput struct {
+	Prompt            string         `json:"prompt" jsonschema:"description:The prompt, e.g. 'Write a shot list for a 30 second coffee commercial' or 'Write alt text for the attached image'"`
+	SystemInstruction string         `json:"system_instruction,omitempty" jsonschema:"description:Optional system instruction that sets the role, tone or rules for the response. Not allowed with cache_name; give the cache its instruction in cache_create instead."`
+	Model             string         `json:"model,omitempty" jsonschema:"description:Gemini model to use for generation,default:gemini-2.5-flash"`
+	JSONOutput        bool           `json:"json_output,omitempty" jsonschema:"description:Return the response as JSON in the structured field. Enabled automatically when a response schema is provided.,default:false"`
+	ResponseSchema    map[string]any `json:"response_schema,omitempty" jsonschema:"description:Optional JSON schema the structured response must follow, e.g. {\"type\":\"object\",\"properties\":{\"title\":{\"type\":\"string\"}}}"`
+	ThinkingBudget    *int           `json:"thinking_budget,omitempty" jsonschema:"description:Optional number of tokens the model may spend thinking before answering. 0 disables thinking, -1 lets the model decide."`
+	Temperature       *float64       `json:"temperature,omitempty" jsonschema:"description:Optional sampling temperature between 0.0 and 2.0. Lower values give more deterministic output."`
+	MaxOutputTokens   int            `json:"max_output_tokens,omitempty" jsonschema:"description:Optional maximum number of tokens in the response"`
+	AttachmentPaths   []string       `json:"attachment_paths,omitempty" jsonschema:"description:Optional paths to local images, videos or audio files (or 'files/<id>' names of uploaded files) to include with the prompt"`
+	CacheName         string         `json:"cache_name,omitempty" jsonschema:"description:Optional context cache (name or display name from cache_create) to use. The model defaults to the cache's model."`
+	DryRun            bool           `json:"dry_run,omitempty" jsonschema:"description:Return the final prompt, config and estimated cost without calling the API. The output estimate uses max_output_tokens if set.,default:false"`
+}
+
+type TokenUsage struct {
+	PromptTokens   int `json:"prompt_tokens"`
+	CachedTokens   int `json:"cached_tokens,omitempty"`
+	OutputTokens   int `json:"output_tokens"`
+	ThinkingTokens int `json:"thinking_tokens,omitempty"`
+	TotalTokens    int `json:"total_tokens"`
+}
+
+type GeminiGenerateTextOutput struct {
+	Model        string     `json:"model"`
+	FallbackFrom string     `json:"fallback_from,omitempty"`
+	Text         string     `json:"text"`
+	Structured   any        `json:"structured,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Usage        TokenUsage `json:"usage"`
+	GeneratedAt  string     `json:"generated_at"`
+	DryRun       *DryRun    `json:"dry_run,omitempty"`
+}
+
+func (s *Server) registerTextTools(server *mcp.Server) {
+	// Register gemini_generate_text tool
+	addTool(server, &mcp.Tool{
+		Name:        "gemini_generate_text",
+		Description: "Generate text using Google's Gemini AI models, such as shot lists, product descriptions or alt text. Supports a system instruction, JSON structured output following a caller-supplied schema, thinking budget, temperature and optional image, video or audio attachments. Returns the response with token usage.",
+	}, s.handleGeminiGenerateText)
+}
+
+func (s *Server) handleGeminiGenerateText(ctx context.Context, req *mcp.CallToolRequest, input GeminiGenerateTextInput) (*mcp.CallToolResult, GeminiGenerateTextOutput, error) {
+	if input.Prompt == "" {
+		return nil, GeminiGenerateTextOutput{}, fmt.Errorf("prompt is required")
+	}
+	if input.Temperature != nil && (*input.Temperature < 0 || *input.Temperature > 2) {
+		return nil, GeminiGenerateTextOutput{}, fmt.Errorf("temperature must be between 0.0 and 2.0")
+	}
+
+	// The API refuses a system instruction next to a cache with an opaque 400
+	if input.CacheName != "" && input.SystemInstruction != "" {
+		return nil, GeminiGenerateTextOutput{}, &retry.Error{
+			Kind:    retry.KindInvalidArgument,
+			Message: "system_instruction cannot be used with cache_name; pass it to cache_create when creating the cache instead",
+		}
+	}
+
+	config, model, err := s.cachedContentConfig(ctx, input.CacheName, input.Model, false)
+	if err != nil {
+		return nil, GeminiGenerateTextOutput{}, err
+	}
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+	if config == nil {
+		config = &genai.GenerateContentConfig{}
+	}
+
+	if input.SystemInstruction != "" {
+		config.SystemInstruction = genai.NewContentFromText(input.SystemInstruction, genai.RoleUser)
+	}
+	jsonOutput := input.JSONOutput || input.ResponseSchema != nil
+	if jsonOutput {
+		config.ResponseMIMEType = "application/json"
+		if input.ResponseSchema != nil {
+			config.ResponseJsonSchema = input.ResponseSchema
+		}
+	}
+	if input.ThinkingBudget != nil {
+		config.ThinkingConfig = &genai.ThinkingConfig{
+			ThinkingBudget: genai.Ptr(int32(*input.ThinkingBudget)),
+		}
+	}
+	if input.Temperature != nil {
+		config.Temperature = genai.Ptr(float32(*input.Temperature))
+	}
+	if input.MaxOutputTokens > 0 {
+		config.MaxOutputTokens = int32(input.MaxOutputTokens)
+	}
+
+	log.Printf("Generating text with model %s (%d attachment(s)): %s", model, len(input.AttachmentPaths), input.Prompt)
+
+	if input.DryRun {
+		dryRun, err := s.dryRunContent(ctx, model, nil, input.Prompt, config, input.AttachmentPaths, input.MaxOutputTokens)
+		if err != nil {
+			return nil, GeminiGenerateTextOutput{}, err
+		}
+		return nil, GeminiGenerateTextOutput{
+			Model:       model,
+			GeneratedAt: time.Now().Format("20060102_150405"),
+			DryRun:      dryRun,
+		}, nil
+	}
+
+	parts := []*genai.Part{genai.NewPartFromText(input.Prompt)}
+	if len(input.AttachmentPaths) > 0 {
+		attachments, err := s.mediaParts(ctx, input.AttachmentPaths)
+		if err != nil {
+			return nil, GeminiGenerateTextOutput{}, err
+		}
+		parts = append(parts, attachments...)
+	}
+
+	contents := []*genai.Content{
+		genai.NewContentFromParts(parts, genai.RoleUser),
+	}
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
+	if err != nil {
+		return nil, GeminiGenerateTextOutput{}, fmt.Errorf("error generating text: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		if response != nil && response.PromptFeedback != nil && response.PromptFeedback.BlockReason != "" {
+			return nil, GeminiGenerateTextOutput{}, fmt.Errorf("prompt was blocked: %s", response.PromptFeedback.BlockReason)
+		}
+		return nil, GeminiGenerateTextOutput{}, fmt.Errorf("no text was generated")
+	}
+
+	resultText := response.Text()
+
+	var structured any
+	if jsonOutput {
+		if err := json.Unmarshal([]byte(resultText), &structured); err != nil {
+			return nil, GeminiGenerateTextOutput{}, fmt.Errorf("model returned invalid JSON: %v", err)
+		}
+	}
+
+	return nil, GeminiGenerateTextOutput{
+		Model:        model,
+		FallbackFrom: fallbackFrom(requestedModel, model),
+		Text:         resultText,
+		Structured:   structured,
+		FinishReason: string(response.Candidates[0].FinishReason),
+		Usage:        tokenUsage(response.UsageMetadata),
+		GeneratedAt:  time.Now().Format("20060102_150405"),
+	}, nil
+}
+
+// tokenUsage converts the usage metadata of a response, which may be missing.
+func tokenUsage(metadata *genai.GenerateContentResponseUsageMetadata) TokenUsage {
+	if metadata == nil {
+		return TokenUsage{}
+	}
+	return TokenUsage{
+		PromptTokens:   int(metadata.PromptTokenCount),
+		CachedTokens:   int(metadata.CachedContentTokenCount),
+		OutputTokens:   int(metadata.CandidatesTokenCount),
+		ThinkingTokens: int(metadata.ThoughtsTokenCount),
+		TotalTokens:    int(metadata.TotalTokenCount),
+	}
+}
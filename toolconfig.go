@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/google/jsonschema-go/jsonschema"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// toolConfigMiddleware fills in the default arguments configured for a tool
+// and resolves model aliases before the call reaches the tool.
+func (s *Server) toolConfigMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil {
+			return next(ctx, method, req)
+		}
+
+		args, err := s.toolArguments(callReq.Params.Name, callReq.Params.Arguments)
+		if err != nil {
+			// Leave invalid arguments for the tool to report.
+			return next(ctx, method, req)
+		}
+		callReq.Params.Arguments = args
+		return next(ctx, method, req)
+	}
+}
+
+// toolArguments returns the arguments of a call to tool with the configured
+// defaults filled in and a model alias replaced by its model.
+func (s *Server) toolArguments(tool string, raw json.RawMessage) (json.RawMessage, error) {
+	toolConfig := s.config.Tools[tool]
+	if len(toolConfig.Defaults) == 0 && toolConfig.Model == "" && len(s.config.Aliases) == 0 {
+		return raw, nil
+	}
+
+	args := make(map[string]any)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range toolConfig.Defaults {
+		if _, ok := args[key]; !ok {
+			args[key] = value
+		}
+	}
+	if _, ok := args["model"]; !ok && toolConfig.Model != "" {
+		args["model"] = toolConfig.Model
+	}
+	if model, ok := args["model"].(string); ok {
+		args["model"] = s.config.ResolveModel(model)
+	}
+	return json.Marshal(args)
+}
+
+// configureTools checks the tool settings of the configuration file against
+// the registered tools and their input schemas, and removes disabled tools.
+func (s *Server) configureTools(ctx context.Context, server *mcp.Server) error {
+	if len(s.config.Tools) == 0 {
+		return nil
+	}
+
+	tools, err := listTools(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var disabled []string
+	names := make([]string, 0, len(s.config.Tools))
+	for name := range s.config.Tools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		tool, ok := tools[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("tools.%s: unknown tool", name))
+			continue
+		}
+
+		toolConfig := s.config.Tools[name]
+		if toolConfig.Model != "" {
+			if err := validateArgument(tool, "model", toolConfig.Model); err != nil {
+				errs = append(errs, fmt.Errorf("tools.%s.model: %w", name, err))
+			}
+		}
+		for key, value := range toolConfig.Defaults {
+			if err := validateArgument(tool, key, value); err != nil {
+				errs = append(errs, fmt.Errorf("tools.%s.defaults.%s: %w", name, key, err))
+			}
+		}
+		if !s.config.ToolEnabled(name) {
+			disabled = append(disabled, name)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if len(disabled) > 0 {
+		log.Printf("Disabling tools: %v", disabled)
+		server.RemoveTools(disabled...)
+	}
+	return nil
+}
+
+// validateArgument checks a default value against the input schema of tool.
+func validateArgument(tool *mcp.Tool, name string, value any) error {
+	var property *jsonschema.Schema
+	if tool.InputSchema != nil {
+		property = tool.InputSchema.Properties[name]
+	}
+	if property == nil {
+		return fmt.Errorf("%s has no argument %s", tool.Name, name)
+	}
+
+	// Round trip the value through JSON so that it has the types a call
+	// would have.
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var instance any
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return err
+	}
+
+	resolved, err := property.Resolve(nil)
+	if err != nil {
+		return err
+	}
+	return resolved.Validate(instance)
+}
+
+// listTools returns the tools registered on server, as clients see them.
+func listTools(ctx context.Context, server *mcp.Server) (map[string]*mcp.Tool, error) {
+	clientTransport, serverTransport := mcp.NewInMemoryTransports()
+	serverSession, err := server.Connect(ctx, serverTransport, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer serverSession.Close()
+
+	client := mcp.NewClient(&mcp.Implementation{Name: serviceName, Version: version}, nil)
+	session, err := client.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	tools := make(map[string]*mcp.Tool)
+	for tool, err := range session.Tools(ctx, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("error listing tools: %w", err)
+		}
+		tools[tool.Name] = tool
+	}
+	return tools, nil
+}
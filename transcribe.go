@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"gemini-mcp/internal/cas"
+	"gemini-mcp/internal/sandbox"
+	"gemini-mcp/internal/storage"
+	"gemini-mcp/internal/subtitle"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// Audio transcription and subtitles
+type GeminiTranscribeInput struct {
+	MediaPath       string `json:"media_path,omitempty" jsonschema:"description:Path to a local audio or video file (MP3, WAV, M4A, FLAC, OGG, MP4, MOV, WebM), such as a Veo 3 clip with generated audio"`
+	FileName        string `json:"file_name,omitempty" jsonschema:"description:Name of a file already uploaded through the Files API (e.g. 'files/abc123'). Used instead of media_path to avoid uploading again; subtitles are then saved to the output directory."`
+	Language        string `json:"language,omitempty" jsonschema:"description:Language of the transcript as a name or BCP-47 code (e.g. 'en', 'ja', 'es-MX'). If omitted, the spoken language is detected and used."`
+	SpeakerLabels   *bool  `json:"speaker_labels,omitempty" jsonschema:"description:Identify speakers and label each subtitle with the speaker,default:true"`
+	Model           string `json:"model,omitempty" jsonschema:"description:Gemini model to use for transcription,default:gemini-2.5-flash"`
+	OutputDirectory string `json:"output_directory,omitempty" jsonschema:"description:Optional. Directory where the .srt and .vtt files are saved. Defaults to the directory of the media file."`
+}
+
+type TranscriptSegment struct {
+	Start   float64 `json:"start" jsonschema:"description:Segment start in seconds"`
+	End     float64 `json:"end" jsonschema:"description:Segment end in seconds"`
+	Speaker string  `json:"speaker,omitempty"`
+	Text    string  `json:"text"`
+}
+
+type GeminiTranscribeOutput struct {
+	MediaPath    string              `json:"media_path,omitempty"`
+	FileName     string              `json:"file_name"`
+	Model        string              `json:"model"`
+	FallbackFrom string              `json:"fallback_from,omitempty"`
+	Language     string              `json:"language"`
+	Transcript   string              `json:"transcript"`
+	Segments     []TranscriptSegment `json:"segments"`
+	SRTPath      string              `json:"srt_path,omitempty"`
+	VTTPath      string              `json:"vtt_path,omitempty"`
+	SavedFiles   []string            `json:"saved_files,omitempty"`
+	StoredFiles  []storage.Object    `json:"stored_files,omitempty"`
+	GeneratedAt  string              `json:"generated_at"`
+}
+
+// transcriptSchema is the response schema requested for transcriptions.
+var transcriptSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"language": map[string]any{"type": "string"},
+		"segments": map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"start":   map[string]any{"type": "number"},
+					"end":     map[string]any{"type": "number"},
+					"speaker": map[string]any{"type": "string"},
+					"text":    map[string]any{"type": "string"},
+				},
+				"required": []any{"start", "end", "text"},
+			},
+		},
+	},
+	"required": []any{"language", "segments"},
+}
+
+func (s *Server) handleGeminiTranscribe(ctx context.Context, req *mcp.CallToolRequest, input GeminiTranscribeInput) (*mcp.CallToolResult, GeminiTranscribeOutput, error) {
+	if input.MediaPath == "" && input.FileName == "" {
+		return nil, GeminiTranscribeOutput{}, fmt.Errorf("media_path or file_name is required")
+	}
+
+	model := input.Model
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+
+	speakerLabels := true
+	if input.SpeakerLabels != nil {
+		speakerLabels = *input.SpeakerLabels
+	}
+
+	// Upload the media, or reuse a previous upload
+	var file *genai.File
+	var err error
+	if input.FileName != "" {
+		file, err = s.getActiveFile(ctx, input.FileName)
+	} else {
+		file, err = s.uploadFile(ctx, input.MediaPath, "")
+	}
+	if err != nil {
+		return nil, GeminiTranscribeOutput{}, err
+	}
+
+	log.Printf("Transcribing %s with model %s (language: %s, speakers: %t)", file.Name, model, input.Language, speakerLabels)
+
+	var promptParts []string
+	promptParts = append(promptParts, "Transcribe all speech in this media file verbatim as subtitle segments. Give each segment's start and end time in seconds from the beginning of the file, and keep segments short enough to read as subtitles (at most two sentences)")
+
+	if input.Language != "" {
+		promptParts = append(promptParts, fmt.Sprintf("Write the transcript in %s and report %s as the language", input.Language, input.Language))
+	} else {
+		promptParts = append(promptParts, "Write the transcript in the spoken language and report its BCP-47 code as the language")
+	}
+
+	if speakerLabels {
+		promptParts = append(promptParts, "Identify the different speakers and label them consistently, using their names if they are mentioned and 'Speaker 1', 'Speaker 2' and so on otherwise")
+	} else {
+		promptParts = append(promptParts, "Leave the speaker empty")
+	}
+
+	promptText := strings.Join(promptParts, ". ")
+	parts := []*genai.Part{
+		genai.NewPartFromURI(file.URI, file.MIMEType),
+		genai.NewPartFromText(promptText),
+	}
+
+	contents := []*genai.Content{
+		genai.NewContentFromParts(parts, genai.RoleUser),
+	}
+
+	config := &genai.GenerateContentConfig{
+		ResponseMIMEType:   "application/json",
+		ResponseJsonSchema: transcriptSchema,
+	}
+
+	requestedModel := model
+	response, model, err := s.generateContent(ctx, requestedModel, contents, config)
+	if err != nil {
+		return nil, GeminiTranscribeOutput{}, fmt.Errorf("error transcribing media: %w", err)
+	}
+
+	s.recordUsage(ctx, contentUsage(model, response))
+
+	if response == nil || len(response.Candidates) == 0 {
+		return nil, GeminiTranscribeOutput{}, fmt.Errorf("no transcript was generated")
+	}
+
+	var result struct {
+		Language string              `json:"language"`
+		Segments []TranscriptSegment `json:"segments"`
+	}
+	if err := json.Unmarshal([]byte(response.Text()), &result); err != nil {
+		return nil, GeminiTranscribeOutput{}, fmt.Errorf("model returned invalid JSON: %v", err)
+	}
+
+	var lines []string
+	segments := make([]subtitle.Segment, 0, len(result.Segments))
+	for i := range result.Segments {
+		seg := &result.Segments[i]
+		if !speakerLabels {
+			seg.Speaker = ""
+		}
+		segments = append(segments, subtitle.Segment{
+			Start:   subtitle.FromSeconds(seg.Start),
+			End:     subtitle.FromSeconds(seg.End),
+			Speaker: seg.Speaker,
+			Text:    seg.Text,
+		})
+		if seg.Speaker != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", seg.Speaker, seg.Text))
+		} else {
+			lines = append(lines, seg.Text)
+		}
+	}
+
+	// Save subtitles next to the media unless another directory is given or
+	// outputs are isolated, named by subtitleBase
+	timestamp := time.Now().Format("20060102_150405")
+	outputDir := input.OutputDirectory
+	base := "transcript_" + timestamp
+	if input.MediaPath != "" {
+		if outputDir == "" && !s.isolated() {
+			outputDir = s.subtitleDir(ctx, req, filepath.Dir(input.MediaPath))
+		}
+		base = strings.TrimSuffix(filepath.Base(input.MediaPath), filepath.Ext(input.MediaPath))
+	}
+	if outputDir == "" {
+		outputDir = s.outputDir(ctx)
+	}
+
+	var savedFiles []string
+	var srtPath, vttPath string
+	if outputDir != "" && len(segments) > 0 {
+		if err := os.MkdirAll(outputDir, 0755); err == nil {
+			base = subtitleBase(outputDir, base, result.Language, timestamp)
+			outputPath := filepath.Join(outputDir, base+".srt")
+			if err := cas.WriteFile(outputPath, []byte(subtitle.SRT(segments)), 0644); err == nil {
+				savedFiles = append(savedFiles, outputPath)
+				srtPath = outputPath
+				log.Printf("Saved SRT subtitles to: %s", outputPath)
+			}
+
+			outputPath = filepath.Join(outputDir, base+".vtt")
+			if err := cas.WriteFile(outputPath, []byte(subtitle.VTT(segments)), 0644); err == nil {
+				savedFiles = append(savedFiles, outputPath)
+				vttPath = outputPath
+				log.Printf("Saved VTT subtitles to: %s", outputPath)
+			}
+		}
+	}
+
+	return nil, GeminiTranscribeOutput{
+		MediaPath:    input.MediaPath,
+		FileName:     file.Name,
+		Model:        model,
+		FallbackFrom: fallbackFrom(requestedModel, model),
+		Language:     result.Language,
+		Transcript:   strings.Join(lines, "\n"),
+		Segments:     result.Segments,
+		SRTPath:      srtPath,
+		VTTPath:      vttPath,
+		SavedFiles:   savedFiles,
+		StoredFiles:  s.storeFiles(ctx, savedFiles),
+		GeneratedAt:  timestamp,
+	}, nil
+}
+
+// subtitleDir returns dir, the directory of the transcribed media, if the
+// sandbox allows writing to it. The sandbox only checked that the media can
+// be read, so otherwise the subtitles go to the output directory.
+func (s *Server) subtitleDir(ctx context.Context, req *mcp.CallToolRequest, dir string) string {
+	if s.sandbox == nil {
+		return dir
+	}
+	checker, err := s.newPathChecker(req, s.outputDir(ctx))
+	if err == nil {
+		var checked any
+		if checked, err = checker.check(ctx, dir, sandbox.Write); err == nil {
+			return checked.(string)
+		}
+	}
+	log.Printf("Not saving subtitles next to the media: %v", err)
+	return ""
+}
+
+// subtitleBase returns the name, without extension, of the subtitles of a
+// media file with the given base name: "<base>.<language>", which players
+// pick up next to the media. Existing subtitles are never overwritten; if
+// the name is taken, the timestamp of the transcript is added to it.
+func subtitleBase(dir, base, language, timestamp string) string {
+	language = strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, language)
+	suffix := ""
+	if language != "" {
+		suffix = "." + language
+	}
+
+	name := base + suffix
+	for i := 1; subtitlesExist(filepath.Join(dir, name)); i++ {
+		name = fmt.Sprintf("%s_%s%s", base, timestamp, suffix)
+		if i > 1 {
+			name = fmt.Sprintf("%s_%s_%d%s", base, timestamp, i, suffix)
+		}
+	}
+	return name
+}
+
+// subtitlesExist reports whether SRT or VTT subtitles exist at path without
+// its extension.
+func subtitlesExist(path string) bool {
+	for _, ext := range []string{".srt", ".vtt"} {
+		if _, err := os.Lstat(path + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gemini-mcp/internal/retry"
+
+	mcpauth "github.com/modelcontextprotocol/go-sdk/auth"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// newMCPServer creates an MCP server with the tools of s, as configured.
+func (s *Server) newMCPServer(ctx context.Context) (*mcp.Server, error) {
+	mcpServer := mcp.NewServer(&mcp.Implementation{
+		Name:    serviceName,
+		Version: version,
+	}, nil)
+
+	// Register tools
+	s.registerTools(mcpServer)
+	if err := s.configureTools(ctx, mcpServer); err != nil {
+		return nil, err
+	}
+	return mcpServer, nil
+}
+
+// httpHandler returns the handler of the HTTP or SSE transport, requiring a
+// bearer token if authentication is configured.
+func (s *Server) httpHandler(mcpServer *mcp.Server) (http.Handler, error) {
+	var handler http.Handler
+	switch s.config.Transport {
+	case "http":
+		handler = mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+			return mcpServer
+		}, nil)
+	case "sse":
+		// SSE requests do not pass the token on to the server and SSE
+		// sessions have no IDs, so each connection gets its own server bound
+		// to the token that opened it and, for isolation, an ID.
+		handler = mcp.NewSSEHandler(func(req *http.Request) *mcp.Server {
+			info := mcpauth.TokenInfoFromContext(req.Context())
+			if info == nil && !s.isolated() {
+				return mcpServer
+			}
+			connServer, err := s.newMCPServer(req.Context())
+			if err != nil {
+				log.Printf("Error creating server for SSE connection: %v", err)
+				return nil
+			}
+			connServer.AddReceivingMiddleware(bindConnection(newConnectionID(), info))
+			return connServer
+		})
+	default:
+		return nil, fmt.Errorf("transport %s is not served over HTTP", s.config.Transport)
+	}
+
+	if s.auth == nil {
+		return handler, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", mcpauth.RequireBearerToken(s.auth.Verify, &mcpauth.RequireBearerTokenOptions{
+		ResourceMetadataURL: s.auth.ResourceMetadataURL(),
+	})(handler))
+	if s.auth.ResourceMetadataURL() != "" {
+		mux.HandleFunc("GET "+s.auth.ResourceMetadataPath(), func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.auth.Metadata())
+		})
+	}
+	return mux, nil
+}
+
+// serveHTTP serves the HTTP or SSE transport on the configured port until ctx
+// is done.
+func (s *Server) serveHTTP(ctx context.Context, mcpServer *mcp.Server) error {
+	handler, err := s.httpHandler(mcpServer)
+	if err != nil {
+		return err
+	}
+	if s.auth == nil {
+		log.Printf("Warning: no auth is configured, so anyone who can reach port %d can use the server", s.config.Port)
+	}
+
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf(":%d", s.config.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		httpServer.Shutdown(context.Background())
+	}()
+	log.Printf("Listening on %s", httpServer.Addr)
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// bindConnection attaches the ID and token of an SSE connection to its
+// requests.
+func bindConnection(id string, info *mcpauth.TokenInfo) mcp.Middleware {
+	return func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			ctx = context.WithValue(ctx, connectionKey{}, id)
+			switch r := req.(type) {
+			case *mcp.CallToolRequest:
+				r.Extra = &mcp.RequestExtra{TokenInfo: info}
+			case *mcp.ListToolsRequest:
+				r.Extra = &mcp.RequestExtra{TokenInfo: info}
+			case *mcp.ListResourcesRequest:
+				r.Extra = &mcp.RequestExtra{TokenInfo: info}
+			case *mcp.ReadResourceRequest:
+				r.Extra = &mcp.RequestExtra{TokenInfo: info}
+			}
+			return next(ctx, method, req)
+		}
+	}
+}
+
+// authMiddleware refuses tool calls that the scopes of the bearer token do
+// not allow and hides those tools from the tool list. Requests without a
+// token, such as those of the stdio transport, are not restricted.
+func (s *Server) authMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		if s.auth == nil {
+			return next(ctx, method, req)
+		}
+
+		switch r := req.(type) {
+		case *mcp.CallToolRequest:
+			if r.Extra == nil || r.Extra.TokenInfo == nil || r.Params == nil {
+				break
+			}
+			if !s.auth.Allowed(r.Extra.TokenInfo.Scopes, r.Params.Name) {
+				err := fmt.Errorf("the scopes of this token do not allow %s", r.Params.Name)
+				log.Printf("Refusing %s for %s: %v", r.Params.Name, clientID(r), err)
+				return &mcp.CallToolResult{
+					IsError:           true,
+					Content:           []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+					StructuredContent: map[string]any{"error": ToolError{Kind: retry.KindAuth, Message: err.Error()}},
+				}, nil
+			}
+
+		case *mcp.ListToolsRequest:
+			if r.Extra == nil || r.Extra.TokenInfo == nil {
+				break
+			}
+			result, err := next(ctx, method, req)
+			if list, ok := result.(*mcp.ListToolsResult); ok && err == nil {
+				tools := []*mcp.Tool{}
+				for _, tool := range list.Tools {
+					if s.auth.Allowed(r.Extra.TokenInfo.Scopes, tool.Name) {
+						tools = append(tools, tool)
+					}
+				}
+				list.Tools = tools
+			}
+			return result, err
+		}
+		return next(ctx, method, req)
+	}
+}
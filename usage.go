@@ -0,0 +1,272 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gemini-mcp/internal/ledger"
+	"gemini-mcp/internal/pricing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"google.golang.org/genai"
+)
+
+// billedTool is a tool that calls billed Gemini, Imagen or Veo APIs, with
+// the model it uses by default and whether it generates videos, from which
+// the cost of a call is estimated before it runs.
+type billedTool struct {
+	model string
+	video bool
+}
+
+// billedTools are the tools refused once a budget or the tenant quota is
+// exhausted. New tools that call billed APIs must be added here.
+var billedTools = map[string]billedTool{
+	"gemini_image_generation":     {model: "gemini-2.5-flash-image-preview"},
+	"gemini_image_edit":           {model: "gemini-2.5-flash-image-preview"},
+	"gemini_multi_image":          {model: "gemini-2.5-flash-image-preview"},
+	"gemini_image_session_start":  {model: "gemini-2.5-flash-image-preview"},
+	"gemini_image_session_edit":   {model: "gemini-2.5-flash-image-preview"},
+	"gemini_image_session_branch": {model: "gemini-2.5-flash-image-preview"},
+	"imagen_t2i":                  {model: "imagen-4.0-generate-001"},
+	"veo_generate_video":          {model: "veo-3.0-generate-001", video: true},
+	"veo_text_to_video":           {model: "veo-3.0-generate-001", video: true},
+	"veo_image_to_video":          {model: "veo-3.0-generate-001", video: true},
+	"gemini_generate_text":        {model: "gemini-2.5-flash"},
+	"gemini_image_analyze":        {model: "gemini-2.5-flash"},
+	"gemini_image_detect":         {model: "gemini-2.5-flash"},
+	"gemini_video_analyze":        {model: "gemini-2.5-flash"},
+	"gemini_transcribe":           {model: "gemini-2.5-flash"},
+	"cache_create":                {model: "gemini-2.5-flash"},
+	"find_similar":                {},
+}
+
+// ledgerFile is the name of the usage ledger in OUTPUT_DIR.
+const ledgerFile = "usage_ledger.jsonl"
+
+// callInfoKey is the context key of the callInfo of a tool call.
+type callInfoKey struct{}
+
+// callInfo identifies the tool call that API usage is recorded against.
+type callInfo struct {
+	tool   string
+	client string
+}
+
+// Usage reporting
+type UsageReportInput struct {
+	Period string `json:"period,omitempty" jsonschema:"description:Period to summarize: 'day' (since midnight), 'month' (since the first of the month) or 'all',default:month,enum:day,enum:month,enum:all"`
+	Client string `json:"client,omitempty" jsonschema:"description:Optional client to report on, e.g. 'session:<id>' or 'token:<id>'. Use 'me' for the calling client. Callers authenticated with a bearer token only see their own usage."`
+}
+
+type BudgetStatus struct {
+	Limits                ledger.Limits `json:"limits"`
+	DailySpentUSD         float64       `json:"daily_spent_usd"`
+	MonthlySpentUSD       float64       `json:"monthly_spent_usd"`
+	ClientDailySpentUSD   float64       `json:"client_daily_spent_usd"`
+	ClientMonthlySpentUSD float64       `json:"client_monthly_spent_usd"`
+	Exceeded              string        `json:"exceeded,omitempty"`
+}
+
+type UsageReportOutput struct {
+	Period string        `json:"period"`
+	Since  string        `json:"since,omitempty"`
+	Client string        `json:"client,omitempty"`
+	Caller string        `json:"caller"`
+	Report ledger.Report `json:"report"`
+	Budget BudgetStatus  `json:"budget"`
+}
+
+func (s *Server) registerUsageTools(server *mcp.Server) {
+	// Record usage and enforce budgets for every tool call
+	server.AddReceivingMiddleware(s.usageMiddleware)
+
+	// Register usage_report tool
+	addTool(server, &mcp.Tool{
+		Name:        "usage_report",
+		Description: "Summarize recorded API usage and estimated spend by model, tool and client for today, this month or all time, along with the configured budget limits and how much of them is used. Callers authenticated with a bearer token only get their own usage.",
+	}, s.handleUsageReport)
+}
+
+// usageMiddleware refuses calls to billed tools once a budget is exhausted
+// and makes the calling tool and client available to recordUsage.
+func (s *Server) usageMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		callReq, ok := req.(*mcp.CallToolRequest)
+		if !ok || callReq.Params == nil {
+			return next(ctx, method, req)
+		}
+
+		info := callInfo{tool: callReq.Params.Name, client: clientID(callReq)}
+		if s.ledger != nil && isBilledTool(info.tool) && !isDryRun(callReq) {
+			release, err := s.ledger.Reserve(info.client, s.callCost(info.tool, callReq.Params.Arguments))
+			if err != nil {
+				log.Printf("Refusing %s for %s: %v", info.tool, info.client, err)
+				return &mcp.CallToolResult{
+					IsError: true,
+					Content: []mcp.Content{&mcp.TextContent{Text: err.Error()}},
+				}, nil
+			}
+			defer release()
+		}
+		return next(context.WithValue(ctx, callInfoKey{}, info), method, req)
+	}
+}
+
+// recordUsage prices the usage of an API call and records it in the ledger
+// against the current tool call.
+func (s *Server) recordUsage(ctx context.Context, usage pricing.Usage) {
+	if s.ledger == nil {
+		return
+	}
+	info, ok := ctx.Value(callInfoKey{}).(callInfo)
+	if !ok {
+		info = callInfo{tool: "unknown", client: "local"}
+	}
+	entry := ledger.Entry{
+		Tool:     info.tool,
+		Client:   info.client,
+		Estimate: s.prices.Estimate(usage),
+	}
+	if err := s.ledger.Record(entry); err != nil {
+		log.Printf("Error recording usage: %v", err)
+	}
+}
+
+// contentUsage returns the billable usage of a GenerateContent response,
+// counting the images it contains for image models.
+func contentUsage(model string, response *genai.GenerateContentResponse) pricing.Usage {
+	usage := pricing.Usage{Model: model}
+	if response == nil {
+		return usage
+	}
+	if metadata := response.UsageMetadata; metadata != nil {
+		usage.InputTokens = int(metadata.PromptTokenCount)
+		usage.OutputTokens = int(metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount)
+	}
+	if isImageModel(model) {
+		for _, candidate := range response.Candidates {
+			if candidate.Content == nil {
+				continue
+			}
+			for _, part := range candidate.Content.Parts {
+				if part.InlineData != nil && len(part.InlineData.Data) > 0 {
+					usage.Images++
+				}
+			}
+		}
+	}
+	return usage
+}
+
+// clientID identifies the caller of a tool for per-client budgets: the
+// client_id of its bearer token if there is one, otherwise its MCP session.
+func clientID(req *mcp.CallToolRequest) string {
+	if req.Extra != nil && req.Extra.TokenInfo != nil {
+		if id, ok := req.Extra.TokenInfo.Extra["client_id"].(string); ok && id != "" {
+			return "token:" + id
+		}
+	}
+	if req.Session != nil && req.Session.ID() != "" {
+		return "session:" + req.Session.ID()
+	}
+	return "local"
+}
+
+// isDryRun reports whether a tool call only asks for a dry run, which is free.
+func isDryRun(req *mcp.CallToolRequest) bool {
+	var args struct {
+		DryRun bool `json:"dry_run"`
+	}
+	return json.Unmarshal(req.Params.Arguments, &args) == nil && args.DryRun
+}
+
+func isBilledTool(name string) bool {
+	_, ok := billedTools[name]
+	return ok
+}
+
+// callCost estimates the cost of a call to a billed tool from its model,
+// which the budget holds while the call runs. Only images and videos are
+// counted: tokens are not known before the call.
+func (s *Server) callCost(tool string, arguments json.RawMessage) float64 {
+	var args struct {
+		Model      string `json:"model"`
+		Resolution string `json:"resolution"`
+		NumImages  int    `json:"num_images"`
+	}
+	json.Unmarshal(arguments, &args)
+	model := cmp.Or(args.Model, billedTools[tool].model)
+
+	usage := pricing.Usage{Model: model}
+	switch {
+	case billedTools[tool].video:
+		usage.Resolution = cmp.Or(args.Resolution, "720p")
+		usage.VideoSeconds = veoVideoSeconds
+	case strings.HasPrefix(model, "imagen"):
+		usage.Images = max(args.NumImages, 1)
+	case isImageModel(model):
+		usage.Images = 1
+	}
+	return s.prices.Estimate(usage).CostUSD
+}
+
+func (s *Server) handleUsageReport(ctx context.Context, req *mcp.CallToolRequest, input UsageReportInput) (*mcp.CallToolResult, UsageReportOutput, error) {
+	if s.ledger == nil {
+		return nil, UsageReportOutput{}, fmt.Errorf("usage ledger is not available")
+	}
+
+	period := input.Period
+	if period == "" {
+		period = "month"
+	}
+	if period != "day" && period != "month" && period != "all" {
+		return nil, UsageReportOutput{}, fmt.Errorf("unsupported period: %s", period)
+	}
+
+	caller := clientID(req)
+	client := input.Client
+	if client == "me" {
+		client = caller
+	}
+	// Callers with a bearer token share the server with other clients, whose
+	// usage they may not see. Local and unauthenticated deployments have a
+	// single operator, who gets the breakdown by client.
+	if req.Extra != nil && req.Extra.TokenInfo != nil {
+		if client != "" && client != caller {
+			return nil, UsageReportOutput{}, fmt.Errorf("usage of client %s is not available to %s", client, caller)
+		}
+		client = caller
+	}
+
+	since := s.ledger.PeriodStart(period)
+	output := UsageReportOutput{
+		Period: period,
+		Client: client,
+		Caller: caller,
+		Report: s.ledger.Report(since, client),
+	}
+	if !since.IsZero() {
+		output.Since = since.Format(time.RFC3339)
+	}
+
+	day, month := s.ledger.PeriodStart("day"), s.ledger.PeriodStart("month")
+	output.Budget = BudgetStatus{
+		Limits:                s.ledger.Limits(),
+		DailySpentUSD:         roundUSD(s.ledger.Spent(day, "")),
+		MonthlySpentUSD:       roundUSD(s.ledger.Spent(month, "")),
+		ClientDailySpentUSD:   roundUSD(s.ledger.Spent(day, caller)),
+		ClientMonthlySpentUSD: roundUSD(s.ledger.Spent(month, caller)),
+	}
+	var budgetErr *ledger.BudgetError
+	if err := s.ledger.Check(caller); errors.As(err, &budgetErr) {
+		output.Budget.Exceeded = budgetErr.Error()
+	}
+	return nil, output, nil
+}